@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/harrybrwn/at/internal/pds"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+func newAdminCmd(cx *Context) *cobra.Command {
+	var (
+		host     string
+		password string
+	)
+	c := cobra.Command{
+		Use:   "admin",
+		Short: "Administer a PDS",
+	}
+	c.PersistentFlags().StringVar(&host, "pds", host, "url of the PDS, defaults to the PDS of the saved session")
+	c.PersistentFlags().StringVar(&password, "admin-password", password, "admin password, defaults to $PDS_ADMIN_PASSWORD")
+	client := func() (*xrpc.Client, error) {
+		if len(host) == 0 {
+			s, err := loadSession()
+			if err != nil {
+				return nil, errors.New("no PDS given, use --pds or sign in with \"at login\"")
+			}
+			host = s.PDS
+		}
+		cli := pdsClient(host)
+		if len(password) > 0 {
+			cli.AdminToken = &password
+		}
+		if cli.AdminToken == nil {
+			return nil, errors.New("an admin password is required, use --admin-password or $PDS_ADMIN_PASSWORD")
+		}
+		return cli, nil
+	}
+	c.AddCommand(newAdminAuditCmd(cx, client))
+	return &c
+}
+
+type adminAuditLog struct {
+	Cursor  string `json:"cursor"`
+	Entries []struct {
+		ID        int64           `json:"id"`
+		Actor     string          `json:"actor"`
+		Method    string          `json:"method"`
+		Subject   string          `json:"subject,omitempty"`
+		Params    json.RawMessage `json:"params,omitempty"`
+		Status    int             `json:"status"`
+		Error     string          `json:"error,omitempty"`
+		CreatedAt string          `json:"createdAt"`
+	} `json:"entries"`
+}
+
+func newAdminAuditCmd(cx *Context, client func() (*xrpc.Client, error)) *cobra.Command {
+	var (
+		actor, method, subject, since string
+		asJSON, all                   bool
+	)
+	c := cobra.Command{
+		Use:   "audit",
+		Short: "List the admin actions taken on a PDS, newest first",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cli, err := client()
+			if err != nil {
+				return err
+			}
+			q := make(url.Values)
+			set := func(k, v string) {
+				if len(v) > 0 {
+					q.Set(k, v)
+				}
+			}
+			set("actor", actor)
+			set("method", method)
+			set("subject", subject)
+			if len(since) > 0 {
+				t, err := parseSince(since)
+				if err != nil {
+					return err
+				}
+				q.Set("since", t.UTC().Format(time.RFC3339))
+			}
+			q.Set("limit", strconv.FormatInt(*cx.pageSize(), 10))
+			if cursor := cx.startCursor(); cursor != nil {
+				q.Set("cursor", *cursor)
+			}
+
+			out := cmd.OutOrStdout()
+			tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			defer tw.Flush()
+			limit, n := cx.listLimit(), 0
+			for {
+				body, err := cli.Query(cmd.Context(), &xrpc.Request{NSID: pds.QueryAdminAuditLogNSID, Params: q})
+				if err != nil {
+					return err
+				}
+				var page adminAuditLog
+				err = json.NewDecoder(body).Decode(&page)
+				body.Close()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				for _, e := range page.Entries {
+					// Reading the log is logged too, which is mostly noise.
+					if !all && len(method) == 0 && e.Method == pds.QueryAdminAuditLogNSID {
+						continue
+					}
+					if limit > 0 && n >= limit {
+						return nil
+					}
+					n++
+					if asJSON {
+						if err = jsonIndent(out, e); err != nil {
+							return err
+						}
+						fmt.Fprintln(out)
+						continue
+					}
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", e.CreatedAt, e.Actor, e.Method, e.Status, e.Subject, e.Params, e.Error)
+				}
+				if len(page.Cursor) == 0 || (limit > 0 && n >= limit) {
+					return nil
+				}
+				q.Set("cursor", page.Cursor)
+			}
+		},
+	}
+	c.Flags().StringVar(&actor, "actor", actor, "only show actions by this actor, like admin@<ip address> or a did")
+	c.Flags().StringVarP(&method, "method", "m", method, "only show calls to this method NSID")
+	c.Flags().StringVarP(&subject, "subject", "s", subject, "only show actions on this did or at-uri")
+	c.Flags().StringVar(&since, "since", since, "only show actions after an RFC 3339 time or within a duration like 24h")
+	c.Flags().BoolVar(&asJSON, "json", asJSON, "print entries as json")
+	c.Flags().BoolVarP(&all, "all", "a", all, "also show reads of the audit log")
+	return &c
+}
+
+// parseSince reads either a timestamp or a duration before now.
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid --since %q, expected a duration or RFC 3339 time", s)
+	}
+	return t, nil
+}
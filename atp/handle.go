@@ -47,6 +47,11 @@ func NewDefaultHandleResolver() (*handleResolver, error) {
 	return NewHandleResolver(dnsConfig, http.DefaultClient, time.Second*5), nil
 }
 
+// SetHTTPClient changes the client used for .well-known lookups.
+func (hr *handleResolver) SetHTTPClient(client *http.Client) {
+	hr.client = client
+}
+
 func (hr *handleResolver) ResolveHandle(ctx context.Context, handle string) (syntax.DID, error) {
 	ctrl := parallel.NewCtrl[string, syntax.DID](&parallel.JobConfig{
 		Timeout: hr.timeout,
@@ -121,18 +126,22 @@ func (wkr *wellKnownResolver) resolveHandle(ctx context.Context, handle string)
 		}
 		switch {
 		case res.StatusCode == http.StatusNotFound:
+			res.Body.Close()
 			return "", errors.New(".well-known/atproto-did not found")
 		case res.StatusCode >= 300 && res.StatusCode < 400:
-			u, err = url.Parse(res.Header.Get("Location"))
+			res.Body.Close()
+			u, err = res.Location()
 			if err != nil {
 				return "", errors.WithStack(err)
 			}
 			continue
 		case res.StatusCode >= 500:
+			res.Body.Close()
 			return "", errors.Errorf("server failure %d from %q", res.StatusCode, u.Host)
 		}
 		var buf bytes.Buffer
-		_, err = io.Copy(&buf, res.Body)
+		// a did is never longer than 2kb
+		_, err = io.Copy(&buf, io.LimitReader(res.Body, 2048))
 		if err != nil {
 			res.Body.Close()
 			return "", errors.WithStack(err)
@@ -15,11 +15,27 @@ import (
 	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/bluesky-social/indigo/plc"
 	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
 	"github.com/whyrusleeping/go-did"
 )
 
+// PLCClient is a [plc.PLCClient] that can also read and write raw did:plc
+// operations.
+type PLCClient interface {
+	plc.PLCClient
+	SubmitOperation(ctx context.Context, did string, op *PlcOperation) error
+	LastOperation(ctx context.Context, did string) (*PlcOperation, error)
+}
+
+var (
+	_ PLCClient = (*PLC)(nil)
+	_ PLCClient = (*FakePLC)(nil)
+)
+
 type PLC struct {
 	*Resolver
 	Host string
@@ -69,6 +85,54 @@ func (plc *PLC) UpdateUserHandle(ctx context.Context, didstr, nhandle string) er
 	panic("not implemented")
 }
 
+// SubmitOperation sends a signed operation to the plc directory.
+func (p *PLC) SubmitOperation(ctx context.Context, did string, op *PlcOperation) error {
+	body, err := json.Marshal(op)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	u := *p.PlcURL
+	u.Path = filepath.Join("/", did)
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := p.HttpClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return errors.Errorf("plc directory returned status %d: %s", res.StatusCode, msg)
+	}
+	return nil
+}
+
+// LastOperation fetches the most recent operation in a did's audit log.
+func (p *PLC) LastOperation(ctx context.Context, did string) (*PlcOperation, error) {
+	u := *p.PlcURL
+	u.Path = filepath.Join("/", did, "log/last")
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	res, err := p.HttpClient.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("plc directory returned status %d", res.StatusCode)
+	}
+	var op PlcOperation
+	if err = json.NewDecoder(res.Body).Decode(&op); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &op, nil
+}
+
 func (p *PLC) opRequest(did string, op *CreateOp) (*http.Request, error) {
 	req := http.Request{
 		Method: "POST",
@@ -87,7 +151,13 @@ func (p *PLC) opRequest(did string, op *CreateOp) (*http.Request, error) {
 	return &req, nil
 }
 
-type FakePLC struct{ *Resolver }
+// FakePLC is a plc client for development. It creates random dids and keeps
+// submitted operations in memory.
+type FakePLC struct {
+	*Resolver
+	mu  sync.Mutex
+	ops map[string]*PlcOperation
+}
 
 func (p *FakePLC) CreateDID(ctx context.Context, sigkey *did.PrivKey, recovery, handle, service string) (string, error) {
 	return createFakeDID(ctx)
@@ -97,6 +167,28 @@ func (plc *FakePLC) UpdateUserHandle(ctx context.Context, didstr, nhandle string
 	return nil
 }
 
+func (p *FakePLC) SubmitOperation(ctx context.Context, did string, op *PlcOperation) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ops == nil {
+		p.ops = make(map[string]*PlcOperation)
+	}
+	cp := *op
+	p.ops[did] = &cp
+	return nil
+}
+
+func (p *FakePLC) LastOperation(ctx context.Context, did string) (*PlcOperation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	op, ok := p.ops[did]
+	if !ok {
+		return nil, errors.Errorf("no operations found for %s", did)
+	}
+	cp := *op
+	return &cp, nil
+}
+
 func createFakeDID(ctx context.Context) (string, error) {
 	slog.WarnContext(ctx, "generating fake did")
 	var buf [8]byte
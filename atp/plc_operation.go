@@ -0,0 +1,164 @@
+package atp
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"slices"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"github.com/whyrusleeping/go-did"
+)
+
+// PlcOperationType is the type of a regular did:plc operation.
+const PlcOperationType = "plc_operation"
+
+// PlcOperation is an operation in a did:plc audit log. Operations are signed
+// by one of the rotation keys of the previous operation or, for the genesis
+// operation, by one of their own rotation keys.
+type PlcOperation struct {
+	Type                string                `json:"type" cbor:"type"`
+	RotationKeys        []string              `json:"rotationKeys" cbor:"rotationKeys"`
+	VerificationMethods map[string]string     `json:"verificationMethods" cbor:"verificationMethods"`
+	AlsoKnownAs         []string              `json:"alsoKnownAs" cbor:"alsoKnownAs"`
+	Services            map[string]PlcService `json:"services" cbor:"services"`
+	Prev                *string               `json:"prev" cbor:"prev"`
+	Sig                 string                `json:"sig,omitempty" cbor:"sig,omitempty"`
+}
+
+// PlcService is a service entry in a did:plc operation.
+type PlcService struct {
+	Type     string `json:"type" cbor:"type"`
+	Endpoint string `json:"endpoint" cbor:"endpoint"`
+}
+
+// dagCbor encodes maps the way DAG-CBOR requires, shorter keys first.
+var dagCbor = must(cbor.EncOptions{Sort: cbor.SortLengthFirst}.EncMode())
+
+func (op *PlcOperation) unsigned() ([]byte, error) {
+	unsigned := *op
+	unsigned.Sig = ""
+	b, err := dagCbor.Marshal(&unsigned)
+	return b, errors.WithStack(err)
+}
+
+// Sign signs the operation with a rotation key.
+func (op *PlcOperation) Sign(key crypto.PrivateKey) error {
+	b, err := op.unsigned()
+	if err != nil {
+		return err
+	}
+	sig, err := key.HashAndSign(b)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	op.Sig = base64.RawURLEncoding.EncodeToString(sig)
+	return nil
+}
+
+// Verify checks that the operation was signed by one of the rotation keys
+// given as did:key strings.
+func (op *PlcOperation) Verify(rotationKeys []string) error {
+	sig, err := base64.RawURLEncoding.DecodeString(op.Sig)
+	if err != nil {
+		return errors.Wrap(err, "invalid operation signature encoding")
+	}
+	b, err := op.unsigned()
+	if err != nil {
+		return err
+	}
+	for _, k := range rotationKeys {
+		pub, err := crypto.ParsePublicDIDKey(k)
+		if err != nil {
+			continue
+		}
+		if pub.HashAndVerify(b, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("operation is not signed by a rotation key")
+}
+
+// CID returns the CID of the signed operation, which is used as the "prev"
+// of the next operation.
+func (op *PlcOperation) CID() (cid.Cid, error) {
+	b, err := dagCbor.Marshal(op)
+	if err != nil {
+		return cid.Undef, errors.WithStack(err)
+	}
+	return cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum(b)
+}
+
+// DID returns the did:plc identifier that a signed genesis operation
+// creates.
+func (op *PlcOperation) DID() (string, error) {
+	if op.Prev != nil {
+		return "", errors.New("not a genesis operation")
+	}
+	b, err := dagCbor.Marshal(op)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	h := sha256.Sum256(b)
+	enc := strings.ToLower(base32.StdEncoding.EncodeToString(h[:]))
+	return "did:plc:" + enc[:24], nil
+}
+
+// Document builds the did document described by the operation.
+func (op *PlcOperation) Document(id string) (*did.Document, error) {
+	d, err := did.ParseDID(id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	doc := did.Document{
+		Context: []string{
+			"https://www.w3.org/ns/did/v1",
+			"https://w3id.org/security/multikey/v1",
+			"https://w3id.org/security/suites/secp256k1-2019/v1",
+		},
+		ID:          d,
+		AlsoKnownAs: op.AlsoKnownAs,
+	}
+	for _, name := range sortedKeys(op.VerificationMethods) {
+		multibase := strings.TrimPrefix(op.VerificationMethods[name], "did:key:")
+		doc.VerificationMethod = append(doc.VerificationMethod, did.VerificationMethod{
+			ID:                 id + "#" + name,
+			Type:               "Multikey",
+			Controller:         id,
+			PublicKeyMultibase: &multibase,
+		})
+	}
+	for _, name := range sortedKeys(op.Services) {
+		sid, err := did.ParseDID("#" + name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		doc.Service = append(doc.Service, did.Service{
+			ID:              sid,
+			Type:            op.Services[name].Type,
+			ServiceEndpoint: op.Services[name].Endpoint,
+		})
+	}
+	return &doc, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
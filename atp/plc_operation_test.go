@@ -0,0 +1,64 @@
+package atp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/matryer/is"
+)
+
+func TestPlcOperation(t *testing.T) {
+	is := is.New(t)
+	rotation, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	signing, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	rotationPub, err := rotation.PublicKey()
+	is.NoErr(err)
+	signingPub, err := signing.PublicKey()
+	is.NoErr(err)
+
+	op := PlcOperation{
+		Type:                PlcOperationType,
+		RotationKeys:        []string{rotationPub.DIDKey()},
+		VerificationMethods: map[string]string{"atproto": signingPub.DIDKey()},
+		AlsoKnownAs:         []string{"at://alice.test"},
+		Services: map[string]PlcService{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", Endpoint: "https://pds.test"},
+		},
+	}
+	is.NoErr(op.Sign(rotation))
+	is.NoErr(op.Verify(op.RotationKeys))
+	is.True(op.Verify([]string{signingPub.DIDKey()}) != nil)
+
+	did, err := op.DID()
+	is.NoErr(err)
+	is.True(strings.HasPrefix(did, "did:plc:"))
+	is.Equal(len(did), len("did:plc:")+24)
+
+	// Changing the operation invalidates the signature
+	tampered := op
+	tampered.AlsoKnownAs = []string{"at://mallory.test"}
+	is.True(tampered.Verify(op.RotationKeys) != nil)
+
+	c, err := op.CID()
+	is.NoErr(err)
+	prev := c.String()
+	next := op
+	next.Prev = &prev
+	_, err = next.DID()
+	is.True(err != nil)
+
+	doc, err := op.Document(did)
+	is.NoErr(err)
+	ident := identity.ParseIdentity(ConvertDidDoc(doc))
+	is.Equal(ident.PDSEndpoint(), "https://pds.test")
+	handle, err := ident.DeclaredHandle()
+	is.NoErr(err)
+	is.Equal(handle.String(), "alice.test")
+	key, err := ident.PublicKey()
+	is.NoErr(err)
+	is.True(key.Equal(signingPub))
+}
@@ -39,6 +39,7 @@ type Context struct {
 	purge   bool
 	noCache bool
 	limit   int
+	all     bool
 	cursor  string
 	history bool
 	diddoc  bool
@@ -75,6 +76,35 @@ func (cctx *Context) WithCtx(ctx context.Context) *Context {
 	return cctx
 }
 
+// maxPageSize is the largest page size most list queries accept.
+const maxPageSize = 100
+
+// listLimit is the total number of items to fetch when paginating, zero
+// meaning everything.
+func (cctx *Context) listLimit() int {
+	if cctx.all || cctx.limit < 0 {
+		return 0
+	}
+	return cctx.limit
+}
+
+// pageSize is the limit parameter to send with each request for a page.
+func (cctx *Context) pageSize() *int64 {
+	size := int64(maxPageSize)
+	if l := cctx.listLimit(); l > 0 && l < maxPageSize {
+		size = int64(l)
+	}
+	return &size
+}
+
+func (cctx *Context) startCursor() *string {
+	if len(cctx.cursor) == 0 || cctx.cursor == "none" {
+		return nil
+	}
+	cursor := cctx.cursor
+	return &cursor
+}
+
 func (cctx *Context) init(ctx context.Context) (err error) {
 	cctx.ctx = ctx
 	base := xdg.Cache("at")
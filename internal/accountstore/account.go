@@ -5,11 +5,13 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/harrybrwn/db"
 	"github.com/pkg/errors"
 
 	"github.com/harrybrwn/at/internal/account"
+	"github.com/harrybrwn/at/xrpc"
 )
 
 type GetAccountOpts struct {
@@ -60,18 +62,117 @@ func (as *AccountStore) GetAccounts(ctx context.Context, opts *GetAccountOpts) (
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanAccounts(rows)
+}
 
-	accounts := make([]*account.ActorAccount, 0)
-	for rows.Next() {
-		var account account.ActorAccount
-		err := scanAccount(&account, rows)
+// GetAccountsByDIDs retrieves many accounts at once, including the ones that
+// are taken down or deactivated. Accounts that do not exist are left out.
+func (as *AccountStore) GetAccountsByDIDs(ctx context.Context, dids []string) ([]*account.ActorAccount, error) {
+	if len(dids) == 0 {
+		return []*account.ActorAccount{}, nil
+	}
+	args := make([]any, len(dids))
+	for i, did := range dids {
+		args[i] = did
+	}
+	var query strings.Builder
+	err := buildSelectAccount(
+		new(GetAccountOpts).WithTakenDown().WithDeactivated(),
+		"account.did IN (?"+strings.Repeat(", ?", len(dids)-1)+")",
+		&query,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := as.db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return scanAccounts(rows)
+}
+
+// Cursor phases of [AccountStore.SearchAccounts].
+const (
+	searchPrefix    = "p"
+	searchSubstring = "s"
+)
+
+// SearchAccounts finds accounts with an email or handle that starts with or
+// contains query, ignoring case. Accounts that match the prefix come first
+// and are found with the lower(email) and lower(handle) indexes. Every
+// account is returned when query is empty. It returns the cursor for the
+// next page, which is empty on the last page.
+func (as *AccountStore) SearchAccounts(ctx context.Context, query string, limit int, cursor string) ([]*account.ActorAccount, string, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	phase, after := searchPrefix, ""
+	if len(cursor) > 0 {
+		var ok bool
+		phase, after, ok = strings.Cut(cursor, "::")
+		if !ok || (phase != searchPrefix && phase != searchSubstring) {
+			return nil, "", xrpc.NewInvalidRequest("malformed cursor")
+		}
+	}
+	// Every string starting with q sorts between q and q followed by the
+	// largest code point.
+	q := strings.ToLower(query)
+	upper := q + "\U0010FFFF"
+	prefixArgs := []any{q, upper, q, upper}
+	const prefix = `((lower(account.email) >= ? AND lower(account.email) < ?)
+    OR (lower(actor.handle) >= ? AND lower(actor.handle) < ?))`
+
+	accounts := make([]*account.ActorAccount, 0, limit)
+	if phase == searchPrefix {
+		found, err := as.searchAccounts(ctx, prefix, prefixArgs, after, limit)
 		if err != nil {
-			return nil, err
+			return nil, "", err
+		}
+		accounts = append(accounts, found...)
+		if len(found) == limit {
+			return accounts, searchPrefix + "::" + found[len(found)-1].DID, nil
+		}
+		if len(q) == 0 {
+			return accounts, "", nil
 		}
-		accounts = append(accounts, &account)
+		after = ""
 	}
-	return accounts, nil
+	remaining := limit - len(accounts)
+	found, err := as.searchAccounts(
+		ctx,
+		`(instr(lower(account.email), ?) > 0 OR instr(coalesce(lower(actor.handle), ''), ?) > 0)
+    AND NOT `+strings.ReplaceAll(prefix, "lower(actor.handle)", "coalesce(lower(actor.handle), '')"),
+		append([]any{q, q}, prefixArgs...),
+		after,
+		remaining,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	accounts = append(accounts, found...)
+	var next string
+	if len(found) > 0 && len(found) == remaining {
+		next = searchSubstring + "::" + found[len(found)-1].DID
+	}
+	return accounts, next, nil
+}
+
+func (as *AccountStore) searchAccounts(ctx context.Context, where string, args []any, after string, limit int) ([]*account.ActorAccount, error) {
+	if len(after) > 0 {
+		where += ` AND account.did > ?`
+		args = append(args, after)
+	}
+	var query strings.Builder
+	err := buildSelectAccount(new(GetAccountOpts).WithTakenDown().WithDeactivated(), where, &query)
+	if err != nil {
+		return nil, err
+	}
+	query.WriteString(` ORDER BY account.did LIMIT ?`)
+	rows, err := as.db.QueryContext(ctx, query.String(), append(args, limit)...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return scanAccounts(rows)
 }
 
 // GetAccountByEmail retrieves an account and its corresponding actor by email.
@@ -85,6 +186,19 @@ func (as *AccountStore) GetAccountByEmail(ctx context.Context, email string, opt
 	return &a, scanAccount(&a, row)
 }
 
+func scanAccounts(rows *sql.Rows) ([]*account.ActorAccount, error) {
+	defer rows.Close()
+	accounts := make([]*account.ActorAccount, 0)
+	for rows.Next() {
+		var a account.ActorAccount
+		if err := scanAccount(&a, rows); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &a)
+	}
+	return accounts, errors.WithStack(rows.Err())
+}
+
 func scanAccount(a *account.ActorAccount, row db.Scanner) error {
 	var invitesDisabled int
 	err := row.Scan(
@@ -183,49 +297,159 @@ func (as *AccountStore) IsAccountActivated(ctx context.Context, did string) (boo
 	return emailConfirmedAt.Valid, nil
 }
 
-// TakedownAccount sets the takedown reference for an actor.
+// TakedownAccount sets or clears the takedown reference for an actor. Taking
+// an account down also revokes all of its sessions.
 func (as *AccountStore) TakedownAccount(ctx context.Context, did string, takedown *StatusAttr) error {
-	tx, err := as.db.Begin()
+	tx, err := as.db.BeginTx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to start transaction")
 	}
+	defer tx.Rollback()
 	err = updateAccountTakedownStatus(ctx, db.NewTx(tx), did, takedown)
 	if err != nil {
 		return err
 	}
-	_, err = tx.ExecContext(ctx, `DELETE FROM refresh_token WHERE did = ?`, did)
+	if takedown.Applied {
+		_, err = tx.ExecContext(ctx, `DELETE FROM refresh_token WHERE did = ?`, did)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM token WHERE did = ?`, did)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+// UpdateAccountPassword sets a new password for an account and revokes all
+// of its sessions.
+func (as *AccountStore) UpdateAccountPassword(ctx context.Context, did, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "failed to hash password")
+	}
+	tx, err := as.db.BeginTx(ctx, nil)
 	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `UPDATE account SET passwordScrypt = ? WHERE did = ?`, hash, did)
+	if err != nil {
+		return errors.Wrap(err, "failed to update password")
+	}
+	if n, err := res.RowsAffected(); err != nil {
 		return errors.WithStack(err)
+	} else if n == 0 {
+		return xrpc.NewInvalidRequest("Account not found")
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM refresh_token WHERE did = ?`, did)
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke sessions")
 	}
 	_, err = tx.ExecContext(ctx, `DELETE FROM token WHERE did = ?`, did)
 	if err != nil {
-		return errors.WithStack(err)
+		return errors.Wrap(err, "failed to revoke sessions")
 	}
-	return err
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
 }
 
 // DeleteAccount deletes all records associated with the given `did` from several tables.
+// Deleting an account that does not exist is not an error.
 func (as *AccountStore) DeleteAccount(ctx context.Context, did string) error {
-	// Execute delete operations
 	tables := []string{
 		"repo_root",
 		"email_token",
 		"refresh_token",
+		"app_password",
+		"account_pds",
 		"account",
 		"actor",
 	}
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
 	for _, table := range tables {
 		query := fmt.Sprintf("DELETE FROM %s WHERE did = ?", table)
-		_, err := as.db.ExecContext(ctx, query, did)
+		_, err := tx.ExecContext(ctx, query, did)
 		if err != nil {
 			return errors.Wrapf(err, "failed to delete from %s", table)
 		}
 	}
-	return nil
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// ScheduleAccountDeletion deactivates an account and marks it to be deleted
+// at the given time. All of the account's sessions are revoked. When token is
+// not empty it must be a valid [PurposeDeleteAccount] token, which is then
+// used up.
+func (as *AccountStore) ScheduleAccountDeletion(ctx context.Context, did, token string, at time.Time) error {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if len(token) > 0 {
+		d := db.NewTx(tx)
+		if err = assertValidEmailToken(ctx, d, did, PurposeDeleteAccount, token); err != nil {
+			return err
+		}
+		if err = deleteEmailToken(ctx, d, did, PurposeDeleteAccount); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE actor
+            SET deactivatedAt = COALESCE(deactivatedAt, ?),
+                deleteAfter = ?
+          WHERE did = ?`,
+		time.Now().UTC().Format(time.RFC3339),
+		at.UTC().Format(time.RFC3339),
+		did,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule account deletion")
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM refresh_token WHERE did = ?`, did)
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke sessions")
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// AccountsDueForDeletion returns up to limit accounts whose "deleteAfter"
+// time has passed, oldest first.
+func (as *AccountStore) AccountsDueForDeletion(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT did FROM actor
+          WHERE deleteAfter IS NOT NULL AND deleteAfter <= ?
+          ORDER BY deleteAfter
+          LIMIT ?`,
+		now.UTC().Format(time.RFC3339),
+		limit,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	dids := make([]string, 0)
+	for rows.Next() {
+		var did string
+		if err = rows.Scan(&did); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		dids = append(dids, did)
+	}
+	return dids, errors.WithStack(rows.Err())
 }
 
-// getAccountAdminStatus retrieves the takedown and deactivated statuses for a given DID.
-func (as *AccountStore) GetAccountAdminStatus(ctx context.Context, did string) (*accountAdminStatus, error) {
+// GetAccountAdminStatus retrieves the takedown and deactivated statuses for a
+// given DID. It returns nil when the account does not exist.
+func (as *AccountStore) GetAccountAdminStatus(ctx context.Context, did string) (*AccountAdminStatus, error) {
 	return getAccountAdminStatus(ctx, db.Simple(as.db), did)
 }
 
@@ -247,8 +471,8 @@ func (as *AccountStore) GetAccountStatus(ctx context.Context, did string) (accou
 
 // DeactivateAccount deactivates an account.
 func (as *AccountStore) DeactivateAccount(ctx context.Context, did string, deleteAfter sql.NullString) error {
-	query := `UPDATE actor SET deactivatedAt = CURRENT_TIMESTAMP, deleteAfter = ? WHERE did = ?`
-	_, err := as.db.ExecContext(ctx, query, deleteAfter, did)
+	query := `UPDATE actor SET deactivatedAt = ?, deleteAfter = ? WHERE did = ?`
+	_, err := as.db.ExecContext(ctx, query, time.Now().UTC().Format(time.RFC3339), deleteAfter, did)
 	return errors.WithStack(err)
 }
 
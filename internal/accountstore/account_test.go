@@ -1,10 +1,14 @@
 package accountstore
 
 import (
+	"database/sql"
 	"strings"
 	"testing"
+	"time"
 
+	database "github.com/harrybrwn/db"
 	"github.com/matryer/is"
+	"github.com/pkg/errors"
 )
 
 func TestGetAccount(t *testing.T) {
@@ -27,3 +31,182 @@ func TestGetAccount(t *testing.T) {
 	is.True(!strings.Contains(q.String(), `actor."takedownRef" is null`))
 	is.True(!strings.Contains(q.String(), `actor."deactivatedAt" is null`))
 }
+
+func TestScheduleAccountDeletion(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	alice, bob := newDID(), newDID()
+	for did, handle := range map[string]string{alice: "alice.pds.local", bob: "bob.pds.local"} {
+		_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+			DID:      did,
+			Handle:   handle,
+			Email:    p(handle + "@example.com"),
+			Password: p("password"),
+		})
+		is.NoErr(err)
+	}
+	now := time.Now()
+	token, err := as.CreateEmailToken(ctx, alice, PurposeDeleteAccount)
+	is.NoErr(err)
+	is.True(errors.Is(as.ScheduleAccountDeletion(ctx, alice, "AAAAA-AAAAA", now), ErrInvalidEmailToken))
+	is.NoErr(as.ScheduleAccountDeletion(ctx, alice, token, now.Add(-time.Second)))
+	// the token is used up
+	is.True(errors.Is(as.AssertValidEmailToken(ctx, alice, PurposeDeleteAccount, token), ErrInvalidEmailToken))
+	is.NoErr(as.ScheduleAccountDeletion(ctx, bob, "", now.Add(time.Hour)))
+	due, err := as.AccountsDueForDeletion(ctx, now, 10)
+	is.NoErr(err)
+	is.Equal(due, []string{alice})
+	// scheduled accounts are deactivated and signed out
+	_, err = as.GetAccount(ctx, alice, nil)
+	is.True(errors.Is(err, sql.ErrNoRows))
+	_, err = getRefreshTokenByDID(ctx, database.Simple(db), alice)
+	is.True(errors.Is(err, sql.ErrNoRows))
+
+	is.NoErr(as.DeleteAccount(ctx, alice))
+	is.NoErr(as.DeleteAccount(ctx, alice))
+	due, err = as.AccountsDueForDeletion(ctx, now.Add(2*time.Hour), 10)
+	is.NoErr(err)
+	is.Equal(due, []string{bob})
+}
+
+func TestSearchAccounts(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	dids := make(map[string]string)
+	for _, handle := range []string{"alice.pds.local", "malice.pds.local", "bob.pds.local", "alicia.pds.local"} {
+		did := newDID()
+		dids[handle] = did
+		_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+			DID:      did,
+			Handle:   handle,
+			Email:    p(strings.ToUpper(handle[:1]) + handle[1:] + "@example.com"),
+			Password: p("password"),
+		})
+		is.NoErr(err)
+	}
+
+	// prefix matches come before substring matches
+	var found []string
+	cursor := ""
+	for range 10 {
+		accounts, next, err := as.SearchAccounts(ctx, "ALI", 1, cursor)
+		is.NoErr(err)
+		for _, a := range accounts {
+			found = append(found, a.Handle.String)
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	is.Equal(len(found), 3)
+	is.Equal(found[2], "malice.pds.local")
+
+	accounts, next, err := as.SearchAccounts(ctx, "bob.pds.local@exa", 10, "")
+	is.NoErr(err)
+	is.Equal(len(accounts), 1)
+	is.Equal(accounts[0].DID, dids["bob.pds.local"])
+	is.Equal(next, "")
+	accounts, _, err = as.SearchAccounts(ctx, "", 10, "")
+	is.NoErr(err)
+	is.Equal(len(accounts), 4)
+	_, _, err = as.SearchAccounts(ctx, "a", 10, "bad")
+	is.True(err != nil)
+
+	// prefix searches use the indexes
+	rows, err := db.QueryContext(ctx, `EXPLAIN QUERY PLAN SELECT did FROM account WHERE lower(email) >= ? AND lower(email) < ?`, "a", "b")
+	is.NoErr(err)
+	var plan strings.Builder
+	for rows.Next() {
+		var id, parent, notused int
+		var detail string
+		is.NoErr(rows.Scan(&id, &parent, &notused, &detail))
+		plan.WriteString(detail)
+	}
+	is.NoErr(rows.Close())
+	is.True(strings.Contains(plan.String(), "account_email_lower_idx"))
+
+	byDID, err := as.GetAccountsByDIDs(ctx, []string{dids["bob.pds.local"], dids["alice.pds.local"], "did:plc:missing"})
+	is.NoErr(err)
+	is.Equal(len(byDID), 2)
+}
+
+func TestTakedownAccount(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	did := newDID()
+	_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+		DID:      did,
+		Handle:   "alice.pds.local",
+		Email:    p("alice@example.com"),
+		Password: p("password"),
+	})
+	is.NoErr(err)
+	sessions := func() (n int) {
+		is.NoErr(db.QueryRowContext(ctx, `SELECT count(*) FROM refresh_token WHERE did = ?`, did).Scan(&n))
+		return n
+	}
+	is.Equal(sessions(), 1)
+
+	is.NoErr(as.TakedownAccount(ctx, did, &StatusAttr{Applied: true, Ref: p("mod-1")}))
+	status, err := as.GetAccountAdminStatus(ctx, did)
+	is.NoErr(err)
+	is.True(status.Takedown.Applied)
+	is.Equal(*status.Takedown.Ref, "mod-1")
+	is.Equal(sessions(), 0) // sessions are revoked
+
+	is.NoErr(as.TakedownAccount(ctx, did, &StatusAttr{}))
+	status, err = as.GetAccountAdminStatus(ctx, did)
+	is.NoErr(err)
+	is.True(!status.Takedown.Applied)
+	is.True(status.Takedown.Ref == nil)
+
+	status, err = as.GetAccountAdminStatus(ctx, newDID())
+	is.NoErr(err)
+	is.True(status == nil)
+}
+
+func TestUpdateAccountPassword(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	did := newDID()
+	_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+		DID:      did,
+		Handle:   "alice.pds.local",
+		Email:    p("alice@example.com"),
+		Password: p("password"),
+	})
+	is.NoErr(err)
+
+	is.NoErr(as.UpdateAccountPassword(ctx, did, "new-password"))
+	is.True(as.VerifyAccountPassword(ctx, did, "password") != nil)
+	is.NoErr(as.VerifyAccountPassword(ctx, did, "new-password"))
+	var n int
+	is.NoErr(db.QueryRowContext(ctx, `SELECT count(*) FROM refresh_token WHERE did = ?`, did).Scan(&n))
+	is.Equal(n, 0) // sessions are revoked
+	is.True(as.UpdateAccountPassword(ctx, newDID(), "password") != nil)
+}
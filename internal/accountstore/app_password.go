@@ -3,6 +3,7 @@ package accountstore
 import (
 	"bytes"
 	"context"
+	"encoding/base32"
 	"time"
 
 	database "github.com/harrybrwn/db"
@@ -13,8 +14,46 @@ func (as *AccountStore) CreateAppPassword(ctx context.Context, did, name string,
 	return createAppPassword(ctx, database.Simple(as.db), did, name, privilaged)
 }
 
+// DeleteAppPassword deletes an app password and revokes the refresh tokens
+// of every session created with it.
 func (as *AccountStore) DeleteAppPassword(ctx context.Context, did, name string) error {
-	return deleteAppPassword(ctx, database.Simple(as.db), did, name)
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	dbtx := database.NewTx(tx)
+	if err = deleteAppPassword(ctx, dbtx, did, name); err != nil {
+		return err
+	}
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM refresh_token WHERE did = ? AND appPasswordName = ?`, did, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke app password sessions")
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// ListAppPasswords returns the app passwords of an account without their
+// password hashes.
+func (as *AccountStore) ListAppPasswords(ctx context.Context, did string) ([]AppPassword, error) {
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT name, createdAt, privileged FROM app_password WHERE did = ? ORDER BY createdAt DESC`,
+		did,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	passwords := make([]AppPassword, 0)
+	for rows.Next() {
+		ap := AppPassword{DID: did}
+		if err = rows.Scan(&ap.Name, &ap.CreatedAt, &ap.Privileged); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		passwords = append(passwords, ap)
+	}
+	return passwords, errors.WithStack(rows.Err())
 }
 
 type AppPassDescript struct {
@@ -39,6 +78,18 @@ func (as *AccountStore) VerifyAppPassword(ctx context.Context, did, password str
 	return &ap, nil
 }
 
+func getAppPassword(ctx context.Context, db database.DB, did, name string) (*AppPassDescript, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, privileged FROM app_password WHERE did = ? AND name = ?", did, name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var ap AppPassDescript
+	if err = database.ScanOne(rows, &ap.Name, &ap.Privileged); err != nil {
+		return nil, err
+	}
+	return &ap, nil
+}
+
 // NuevoAppPassword is a newly created app password.
 type NuevoAppPassword struct {
 	DID        string
@@ -49,10 +100,12 @@ type NuevoAppPassword struct {
 }
 
 func createAppPassword(ctx context.Context, db database.DB, did, name string, privilaged bool) (*NuevoAppPassword, error) {
-	gen, err := genRandomBytes(16)
+	raw, err := genRandomBytes(16)
 	if err != nil {
 		return nil, err
 	}
+	// formatted as xxxx-xxxx-xxxx-xxxx
+	gen := bytes.ToLower([]byte(base32.StdEncoding.EncodeToString(raw)))
 	chunks := [][]byte{gen[:4], gen[4:8], gen[8:12], gen[12:16]}
 	password := bytes.Join(chunks, []byte{'-'})
 	pwScrypt, err := hashAppPassword(did, password)
@@ -66,7 +119,7 @@ func createAppPassword(ctx context.Context, db database.DB, did, name string, pr
 			did, name, passwordScrypt,
 			createdAt, privileged
 		) VALUES (?, ?, ?, ?, ?)`,
-		did, name, pwScrypt,
+		did, name, string(pwScrypt),
 		createdAt.Format(time.RFC3339),
 		privilaged,
 	)
@@ -0,0 +1,64 @@
+package accountstore
+
+import (
+	"database/sql"
+	"regexp"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/auth"
+)
+
+func TestAppPasswords(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	did := newDID()
+	scope := func(token string) auth.Scope {
+		claims := make(jwt.MapClaims)
+		_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) { return as.jwtKey, nil })
+		is.NoErr(err)
+		s, _ := claims["scope"].(string)
+		return auth.Scope(s)
+	}
+
+	ap, err := as.CreateAppPassword(ctx, did, "phone", false)
+	is.NoErr(err)
+	is.True(regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`).Match(ap.Password))
+	_, err = as.CreateAppPassword(ctx, did, "laptop", true)
+	is.NoErr(err)
+	passwords, err := as.ListAppPasswords(ctx, did)
+	is.NoErr(err)
+	is.Equal(len(passwords), 2)
+
+	desc, err := as.VerifyAppPassword(ctx, did, string(ap.Password))
+	is.NoErr(err)
+	is.Equal(desc.Name, "phone")
+	access, refresh, err := as.CreateSession(ctx, did, desc)
+	is.NoErr(err)
+	is.Equal(scope(access), auth.ScopeAppPass)
+	rt, err := decodeRefreshToken(refresh, as.jwtKey)
+	is.NoErr(err)
+	access, refresh, err = as.RotateRefreshToken(ctx, rt.ID)
+	is.NoErr(err)
+	is.Equal(scope(access), auth.ScopeAppPass)
+
+	is.NoErr(as.DeleteAppPassword(ctx, did, "phone"))
+	rt, err = decodeRefreshToken(refresh, as.jwtKey)
+	is.NoErr(err)
+	_, _, err = as.RotateRefreshToken(ctx, rt.ID)
+	is.True(errors.Is(err, ErrTokenRevoked))
+	passwords, err = as.ListAppPasswords(ctx, did)
+	is.NoErr(err)
+	is.Equal(len(passwords), 1)
+	is.Equal(passwords[0].Name, "laptop")
+	is.True(passwords[0].Privileged)
+}
@@ -0,0 +1,154 @@
+package accountstore
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// AdminAction is one entry in the admin audit log.
+type AdminAction struct {
+	ID int64
+	// Actor is who made the call. It is the did of service token callers
+	// and the admin username and address of everyone else.
+	Actor string
+	// Method is the NSID of the xrpc method that was called.
+	Method string
+	// Subject is the account, record or blob the call acted on, if any.
+	Subject string
+	// Params holds the call's parameters as json with secrets redacted.
+	Params    string
+	Status    int
+	Error     string
+	CreatedAt time.Time
+}
+
+// AdminActionFilter narrows down the entries returned by
+// [AccountStore.ListAdminActions]. Empty fields match everything.
+type AdminActionFilter struct {
+	Actor   string
+	Method  string
+	Subject string
+	Since   time.Time
+}
+
+// RecordAdminAction adds an entry to the admin audit log.
+func (as *AccountStore) RecordAdminAction(ctx context.Context, action *AdminAction) error {
+	if action.CreatedAt.IsZero() {
+		action.CreatedAt = time.Now()
+	}
+	res, err := as.db.ExecContext(
+		ctx,
+		`INSERT INTO admin_audit (actor, method, subject, params, status, error, createdAt)
+         VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		action.Actor,
+		action.Method,
+		nullString(action.Subject),
+		nullString(action.Params),
+		action.Status,
+		nullString(action.Error),
+		action.CreatedAt.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	action.ID, err = res.LastInsertId()
+	return errors.WithStack(err)
+}
+
+// ListAdminActions returns the admin audit log newest first, along with a
+// cursor for the next page that is empty on the last page.
+func (as *AccountStore) ListAdminActions(ctx context.Context, filter AdminActionFilter, limit int, cursor string) ([]AdminAction, string, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	var (
+		where []string
+		args  []any
+	)
+	if len(cursor) > 0 {
+		before, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			return nil, "", xrpc.NewInvalidRequest("malformed cursor")
+		}
+		where = append(where, "id < ?")
+		args = append(args, before)
+	}
+	if len(filter.Actor) > 0 {
+		where = append(where, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if len(filter.Method) > 0 {
+		where = append(where, "method = ?")
+		args = append(args, filter.Method)
+	}
+	if len(filter.Subject) > 0 {
+		where = append(where, "subject = ?")
+		args = append(args, filter.Subject)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "createdAt >= ?")
+		args = append(args, filter.Since.UTC().Format(time.RFC3339))
+	}
+	query := `SELECT id, actor, method, subject, params, status, error, createdAt FROM admin_audit`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	rows, err := as.db.QueryContext(ctx, query, append(args, limit)...)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	defer rows.Close()
+	actions := make([]AdminAction, 0)
+	for rows.Next() {
+		var (
+			a                      AdminAction
+			subject, params, cause sql.NullString
+			createdAt              string
+		)
+		err = rows.Scan(&a.ID, &a.Actor, &a.Method, &subject, &params, &a.Status, &cause, &createdAt)
+		if err != nil {
+			return nil, "", errors.WithStack(err)
+		}
+		a.Subject, a.Params, a.Error = subject.String, params.String, cause.String
+		a.CreatedAt, err = time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return nil, "", errors.WithStack(err)
+		}
+		actions = append(actions, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	var next string
+	if len(actions) == limit {
+		next = strconv.FormatInt(actions[len(actions)-1].ID, 10)
+	}
+	return actions, next, nil
+}
+
+// PurgeAdminActions deletes audit log entries created before the given time
+// and returns how many were removed.
+func (as *AccountStore) PurgeAdminActions(ctx context.Context, before time.Time) (int64, error) {
+	res, err := as.db.ExecContext(
+		ctx,
+		`DELETE FROM admin_audit WHERE createdAt < ?`,
+		before.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	n, err := res.RowsAffected()
+	return n, errors.WithStack(err)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: len(s) > 0}
+}
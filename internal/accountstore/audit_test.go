@@ -0,0 +1,78 @@
+package accountstore
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestAdminAudit(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+
+	now := time.Now().Truncate(time.Second)
+	did := newDID()
+	actions := []AdminAction{
+		{Actor: "admin", Method: "com.atproto.admin.getAccountInfo", Subject: did, Params: `{"did":"` + did + `"}`, Status: 200, CreatedAt: now.Add(-48 * time.Hour)},
+		{Actor: "admin", Method: "com.atproto.admin.updateAccountPassword", Subject: did, Params: `{"password":"[redacted]"}`, Status: 200, CreatedAt: now.Add(-time.Hour)},
+		{Actor: "admin", Method: "com.atproto.admin.getAccountInfo", Subject: newDID(), Status: 400, Error: "InvalidRequest", CreatedAt: now},
+	}
+	for i := range actions {
+		is.NoErr(as.RecordAdminAction(ctx, &actions[i]))
+		is.True(actions[i].ID > 0)
+	}
+
+	all, cursor, err := as.ListAdminActions(ctx, AdminActionFilter{}, 10, "")
+	is.NoErr(err)
+	is.Equal(cursor, "")
+	is.Equal(len(all), 3)
+	is.Equal(all[0].ID, actions[2].ID) // newest first
+	is.Equal(all[0].Error, "InvalidRequest")
+	is.Equal(all[0].Params, "")
+	is.True(all[0].CreatedAt.Equal(now))
+	is.Equal(all[2].Params, actions[0].Params)
+
+	// paging
+	page, cursor, err := as.ListAdminActions(ctx, AdminActionFilter{}, 2, "")
+	is.NoErr(err)
+	is.Equal(len(page), 2)
+	is.True(cursor != "")
+	page, cursor, err = as.ListAdminActions(ctx, AdminActionFilter{}, 2, cursor)
+	is.NoErr(err)
+	is.Equal(len(page), 1)
+	is.Equal(page[0].ID, actions[0].ID)
+	is.Equal(cursor, "")
+	_, _, err = as.ListAdminActions(ctx, AdminActionFilter{}, 2, "nope")
+	is.True(err != nil)
+
+	// filters
+	found, _, err := as.ListAdminActions(ctx, AdminActionFilter{Subject: did}, 10, "")
+	is.NoErr(err)
+	is.Equal(len(found), 2)
+	found, _, err = as.ListAdminActions(ctx, AdminActionFilter{Method: "com.atproto.admin.getAccountInfo", Subject: did}, 10, "")
+	is.NoErr(err)
+	is.Equal(len(found), 1)
+	is.Equal(found[0].ID, actions[0].ID)
+	found, _, err = as.ListAdminActions(ctx, AdminActionFilter{Since: now.Add(-2 * time.Hour)}, 10, "")
+	is.NoErr(err)
+	is.Equal(len(found), 2)
+	found, _, err = as.ListAdminActions(ctx, AdminActionFilter{Actor: "someone"}, 10, "")
+	is.NoErr(err)
+	is.Equal(len(found), 0)
+
+	// retention
+	n, err := as.PurgeAdminActions(ctx, now.Add(-24*time.Hour))
+	is.NoErr(err)
+	is.Equal(n, int64(1))
+	all, _, err = as.ListAdminActions(ctx, AdminActionFilter{}, 10, "")
+	is.NoErr(err)
+	is.Equal(len(all), 2)
+}
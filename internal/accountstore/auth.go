@@ -2,14 +2,203 @@ package accountstore
 
 import (
 	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/harrybrwn/db"
 	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
 )
 
+// RefreshGracePeriod is how long a refresh token can still be used after it
+// has been rotated so that clients can retry a refresh when they never saw
+// the response.
+const RefreshGracePeriod = 2 * time.Hour
+
+// refreshTokenLifetime is the default expiration of refresh tokens created by
+// [auth.CreateRefreshToken].
+const refreshTokenLifetime = 90 * 24 * time.Hour
+
+// ErrTokenRevoked is returned when a refresh token has expired, been revoked
+// or has been reused after it was rotated.
+var ErrTokenRevoked = &xrpc.ErrorResponse{
+	Code:    "ExpiredToken",
+	Message: "Token has been revoked",
+	Status:  http.StatusBadRequest,
+}
+
+// RotateRefreshToken exchanges the refresh token with the given id for a new
+// pair of tokens. The old token is linked to its replacement and stays usable
+// for [RefreshGracePeriod], returning a token with the same id each time. Using
+// it after the grace period revokes every token in the chain.
+func (as *AccountStore) RotateRefreshToken(ctx context.Context, id string) (accessJwt, refreshJwt string, err error) {
+	d := db.Simple(as.db)
+	token, err := getRefreshToken(ctx, d, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrTokenRevoked
+	} else if err != nil {
+		return "", "", errors.Wrap(err, "failed to get refresh token")
+	}
+	now := time.Now().UTC()
+	if err = deleteExpiredRefreshTokens(ctx, d, token.DID, now); err != nil {
+		return "", "", err
+	}
+	if now.Unix() >= token.ExpiresAt {
+		if token.NextID.Valid {
+			// The token was used again after it has been replaced, so it may
+			// have been stolen.
+			if err = revokeRefreshTokenChain(ctx, d, id); err != nil {
+				return "", "", err
+			}
+		}
+		return "", "", ErrTokenRevoked
+	}
+
+	scope := auth.ScopeAccess
+	if token.AppPasswordName.Valid {
+		ap, err := getAppPassword(ctx, d, token.DID, token.AppPasswordName.String)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the app password has been revoked
+			return "", "", ErrTokenRevoked
+		} else if err != nil {
+			return "", "", err
+		}
+		scope = auth.AppPassScope(ap.Privileged)
+	}
+
+	nextID := token.NextID.String
+	if !token.NextID.Valid {
+		nextID, err = auth.GetRefreshTokenID()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	accessJwt, refreshJwt, err = auth.CreateTokens(&auth.CreateTokenOpts{
+		DID:        token.DID,
+		JWTKey:     as.jwtKey,
+		ServiceDID: as.serviceDID,
+		Scope:      scope,
+		JTI:        nextID,
+		Now:        &now,
+		SigningKey: as.accessKey,
+	})
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to create tokens")
+	}
+	payload, err := decodeRefreshToken(refreshJwt, as.jwtKey)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to decode refresh token")
+	}
+	payload.AppPasswordName = token.AppPasswordName
+
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	graceExpiresAt := min(now.Add(RefreshGracePeriod).Unix(), token.ExpiresAt)
+	res, err := tx.ExecContext(
+		ctx,
+		`UPDATE refresh_token SET expiresAt = ?, nextId = ?
+          WHERE id = ? AND (nextId IS NULL OR nextId = ?)`,
+		graceExpiresAt,
+		nextID,
+		id,
+		nextID,
+	)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to add refresh grace period")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", "", errors.WithStack(err)
+	} else if n == 0 {
+		// Another refresh of the same token won the race, try again so that
+		// we return the token it created.
+		_ = tx.Rollback()
+		return as.RotateRefreshToken(ctx, id)
+	}
+	if err = storeRefreshToken(ctx, db.NewTx(tx), payload, nil); err != nil {
+		return "", "", errors.Wrap(err, "failed to store refresh token")
+	}
+	if err = tx.Commit(); err != nil {
+		return "", "", errors.Wrap(err, "failed to commit transaction")
+	}
+	return accessJwt, refreshJwt, nil
+}
+
+// RevokeRefreshToken deletes a refresh token along with every token it was
+// rotated from or into.
+func (as *AccountStore) RevokeRefreshToken(ctx context.Context, id string) error {
+	return revokeRefreshTokenChain(ctx, db.Simple(as.db), id)
+}
+
+func getRefreshToken(ctx context.Context, d db.DB, id string) (*RefreshTokenModel, error) {
+	rows, err := d.QueryContext(ctx, `SELECT id, did, expiresAt, nextId, appPasswordName FROM refresh_token WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	var rt RefreshTokenModel
+	err = db.ScanOne(
+		rows,
+		&rt.ID,
+		&rt.DID,
+		&rt.ExpiresAt,
+		&rt.NextID,
+		&rt.AppPasswordName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// deleteExpiredRefreshTokens removes the expired tokens of an account. Tokens
+// that have been rotated are kept until the jwt itself expires so that reuse
+// can still be detected.
+func deleteExpiredRefreshTokens(ctx context.Context, d db.DB, did string, now time.Time) error {
+	_, err := d.ExecContext(
+		ctx,
+		`DELETE FROM refresh_token
+          WHERE did = ? AND (
+            (nextId IS NULL AND CAST(expiresAt AS INTEGER) <= ?) OR
+            CAST(expiresAt AS INTEGER) <= ?
+          )`,
+		did,
+		now.Unix(),
+		now.Add(-refreshTokenLifetime).Unix(),
+	)
+	return errors.Wrap(err, "failed to delete expired refresh tokens")
+}
+
+func revokeRefreshTokenChain(ctx context.Context, d db.DB, id string) error {
+	_, err := d.ExecContext(
+		ctx,
+		`WITH RECURSIVE
+          next(id) AS (
+            SELECT ?
+            UNION
+            SELECT rt.nextId FROM refresh_token rt JOIN next ON rt.id = next.id
+             WHERE rt.nextId IS NOT NULL
+          ),
+          prev(id) AS (
+            SELECT ?
+            UNION
+            SELECT rt.id FROM refresh_token rt JOIN prev ON rt.nextId = prev.id
+          )
+        DELETE FROM refresh_token
+         WHERE id IN (SELECT id FROM next UNION SELECT id FROM prev)`,
+		id,
+		id,
+	)
+	return errors.Wrap(err, "failed to revoke refresh tokens")
+}
+
 func getRefreshTokenByDID(ctx context.Context, d db.DB, did string) (*RefreshTokenModel, error) {
 	rows, err := d.QueryContext(ctx, `SELECT id, did, expiresAt, nextId, appPasswordName FROM refresh_token WHERE did = ?`, did)
 	if err != nil {
@@ -30,7 +219,10 @@ func getRefreshTokenByDID(ctx context.Context, d db.DB, did string) (*RefreshTok
 	return &rt, nil
 }
 
-func storeRefreshToken(ctx context.Context, d db.DB, token *RefreshTokenModel, _ any) error {
+func storeRefreshToken(ctx context.Context, d db.DB, token *RefreshTokenModel, appPassword *AppPassDescript) error {
+	if appPassword != nil {
+		token.AppPasswordName = sql.NullString{String: appPassword.Name, Valid: true}
+	}
 	_, err := d.ExecContext(
 		ctx,
 		`INSERT INTO refresh_token (
@@ -39,7 +231,8 @@ func storeRefreshToken(ctx context.Context, d db.DB, token *RefreshTokenModel, _
             expiresAt,
             nextId,
             appPasswordName
-        ) VALUES (?, ?, ?, ?, ?)`,
+        ) VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT (id) DO NOTHING`,
 		token.ID,
 		token.DID,
 		token.ExpiresAt,
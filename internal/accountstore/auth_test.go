@@ -0,0 +1,69 @@
+package accountstore
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	database "github.com/harrybrwn/db"
+	"github.com/matryer/is"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	did := newDID()
+	tokenID := func(refresh string) string {
+		rt, err := decodeRefreshToken(refresh, as.jwtKey)
+		is.NoErr(err)
+		return rt.ID
+	}
+
+	_, refresh, err := as.CreateSession(ctx, did, nil)
+	is.NoErr(err)
+	first := tokenID(refresh)
+	_, refresh, err = as.RotateRefreshToken(ctx, first)
+	is.NoErr(err)
+	second := tokenID(refresh)
+	is.True(second != first)
+
+	// retrying within the grace period gives back the same token id
+	_, refresh, err = as.RotateRefreshToken(ctx, first)
+	is.NoErr(err)
+	is.Equal(tokenID(refresh), second)
+	old, err := getRefreshToken(ctx, database.Simple(db), first)
+	is.NoErr(err)
+	is.Equal(old.NextID.String, second)
+	is.True(old.ExpiresAt <= time.Now().Add(RefreshGracePeriod).Unix())
+
+	_, refresh, err = as.RotateRefreshToken(ctx, second)
+	is.NoErr(err)
+	third := tokenID(refresh)
+
+	// reusing the first token after its grace period revokes the whole chain
+	_, err = db.ExecContext(ctx, `UPDATE refresh_token SET expiresAt = ? WHERE id = ?`, time.Now().Add(-time.Minute).Unix(), first)
+	is.NoErr(err)
+	_, _, err = as.RotateRefreshToken(ctx, first)
+	is.True(errors.Is(err, ErrTokenRevoked))
+	for _, id := range []string{first, second, third} {
+		_, err = getRefreshToken(ctx, database.Simple(db), id)
+		is.True(errors.Is(err, sql.ErrNoRows))
+	}
+	_, _, err = as.RotateRefreshToken(ctx, third)
+	is.True(errors.Is(err, ErrTokenRevoked))
+
+	_, refresh, err = as.CreateSession(ctx, did, nil)
+	is.NoErr(err)
+	id := tokenID(refresh)
+	is.NoErr(as.RevokeRefreshToken(ctx, id))
+	_, _, err = as.RotateRefreshToken(ctx, id)
+	is.True(errors.Is(err, ErrTokenRevoked))
+}
@@ -0,0 +1,213 @@
+package accountstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/harrybrwn/db"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// EmailTokenPurpose is what an email token can be used for. An account has
+// at most one token for each purpose.
+type EmailTokenPurpose string
+
+const (
+	PurposeConfirmEmail  EmailTokenPurpose = "confirm_email"
+	PurposeUpdateEmail   EmailTokenPurpose = "update_email"
+	PurposeResetPassword EmailTokenPurpose = "reset_password"
+	PurposeDeleteAccount EmailTokenPurpose = "delete_account"
+	PurposePlcOperation  EmailTokenPurpose = "plc_operation"
+)
+
+// EmailTokenLifetime is how long an email token can be used after it was
+// requested.
+const EmailTokenLifetime = 15 * time.Minute
+
+var (
+	ErrInvalidEmailToken = &xrpc.ErrorResponse{
+		Code:    "InvalidToken",
+		Message: "Token is invalid",
+		Status:  http.StatusBadRequest,
+	}
+	ErrExpiredEmailToken = &xrpc.ErrorResponse{
+		Code:    "ExpiredToken",
+		Message: "Token is expired",
+		Status:  http.StatusBadRequest,
+	}
+)
+
+// CreateEmailToken creates a token for the account replacing any previous
+// token with the same purpose. Tokens are formatted as XXXXX-XXXXX.
+func (as *AccountStore) CreateEmailToken(ctx context.Context, did string, purpose EmailTokenPurpose) (string, error) {
+	raw, err := genRandomBytes(8)
+	if err != nil {
+		return "", err
+	}
+	enc := base32.StdEncoding.EncodeToString(raw)
+	token := enc[:5] + "-" + enc[5:10]
+	_, err = as.db.ExecContext(
+		ctx,
+		`INSERT INTO email_token (purpose, did, token, requestedAt)
+         VALUES (?, ?, ?, ?)
+         ON CONFLICT (purpose, did) DO UPDATE
+            SET token = excluded.token,
+                requestedAt = excluded.requestedAt`,
+		purpose,
+		did,
+		token,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create email token")
+	}
+	return token, nil
+}
+
+// AssertValidEmailToken checks that token is the account's current unexpired
+// token for purpose.
+func (as *AccountStore) AssertValidEmailToken(ctx context.Context, did string, purpose EmailTokenPurpose, token string) error {
+	return assertValidEmailToken(ctx, db.Simple(as.db), did, purpose, token)
+}
+
+// DeleteEmailToken removes the account's token for purpose.
+func (as *AccountStore) DeleteEmailToken(ctx context.Context, did string, purpose EmailTokenPurpose) error {
+	return deleteEmailToken(ctx, db.Simple(as.db), did, purpose)
+}
+
+// ConfirmEmail marks the account's email as confirmed using a
+// [PurposeConfirmEmail] token.
+func (as *AccountStore) ConfirmEmail(ctx context.Context, did, token string) error {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	d := db.NewTx(tx)
+	if err = assertValidEmailToken(ctx, d, did, PurposeConfirmEmail, token); err != nil {
+		return err
+	}
+	_, err = d.ExecContext(
+		ctx,
+		`UPDATE account SET emailConfirmedAt = ? WHERE did = ?`,
+		time.Now().UTC().Format(time.RFC3339),
+		did,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to confirm email")
+	}
+	if err = deleteEmailToken(ctx, d, did, PurposeConfirmEmail); err != nil {
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// UpdateEmailWithToken changes the account's email. When token is not empty
+// it must be a valid [PurposeUpdateEmail] token, which is then used up.
+func (as *AccountStore) UpdateEmailWithToken(ctx context.Context, did, email, token string) error {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	d := db.NewTx(tx)
+	if len(token) > 0 {
+		if err = assertValidEmailToken(ctx, d, did, PurposeUpdateEmail, token); err != nil {
+			return err
+		}
+		if err = deleteEmailToken(ctx, d, did, PurposeUpdateEmail); err != nil {
+			return err
+		}
+	}
+	_, err = d.ExecContext(
+		ctx,
+		`UPDATE account SET email = ?, emailConfirmedAt = NULL WHERE did = ?`,
+		strings.ToLower(email),
+		did,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to update email")
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// ResetPassword sets a new password for the account that owns a
+// [PurposeResetPassword] token. Every session of the account is revoked.
+func (as *AccountStore) ResetPassword(ctx context.Context, token, password string) (did string, err error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to hash password")
+	}
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	d := db.NewTx(tx)
+	did, err = findEmailToken(ctx, d, PurposeResetPassword, token)
+	if err != nil {
+		return "", err
+	}
+	_, err = d.ExecContext(ctx, `UPDATE account SET passwordScrypt = ? WHERE did = ?`, hash, did)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to update password")
+	}
+	if err = deleteEmailToken(ctx, d, did, PurposeResetPassword); err != nil {
+		return "", err
+	}
+	_, err = d.ExecContext(ctx, `DELETE FROM refresh_token WHERE did = ?`, did)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to revoke sessions")
+	}
+	return did, errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// findEmailToken returns the did that owns a valid token.
+func findEmailToken(ctx context.Context, d db.DB, purpose EmailTokenPurpose, token string) (string, error) {
+	var did, requestedAt string
+	rows, err := d.QueryContext(
+		ctx,
+		`SELECT did, requestedAt FROM email_token WHERE purpose = ? AND token = ?`,
+		purpose,
+		strings.ToUpper(strings.TrimSpace(token)),
+	)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	err = db.ScanOne(rows, &did, &requestedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errors.WithStack(ErrInvalidEmailToken)
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+	t, err := time.Parse(time.RFC3339, requestedAt)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if time.Since(t) > EmailTokenLifetime {
+		return "", errors.WithStack(ErrExpiredEmailToken)
+	}
+	return did, nil
+}
+
+func assertValidEmailToken(ctx context.Context, d db.DB, did string, purpose EmailTokenPurpose, token string) error {
+	owner, err := findEmailToken(ctx, d, purpose, token)
+	if err != nil {
+		return err
+	}
+	if owner != did {
+		return errors.WithStack(ErrInvalidEmailToken)
+	}
+	return nil
+}
+
+func deleteEmailToken(ctx context.Context, d db.DB, did string, purpose EmailTokenPurpose) error {
+	_, err := d.ExecContext(ctx, `DELETE FROM email_token WHERE did = ? AND purpose = ?`, did, purpose)
+	return errors.Wrap(err, "failed to delete email token")
+}
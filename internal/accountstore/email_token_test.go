@@ -0,0 +1,70 @@
+package accountstore
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	database "github.com/harrybrwn/db"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+)
+
+func TestEmailTokens(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	did := newDID()
+	_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+		DID:      did,
+		Handle:   "alice.pds.local",
+		Email:    p("alice@example.com"),
+		Password: p("password"),
+	})
+	is.NoErr(err)
+
+	token, err := as.CreateEmailToken(ctx, did, PurposeConfirmEmail)
+	is.NoErr(err)
+	is.True(regexp.MustCompile(`^[A-Z2-7]{5}-[A-Z2-7]{5}$`).MatchString(token))
+	// requesting again replaces the token
+	again, err := as.CreateEmailToken(ctx, did, PurposeConfirmEmail)
+	is.NoErr(err)
+	is.True(errors.Is(as.ConfirmEmail(ctx, did, token), ErrInvalidEmailToken))
+	is.True(errors.Is(as.AssertValidEmailToken(ctx, newDID(), PurposeConfirmEmail, again), ErrInvalidEmailToken))
+	is.True(errors.Is(as.AssertValidEmailToken(ctx, did, PurposeUpdateEmail, again), ErrInvalidEmailToken))
+	is.NoErr(as.ConfirmEmail(ctx, did, strings.ToLower(again)))
+	confirmed, err := as.IsAccountActivated(ctx, did)
+	is.NoErr(err)
+	is.True(confirmed)
+	is.True(errors.Is(as.ConfirmEmail(ctx, did, again), ErrInvalidEmailToken))
+
+	token, err = as.CreateEmailToken(ctx, did, PurposeUpdateEmail)
+	is.NoErr(err)
+	is.NoErr(as.UpdateEmailWithToken(ctx, did, "Alice@Example.org", token))
+	acct, err := as.GetAccount(ctx, did, nil)
+	is.NoErr(err)
+	is.Equal(acct.Email, "alice@example.org")
+	is.True(!acct.EmailConfirmedAt.Valid)
+
+	token, err = as.CreateEmailToken(ctx, did, PurposeResetPassword)
+	is.NoErr(err)
+	_, err = db.ExecContext(ctx, `UPDATE email_token SET requestedAt = ?`, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	is.NoErr(err)
+	_, err = as.ResetPassword(ctx, token, "new-password")
+	is.True(errors.Is(err, ErrExpiredEmailToken))
+	token, err = as.CreateEmailToken(ctx, did, PurposeResetPassword)
+	is.NoErr(err)
+	owner, err := as.ResetPassword(ctx, token, "new-password")
+	is.NoErr(err)
+	is.Equal(owner, did)
+	is.NoErr(as.VerifyAccountPassword(ctx, did, "new-password"))
+	_, err = getRefreshTokenByDID(ctx, database.Simple(db), did)
+	is.True(errors.Is(err, sql.ErrNoRows))
+}
@@ -0,0 +1,70 @@
+package accountstore
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/harrybrwn/db"
+	"github.com/pkg/errors"
+)
+
+// ErrNoPDS is returned when an entryway has no PDS to put an account on.
+var ErrNoPDS = errors.New("no pds available")
+
+// GetAccountPDS returns the url of the PDS hosting an account's repo.
+func (as *AccountStore) GetAccountPDS(ctx context.Context, did string) (string, error) {
+	var url string
+	err := as.db.QueryRowContext(ctx, `SELECT pdsUrl FROM account_pds WHERE did = ?`, did).Scan(&url)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNoPDS
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return url, nil
+}
+
+// SetAccountPDS records which PDS hosts an account's repo.
+func (as *AccountStore) SetAccountPDS(ctx context.Context, did, pdsURL string) error {
+	return setAccountPDS(ctx, db.Simple(as.db), did, pdsURL)
+}
+
+// LeastUsedPDS picks the PDS from hosts with the fewest accounts. Ties go to
+// the one listed first.
+func (as *AccountStore) LeastUsedPDS(ctx context.Context, hosts []string) (string, error) {
+	if len(hosts) == 0 {
+		return "", ErrNoPDS
+	}
+	rows, err := as.db.QueryContext(ctx, `SELECT pdsUrl, count(*) FROM account_pds GROUP BY pdsUrl`)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer rows.Close()
+	counts := make(map[string]int, len(hosts))
+	for rows.Next() {
+		var (
+			url string
+			n   int
+		)
+		if err = rows.Scan(&url, &n); err != nil {
+			return "", errors.WithStack(err)
+		}
+		counts[url] = n
+	}
+	if err = rows.Err(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	best := hosts[0]
+	for _, host := range hosts[1:] {
+		if counts[host] < counts[best] {
+			best = host
+		}
+	}
+	return best, nil
+}
+
+func setAccountPDS(ctx context.Context, d db.DB, did, pdsURL string) error {
+	_, err := d.ExecContext(ctx, `
+		INSERT INTO account_pds (did, pdsUrl) VALUES (?, ?)
+		ON CONFLICT (did) DO UPDATE SET pdsUrl = excluded.pdsUrl`, did, pdsURL)
+	return errors.Wrap(err, "failed to set account pds")
+}
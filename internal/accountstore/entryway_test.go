@@ -0,0 +1,68 @@
+package accountstore
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/matryer/is"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/auth"
+)
+
+func TestEntrywayAccounts(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:entryway.local")
+	is.NoErr(as.Migrate(ctx))
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	as.SetAccessTokenKey(key)
+
+	hosts := []string{"https://pds1.local", "https://pds2.local"}
+	host, err := as.LeastUsedPDS(ctx, hosts)
+	is.NoErr(err)
+	is.Equal(host, hosts[0])
+	_, err = as.LeastUsedPDS(ctx, nil)
+	is.True(errors.Is(err, ErrNoPDS))
+
+	did := newDID()
+	email, password := "entryway@test.local", "testlab01"
+	access, _, err := as.CreateAccount(ctx, CreateAccountOpts{
+		DID:      did,
+		Handle:   "entryway.test",
+		Email:    &email,
+		Password: &password,
+		PDS:      host,
+	})
+	is.NoErr(err)
+	pds, err := as.GetAccountPDS(ctx, did)
+	is.NoErr(err)
+	is.Equal(pds, host)
+	host, err = as.LeastUsedPDS(ctx, hosts)
+	is.NoErr(err)
+	is.Equal(host, hosts[1])
+	_, err = as.GetAccountPDS(ctx, newDID())
+	is.True(errors.Is(err, ErrNoPDS))
+
+	// access tokens can be checked with only the public key
+	pub, err := key.PublicKey()
+	is.NoErr(err)
+	tok, err := jwt.Parse(access, func(*jwt.Token) (any, error) { return pub, nil })
+	is.NoErr(err)
+	is.Equal(tok.Method, auth.K256SigningMethod)
+	sub, err := tok.Claims.GetSubject()
+	is.NoErr(err)
+	is.Equal(sub, did)
+
+	is.NoErr(as.DeleteAccount(ctx, did))
+	_, err = as.GetAccountPDS(ctx, did)
+	is.True(errors.Is(err, ErrNoPDS))
+}
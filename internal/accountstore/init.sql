@@ -143,3 +143,27 @@ CREATE TABLE IF NOT EXISTS "used_refresh_token" (
 );
 
 CREATE INDEX IF NOT EXISTS "used_refresh_token_id_idx" on "used_refresh_token" ("tokenId");
+
+CREATE TABLE IF NOT EXISTS "account_pds" (
+  "did" varchar primary key,
+  "pdsUrl" varchar not null
+);
+
+CREATE INDEX IF NOT EXISTS "account_pds_url_idx" on "account_pds" ("pdsUrl");
+
+CREATE TABLE IF NOT EXISTS "admin_audit" (
+  "id" integer primary key autoincrement,
+  "actor" varchar not null,
+  "method" varchar not null,
+  "subject" varchar,
+  "params" varchar,
+  "status" integer not null,
+  "error" varchar,
+  "createdAt" varchar not null
+);
+
+CREATE INDEX IF NOT EXISTS "admin_audit_created_at_idx" on "admin_audit" ("createdAt");
+
+CREATE INDEX IF NOT EXISTS "admin_audit_method_idx" on "admin_audit" ("method");
+
+CREATE INDEX IF NOT EXISTS "admin_audit_subject_idx" on "admin_audit" ("subject");
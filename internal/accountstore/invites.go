@@ -3,6 +3,9 @@ package accountstore
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/harrybrwn/db"
@@ -12,30 +15,383 @@ import (
 )
 
 func (as *AccountStore) CreateInviteCode(ctx context.Context, codes []string, forAccount string, useCount int) error {
+	now := time.Now().UTC()
 	for _, code := range codes {
-		_, err := as.db.ExecContext(ctx, `
-			INSERT INTO invite_code (
-				code,
-				availableUses,
-				disabled,
-				forAccount,
-				createdBy,
-				createdAt
-			) VALUES (?, ?, ?, ?, ?, ?)`,
-			code,
-			useCount,
-			0,
-			forAccount,
-			"admin",
-			time.Now().UTC().Format(time.RFC3339),
+		err := insertInviteCode(ctx, db.Simple(as.db), code, useCount, false, forAccount, adminCreator, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adminCreator is the "createdBy" value of codes created by an admin.
+const adminCreator = "admin"
+
+// CodeDetail is an invite code along with every time it has been used.
+type CodeDetail struct {
+	InviteCode
+	Uses []InviteCodeUse
+}
+
+// AccountCodes is a set of invite codes for one account.
+type AccountCodes struct {
+	Account string
+	Codes   []string
+}
+
+// CreateInviteCodes creates invite codes for many accounts at once as an
+// admin.
+func (as *AccountStore) CreateInviteCodes(ctx context.Context, toCreate []AccountCodes, useCount int) error {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	dbtx := db.NewTx(tx)
+	now := time.Now().UTC()
+	for _, ac := range toCreate {
+		for _, code := range ac.Codes {
+			err = insertInviteCode(ctx, dbtx, code, useCount, false, ac.Account, adminCreator, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// CreateAccountInviteCodes creates single use codes that an account has earned.
+// expectedTotal is the number of codes the account should have created itself
+// afterwards, which guards against concurrent requests creating extra codes.
+func (as *AccountStore) CreateAccountInviteCodes(
+	ctx context.Context,
+	forAccount string,
+	codes []string,
+	expectedTotal int,
+	disabled bool,
+) ([]CodeDetail, error) {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	dbtx := db.NewTx(tx)
+	now := time.Now().UTC()
+	created := make([]CodeDetail, 0, len(codes))
+	for _, code := range codes {
+		err = insertInviteCode(ctx, dbtx, code, 1, disabled, forAccount, forAccount, now)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, CodeDetail{
+			InviteCode: InviteCode{
+				Code:          code,
+				AvailableUses: 1,
+				Disabled:      disabled,
+				ForAccount:    forAccount,
+				CreatedBy:     forAccount,
+				CreatedAt:     now.Format(time.RFC3339),
+			},
+			Uses: make([]InviteCodeUse, 0),
+		})
+	}
+	var total int
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*) FROM invite_code WHERE forAccount = ? AND createdBy != ?`,
+		forAccount,
+		adminCreator,
+	).Scan(&total)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to count invite codes")
+	}
+	if total > expectedTotal {
+		return nil, errors.New("attempted to create additional codes in another request")
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "failed to commit transaction")
+	}
+	return created, nil
+}
+
+// GetAccountInviteCodes returns every invite code for an account.
+func (as *AccountStore) GetAccountInviteCodes(ctx context.Context, did string) ([]CodeDetail, error) {
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT code, availableUses, disabled, forAccount, createdBy, createdAt
+           FROM invite_code
+          WHERE forAccount = ?
+          ORDER BY createdAt, code`,
+		did,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	codes, err := scanCodeDetails(rows)
+	if err != nil {
+		return nil, err
+	}
+	return codes, as.loadInviteCodeUses(ctx, codes)
+}
+
+// GetInviteCodesForAccounts returns the invite codes made for each of the
+// given accounts.
+func (as *AccountStore) GetInviteCodesForAccounts(ctx context.Context, dids []string) (map[string][]CodeDetail, error) {
+	res := make(map[string][]CodeDetail, len(dids))
+	if len(dids) == 0 {
+		return res, nil
+	}
+	args := make([]any, len(dids))
+	for i, did := range dids {
+		args[i] = did
+	}
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT code, availableUses, disabled, forAccount, createdBy, createdAt
+           FROM invite_code
+          WHERE forAccount IN (?`+strings.Repeat(", ?", len(dids)-1)+`)
+          ORDER BY createdAt, code`,
+		args...,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	codes, err := scanCodeDetails(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err = as.loadInviteCodeUses(ctx, codes); err != nil {
+		return nil, err
+	}
+	for _, c := range codes {
+		res[c.ForAccount] = append(res[c.ForAccount], c)
+	}
+	return res, nil
+}
+
+// GetInvitedBy returns the invite code that each of the given accounts
+// signed up with. Accounts that did not use an invite code are left out.
+func (as *AccountStore) GetInvitedBy(ctx context.Context, dids []string) (map[string]*CodeDetail, error) {
+	res := make(map[string]*CodeDetail, len(dids))
+	if len(dids) == 0 {
+		return res, nil
+	}
+	args := make([]any, len(dids))
+	for i, did := range dids {
+		args[i] = did
+	}
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT u.usedBy, ic.code, ic.availableUses, ic.disabled, ic.forAccount, ic.createdBy, ic.createdAt
+           FROM invite_code_use u
+           JOIN invite_code ic ON ic.code = u.code
+          WHERE u.usedBy IN (?`+strings.Repeat(", ?", len(dids)-1)+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	codes := make([]CodeDetail, 0, len(dids))
+	usedBy := make([]string, 0, len(dids))
+	for rows.Next() {
+		var (
+			did string
+			c   = CodeDetail{Uses: make([]InviteCodeUse, 0)}
 		)
+		err = rows.Scan(&did, &c.Code, &c.AvailableUses, &c.Disabled, &c.ForAccount, &c.CreatedBy, &c.CreatedAt)
 		if err != nil {
-			return errors.WithStack(err)
+			return nil, errors.WithStack(err)
+		}
+		codes = append(codes, c)
+		usedBy = append(usedBy, did)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = as.loadInviteCodeUses(ctx, codes); err != nil {
+		return nil, err
+	}
+	for i := range codes {
+		res[usedBy[i]] = &codes[i]
+	}
+	return res, nil
+}
+
+// Invite code sort orders for [AccountStore.ListInviteCodes].
+const (
+	InviteSortRecent = "recent"
+	InviteSortUsage  = "usage"
+)
+
+// ListInviteCodes pages through every invite code sorted by creation time
+// or by the number of times each code has been used, most first. It returns
+// the cursor for the next page, which is empty on the last page.
+func (as *AccountStore) ListInviteCodes(ctx context.Context, sort string, limit int, cursor string) ([]CodeDetail, string, error) {
+	var (
+		primary string
+		args    []any
+		where   string
+	)
+	switch sort {
+	case InviteSortRecent, "":
+		sort = InviteSortRecent
+		primary = "createdAt"
+	case InviteSortUsage:
+		primary = "uses"
+	default:
+		return nil, "", xrpc.NewInvalidRequest("unknown sort method: %s", sort)
+	}
+	if len(cursor) > 0 {
+		key, code, ok := strings.Cut(cursor, "::")
+		if !ok {
+			return nil, "", xrpc.NewInvalidRequest("malformed cursor")
+		}
+		var k any = key
+		if sort == InviteSortUsage {
+			n, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, "", xrpc.NewInvalidRequest("malformed cursor")
+			}
+			k = n
+		}
+		where = fmt.Sprintf("WHERE %[1]s < ? OR (%[1]s = ? AND code < ?)", primary)
+		args = append(args, k, k, code)
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	args = append(args, limit)
+	rows, err := as.db.QueryContext(ctx, fmt.Sprintf(
+		`SELECT code, availableUses, disabled, forAccount, createdBy, createdAt FROM (
+            SELECT ic.*, (SELECT COUNT(*) FROM invite_code_use u WHERE u.code = ic.code) AS uses
+              FROM invite_code ic
+         ) %[1]s
+         ORDER BY %[2]s DESC, code DESC
+         LIMIT ?`,
+		where,
+		primary,
+	), args...)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	codes, err := scanCodeDetails(rows)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = as.loadInviteCodeUses(ctx, codes); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(codes) == limit {
+		last := codes[len(codes)-1]
+		if sort == InviteSortUsage {
+			next = fmt.Sprintf("%d::%s", len(last.Uses), last.Code)
+		} else {
+			next = last.CreatedAt + "::" + last.Code
+		}
+	}
+	return codes, next, nil
+}
+
+// GetInviteCodesUses returns the uses of each code.
+func (as *AccountStore) GetInviteCodesUses(ctx context.Context, codes []string) (map[string][]InviteCodeUse, error) {
+	uses := make(map[string][]InviteCodeUse, len(codes))
+	if len(codes) == 0 {
+		return uses, nil
+	}
+	args := make([]any, len(codes))
+	for i, c := range codes {
+		args[i] = c
+	}
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT code, usedBy, usedAt FROM invite_code_use
+          WHERE code IN (?`+strings.Repeat(", ?", len(codes)-1)+`)
+          ORDER BY usedAt`,
+		args...,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u InviteCodeUse
+		if err = rows.Scan(&u.Code, &u.UsedBy, &u.UsedAt); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		uses[u.Code] = append(uses[u.Code], u)
+	}
+	return uses, errors.WithStack(rows.Err())
+}
+
+func (as *AccountStore) loadInviteCodeUses(ctx context.Context, codes []CodeDetail) error {
+	names := make([]string, len(codes))
+	for i := range codes {
+		names[i] = codes[i].Code
+	}
+	uses, err := as.GetInviteCodesUses(ctx, names)
+	if err != nil {
+		return err
+	}
+	for i := range codes {
+		if u, ok := uses[codes[i].Code]; ok {
+			codes[i].Uses = u
 		}
 	}
 	return nil
 }
 
+func scanCodeDetails(rows *sql.Rows) ([]CodeDetail, error) {
+	defer rows.Close()
+	codes := make([]CodeDetail, 0)
+	for rows.Next() {
+		c := CodeDetail{Uses: make([]InviteCodeUse, 0)}
+		err := rows.Scan(
+			&c.Code,
+			&c.AvailableUses,
+			&c.Disabled,
+			&c.ForAccount,
+			&c.CreatedBy,
+			&c.CreatedAt,
+		)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		codes = append(codes, c)
+	}
+	return codes, errors.WithStack(rows.Err())
+}
+
+func insertInviteCode(
+	ctx context.Context,
+	d db.DB,
+	code string,
+	useCount int,
+	disabled bool,
+	forAccount, createdBy string,
+	now time.Time,
+) error {
+	_, err := d.ExecContext(ctx, `
+		INSERT INTO invite_code (
+			code,
+			availableUses,
+			disabled,
+			forAccount,
+			createdBy,
+			createdAt
+		) VALUES (?, ?, ?, ?, ?, ?)`,
+		code,
+		useCount,
+		disabled,
+		forAccount,
+		createdBy,
+		now.Format(time.RFC3339),
+	)
+	return errors.Wrap(err, "failed to create invite code")
+}
+
 func (as *AccountStore) RecordInviteUse(ctx context.Context, code, usedBy string) error {
 	return recordInviteUse(
 		ctx,
@@ -46,6 +402,64 @@ func (as *AccountStore) RecordInviteUse(ctx context.Context, code, usedBy string
 	)
 }
 
+// SetAccountInvitesDisabled stops or allows an account from giving out
+// invites. The codes made for an account can't be used while its invites are
+// disabled.
+func (as *AccountStore) SetAccountInvitesDisabled(ctx context.Context, did string, disabled bool) error {
+	res, err := as.db.ExecContext(ctx, `UPDATE account SET invitesDisabled = ? WHERE did = ?`, disabled, did)
+	if err != nil {
+		return errors.Wrap(err, "failed to update account invites")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n == 0 {
+		return xrpc.NewInvalidRequest("Account not found")
+	}
+	return nil
+}
+
+// DisableInviteCodes disables the given codes along with every code made for
+// the given accounts. Disabled codes can't be enabled again.
+func (as *AccountStore) DisableInviteCodes(ctx context.Context, codes, accounts []string) error {
+	for _, a := range accounts {
+		if a == "admin" {
+			return xrpc.NewInvalidRequest("Cannot disable admin invite codes")
+		}
+	}
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	for _, by := range []struct {
+		column string
+		values []string
+	}{
+		{"code", codes},
+		{"forAccount", accounts},
+	} {
+		column, values := by.column, by.values
+		if len(values) == 0 {
+			continue
+		}
+		args := make([]any, len(values))
+		for i, v := range values {
+			args[i] = v
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE invite_code SET disabled = 1 WHERE `+column+` IN (?`+strings.Repeat(", ?", len(values)-1)+`)`,
+			args...,
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to disable invite codes")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
 // EnsureInviteIsAvailable checks if an invite code is valid and available
 func (as *AccountStore) EnsureInviteAvailable(ctx context.Context, inviteCode string) error {
 	return EnsureInviteIsAvailable(ctx, as.db, inviteCode)
@@ -57,7 +471,9 @@ func EnsureInviteIsAvailable(ctx context.Context, db *sql.DB, inviteCode string)
 		SELECT ic.code, ic.forAccount, ic.disabled, ic.availableUses
 		FROM invite_code ic
 		LEFT JOIN actor a ON a.did = ic.forAccount
+		LEFT JOIN account acc ON acc.did = ic.forAccount
 		WHERE a.takedownRef IS NULL
+			  AND coalesce(acc.invitesDisabled, 0) = 0
 			  AND ic.code = ?`
 	var invite InviteCode
 	err := db.QueryRowContext(ctx, inviteQuery, inviteCode).Scan(
@@ -67,11 +483,7 @@ func EnsureInviteIsAvailable(ctx context.Context, db *sql.DB, inviteCode string)
 		&invite.AvailableUses,
 	)
 	if err == sql.ErrNoRows || invite.Disabled {
-		return &xrpc.ErrorResponse{
-			Message: "Provided invite code not available",
-			Code:    "InvalidInviteCode",
-			Inner:   errors.WithStack(err),
-		}
+		return errInviteNotAvailable(err)
 	}
 	if err != nil {
 		return errors.Wrap(err, "error querying invite code")
@@ -88,14 +500,22 @@ func EnsureInviteIsAvailable(ctx context.Context, db *sql.DB, inviteCode string)
 		return errors.Wrap(err, "error counting invite code uses")
 	}
 	if invite.AvailableUses <= useCount {
-		return &xrpc.ErrorResponse{
-			Message: "Provided invite code not available",
-			Code:    "InvalidInviteCode",
-		}
+		return errInviteNotAvailable(nil)
 	}
 	return nil
 }
 
+func errInviteNotAvailable(err error) error {
+	e := &xrpc.ErrorResponse{
+		Message: "Provided invite code not available",
+		Code:    "InvalidInviteCode",
+	}
+	if err != nil {
+		e.Inner = errors.WithStack(err)
+	}
+	return e
+}
+
 // recordInviteUse records the use of an invite code
 func recordInviteUse(ctx context.Context, tx db.DB, did, inviteCode string, now time.Time) error {
 	if inviteCode == "" {
@@ -0,0 +1,137 @@
+package accountstore
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/xrpc"
+)
+
+func TestInviteCodes(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	alice, bob := newDID(), newDID()
+
+	is.NoErr(as.CreateInviteCodes(ctx, []AccountCodes{
+		{Account: alice, Codes: []string{"a-1", "a-2"}},
+		{Account: bob, Codes: []string{"b-1"}},
+	}, 2))
+	codes, err := as.GetAccountInviteCodes(ctx, alice)
+	is.NoErr(err)
+	is.Equal(len(codes), 2)
+	is.Equal(codes[0].CreatedBy, adminCreator)
+	is.Equal(codes[0].AvailableUses, 2)
+
+	// codes used up by new accounts are not available
+	for _, handle := range []string{"one.pds.local", "two.pds.local"} {
+		_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+			DID:        newDID(),
+			Handle:     handle,
+			Email:      p(handle + "@example.com"),
+			Password:   p("password"),
+			InviteCode: p("a-1"),
+		})
+		is.NoErr(err)
+	}
+	_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+		DID:        newDID(),
+		Handle:     "three.pds.local",
+		Email:      p("three@example.com"),
+		Password:   p("password"),
+		InviteCode: p("a-1"),
+	})
+	var e *xrpc.ErrorResponse
+	is.True(errors.As(err, &e))
+	is.Equal(e.Code, xrpc.Code("InvalidInviteCode"))
+	codes, err = as.GetAccountInviteCodes(ctx, alice)
+	is.NoErr(err)
+	is.Equal(len(codes[0].Uses), 2)
+
+	// earned codes are guarded against concurrent creation
+	created, err := as.CreateAccountInviteCodes(ctx, alice, []string{"a-3"}, 1, false)
+	is.NoErr(err)
+	is.Equal(len(created), 1)
+	is.Equal(created[0].CreatedBy, alice)
+	_, err = as.CreateAccountInviteCodes(ctx, alice, []string{"a-4"}, 1, false)
+	is.True(err != nil)
+
+	list, cursor, err := as.ListInviteCodes(ctx, InviteSortUsage, 2, "")
+	is.NoErr(err)
+	is.Equal(len(list), 2)
+	is.Equal(list[0].Code, "a-1")
+	is.True(len(cursor) > 0)
+	list, cursor, err = as.ListInviteCodes(ctx, InviteSortUsage, 2, cursor)
+	is.NoErr(err)
+	is.Equal(len(list), 2)
+	is.True(list[0].Code != "a-1" && list[1].Code != "a-1")
+	list, _, err = as.ListInviteCodes(ctx, InviteSortUsage, 2, cursor)
+	is.NoErr(err)
+	is.Equal(len(list), 0)
+	list, _, err = as.ListInviteCodes(ctx, InviteSortRecent, 10, "")
+	is.NoErr(err)
+	is.Equal(len(list), 4)
+	_, _, err = as.ListInviteCodes(ctx, "oldest", 10, "")
+	is.True(err != nil)
+}
+
+func TestDisableInvites(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	alice, bob := newDID(), newDID()
+	for did, handle := range map[string]string{alice: "alice.pds.local", bob: "bob.pds.local"} {
+		_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+			DID:      did,
+			Handle:   handle,
+			Email:    p(handle + "@example.com"),
+			Password: p("password"),
+		})
+		is.NoErr(err)
+	}
+	is.NoErr(as.CreateInviteCodes(ctx, []AccountCodes{
+		{Account: alice, Codes: []string{"a-1", "a-2"}},
+		{Account: bob, Codes: []string{"b-1"}},
+		{Account: "admin", Codes: []string{"admin-1"}},
+	}, 1))
+
+	// an account's codes stop working while its invites are disabled
+	is.NoErr(as.SetAccountInvitesDisabled(ctx, alice, true))
+	is.True(as.EnsureInviteAvailable(ctx, "a-1") != nil)
+	_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+		DID:        newDID(),
+		Handle:     "one.pds.local",
+		Email:      p("one@example.com"),
+		Password:   p("password"),
+		InviteCode: p("a-1"),
+	})
+	var e *xrpc.ErrorResponse
+	is.True(errors.As(err, &e))
+	is.Equal(e.Code, xrpc.Code("InvalidInviteCode"))
+	acct, err := as.GetAccount(ctx, alice, nil)
+	is.NoErr(err)
+	is.True(acct.InvitesDisabled)
+	is.NoErr(as.SetAccountInvitesDisabled(ctx, alice, false))
+	is.NoErr(as.EnsureInviteAvailable(ctx, "a-1"))
+	is.True(as.SetAccountInvitesDisabled(ctx, newDID(), true) != nil)
+
+	is.NoErr(as.DisableInviteCodes(ctx, []string{"a-1"}, []string{bob}))
+	is.True(as.EnsureInviteAvailable(ctx, "a-1") != nil)
+	is.True(as.EnsureInviteAvailable(ctx, "b-1") != nil)
+	is.NoErr(as.EnsureInviteAvailable(ctx, "a-2"))
+	is.True(as.DisableInviteCodes(ctx, nil, []string{"admin"}) != nil)
+	is.NoErr(as.EnsureInviteAvailable(ctx, "admin-1"))
+}
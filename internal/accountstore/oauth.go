@@ -0,0 +1,462 @@
+package accountstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/harrybrwn/db"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrOAuthRequestNotFound = errors.New("authorization request not found")
+	ErrOAuthRequestExpired  = errors.New("authorization request expired")
+	ErrOAuthTokenNotFound   = errors.New("oauth token not found")
+	// ErrRefreshTokenReplayed is returned when a refresh token that was
+	// already rotated is used again. The token it belonged to is revoked.
+	ErrRefreshTokenReplayed = errors.New("refresh token replayed")
+)
+
+func (as *AccountStore) CreateAuthorizationRequest(ctx context.Context, req *AuthorizationRequest) error {
+	_, err := as.db.ExecContext(
+		ctx,
+		`INSERT INTO authorization_request
+			(id, did, deviceId, clientId, clientAuth, parameters, expiresAt, code)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		req.ID,
+		req.DID,
+		req.DeviceID,
+		req.ClientID,
+		req.ClientAuth,
+		req.Parameters,
+		req.ExpiresAt,
+		req.Code,
+	)
+	return errors.Wrap(err, "failed to create authorization request")
+}
+
+// GetAuthorizationRequest returns an unexpired authorization request.
+func (as *AccountStore) GetAuthorizationRequest(ctx context.Context, id string) (*AuthorizationRequest, error) {
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT id, did, deviceId, clientId, clientAuth, parameters, expiresAt, code
+		   FROM authorization_request WHERE id = ?`,
+		id,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return scanAuthorizationRequest(rows)
+}
+
+// AuthorizeRequest records the user that accepted the request along with the
+// authorization code that the client can exchange for tokens.
+func (as *AccountStore) AuthorizeRequest(ctx context.Context, id, did, deviceID, code string, expiresAt time.Time) error {
+	res, err := as.db.ExecContext(
+		ctx,
+		`UPDATE authorization_request
+		    SET did = ?, deviceId = ?, code = ?, expiresAt = ?
+		  WHERE id = ?`,
+		did,
+		sql.NullString{String: deviceID, Valid: len(deviceID) > 0},
+		code,
+		expiresAt.UTC().Format(time.RFC3339),
+		id,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to update authorization request")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errors.WithStack(ErrOAuthRequestNotFound)
+	}
+	return nil
+}
+
+// ConsumeAuthorizationCode deletes and returns the request that an
+// authorization code was issued for. Codes can only be used once.
+func (as *AccountStore) ConsumeAuthorizationCode(ctx context.Context, code string) (*AuthorizationRequest, error) {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT id, did, deviceId, clientId, clientAuth, parameters, expiresAt, code
+		   FROM authorization_request WHERE code = ?`,
+		code,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req, err := scanAuthorizationRequest(rows)
+	if err != nil && !errors.Is(err, ErrOAuthRequestExpired) {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM authorization_request WHERE id = ?`, req.ID); err != nil {
+		return nil, errors.Wrap(err, "failed to delete authorization request")
+	}
+	if cerr := tx.Commit(); cerr != nil {
+		return nil, errors.Wrap(cerr, "failed to commit transaction")
+	}
+	return req, err
+}
+
+func (as *AccountStore) DeleteAuthorizationRequest(ctx context.Context, id string) error {
+	_, err := as.db.ExecContext(ctx, `DELETE FROM authorization_request WHERE id = ?`, id)
+	return errors.Wrap(err, "failed to delete authorization request")
+}
+
+// DeleteExpiredAuthorizationRequests removes requests that were never
+// completed.
+func (as *AccountStore) DeleteExpiredAuthorizationRequests(ctx context.Context) error {
+	_, err := as.db.ExecContext(
+		ctx,
+		`DELETE FROM authorization_request WHERE expiresAt < ?`,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	return errors.Wrap(err, "failed to delete expired authorization requests")
+}
+
+func scanAuthorizationRequest(rows *sql.Rows) (*AuthorizationRequest, error) {
+	var req AuthorizationRequest
+	err := db.ScanOne(
+		rows,
+		&req.ID,
+		&req.DID,
+		&req.DeviceID,
+		&req.ClientID,
+		&req.ClientAuth,
+		&req.Parameters,
+		&req.ExpiresAt,
+		&req.Code,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.WithStack(ErrOAuthRequestNotFound)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, req.ExpiresAt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if time.Now().After(expiresAt) {
+		return &req, errors.WithStack(ErrOAuthRequestExpired)
+	}
+	return &req, nil
+}
+
+// CreateOAuthToken stores the session created when an authorization code is
+// exchanged. The refresh token is generated if it is empty.
+func (as *AccountStore) CreateOAuthToken(ctx context.Context, tok *Token) error {
+	if !tok.CurrentRefreshToken.Valid {
+		refresh, err := NewOAuthRefreshToken()
+		if err != nil {
+			return err
+		}
+		tok.CurrentRefreshToken = sql.NullString{String: refresh, Valid: true}
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	tok.CreatedAt, tok.UpdatedAt = now, now
+	res, err := as.db.ExecContext(
+		ctx,
+		`INSERT INTO token
+			(did, tokenId, createdAt, updatedAt, expiresAt, clientId, clientAuth,
+			 deviceId, parameters, details, code, currentRefreshToken)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		tok.DID,
+		tok.TokenID,
+		tok.CreatedAt,
+		tok.UpdatedAt,
+		tok.ExpiresAt,
+		tok.ClientID,
+		tok.ClientAuth,
+		tok.DeviceID,
+		tok.Parameters,
+		tok.Details,
+		tok.Code,
+		tok.CurrentRefreshToken,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to create oauth token")
+	}
+	id, err := res.LastInsertId()
+	tok.ID = int(id)
+	return errors.WithStack(err)
+}
+
+// RotateOAuthRefreshToken exchanges a refresh token for a new one and a new
+// access token id. Using a refresh token twice revokes the whole session.
+func (as *AccountStore) RotateOAuthRefreshToken(ctx context.Context, refreshToken, tokenID string, expiresAt time.Time) (*Token, error) {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	d := db.NewTx(tx)
+	tok, err := getOAuthToken(ctx, d, `currentRefreshToken = ?`, refreshToken)
+	if errors.Is(err, ErrOAuthTokenNotFound) {
+		var id int
+		rows, qerr := d.QueryContext(ctx, `SELECT tokenId FROM used_refresh_token WHERE refreshToken = ?`, refreshToken)
+		if qerr != nil {
+			return nil, errors.WithStack(qerr)
+		}
+		if db.ScanOne(rows, &id) != nil {
+			return nil, err
+		}
+		if _, err = d.ExecContext(ctx, `DELETE FROM token WHERE id = ?`, id); err != nil {
+			return nil, errors.Wrap(err, "failed to revoke token")
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, errors.Wrap(err, "failed to commit transaction")
+		}
+		return nil, errors.WithStack(ErrRefreshTokenReplayed)
+	} else if err != nil {
+		return nil, err
+	}
+	exp, err := time.Parse(time.RFC3339, tok.ExpiresAt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if time.Now().After(exp) {
+		return nil, errors.WithStack(ErrOAuthTokenNotFound)
+	}
+	next, err := NewOAuthRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.ExecContext(
+		ctx,
+		`INSERT INTO used_refresh_token (refreshToken, tokenId) VALUES (?, ?)`,
+		refreshToken,
+		tok.ID,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to store used refresh token")
+	}
+	tok.TokenID = tokenID
+	tok.CurrentRefreshToken = sql.NullString{String: next, Valid: true}
+	tok.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	tok.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+	_, err = d.ExecContext(
+		ctx,
+		`UPDATE token
+		    SET tokenId = ?, currentRefreshToken = ?, updatedAt = ?, expiresAt = ?
+		  WHERE id = ?`,
+		tok.TokenID,
+		tok.CurrentRefreshToken,
+		tok.UpdatedAt,
+		tok.ExpiresAt,
+		tok.ID,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to rotate refresh token")
+	}
+	return tok, errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// GetOAuthToken looks up a session by the id of its current access token.
+func (as *AccountStore) GetOAuthToken(ctx context.Context, tokenID string) (*Token, error) {
+	return getOAuthToken(ctx, db.Simple(as.db), `tokenId = ?`, tokenID)
+}
+
+// RevokeOAuthToken deletes the session with the given access token id or
+// refresh token.
+func (as *AccountStore) RevokeOAuthToken(ctx context.Context, token string) error {
+	_, err := as.db.ExecContext(
+		ctx,
+		`DELETE FROM token WHERE tokenId = ? OR currentRefreshToken = ?`,
+		token,
+		token,
+	)
+	return errors.Wrap(err, "failed to revoke oauth token")
+}
+
+func getOAuthToken(ctx context.Context, d db.DB, where string, arg any) (*Token, error) {
+	var tok Token
+	rows, err := d.QueryContext(
+		ctx,
+		`SELECT id, did, tokenId, createdAt, updatedAt, expiresAt, clientId,
+		        clientAuth, deviceId, parameters, details, code, currentRefreshToken
+		   FROM token WHERE `+where,
+		arg,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = db.ScanOne(
+		rows,
+		&tok.ID,
+		&tok.DID,
+		&tok.TokenID,
+		&tok.CreatedAt,
+		&tok.UpdatedAt,
+		&tok.ExpiresAt,
+		&tok.ClientID,
+		&tok.ClientAuth,
+		&tok.DeviceID,
+		&tok.Parameters,
+		&tok.Details,
+		&tok.Code,
+		&tok.CurrentRefreshToken,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.WithStack(ErrOAuthTokenNotFound)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &tok, nil
+}
+
+// NewOAuthRefreshToken generates a random refresh token.
+func NewOAuthRefreshToken() (string, error) {
+	b, err := genRandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return "ref-" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// UpsertDevice creates a device or updates its session and last seen time.
+func (as *AccountStore) UpsertDevice(ctx context.Context, d *Device) error {
+	_, err := as.db.ExecContext(
+		ctx,
+		`INSERT INTO device (id, sessionId, userAgent, ipAddress, lastSeenAt)
+		 VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (id) DO UPDATE
+		    SET sessionId = excluded.sessionId,
+		        userAgent = excluded.userAgent,
+		        ipAddress = excluded.ipAddress,
+		        lastSeenAt = excluded.lastSeenAt`,
+		d.ID,
+		d.SessionID,
+		d.UserAgent,
+		d.IPAddress,
+		d.LastSeenAt,
+	)
+	return errors.Wrap(err, "failed to store device")
+}
+
+// GetDevice finds a device by its id and session id. Both are stored in the
+// browser's cookies.
+func (as *AccountStore) GetDevice(ctx context.Context, id, sessionID string) (*Device, error) {
+	var d Device
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT id, sessionId, userAgent, ipAddress, lastSeenAt
+		   FROM device WHERE id = ? AND sessionId = ?`,
+		id,
+		sessionID,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = db.ScanOne(rows, &d.ID, &d.SessionID, &d.UserAgent, &d.IPAddress, &d.LastSeenAt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &d, nil
+}
+
+// UpsertDeviceAccount records a sign in on a device. The client is added to
+// the clients the account has authorized on the device.
+func (as *AccountStore) UpsertDeviceAccount(ctx context.Context, deviceID, did string, remember bool, clientID string) error {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	var (
+		raw     string
+		clients []string
+	)
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT authorizedClients FROM device_account WHERE deviceId = ? AND did = ?`,
+		deviceID,
+		did,
+	).Scan(&raw)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return errors.WithStack(err)
+	default:
+		if err = json.Unmarshal([]byte(raw), &clients); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if len(clientID) > 0 && !slices.Contains(clients, clientID) {
+		clients = append(clients, clientID)
+	}
+	b, err := json.Marshal(clients)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO device_account (did, deviceId, authenticatedAt, remember, authorizedClients)
+		 VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (deviceId, did) DO UPDATE
+		    SET authenticatedAt = excluded.authenticatedAt,
+		        remember = excluded.remember,
+		        authorizedClients = excluded.authorizedClients`,
+		did,
+		deviceID,
+		time.Now().UTC().Format(time.RFC3339),
+		remember,
+		string(b),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to store device account")
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// RememberedAccount is an account that chose to stay signed in on a device.
+type RememberedAccount struct {
+	DeviceAccount
+	Handle string
+}
+
+// ListDeviceAccounts returns the accounts that are remembered on a device.
+func (as *AccountStore) ListDeviceAccounts(ctx context.Context, deviceID string) ([]*RememberedAccount, error) {
+	rows, err := as.db.QueryContext(
+		ctx,
+		`SELECT device_account.did, deviceId, authenticatedAt, remember, authorizedClients, actor.handle
+		   FROM device_account
+		   JOIN actor ON actor.did = device_account.did
+		  WHERE deviceId = ? AND remember = 1
+		    AND actor.takedownRef IS NULL
+		  ORDER BY authenticatedAt DESC`,
+		deviceID,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var accounts []*RememberedAccount
+	for rows.Next() {
+		var (
+			acct   RememberedAccount
+			handle sql.NullString
+		)
+		err = rows.Scan(
+			&acct.DID,
+			&acct.DeviceID,
+			&acct.AuthenticatedAt,
+			&acct.Remember,
+			&acct.AuthorizedClients,
+			&handle,
+		)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		acct.Handle = handle.String
+		accounts = append(accounts, &acct)
+	}
+	return accounts, errors.WithStack(rows.Err())
+}
@@ -0,0 +1,100 @@
+package accountstore
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+)
+
+func TestOAuthStore(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	as := New(db, []byte("fe62fcf606785c916f265548c39a3628"), "did:web:pds.local")
+	is.NoErr(as.Migrate(ctx))
+	did := newDID()
+	_, _, err = as.CreateAccount(ctx, CreateAccountOpts{
+		DID:      did,
+		Handle:   "alice.pds.local",
+		Email:    p("alice@example.com"),
+		Password: p("password"),
+	})
+	is.NoErr(err)
+	expires := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+
+	is.NoErr(as.CreateAuthorizationRequest(ctx, &AuthorizationRequest{
+		ID:         "req-1",
+		ClientID:   "https://app.example.com/client-metadata.json",
+		ClientAuth: `{"method":"none"}`,
+		Parameters: `{}`,
+		ExpiresAt:  expires,
+	}))
+	req, err := as.GetAuthorizationRequest(ctx, "req-1")
+	is.NoErr(err)
+	is.Equal(req.ClientID, "https://app.example.com/client-metadata.json")
+	is.True(!req.DID.Valid)
+	_, err = as.ConsumeAuthorizationCode(ctx, "cod-1")
+	is.True(errors.Is(err, ErrOAuthRequestNotFound))
+	is.NoErr(as.AuthorizeRequest(ctx, "req-1", did, "", "cod-1", time.Now().Add(time.Minute)))
+	req, err = as.ConsumeAuthorizationCode(ctx, "cod-1")
+	is.NoErr(err)
+	is.Equal(req.DID.String, did)
+	_, err = as.ConsumeAuthorizationCode(ctx, "cod-1")
+	is.True(errors.Is(err, ErrOAuthRequestNotFound)) // used up
+	is.NoErr(as.CreateAuthorizationRequest(ctx, &AuthorizationRequest{
+		ID:        "req-2",
+		ExpiresAt: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+	}))
+	_, err = as.GetAuthorizationRequest(ctx, "req-2")
+	is.True(errors.Is(err, ErrOAuthRequestExpired))
+
+	tok := Token{
+		DID:        did,
+		TokenID:    "tok-1",
+		ExpiresAt:  expires,
+		ClientID:   req.ClientID,
+		ClientAuth: req.ClientAuth,
+		Parameters: req.Parameters,
+	}
+	is.NoErr(as.CreateOAuthToken(ctx, &tok))
+	first := tok.CurrentRefreshToken.String
+	rotated, err := as.RotateOAuthRefreshToken(ctx, first, "tok-2", time.Now().Add(time.Hour))
+	is.NoErr(err)
+	is.Equal(rotated.TokenID, "tok-2")
+	is.True(rotated.CurrentRefreshToken.String != first)
+	_, err = as.GetOAuthToken(ctx, "tok-2")
+	is.NoErr(err)
+	// reusing a refresh token revokes the session
+	_, err = as.RotateOAuthRefreshToken(ctx, first, "tok-3", time.Now().Add(time.Hour))
+	is.True(errors.Is(err, ErrRefreshTokenReplayed))
+	_, err = as.GetOAuthToken(ctx, "tok-2")
+	is.True(errors.Is(err, ErrOAuthTokenNotFound))
+	_, err = as.RotateOAuthRefreshToken(ctx, rotated.CurrentRefreshToken.String, "tok-3", time.Now().Add(time.Hour))
+	is.True(errors.Is(err, ErrOAuthTokenNotFound))
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	is.NoErr(as.UpsertDevice(ctx, &Device{ID: "dev-1", SessionID: "ses-1", IPAddress: "127.0.0.1", LastSeenAt: now}))
+	is.NoErr(as.UpsertDevice(ctx, &Device{ID: "dev-1", SessionID: "ses-2", IPAddress: "127.0.0.1", LastSeenAt: now}))
+	_, err = as.GetDevice(ctx, "dev-1", "ses-1")
+	is.True(err != nil)
+	_, err = as.GetDevice(ctx, "dev-1", "ses-2")
+	is.NoErr(err)
+	is.NoErr(as.UpsertDeviceAccount(ctx, "dev-1", did, true, "https://a.example.com"))
+	is.NoErr(as.UpsertDeviceAccount(ctx, "dev-1", did, true, "https://b.example.com"))
+	is.NoErr(as.UpsertDeviceAccount(ctx, "dev-1", did, true, "https://a.example.com"))
+	accounts, err := as.ListDeviceAccounts(ctx, "dev-1")
+	is.NoErr(err)
+	is.Equal(len(accounts), 1)
+	is.Equal(accounts[0].Handle, "alice.pds.local")
+	is.Equal(accounts[0].AuthorizedClients, `["https://a.example.com","https://b.example.com"]`)
+	is.NoErr(as.UpsertDeviceAccount(ctx, "dev-1", did, false, ""))
+	accounts, err = as.ListDeviceAccounts(ctx, "dev-1")
+	is.NoErr(err)
+	is.Equal(len(accounts), 0)
+}
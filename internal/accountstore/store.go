@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/harrybrwn/db"
 	"github.com/pkg/errors"
 
@@ -20,12 +21,19 @@ type AccountStore struct {
 	db         *sql.DB
 	jwtKey     []byte
 	serviceDID string
+	accessKey  *crypto.PrivateKeyK256
 }
 
 func New(db *sql.DB, jwtKey []byte, serviceDID string) *AccountStore {
 	return &AccountStore{db: db, jwtKey: jwtKey, serviceDID: serviceDID}
 }
 
+// SetAccessTokenKey makes the store sign access tokens with ES256K using key.
+// An entryway does this so that the PDSes behind it can verify its tokens.
+func (as *AccountStore) SetAccessTokenKey(key *crypto.PrivateKeyK256) {
+	as.accessKey = key
+}
+
 func (as *AccountStore) Close() error {
 	return as.db.Close()
 }
@@ -91,19 +99,25 @@ func (as *AccountStore) UpdateHandle(ctx context.Context, did string, handle str
 	return nil
 }
 
-// TODO In atproto/packages/pds/src/account-manager/index.ts, createSession
-// accepts an `appPassword` type and this should be supported in the future.
+// CreateSession creates a new pair of tokens. Sessions created with an app
+// password get an access token scoped to the app password.
 func (as *AccountStore) CreateSession(
 	ctx context.Context,
 	did string,
 	appPassword *AppPassDescript,
 ) (accessJwt string, refreshJwt string, err error) {
 	now := time.Now().UTC()
+	scope := auth.ScopeAccess
+	if appPassword != nil {
+		scope = auth.AppPassScope(appPassword.Privileged)
+	}
 	accessJwt, refreshJwt, err = auth.CreateTokens(&auth.CreateTokenOpts{
 		DID:        did,
 		JWTKey:     as.jwtKey,
 		ServiceDID: as.serviceDID,
+		Scope:      scope,
 		Now:        &now,
+		SigningKey: as.accessKey,
 	})
 	if err != nil {
 		return "", "", err
@@ -148,13 +162,14 @@ func updateAccountTakedownStatus(ctx context.Context, tx db.DB, did string, take
 	return nil
 }
 
-type accountAdminStatus struct {
+// AccountAdminStatus is the moderation state of an account.
+type AccountAdminStatus struct {
 	Takedown    StatusAttr
 	Deactivated StatusAttr
 }
 
 // getAccountAdminStatus retrieves the takedown and deactivated statuses for a given DID.
-func getAccountAdminStatus(ctx context.Context, d db.DB, did string) (*accountAdminStatus, error) {
+func getAccountAdminStatus(ctx context.Context, d db.DB, did string) (*AccountAdminStatus, error) {
 	// Query to select takedownRef and deactivatedAt from the actor table
 	query := `SELECT takedownRef, deactivatedAt FROM actor WHERE did = ?`
 
@@ -188,7 +203,7 @@ func getAccountAdminStatus(ctx context.Context, d db.DB, did string) (*accountAd
 	}
 
 	// Return the result
-	return &accountAdminStatus{
+	return &AccountAdminStatus{
 		Takedown:    takedown,
 		Deactivated: deactivated,
 	}, nil
@@ -2,6 +2,7 @@ package accountstore
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
 	"github.com/harrybrwn/db"
@@ -21,6 +22,9 @@ type CreateAccountOpts struct {
 	RepoRev     string
 	InviteCode  *string
 	Deactivated *bool
+	// PDS is the url of the server hosting the repo when this store belongs
+	// to an entryway.
+	PDS string
 }
 
 type FreshAccount struct {
@@ -54,6 +58,7 @@ func (as *AccountStore) CreateAccount(ctx context.Context, opts CreateAccountOpt
 		JWTKey:     as.jwtKey,
 		ServiceDID: as.serviceDID,
 		Now:        &now,
+		SigningKey: as.accessKey,
 	})
 	if err != nil {
 		return "", "", errors.Wrap(err, "failed to create tokens")
@@ -68,6 +73,14 @@ func (as *AccountStore) CreateAccount(ctx context.Context, opts CreateAccountOpt
 		return "", "", errors.Wrap(err, "failed to start transaction")
 	}
 	dbtx := db.NewTx(tx)
+	if opts.InviteCode != nil {
+		// Check the invite before anything else so that concurrent jobs
+		// cannot record a use of an exhausted code.
+		if err = ensureInviteIsAvailable(ctx, dbtx, *opts.InviteCode); err != nil {
+			_ = tx.Rollback()
+			return "", "", err
+		}
+	}
 	jobs := parallel.BasicJobs{
 		// Register actor
 		func(ctx context.Context) error {
@@ -83,15 +96,16 @@ func (as *AccountStore) CreateAccount(ctx context.Context, opts CreateAccountOpt
 		},
 	}
 	if opts.InviteCode != nil {
-		// Ensure invite is available if inviteCode is provided
-		jobs.Add(func(ctx context.Context) error {
-			return ensureInviteIsAvailable(ctx, dbtx, *opts.InviteCode)
-		})
 		// Record invite use if applicable
 		jobs.Add(func(ctx context.Context) error {
 			return recordInviteUse(ctx, dbtx, did, *opts.InviteCode, now)
 		})
 	}
+	if len(opts.PDS) > 0 {
+		jobs.Add(func(ctx context.Context) error {
+			return setAccountPDS(ctx, dbtx, did, opts.PDS)
+		})
+	}
 	// Register account if email and password are provided
 	if email != nil && passwordHash != nil {
 		jobs.Add(func(ctx context.Context) error {
@@ -155,18 +169,22 @@ func registerAccount(ctx context.Context, tx db.DB, did, email string, passwordH
 func ensureInviteIsAvailable(ctx context.Context, tx db.DB, inviteCode string) error {
 	query := `SELECT availableUses, disabled FROM invite_code 
 			  LEFT JOIN actor ON actor.did = invite_code.forAccount
-			  WHERE code = ? AND takedownRef IS NULL`
+			  LEFT JOIN account ON account.did = invite_code.forAccount
+			  WHERE code = ? AND takedownRef IS NULL
+			  AND coalesce(account.invitesDisabled, 0) = 0`
 	var availableUses, disabled int
 	rows, err := tx.QueryContext(ctx, query, inviteCode)
 	if err != nil {
 		return errors.Wrap(err, "failed to ensure invite is available")
 	}
 	err = db.ScanOne(rows, &availableUses, &disabled)
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
+		return errInviteNotAvailable(err)
+	} else if err != nil {
 		return errors.Wrap(err, "failed to ensure invite is available")
 	}
 	if disabled == 1 || availableUses <= 0 {
-		return errors.New("invite code not available")
+		return errInviteNotAvailable(nil)
 	}
 
 	// Check how many times the invite has been used
@@ -180,7 +198,7 @@ func ensureInviteIsAvailable(ctx context.Context, tx db.DB, inviteCode string) e
 		return errors.Wrap(err, "failed to count invite uses")
 	}
 	if availableUses <= usesCount {
-		return errors.New("invite code not available")
+		return errInviteNotAvailable(nil)
 	}
 	return nil
 }
@@ -1,18 +1,23 @@
 package actorstore
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"io"
 	"iter"
 	"log/slog"
+	"net/http"
 	"slices"
+	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/harrybrwn/db"
 	"github.com/huandu/go-sqlbuilder"
 	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 	"github.com/pkg/errors"
 
 	"github.com/harrybrwn/at/array"
@@ -80,7 +85,9 @@ type ListBlobsOpts struct {
 
 func (br *BlobReader) ListBlobs(ctx context.Context, limit int, opts *ListBlobsOpts) ([]string, error) {
 	var (
-		query = "SELECT DISTINCT blobCid FROM record_blob"
+		query = `SELECT DISTINCT blobCid FROM record_blob
+			INNER JOIN blob ON blob.cid = record_blob.blobCid`
+		where = []string{"blob.takedownRef IS NULL"}
 		args  []any
 		blobs []string
 	)
@@ -88,13 +95,15 @@ func (br *BlobReader) ListBlobs(ctx context.Context, limit int, opts *ListBlobsO
 		opts = new(ListBlobsOpts)
 	}
 	if opts.Since != nil {
-		query += " INNER JOIN record ON record.uri = record_blob.recordUri WHERE record.repoRev > ?"
+		query += " INNER JOIN record ON record.uri = record_blob.recordUri"
+		where = append(where, "record.repoRev > ?")
 		args = append(args, *opts.Since)
 	}
 	if opts.Cursor != nil {
-		query += " AND blobCid > ?"
+		where = append(where, "blobCid > ?")
 		args = append(args, *opts.Cursor)
 	}
+	query += " WHERE " + strings.Join(where, " AND ")
 	query += " ORDER BY blobCid ASC LIMIT ?"
 	args = append(args, limit)
 
@@ -215,10 +224,73 @@ func (br *BlobReader) ListMissingBlobs(ctx context.Context, cursor *string, limi
 
 type BlobTransactor struct{ *BlobReader }
 
+// Blob opens an actor's blob metadata alongside the store holding the blob
+// contents.
+func (as *ActorStore) Blob(did syntax.DID, blobstore repo.BlobStore) (*BlobTransactor, error) {
+	ds, err := as.datastore(did)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobTransactor{BlobReader: &BlobReader{datastore: *ds, blobstore: blobstore}}, nil
+}
+
 func NewBlobTransactor(db db.DB, br *BlobReader) *BlobTransactor {
 	return &BlobTransactor{BlobReader: NewBlobReader(db, br.blobstore, br.did, br.key)}
 }
 
+// UploadBlob stores a blob and records its metadata. New blobs stay in
+// temporary storage until a record references them. Blobs that are already
+// referenced, which happens when blobs are uploaded after a repo import, are
+// stored permanently right away. The mime type is sniffed from the content
+// when mimeType is empty.
+func (t *BlobTransactor) UploadBlob(ctx context.Context, r io.Reader, mimeType string) (*repo.BlobRef, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(b)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ref := repo.BlobRef{
+		CID:      c,
+		MimeType: mimeType,
+		Size:     int64(len(b)),
+	}
+	if len(ref.MimeType) == 0 {
+		ref.MimeType = http.DetectContentType(b)
+	}
+	rows, err := t.db.QueryContext(ctx, `SELECT COUNT(*) FROM record_blob WHERE blobCid = ?`, c.String())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var references int64
+	if err = db.ScanOne(rows, &references); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var tempKey sql.NullString
+	if references > 0 {
+		err = t.blobstore.PutPermanent(ctx, c, bytes.NewReader(b))
+	} else {
+		tempKey.String, err = t.blobstore.PutTemp(ctx, bytes.NewReader(b))
+		tempKey.Valid = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.db.ExecContext(ctx, `
+		INSERT INTO blob (cid, mimeType, size, tempKey, createdAt)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (cid) DO UPDATE SET
+			tempKey = CASE WHEN blob.tempKey IS NULL THEN NULL ELSE excluded.tempKey END`,
+		c.String(), ref.MimeType, ref.Size, tempKey,
+		time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &ref, nil
+}
+
 func (t *BlobTransactor) DeleteBlob(ctx context.Context, cid cid.Cid) error {
 	// Delete the blob
 	if err := t.blobstore.Delete(ctx, cid); err != nil {
@@ -238,6 +310,35 @@ func (t *BlobTransactor) UnQuarantineBlob(ctx context.Context, cid cid.Cid) erro
 	return t.blobstore.Unquarantine(ctx, cid)
 }
 
+// UpdateBlobTakedownStatus takes down or restores a blob. The contents of
+// taken down blobs are moved to quarantine so they can't be served.
+func (t *BlobTransactor) UpdateBlobTakedownStatus(ctx context.Context, cid cid.Cid, takedown StatusAttr) error {
+	current, err := t.GetBlobTakedownStatus(ctx, cid.String())
+	if err != nil {
+		return err
+	}
+	// Files are moved first so that a failed update can be retried.
+	switch {
+	case takedown.Applied && !current.Applied:
+		err = t.QuarantineBlob(ctx, cid)
+	case !takedown.Applied && current.Applied:
+		err = t.UnQuarantineBlob(ctx, cid)
+	}
+	// Blobs that were never made permanent have nothing to move.
+	if err != nil && !errors.Is(err, repo.ErrBlobNotFound) {
+		return errors.WithStack(err)
+	}
+	var takedownRef any
+	if takedown.Applied {
+		takedownRef = takedown.Ref
+		if len(takedown.Ref) == 0 {
+			takedownRef = time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+	_, err = t.db.ExecContext(ctx, "UPDATE blob SET takedownRef = ? WHERE cid = ?", takedownRef, cid.String())
+	return errors.WithStack(err)
+}
+
 func (t *BlobTransactor) GetBlobDetails(ctx context.Context, cid string) (map[string]interface{}, error) {
 	query := "SELECT size, mimeType, quarantined FROM blob WHERE cid = ?"
 	rows, err := t.db.QueryContext(ctx, query, cid)
@@ -0,0 +1,175 @@
+package actorstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/harrybrwn/db"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/cbor/dagcbor"
+	"github.com/harrybrwn/at/internal/repo"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// ImportRepo replaces the contents of an actor's repo with the repo read from
+// a CAR file. The repo's commit must belong to the actor and be signed by the
+// key returned from keyfn. Records are indexed and the blobs they reference
+// are tracked so they can be listed as missing until they are uploaded.
+func (as *ActorStore) ImportRepo(ctx context.Context, did syntax.DID, r io.Reader, keyfn repo.KeyFunc) error {
+	root, blocks, err := repo.ReadCar(r)
+	if err != nil {
+		return xrpc.NewInvalidRequest("Invalid repo CAR file").Wrap(err)
+	}
+	report := repo.Verify(ctx, root, blocks, keyfn)
+	if report.DID != did.String() {
+		return xrpc.NewInvalidRequest("Imported repo belongs to %q, not %q", report.DID, did)
+	}
+	if !report.OK() {
+		p := report.Problems[0]
+		return xrpc.NewInvalidRequest("Invalid repo: %s: %s", p.Check, p.Message)
+	}
+	loaded, err := repo.Load(ctx, repo.NewMemoryBlockstore(blocks), root, nil)
+	if err != nil {
+		return xrpc.NewInvalidRequest("Failed to load repo").Wrap(err)
+	}
+	ds, err := as.datastore(did)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	tx, err := ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = importRepo(ctx, tx, ds, loaded, blocks)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+// ResignRoot replaces an actor's head commit with one over the same tree
+// signed by the actor's key on this server. An imported repo is still signed
+// by the previous PDS, which stops verifying once the did document names the
+// new signing key. Nil is returned when the head commit is already signed by
+// this server.
+func (as *ActorStore) ResignRoot(ctx context.Context, did syntax.DID) (*repo.CommitData, error) {
+	ds, err := as.datastore(did)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+	tx, err := ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	commit, err := resignRoot(ctx, NewSQLRepoTransactor(tx, ds.did, ds.key), ds)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return commit, errors.WithStack(tx.Commit())
+}
+
+func resignRoot(ctx context.Context, storage *SQLRepoTransactor, ds *datastore) (*repo.CommitData, error) {
+	root, err := storage.GetRootDetailed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, xrpc.NewInvalidRequest("Repo has no commits")
+	}
+	raw, err := storage.GetBytes(ctx, root.CID)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, errors.Errorf("commit block %q not found", root.CID)
+	}
+	var prev repo.SignedCommit
+	if err = dagcbor.Unmarshal(raw, &prev); err != nil {
+		return nil, errors.Wrap(err, "failed to decode commit")
+	}
+	pub, err := ds.key.PublicKey()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if repo.VerifyCommitSignature(&prev, pub) == nil {
+		return nil, nil
+	}
+	c, signed, err := repo.SignCommit(&repo.UnsignedCommit{
+		DID:     prev.DID,
+		Version: prev.Version,
+		Data:    prev.Data,
+		Rev:     repo.NextTID().String(),
+	}, ds.key)
+	if err != nil {
+		return nil, err
+	}
+	commit := repo.CommitData{
+		CID:          c,
+		Rev:          signed.Rev,
+		Since:        root.Rev,
+		Prev:         root.CID,
+		NewBlocks:    repo.NewBlockMap(),
+		RemovedCIDs:  cid.NewSet(),
+		SignedCommit: signed,
+	}
+	commit.NewBlocks.Set(c, signed.Bytes())
+	commit.RemovedCIDs.Add(root.CID)
+	if err = storage.ApplyCommit(ctx, &commit, false); err != nil {
+		return nil, err
+	}
+	return &commit, nil
+}
+
+func importRepo(ctx context.Context, tx db.DB, ds *datastore, loaded *repo.Repo, blocks *repo.BlockMap) error {
+	for _, table := range []string{"record_blob", "backlink", "record", "repo_block", "repo_root"} {
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+table)
+		if err != nil {
+			return errors.Wrapf(err, "failed to clear %s", table)
+		}
+	}
+	rev := loaded.Rev()
+	storage := NewSQLRepoTransactor(tx, ds.did, ds.key)
+	if err := storage.PutMany(ctx, blocks, rev); err != nil {
+		return err
+	}
+	if err := storage.UpdateRoot(ctx, loaded.Root(), rev, true); err != nil {
+		return err
+	}
+	records := newRecordTransactor(tx, ds)
+	now := time.Now()
+	return loaded.Walk(ctx, func(collection, rkey string, c cid.Cid) error {
+		raw, ok := blocks.Get(c)
+		if !ok {
+			return errors.Errorf("record block %q not found", c)
+		}
+		record := make(map[string]any)
+		if err := dagcbor.Unmarshal(raw, &record); err != nil {
+			return errors.Wrapf(err, "failed to decode record %s/%s", collection, rkey)
+		}
+		uri := syntax.ATURI(fmt.Sprintf("at://%s/%s/%s", ds.did, collection, rkey))
+		err := records.IndexRecord(ctx, uri, c, record, repo.WriteOpActionCreate, rev, now)
+		if err != nil {
+			return err
+		}
+		for _, ref := range repo.BlobRefs(record) {
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO record_blob (blobCid, recordUri)
+				VALUES (?, ?)
+				ON CONFLICT DO NOTHING`,
+				ref.CID.String(), uri.String())
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+}
@@ -92,6 +92,23 @@ func (rr *RecordReader) GetRecord(ctx context.Context, uri syntax.ATURI, cid *ci
 	return &res, err
 }
 
+// GetRecordTakedownStatus returns the takedown status of a record along with
+// its current cid.
+func (rr *RecordReader) GetRecordTakedownStatus(ctx context.Context, uri syntax.ATURI) (*StatusAttr, cid.Cid, error) {
+	rows, err := rr.db.QueryContext(ctx, `SELECT cid, takedownRef FROM record WHERE uri = ?`, uri.String())
+	if err != nil {
+		return nil, cid.Undef, errors.WithStack(err)
+	}
+	var (
+		c           StoredCid
+		takedownRef sql.NullString
+	)
+	if err = db.ScanOne(rows, &c, &takedownRef); err != nil {
+		return nil, cid.Undef, errors.WithStack(err)
+	}
+	return &StatusAttr{Applied: takedownRef.Valid, Ref: takedownRef.String}, c.CID, nil
+}
+
 func (rr *RecordReader) GetByRev(ctx context.Context, rev string) (*Record, error) {
 	rows, err := rr.db.QueryContext(ctx, `
 		SELECT rb.cid, r.uri, rb.content, r.collection, r.rkey, r.repoRev, r.takedownRef
@@ -494,6 +511,30 @@ func (rt *RecordTransactor) DeleteRecord(ctx context.Context, uri syntax.ATURI)
 		})
 }
 
+// UpdateRecordTakedownStatus takes down or restores a record. Taken down
+// records are hidden from reads but stay in the repo.
+func (rt *RecordTransactor) UpdateRecordTakedownStatus(ctx context.Context, uri syntax.ATURI, takedown StatusAttr) error {
+	var takedownRef any
+	if takedown.Applied {
+		takedownRef = takedown.Ref
+		if len(takedown.Ref) == 0 {
+			takedownRef = time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+	res, err := rt.db.ExecContext(ctx, `UPDATE record SET takedownRef = ? WHERE uri = ?`, takedownRef, uri.String())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n == 0 {
+		return errors.WithStack(sql.ErrNoRows)
+	}
+	return nil
+}
+
 type RepoRecord map[string]any
 
 func (r RepoRecord) Type() (string, bool) {
@@ -2,6 +2,7 @@ package actorstore
 
 import (
 	"context"
+	"database/sql"
 	"testing"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/matryer/is"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 
 	comatp "github.com/harrybrwn/at/api/com/atproto"
 	"github.com/harrybrwn/at/internal/repo"
@@ -107,6 +109,62 @@ of a generic database of records attached to your identity.`,
 	is.NoErr(err)
 }
 
+func TestRecordTakedown(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	key := testKey(t)
+	did := syntax.DID("did:plc:kzvsijt4365vidgqv7o6wksi")
+	as, _ := teststore(t, did.String(), key)
+	rr, err := as.Record(did)
+	is.NoErr(err)
+	defer rr.Close()
+	uri := syntax.ATURI("at://" + did + "/app.bsky.feed.post/1")
+	c := cid.MustParse("bafyreiatwnfkxm53e3puyimx45ftesimjzku5xkotmxz6g6fu6dyygqkdy")
+	err = rr.Tx(ctx, func(ctx context.Context, tx *RecordTransactor) error {
+		return tx.IndexRecord(ctx, uri, c, nil, repo.WriteOpActionCreate, "", time.Now())
+	})
+	is.NoErr(err)
+
+	err = rr.Tx(ctx, func(ctx context.Context, tx *RecordTransactor) error {
+		return tx.UpdateRecordTakedownStatus(ctx, uri, StatusAttr{Applied: true, Ref: "mod-1"})
+	})
+	is.NoErr(err)
+	status, recordCid, err := rr.GetRecordTakedownStatus(ctx, uri)
+	is.NoErr(err)
+	is.Equal(*status, StatusAttr{Applied: true, Ref: "mod-1"})
+	is.Equal(recordCid, c)
+	repoReader, err := as.Repo(did, key)
+	is.NoErr(err)
+	defer repoReader.Close()
+	cids, err := repoReader.ListTakendownRecords(ctx)
+	is.NoErr(err)
+	is.Equal(cids, []cid.Cid{c})
+	// the block is still needed by a live record with the same content
+	err = rr.Tx(ctx, func(ctx context.Context, tx *RecordTransactor) error {
+		return tx.IndexRecord(ctx, syntax.ATURI("at://"+did+"/app.bsky.feed.post/3"), c, nil, repo.WriteOpActionCreate, "", time.Now())
+	})
+	is.NoErr(err)
+	cids, err = repoReader.ListTakendownRecords(ctx)
+	is.NoErr(err)
+	is.Equal(len(cids), 0)
+
+	err = rr.Tx(ctx, func(ctx context.Context, tx *RecordTransactor) error {
+		return tx.UpdateRecordTakedownStatus(ctx, uri, StatusAttr{})
+	})
+	is.NoErr(err)
+	status, _, err = rr.GetRecordTakedownStatus(ctx, uri)
+	is.NoErr(err)
+	is.True(!status.Applied)
+	cids, err = repoReader.ListTakendownRecords(ctx)
+	is.NoErr(err)
+	is.Equal(len(cids), 0)
+
+	err = rr.Tx(ctx, func(ctx context.Context, tx *RecordTransactor) error {
+		return tx.UpdateRecordTakedownStatus(ctx, syntax.ATURI("at://"+did+"/app.bsky.feed.post/2"), StatusAttr{Applied: true})
+	})
+	is.True(errors.Is(err, sql.ErrNoRows))
+}
+
 func TestSQLBuilder(t *testing.T) {
 	is := is.New(t)
 	collection := "app.bsky.feed.post"
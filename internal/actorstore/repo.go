@@ -17,6 +17,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/harrybrwn/at/array"
+	sqlblockstore "github.com/harrybrwn/at/internal/blockstore"
 	"github.com/harrybrwn/at/internal/parallel"
 	"github.com/harrybrwn/at/internal/repo"
 	"github.com/harrybrwn/at/internal/xiter"
@@ -192,6 +193,46 @@ func (s *SQLRepoReader) ListAllBlocks(ctx context.Context) (*repo.BlockMap, erro
 	return m, nil
 }
 
+// ListTakendownRecords returns the cids of every record that has been taken
+// down. Records with the same content as a live record share its block, so
+// their cids are left out.
+func (s *SQLRepoReader) ListTakendownRecords(ctx context.Context) ([]cid.Cid, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT cid FROM record
+		WHERE takedownRef IS NOT NULL
+		  AND cid NOT IN (SELECT cid FROM record WHERE takedownRef IS NULL)`)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var cids []cid.Cid
+	for rows.Next() {
+		var c StoredCid
+		if err = rows.Scan(&c); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		cids = append(cids, c.CID)
+	}
+	return cids, errors.WithStack(rows.Err())
+}
+
+// GetRecordProof returns the current root and the blocks proving that a
+// record is in the repo.
+func (s *SQLRepoReader) GetRecordProof(ctx context.Context, collection, rkey string) (cid.Cid, *repo.BlockMap, error) {
+	root, err := s.GetRootDetailed(ctx)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	if root == nil {
+		return cid.Undef, nil, errors.New("repo has no root")
+	}
+	blocks, err := repo.RecordProof(ctx, sqlblockstore.NewSQLStore(s.db, root.Rev), root.CID, collection, rkey)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	return root.CID, blocks, nil
+}
+
 // SQLRepoTransactor extends SQLRepoReader with write operations
 type SQLRepoTransactor struct {
 	*SQLRepoReader
@@ -256,7 +297,8 @@ func (s *SQLRepoTransactor) PutMany(ctx context.Context, toPut *repo.BlockMap, r
 	}, toPut.Iter()))
 	errs := xiter.Map(func(blocks []*RepoBlock) error {
 		query := "INSERT INTO repo_block (cid, repoRev, size, content) VALUES "
-		query += strings.Repeat("(?,?,?,?)", len(blocks))
+		query += strings.Repeat(",(?,?,?,?)", len(blocks))[1:]
+		query += " ON CONFLICT DO NOTHING"
 		args := make([]any, 0, 4*len(blocks))
 		for i := 0; i < len(blocks); i++ {
 			args = append(args, blocks[i].cid)
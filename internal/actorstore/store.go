@@ -88,6 +88,113 @@ func (as *ActorStore) Destroy(did syntax.DID) error {
 	return os.RemoveAll(dir)
 }
 
+// SigningKey returns the repo signing key of an actor.
+func (as *ActorStore) SigningKey(did syntax.DID) (*crypto.PrivateKeyK256, error) {
+	_, _, keypath := as.location(did)
+	return as.key(keypath)
+}
+
+// ReserveSigningKey generates a signing key for an account that is being
+// migrated to this server. The key is used when the account is created so
+// that the did document can be updated to point at it beforehand. Reserving
+// a key for the same did twice returns the same key. Keys reserved without a
+// did are stored under their own did:key.
+func (as *ActorStore) ReserveSigningKey(did string) (*crypto.PrivateKeyK256, error) {
+	if len(did) > 0 {
+		key, err := as.ReservedSigningKey(did)
+		if err == nil {
+			return key, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	key, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(did) == 0 {
+		pub, err := key.PublicKey()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		did = pub.DIDKey()
+	}
+	path := as.reservedKeyLocation(did)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = os.WriteFile(path, key.Bytes(), 0600); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return key, nil
+}
+
+// ReservedSigningKey returns the key reserved for a did. It returns
+// [os.ErrNotExist] if no key has been reserved.
+func (as *ActorStore) ReservedSigningKey(did string) (*crypto.PrivateKeyK256, error) {
+	return as.key(as.reservedKeyLocation(did))
+}
+
+// ClearReservedSigningKey removes the key reserved for a did.
+func (as *ActorStore) ClearReservedSigningKey(did string) error {
+	err := os.Remove(as.reservedKeyLocation(did))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (as *ActorStore) reservedKeyLocation(did string) string {
+	return filepath.Join(as.Dir, "reserved_keys", sha256Hex(did))
+}
+
+// RepoStats summarizes what is stored for an actor.
+type RepoStats struct {
+	Root               *repo.RootInfo
+	RepoBlocks         int64
+	IndexedRecords     int64
+	PrivateStateValues int64
+	// ExpectedBlobs is the number of distinct blobs referenced by records and
+	// ImportedBlobs is how many blobs are actually stored.
+	ExpectedBlobs int64
+	ImportedBlobs int64
+}
+
+// Stats counts the blocks, records, preferences and blobs stored for an
+// actor.
+func (as *ActorStore) Stats(ctx context.Context, did syntax.DID) (*RepoStats, error) {
+	ds, err := as.datastore(did)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+	var stats RepoStats
+	stats.Root, err = NewSQLRepoReader(ds.db, did, ds.key).GetRootDetailed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts := []struct {
+		query string
+		dest  *int64
+	}{
+		{`SELECT COUNT(*) FROM repo_block`, &stats.RepoBlocks},
+		{`SELECT COUNT(*) FROM record`, &stats.IndexedRecords},
+		{`SELECT COUNT(*) FROM account_pref`, &stats.PrivateStateValues},
+		{`SELECT COUNT(DISTINCT blobCid) FROM record_blob`, &stats.ExpectedBlobs},
+		{`SELECT COUNT(*) FROM blob`, &stats.ImportedBlobs},
+	}
+	for _, c := range counts {
+		rows, err := ds.db.QueryContext(ctx, c.query)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err = db.ScanOne(rows, c.dest); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return &stats, nil
+}
+
 func (as *ActorStore) datastore(did syntax.DID) (ds *datastore, err error) {
 	ds = new(datastore)
 	_, dbpath, keypath := as.location(did)
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base32"
 	"encoding/base64"
+	"strings"
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/crypto"
@@ -21,6 +22,76 @@ const (
 	ScopeSignupQueued      Scope = "com.atproto.signupQueued"
 )
 
+// protectedMethods can only be called with a full access token and never
+// with an app password.
+var protectedMethods = map[string]struct{}{
+	"com.atproto.admin.sendEmail":                       {},
+	"com.atproto.identity.requestPlcOperationSignature": {},
+	"com.atproto.identity.signPlcOperation":             {},
+	"com.atproto.identity.updateHandle":                 {},
+	"com.atproto.server.activateAccount":                {},
+	"com.atproto.server.confirmEmail":                   {},
+	"com.atproto.server.createAppPassword":              {},
+	"com.atproto.server.deactivateAccount":              {},
+	"com.atproto.server.getAccountInviteCodes":          {},
+	"com.atproto.server.listAppPasswords":               {},
+	"com.atproto.server.requestAccountDelete":           {},
+	"com.atproto.server.requestEmailConfirmation":       {},
+	"com.atproto.server.requestEmailUpdate":             {},
+	"com.atproto.server.revokeAppPassword":              {},
+	"com.atproto.server.updateEmail":                    {},
+}
+
+// Protected returns true for methods that can only be called with a full
+// access token.
+func Protected(nsid string) bool {
+	_, ok := protectedMethods[nsid]
+	return ok
+}
+
+// privilegedPrefixes are namespaces that need a privileged app password.
+var privilegedPrefixes = []string{"chat.bsky."}
+
+// AccessScope returns true if the scope is for an access token.
+func (s Scope) AccessScope() bool {
+	switch s {
+	case ScopeAccess, ScopeAppPass, ScopeAppPassPrivileged:
+		return true
+	}
+	return false
+}
+
+// Allows returns true if a token with this scope can call the method.
+func (s Scope) Allows(nsid string) bool {
+	switch s {
+	case ScopeAccess:
+		return true
+	case ScopeAppPass, ScopeAppPassPrivileged:
+		if Protected(nsid) {
+			return false
+		}
+		if s == ScopeAppPassPrivileged {
+			return true
+		}
+		for _, prefix := range privilegedPrefixes {
+			if strings.HasPrefix(nsid, prefix) {
+				return false
+			}
+		}
+		return true
+	}
+	return oauthAllows(s, nsid)
+}
+
+// AppPassScope returns the access token scope for a session created with an
+// app password.
+func AppPassScope(privileged bool) Scope {
+	if privileged {
+		return ScopeAppPassPrivileged
+	}
+	return ScopeAppPass
+}
+
 type CreateTokenOpts struct {
 	DID        string
 	JWTKey     []byte
@@ -29,15 +100,21 @@ type CreateTokenOpts struct {
 	ExpiresIn  time.Duration
 	JTI        string // only used for creating refresh tokens
 	Now        *time.Time
+	// SigningKey signs access tokens with ES256K instead of JWTKey so that
+	// servers without the jwt secret can verify them.
+	SigningKey *crypto.PrivateKeyK256
 }
 
+// CreateTokens creates an access token with opts.Scope, defaulting to
+// [ScopeAccess], and a refresh token.
 func CreateTokens(opts *CreateTokenOpts) (access, refresh string, err error) {
-	opts.Scope = ScopeAccess
+	if opts.Scope == "" {
+		opts.Scope = ScopeAccess
+	}
 	access, err = CreateAccessToken(opts)
 	if err != nil {
 		return
 	}
-	opts.Scope = ScopeRefresh
 	refresh, err = CreateRefreshToken(opts)
 	if err != nil {
 		return
@@ -70,8 +147,15 @@ func CreateAccessToken(opts *CreateTokenOpts) (string, error) {
 		"exp":   expirationTime.Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString(opts.JWTKey)
+	var (
+		signedToken string
+		err         error
+	)
+	if opts.SigningKey != nil {
+		signedToken, err = jwt.NewWithClaims(K256SigningMethod, claims).SignedString(opts.SigningKey)
+	} else {
+		signedToken, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(opts.JWTKey)
+	}
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
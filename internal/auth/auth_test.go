@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -8,8 +9,11 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/bluesky-social/indigo/did"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/matryer/is"
 )
 
@@ -84,3 +88,179 @@ func TestPublicKeyFromDIDDoc(t *testing.T) {
 		t.Error("parsed multibase should be the same as the input multibase")
 	}
 }
+
+type staticResolver map[string]*did.Document
+
+func (sr staticResolver) GetDocument(_ context.Context, d string) (*did.Document, error) {
+	doc, ok := sr[d]
+	if !ok {
+		return nil, fmt.Errorf("did %q not found", d)
+	}
+	return doc, nil
+}
+
+func (sr staticResolver) FlushCacheFor(string) {}
+
+func TestEntrywayTokens(t *testing.T) {
+	is := is.New(t)
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	pub, err := key.PublicKey()
+	is.NoErr(err)
+	opts := Opts{
+		Logger:      slog.Default(),
+		JWTSecret:   jwtKey,
+		ServiceDID:  "did:web:pds.test",
+		EntrywayDID: "did:web:entryway.test",
+		EntrywayKey: pub.(*crypto.PublicKeyK256),
+	}
+	var user string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = UserFromContext(r.Context()).DID
+	})
+	do := func(h http.Handler, token string) int {
+		req := httptest.NewRequest("POST", "/xrpc/com.atproto.server.createAccount", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	access, err := CreateAccessToken(&CreateTokenOpts{
+		DID:        "did:plc:ar7c4by46qjdydhdevvrndac",
+		ServiceDID: "did:web:entryway.test",
+		SigningKey: key,
+	})
+	is.NoErr(err)
+	is.Equal(do(Required(&opts)(handler), access), 200)
+	is.Equal(user, "did:plc:ar7c4by46qjdydhdevvrndac")
+	withoutKey := opts
+	withoutKey.EntrywayKey = nil
+	is.True(do(Required(&withoutKey)(handler), access) != 200)
+
+	// service jwts from the entryway do not need a did document
+	lxm := "com.atproto.server.createAccount"
+	token, err := CreateServiceJwt(&ServiceJwtOpts{
+		Iss:     "did:web:entryway.test",
+		Aud:     "did:web:pds.test",
+		LXM:     &lxm,
+		KeyPair: key,
+	})
+	is.NoErr(err)
+	is.Equal(do(ServiceJwt(&opts)(handler), token), 200)
+	is.Equal(user, "did:web:entryway.test")
+	other, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	forged, err := CreateServiceJwt(&ServiceJwtOpts{
+		Iss:     "did:web:entryway.test",
+		Aud:     "did:web:pds.test",
+		LXM:     &lxm,
+		KeyPair: other,
+	})
+	is.NoErr(err)
+	is.True(do(ServiceJwt(&opts)(handler), forged) != 200)
+}
+
+func TestVerifyServiceJwt(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	pub, err := key.PublicKey()
+	is.NoErr(err)
+	const iss = "did:plc:nsu4iq7726acidyqpha2zuk3"
+	var doc did.Document
+	is.NoErr(json.Unmarshal([]byte(fmt.Sprintf(`{
+		"id": %[1]q,
+		"verificationMethod": [{"id": "%[1]s#atproto", "type": "Multikey", "controller": %[1]q, "publicKeyMultibase": %[2]q}]
+	}`, iss, pub.Multibase())), &doc))
+	resolver := staticResolver{iss: &doc}
+
+	exp := time.Now().Add(time.Minute)
+	lxm := "com.atproto.server.createAccount"
+	token, err := CreateServiceJwt(&ServiceJwtOpts{
+		Iss:     iss,
+		Aud:     "did:web:pds.test",
+		Exp:     &exp,
+		LXM:     &lxm,
+		KeyPair: key,
+	})
+	is.NoErr(err)
+
+	did, err := VerifyServiceJwt(ctx, resolver, token, "did:web:pds.test", lxm)
+	is.NoErr(err)
+	is.Equal(did, iss)
+	_, err = VerifyServiceJwt(ctx, resolver, token, "did:web:other.test", lxm)
+	is.True(err != nil)
+	_, err = VerifyServiceJwt(ctx, resolver, token, "did:web:pds.test", "com.atproto.repo.importRepo")
+	is.True(err != nil)
+
+	other, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	forged, err := CreateServiceJwt(&ServiceJwtOpts{
+		Iss:     iss,
+		Aud:     "did:web:pds.test",
+		LXM:     &lxm,
+		KeyPair: other,
+	})
+	is.NoErr(err)
+	_, err = VerifyServiceJwt(ctx, resolver, forged, "did:web:pds.test", lxm)
+	is.True(err != nil)
+}
+
+func TestTokenID(t *testing.T) {
+	is := is.New(t)
+	_, refresh, err := CreateTokens(&CreateTokenOpts{
+		JWTKey: jwtKey,
+		DID:    "did:plc:ar7c4by46qjdydhdevvrndac",
+		JTI:    "abc123",
+	})
+	is.NoErr(err)
+	tok, _, err := validateBearerToken(refresh, func(*jwt.Token) (any, error) { return jwtKey, nil }, ScopeRefresh)
+	is.NoErr(err)
+	is.Equal(TokenID(tok), "abc123")
+	is.Equal(TokenID(nil), "")
+}
+
+func TestScopeAllows(t *testing.T) {
+	is := is.New(t)
+	for _, tt := range []struct {
+		scope Scope
+		nsid  string
+		ok    bool
+	}{
+		{ScopeAccess, "com.atproto.server.updateEmail", true},
+		{ScopeAccess, "chat.bsky.convo.listConvos", true},
+		{ScopeAppPass, "com.atproto.repo.createRecord", true},
+		{ScopeAppPass, "com.atproto.server.updateEmail", false},
+		{ScopeAppPass, "com.atproto.server.createAppPassword", false},
+		{ScopeAppPass, "chat.bsky.convo.listConvos", false},
+		{ScopeAppPassPrivileged, "chat.bsky.convo.listConvos", true},
+		{ScopeAppPassPrivileged, "com.atproto.server.revokeAppPassword", false},
+		{ScopeRefresh, "com.atproto.repo.createRecord", false},
+	} {
+		is.Equal(tt.scope.Allows(tt.nsid), tt.ok)
+	}
+
+	access, err := CreateAccessToken(&CreateTokenOpts{
+		JWTKey: jwtKey,
+		DID:    "did:plc:ar7c4by46qjdydhdevvrndac",
+		Scope:  ScopeAppPass,
+	})
+	is.NoErr(err)
+	h := Required(&Opts{
+		Logger:    slog.Default(),
+		JWTSecret: jwtKey,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, code := range map[string]int{
+		"/xrpc/com.atproto.repo.createRecord":      200,
+		"/xrpc/com.atproto.server.updateEmail":     403,
+		"/xrpc/chat.bsky.convo.getConvoForMembers": 403,
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Authorization", "Bearer "+access)
+		h.ServeHTTP(rec, req)
+		is.Equal(rec.Code, code)
+	}
+}
@@ -0,0 +1,339 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/queue"
+)
+
+const (
+	// dpopNonceWindow is how often the server nonce changes. Nonces from the
+	// previous and next window are still accepted.
+	dpopNonceWindow = 3 * time.Minute
+	// dpopMaxAge is how far the "iat" of a proof may be from now.
+	dpopMaxAge = 5 * time.Minute
+)
+
+// DPoPError is returned for missing or invalid DPoP proofs. Code is an oauth
+// error code.
+type DPoPError struct {
+	Code        string
+	Description string
+}
+
+func (e *DPoPError) Error() string { return e.Code + ": " + e.Description }
+
+// ErrUseDPoPNonce means a proof did not include the current server nonce. The
+// client should retry with the nonce from the DPoP-Nonce response header.
+var ErrUseDPoPNonce = &DPoPError{
+	Code:        "use_dpop_nonce",
+	Description: "DPoP proof requires a server provided nonce",
+}
+
+func invalidDPoP(format string, args ...any) error {
+	return &DPoPError{Code: "invalid_dpop_proof", Description: fmt.Sprintf(format, args...)}
+}
+
+// JWK is a public elliptic curve json web key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d,omitempty"`
+}
+
+// NewJWK returns the public json web key of an ecdsa P-256 key.
+func NewJWK(key *ecdsa.PublicKey) *JWK {
+	var x, y [32]byte
+	key.X.FillBytes(x[:])
+	key.Y.FillBytes(y[:])
+	return &JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(x[:]),
+		Y:   base64.RawURLEncoding.EncodeToString(y[:]),
+	}
+}
+
+// NewPrivateJWK returns the json web key of an ecdsa P-256 key including
+// its private part.
+func NewPrivateJWK(key *ecdsa.PrivateKey) *JWK {
+	jwk := NewJWK(&key.PublicKey)
+	var d [32]byte
+	key.D.FillBytes(d[:])
+	jwk.D = base64.RawURLEncoding.EncodeToString(d[:])
+	return jwk
+}
+
+// PrivateKey parses a P-256 key that includes its private part.
+func (k *JWK) PrivateKey() (*ecdsa.PrivateKey, error) {
+	pub, err := k.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	d, err := base64.RawURLEncoding.DecodeString(k.D)
+	if err != nil || len(d) == 0 {
+		return nil, errors.New("jwk has no private key")
+	}
+	return &ecdsa.PrivateKey{PublicKey: *pub, D: new(big.Int).SetBytes(d)}, nil
+}
+
+// PublicKey parses a P-256 key.
+func (k *JWK) PublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, errors.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pub := ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("key is not on the P-256 curve")
+	}
+	return &pub, nil
+}
+
+// Thumbprint is the RFC 7638 thumbprint of the key. Access tokens are bound
+// to a key with its thumbprint.
+func (k *JWK) Thumbprint() string {
+	canonical := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type dpopHeader struct {
+	Typ string `json:"typ"`
+	Alg string `json:"alg"`
+	JWK *JWK   `json:"jwk"`
+}
+
+type dpopClaims struct {
+	JTI   string `json:"jti"`
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	IAT   int64  `json:"iat"`
+	Nonce string `json:"nonce,omitempty"`
+	ATH   string `json:"ath,omitempty"`
+}
+
+// DPoPVerifier checks DPoP proofs (RFC 9449). It hands out nonces derived
+// from a secret so that they don't need to be stored and remembers the "jti"
+// of recent proofs to stop replays.
+type DPoPVerifier struct {
+	secret []byte
+	now    func() time.Time
+	mu     sync.Mutex
+	seen   map[string]struct{}
+	// expiry holds the seen jtis oldest first so that expired ones can be
+	// dropped without looking at the rest.
+	expiry *queue.List[seenJTI]
+}
+
+type seenJTI struct {
+	jti string
+	exp time.Time
+}
+
+func NewDPoPVerifier(secret []byte) *DPoPVerifier {
+	return &DPoPVerifier{
+		secret: secret,
+		now:    time.Now,
+		seen:   make(map[string]struct{}),
+		expiry: queue.New[seenJTI](),
+	}
+}
+
+// Nonce returns the current server nonce.
+func (v *DPoPVerifier) Nonce() string {
+	return v.nonce(v.now().Unix() / int64(dpopNonceWindow/time.Second))
+}
+
+func (v *DPoPVerifier) nonce(counter int64) string {
+	mac := hmac.New(sha256.New, v.secret)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (v *DPoPVerifier) validNonce(nonce string) bool {
+	counter := v.now().Unix() / int64(dpopNonceWindow/time.Second)
+	for _, c := range []int64{counter, counter - 1, counter + 1} {
+		if hmac.Equal([]byte(nonce), []byte(v.nonce(c))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks a DPoP proof for a request with method htm to the url htu
+// and returns the thumbprint of the key that signed it. Proofs sent with an
+// access token must include a hash of the token.
+func (v *DPoPVerifier) Verify(proof, htm, htu, accessToken string) (string, error) {
+	if len(proof) == 0 {
+		return "", invalidDPoP("DPoP proof required")
+	}
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return "", invalidDPoP("malformed DPoP proof")
+	}
+	var (
+		header dpopHeader
+		claims dpopClaims
+	)
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", invalidDPoP("invalid DPoP header")
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", invalidDPoP("invalid DPoP claims")
+	}
+	if header.Typ != "dpop+jwt" {
+		return "", invalidDPoP("invalid DPoP typ %q", header.Typ)
+	}
+	if header.Alg != "ES256" {
+		return "", invalidDPoP("unsupported DPoP alg %q", header.Alg)
+	}
+	if header.JWK == nil || len(header.JWK.D) > 0 {
+		return "", invalidDPoP("DPoP proof must include a public jwk")
+	}
+	pub, err := header.JWK.PublicKey()
+	if err != nil {
+		return "", invalidDPoP("invalid DPoP jwk: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return "", invalidDPoP("invalid DPoP signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, digest[:], r, s) {
+		return "", invalidDPoP("invalid DPoP signature")
+	}
+
+	if !strings.EqualFold(claims.HTM, htm) {
+		return "", invalidDPoP("DPoP htm mismatch")
+	}
+	if !sameURL(claims.HTU, htu) {
+		return "", invalidDPoP("DPoP htu mismatch")
+	}
+	if len(accessToken) > 0 {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.ATH != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", invalidDPoP("DPoP ath mismatch")
+		}
+	}
+	now := v.now()
+	iat := time.Unix(claims.IAT, 0)
+	if iat.Before(now.Add(-dpopMaxAge)) || iat.After(now.Add(dpopMaxAge)) {
+		return "", invalidDPoP("DPoP proof is expired")
+	}
+	if len(claims.Nonce) == 0 || !v.validNonce(claims.Nonce) {
+		return "", ErrUseDPoPNonce
+	}
+	if len(claims.JTI) == 0 {
+		return "", invalidDPoP("DPoP proof requires a jti")
+	}
+	if !v.remember(claims.JTI, now) {
+		return "", invalidDPoP("DPoP proof replayed")
+	}
+	return header.JWK.Thumbprint(), nil
+}
+
+// remember stores a jti and returns false if it was already seen.
+func (v *DPoPVerifier) remember(jti string, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for e := v.expiry.Front(); e != nil && e.Value.exp.Before(now); e = v.expiry.Front() {
+		delete(v.seen, v.expiry.Remove(e).jti)
+	}
+	if _, ok := v.seen[jti]; ok {
+		return false
+	}
+	v.seen[jti] = struct{}{}
+	v.expiry.PushBack(seenJTI{jti: jti, exp: now.Add(2 * dpopMaxAge)})
+	return true
+}
+
+// CreateDPoPProof signs a DPoP proof for a request. The nonce and access
+// token are optional.
+func CreateDPoPProof(key *ecdsa.PrivateKey, htm, htu, nonce, accessToken string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", errors.WithStack(err)
+	}
+	claims := dpopClaims{
+		JTI:   base64.RawURLEncoding.EncodeToString(jti),
+		HTM:   htm,
+		HTU:   htu,
+		IAT:   time.Now().Unix(),
+		Nonce: nonce,
+	}
+	if len(accessToken) > 0 {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims.ATH = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	header, err := json.Marshal(&dpopHeader{Typ: "dpop+jwt", Alg: "ES256", JWK: NewJWK(&key.PublicKey)})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	payload, err := json.Marshal(&claims)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	var sig [64]byte
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig[:]), nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(json.Unmarshal(b, v))
+}
+
+// sameURL compares urls without their query or fragment.
+func sameURL(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) &&
+		strings.EqualFold(ua.Host, ub.Host) &&
+		ua.Path == ub.Path
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestDPoPVerifier(t *testing.T) {
+	is := is.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	v := NewDPoPVerifier(jwtKey)
+	htu := "https://pds.local/oauth/token"
+
+	proof, err := CreateDPoPProof(key, "POST", htu, "", "")
+	is.NoErr(err)
+	_, err = v.Verify(proof, "POST", htu, "")
+	is.Equal(err, ErrUseDPoPNonce)
+
+	proof, err = CreateDPoPProof(key, "POST", htu+"?x=1", v.Nonce(), "")
+	is.NoErr(err)
+	jkt, err := v.Verify(proof, "POST", htu, "")
+	is.NoErr(err)
+	is.Equal(jkt, NewJWK(&key.PublicKey).Thumbprint())
+	_, err = v.Verify(proof, "POST", htu, "")
+	is.True(err != nil) // replayed
+
+	for _, tt := range []struct {
+		htm, htu, token string
+	}{
+		{"GET", htu, ""},
+		{"POST", "https://pds.local/oauth/par", ""},
+		{"POST", htu, "access-token"},
+	} {
+		proof, err = CreateDPoPProof(key, "POST", htu, v.Nonce(), "")
+		is.NoErr(err)
+		_, err = v.Verify(proof, tt.htm, tt.htu, tt.token)
+		is.True(err != nil)
+	}
+
+	// nonces from the last window are still valid
+	nonce := v.Nonce()
+	v.now = func() time.Time { return time.Now().Add(dpopNonceWindow) }
+	proof, err = CreateDPoPProof(key, "POST", htu, nonce, "")
+	is.NoErr(err)
+	_, err = v.Verify(proof, "POST", htu, "")
+	is.NoErr(err)
+	v.now = func() time.Time { return time.Now().Add(3 * dpopNonceWindow) }
+	proof, err = CreateDPoPProof(key, "POST", htu, nonce, "")
+	is.NoErr(err)
+	_, err = v.Verify(proof, "POST", htu, "")
+	is.True(err != nil)
+
+	// expired jtis are forgotten
+	v = NewDPoPVerifier(jwtKey)
+	now := time.Now()
+	is.True(v.remember("a", now))
+	is.True(!v.remember("a", now.Add(dpopMaxAge)))
+	is.True(v.remember("b", now.Add(dpopMaxAge)))
+	is.True(v.remember("c", now.Add(3*dpopMaxAge)))
+	is.Equal(len(v.seen), 2) // b and c
+	is.Equal(v.expiry.Len(), 2)
+	is.True(v.remember("a", now.Add(3*dpopMaxAge)))
+}
+
+func TestRequired_DPoP(t *testing.T) {
+	is := is.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	v := NewDPoPVerifier(jwtKey)
+	opts := Opts{
+		Logger:    slog.Default(),
+		JWTSecret: jwtKey,
+		DPoP:      v,
+		PublicURL: "https://pds.local",
+	}
+	var user string
+	h := Required(&opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = UserFromContext(r.Context()).DID
+	}))
+	token, err := CreateOAuthAccessToken(&OAuthTokenOpts{
+		DID:     "did:plc:ar7c4by46qjdydhdevvrndac",
+		Scope:   "atproto transition:generic",
+		JKT:     NewJWK(&key.PublicKey).Thumbprint(),
+		TokenID: "tok-1",
+		JWTKey:  jwtKey,
+	})
+	is.NoErr(err)
+	do := func(path string, key *ecdsa.PrivateKey, nonce string) *httptest.ResponseRecorder {
+		proof, err := CreateDPoPProof(key, "GET", "https://pds.local"+path, nonce, token)
+		is.NoErr(err)
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "DPoP "+token)
+		req.Header.Set("DPoP", proof)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("/xrpc/com.atproto.repo.createRecord", key, "")
+	is.Equal(rec.Code, http.StatusUnauthorized)
+	nonce := rec.Header().Get("DPoP-Nonce")
+	is.True(len(nonce) > 0)
+	rec = do("/xrpc/com.atproto.repo.createRecord", key, nonce)
+	is.Equal(rec.Code, http.StatusOK)
+	is.Equal(user, "did:plc:ar7c4by46qjdydhdevvrndac")
+	rec = do("/xrpc/com.atproto.repo.createRecord", other, nonce)
+	is.Equal(rec.Code, http.StatusUnauthorized) // wrong key
+	rec = do("/xrpc/com.atproto.server.updateEmail", key, nonce)
+	is.Equal(rec.Code, http.StatusForbidden) // scope
+
+	// revoked sessions can't be used
+	revoked := false
+	opts.OAuthTokenActive = func(_ context.Context, id string) (bool, error) {
+		return id == "tok-1" && !revoked, nil
+	}
+	rec = do("/xrpc/com.atproto.repo.createRecord", key, nonce)
+	is.Equal(rec.Code, http.StatusOK)
+	revoked = true
+	rec = do("/xrpc/com.atproto.repo.createRecord", key, nonce)
+	is.Equal(rec.Code, http.StatusUnauthorized)
+
+	// oauth tokens can't be used as bearer tokens
+	req := httptest.NewRequest("GET", "/xrpc/com.atproto.repo.createRecord", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	is.True(rec.Code != http.StatusOK)
+}
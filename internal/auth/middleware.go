@@ -3,8 +3,11 @@ package auth
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"path"
+	"slices"
 	"strings"
 	"unicode"
 
@@ -31,12 +34,50 @@ type Opts struct {
 	JWTSecret     []byte
 	AdminPassword string
 	Resolver      indigodid.Resolver
+	// ServiceDID is the expected audience of service jwts.
+	ServiceDID string
+	// DPoP checks the proofs sent with oauth access tokens. OAuth tokens are
+	// rejected when it is nil.
+	DPoP *DPoPVerifier
+	// PublicURL is the url clients use to reach the server. It is needed to
+	// check DPoP proofs.
+	PublicURL string
+	// OAuthTokenActive reports whether the session of an oauth access token
+	// id still exists. Access tokens of revoked sessions are rejected when it
+	// is set.
+	OAuthTokenActive func(ctx context.Context, tokenID string) (bool, error)
+	// EntrywayDID and EntrywayKey identify the entryway that owns accounts.
+	// Access tokens signed with ES256K and service jwts issued by
+	// EntrywayDID are checked against EntrywayKey.
+	EntrywayDID string
+	EntrywayKey *crypto.PublicKeyK256
 }
 
-func (ao *Opts) secret(*jwt.Token) (any, error) {
+func (ao *Opts) secret(tok *jwt.Token) (any, error) {
+	if tok.Method == K256SigningMethod {
+		if ao.EntrywayKey == nil {
+			return nil, errors.New("unexpected signing method")
+		}
+		return ao.EntrywayKey, nil
+	}
 	return ao.JWTSecret, nil
 }
 
+// serviceKey finds the key that signed a service jwt. The entryway's key is
+// configured, everyone else's comes from their did document.
+func (ao *Opts) serviceKey(ctx context.Context) jwt.Keyfunc {
+	return func(t *jwt.Token) (any, error) {
+		iss, err := t.Claims.GetIssuer()
+		if err != nil {
+			return nil, err
+		}
+		if ao.EntrywayKey != nil && iss == ao.EntrywayDID {
+			return ao.EntrywayKey, nil
+		}
+		return GetResolverSigningKey(ctx, ao.Resolver, iss)
+	}
+}
+
 // AuthRequired will extract a jwt token and store it in the request context. It
 // will fail hard if the token is invalid or not found.
 func Required(opts *Opts) func(http.Handler) http.Handler {
@@ -71,15 +112,42 @@ func Required(opts *Opts) func(http.Handler) http.Handler {
 				ctx = storeUser(ctx, &xrpc.Auth{Handle: username})
 
 			case bearer:
-				tok, did, err := validateBearerToken(raw, ScopeAccess, opts.secret)
+				tok, did, err := validateBearerToken(raw, opts.secret, ScopeAccess, ScopeAppPass, ScopeAppPassPrivileged)
 				if err != nil {
 					xrpc.WriteError(opts.Logger, w, err, "")
 					return
 				}
+				if !TokenScope(tok).Allows(path.Base(r.URL.Path)) {
+					err = &xrpc.ErrorResponse{
+						Code:    "InvalidToken",
+						Message: "Bad token scope",
+						Status:  http.StatusForbidden,
+					}
+					xrpc.WriteError(opts.Logger, w, err, "")
+					return
+				}
 				ctx = storeUser(ctx, &xrpc.Auth{
 					DID: did,
 				})
 				ctx = storeToken(ctx, tok)
+
+			case dpop:
+				tok, did, err := validateDPoPRequest(opts, w, r, raw)
+				if err != nil {
+					xrpc.WriteError(opts.Logger, w, err, "")
+					return
+				}
+				if !TokenScope(tok).Allows(path.Base(r.URL.Path)) {
+					err = &xrpc.ErrorResponse{
+						Code:    "InvalidToken",
+						Message: "Bad token scope",
+						Status:  http.StatusForbidden,
+					}
+					xrpc.WriteError(opts.Logger, w, err, "")
+					return
+				}
+				ctx = storeUser(ctx, &xrpc.Auth{DID: did})
+				ctx = storeToken(ctx, tok)
 			}
 			r = r.WithContext(ctx)
 			h.ServeHTTP(w, r)
@@ -87,6 +155,66 @@ func Required(opts *Opts) func(http.Handler) http.Handler {
 	}
 }
 
+// Optional is like [Required] but lets requests without an Authorization
+// header through without a user.
+func Optional(opts *Opts) Middelware {
+	required := Required(opts)
+	return func(h http.Handler) http.Handler {
+		withAuth := required(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.Header.Get("Authorization")) == 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+			withAuth.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validateDPoPRequest checks an oauth access token and the DPoP proof that
+// was sent with it. The current DPoP nonce is always added to the response.
+func validateDPoPRequest(opts *Opts, w http.ResponseWriter, r *http.Request, raw string) (*jwt.Token, string, error) {
+	if opts.DPoP == nil {
+		return nil, "", xrpc.NewAuthRequired("OAuth tokens are not supported")
+	}
+	w.Header().Set("DPoP-Nonce", opts.DPoP.Nonce())
+	w.Header().Add("Access-Control-Expose-Headers", "DPoP-Nonce, WWW-Authenticate")
+	tok, did, jkt, err := validateOAuthToken(raw, opts.secret)
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.OAuthTokenActive != nil {
+		active, err := opts.OAuthTokenActive(r.Context(), TokenID(tok))
+		if err != nil {
+			return nil, "", err
+		}
+		if !active {
+			return nil, "", &xrpc.ErrorResponse{
+				Code:    "InvalidToken",
+				Message: "Token has been revoked",
+				Status:  http.StatusUnauthorized,
+			}
+		}
+	}
+	proofJkt, err := opts.DPoP.Verify(r.Header.Get("DPoP"), r.Method, opts.PublicURL+r.URL.Path, raw)
+	if err == nil && proofJkt != jkt {
+		err = invalidDPoP("DPoP key does not match the access token")
+	}
+	if err != nil {
+		var dpopErr *DPoPError
+		if !errors.As(err, &dpopErr) {
+			return nil, "", err
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`DPoP error=%q, error_description=%q`, dpopErr.Code, dpopErr.Description))
+		return nil, "", &xrpc.ErrorResponse{
+			Code:    xrpc.Code(dpopErr.Code),
+			Message: dpopErr.Description,
+			Status:  http.StatusUnauthorized,
+		}
+	}
+	return tok, did, nil
+}
+
 func AdminOnly(opts *Opts) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -118,7 +246,7 @@ func RefreshTokenOnly(opts *Opts) func(http.Handler) http.Handler {
 			raw, tt := getRawToken(r)
 			switch tt {
 			case bearer:
-				tok, did, err := validateBearerToken(raw, ScopeRefresh, opts.secret)
+				tok, did, err := validateBearerToken(raw, opts.secret, ScopeRefresh)
 				if err != nil {
 					xrpc.WriteError(opts.Logger, w, err, "")
 					return
@@ -136,6 +264,9 @@ func RefreshTokenOnly(opts *Opts) func(http.Handler) http.Handler {
 	}
 }
 
+// ServiceJwt accepts admin basic auth or a service jwt signed by the issuing
+// account. Requests without any authorization are let through so that
+// handlers can decide what unauthenticated callers are allowed to do.
 func ServiceJwt(opts *Opts) Middelware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -143,10 +274,7 @@ func ServiceJwt(opts *Opts) Middelware {
 			raw, tt := getRawToken(r)
 			switch tt {
 			case empty:
-				err := xrpc.NewAuthRequired("Empty auth")
-				xrpc.WriteError(opts.Logger, w, err, xrpc.AuthRequired)
-				return
-			case invalid:
+			case invalid, dpop:
 				err := xrpc.NewInvalidRequest("Invalid auth token")
 				xrpc.WriteError(opts.Logger, w, err, xrpc.InvalidRequest)
 				return
@@ -158,23 +286,12 @@ func ServiceJwt(opts *Opts) Middelware {
 				}
 				ctx = storeUser(ctx, &xrpc.Auth{Handle: username})
 			case bearer:
-				tok, did, err := validateBearerToken(raw, "", func(t *jwt.Token) (interface{}, error) {
-					iss, err := t.Claims.GetIssuer()
-					if err != nil {
-						return nil, err
-					}
-					key, err := GetResolverSigningKey(ctx, opts.Resolver, iss)
-					if err != nil {
-						return nil, err
-					}
-					return key, nil
-				})
+				did, err := verifyServiceJwt(raw, opts.ServiceDID, path.Base(r.URL.Path), opts.serviceKey(ctx))
 				if err != nil {
 					xrpc.WriteError(opts.Logger, w, err, "")
 					return
 				}
 				ctx = storeUser(ctx, &xrpc.Auth{DID: did})
-				ctx = storeToken(ctx, tok)
 			}
 			r = r.WithContext(ctx)
 			h.ServeHTTP(w, r)
@@ -201,7 +318,9 @@ func GetResolverSigningKey(
 	return publicKeyFromDidDoc(doc, keyId)
 }
 
-func validateBearerToken(raw string, expectedScope Scope, keyfn jwt.Keyfunc) (*jwt.Token, string, error) {
+// validateBearerToken parses a jwt and checks that its scope is one of
+// expected. The scope is not checked when expected is empty.
+func validateBearerToken(raw string, keyfn jwt.Keyfunc, expected ...Scope) (*jwt.Token, string, error) {
 	claims := make(jwt.MapClaims)
 	tok, err := jwt.ParseWithClaims(raw, &claims, keyfn)
 	if err != nil {
@@ -211,7 +330,7 @@ func validateBearerToken(raw string, expectedScope Scope, keyfn jwt.Keyfunc) (*j
 		return nil, "", xrpc.NewInvalidRequest("Invalid token")
 	}
 
-	if len(expectedScope) > 0 {
+	if len(expected) > 0 {
 		scopeAny, ok := claims["scope"]
 		if !ok {
 			return nil, "", xrpc.NewInvalidRequest("Invalid JWT claims")
@@ -220,8 +339,11 @@ func validateBearerToken(raw string, expectedScope Scope, keyfn jwt.Keyfunc) (*j
 		if !ok {
 			return nil, "", xrpc.NewInvalidRequest("Invalid JWT claims")
 		}
-		if Scope(scope) != expectedScope {
-			return nil, "", xrpc.NewInvalidRequest("Expected refresh token")
+		if !slices.Contains(expected, Scope(scope)) {
+			if expected[0] == ScopeRefresh {
+				return nil, "", xrpc.NewInvalidRequest("Expected refresh token")
+			}
+			return nil, "", xrpc.NewInvalidRequest("Invalid token scope")
 		}
 	}
 
@@ -317,6 +439,40 @@ func TokenFromContext(ctx context.Context) *jwt.Token {
 	return tok
 }
 
+// TokenID returns the "jti" claim of a token, which is only set on refresh
+// tokens.
+func TokenID(tok *jwt.Token) string {
+	claims, ok := mapClaims(tok)
+	if !ok {
+		return ""
+	}
+	jti, _ := claims["jti"].(string)
+	return jti
+}
+
+// TokenScope returns the "scope" claim of a token.
+func TokenScope(tok *jwt.Token) Scope {
+	claims, ok := mapClaims(tok)
+	if !ok {
+		return ""
+	}
+	scope, _ := claims["scope"].(string)
+	return Scope(scope)
+}
+
+func mapClaims(tok *jwt.Token) (jwt.MapClaims, bool) {
+	if tok == nil {
+		return nil, false
+	}
+	switch c := tok.Claims.(type) {
+	case jwt.MapClaims:
+		return c, true
+	case *jwt.MapClaims:
+		return *c, true
+	}
+	return nil, false
+}
+
 func UserFromContext(ctx context.Context) *xrpc.Auth {
 	val := ctx.Value(userKey)
 	if val == nil {
@@ -368,6 +524,9 @@ func getRawToken(r *http.Request) (string, tokenType) {
 	if len(h) == 0 {
 		return "", empty
 	}
+	if len(h) > 5 && strings.EqualFold(h[:5], "dpop ") {
+		return h[5:], dpop
+	}
 	h = string(unicode.ToLower(rune(h[0]))) + h[1:]
 	v, found := strings.CutPrefix(h, "bearer ")
 	if found {
@@ -387,6 +546,7 @@ const (
 	empty
 	bearer
 	basic
+	dpop
 )
 
 func parseBasicAuth(rawToken string) (username, password string, err error) {
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// OAuth scopes.
+const (
+	OAuthScopeAtproto           = "atproto"
+	OAuthScopeTransitionGeneric = "transition:generic"
+	OAuthScopeTransitionChat    = "transition:chat.bsky"
+)
+
+// OAuthScopes are the oauth scopes the server supports.
+var OAuthScopes = []string{
+	OAuthScopeAtproto,
+	OAuthScopeTransitionGeneric,
+	OAuthScopeTransitionChat,
+}
+
+// oauthAllows maps the transition oauth scopes to the app password scopes
+// that have the same permissions.
+func oauthAllows(scope Scope, nsid string) bool {
+	fields := strings.Fields(string(scope))
+	if !slices.Contains(fields, OAuthScopeAtproto) || !slices.Contains(fields, OAuthScopeTransitionGeneric) {
+		return false
+	}
+	return AppPassScope(slices.Contains(fields, OAuthScopeTransitionChat)).Allows(nsid)
+}
+
+type OAuthTokenOpts struct {
+	DID        string
+	ClientID   string
+	ServiceDID string
+	Scope      string
+	// JKT is the thumbprint of the DPoP key the token is bound to.
+	JKT       string
+	TokenID   string
+	JWTKey    []byte
+	ExpiresIn time.Duration
+	Now       *time.Time
+}
+
+// CreateOAuthAccessToken creates a DPoP bound access token.
+func CreateOAuthAccessToken(opts *OAuthTokenOpts) (string, error) {
+	now := time.Now().UTC()
+	if opts.Now != nil {
+		now = *opts.Now
+	}
+	expiresIn := opts.ExpiresIn
+	if expiresIn == 0 {
+		expiresIn = time.Hour
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"scope":     opts.Scope,
+		"aud":       opts.ServiceDID,
+		"sub":       opts.DID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(expiresIn).Unix(),
+		"jti":       opts.TokenID,
+		"client_id": opts.ClientID,
+		"cnf":       map[string]string{"jkt": opts.JKT},
+	})
+	token.Header["typ"] = "at+jwt"
+	signed, err := token.SignedString(opts.JWTKey)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return signed, nil
+}
+
+// validateOAuthToken checks an oauth access token and returns the token, the
+// subject and the thumbprint of the DPoP key it is bound to.
+func validateOAuthToken(raw string, keyfn jwt.Keyfunc) (*jwt.Token, string, string, error) {
+	claims := make(jwt.MapClaims)
+	tok, err := jwt.ParseWithClaims(
+		raw,
+		&claims,
+		keyfn,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || !tok.Valid {
+		return nil, "", "", &xrpc.ErrorResponse{Code: "InvalidToken", Message: "Invalid token"}
+	}
+	if typ, _ := tok.Header["typ"].(string); typ != "at+jwt" {
+		return nil, "", "", &xrpc.ErrorResponse{Code: "InvalidToken", Message: "Not an access token"}
+	}
+	cnf, _ := claims["cnf"].(map[string]any)
+	jkt, _ := cnf["jkt"].(string)
+	if len(jkt) == 0 {
+		return nil, "", "", &xrpc.ErrorResponse{Code: "InvalidToken", Message: "Token is not DPoP bound"}
+	}
+	sub, err := claims.GetSubject()
+	if err != nil || len(sub) == 0 {
+		return nil, "", "", &xrpc.ErrorResponse{Code: "InvalidToken", Message: "Token has no subject"}
+	}
+	return tok, sub, jkt, nil
+}
+
+// ParseOAuthTokenID returns the "jti" of a valid oauth access token.
+func ParseOAuthTokenID(raw string, jwtKey []byte) (string, error) {
+	tok, _, _, err := validateOAuthToken(raw, func(*jwt.Token) (any, error) { return jwtKey, nil })
+	if err != nil {
+		return "", err
+	}
+	return TokenID(tok), nil
+}
@@ -1,10 +1,14 @@
 package auth
 
 import (
+	"context"
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/crypto"
+	indigodid "github.com/bluesky-social/indigo/did"
 	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/harrybrwn/at/xrpc"
 )
 
 type ServiceJwtOpts struct {
@@ -15,6 +19,11 @@ type ServiceJwtOpts struct {
 	// LXM is the lexicon method
 	LXM     *string
 	KeyPair crypto.PrivateKey
+	// Sub and Scope are set when an entryway acts for one of its accounts on
+	// the PDS holding the account's repo. That PDS then accepts the jwt like
+	// an access token.
+	Sub   string
+	Scope Scope
 }
 
 func CreateServiceJwt(params *ServiceJwtOpts) (tokenJwt string, err error) {
@@ -37,17 +46,76 @@ func CreateServiceJwt(params *ServiceJwtOpts) (tokenJwt string, err error) {
 	if err != nil {
 		return "", err
 	}
-	token := jwt.NewWithClaims(K256SigningMethod, jwt.MapClaims{
+	claims := jwt.MapClaims{
 		"iat": iat.UTC().Unix(),
 		"exp": exp.UTC().Unix(),
 		"iss": params.Iss,
 		"aud": params.Aud,
 		"jti": jti,
 		"lxm": lxm,
-	})
+	}
+	if len(params.Sub) > 0 {
+		claims["sub"] = params.Sub
+	}
+	if len(params.Scope) > 0 {
+		claims["scope"] = params.Scope
+	}
+	token := jwt.NewWithClaims(K256SigningMethod, claims)
 	signedToken, err := token.SignedString(params.KeyPair)
 	if err != nil {
 		return "", err
 	}
 	return signedToken, nil
 }
+
+// VerifyServiceJwt checks the signature of a service jwt against the signing
+// key of its issuer and checks that it was meant for the given audience and
+// lexicon method. It returns the did of the issuer.
+func VerifyServiceJwt(
+	ctx context.Context,
+	resolver indigodid.Resolver,
+	raw, aud, lxm string,
+) (string, error) {
+	return verifyServiceJwt(raw, aud, lxm, func(t *jwt.Token) (any, error) {
+		iss, err := t.Claims.GetIssuer()
+		if err != nil {
+			return nil, err
+		}
+		return GetResolverSigningKey(ctx, resolver, iss)
+	})
+}
+
+func verifyServiceJwt(raw, aud, lxm string, keyfn jwt.Keyfunc) (string, error) {
+	claims := make(jwt.MapClaims)
+	tok, err := jwt.ParseWithClaims(raw, &claims, keyfn, jwt.WithExpirationRequired())
+	if err != nil {
+		return "", xrpc.NewInvalidRequest("Invalid service token").Wrap(err)
+	}
+	if !tok.Valid {
+		return "", xrpc.NewInvalidRequest("Invalid service token")
+	}
+	if aud != "" {
+		audience, err := claims.GetAudience()
+		if err != nil || len(audience) != 1 || audience[0] != aud {
+			return "", &xrpc.ErrorResponse{
+				Code:    xrpc.AuthRequired,
+				Message: "jwt audience does not match service did",
+			}
+		}
+	}
+	if lxm != "" {
+		method, _ := claims["lxm"].(string)
+		if method != lxm {
+			return "", &xrpc.ErrorResponse{
+				Code:    xrpc.AuthRequired,
+				Message: "bad jwt lexicon method (\"lxm\")",
+			}
+		}
+	}
+	iss, err := claims.GetIssuer()
+	if err != nil {
+		return "", xrpc.NewInvalidRequest("JWT claims has no iss.").Wrap(err)
+	}
+	did, _ := split2(iss, '#')
+	return did, nil
+}
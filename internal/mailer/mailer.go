@@ -0,0 +1,232 @@
+// Package mailer sends the emails a PDS needs for account management.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message is a single email.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	// HTML is the message body.
+	HTML string
+}
+
+// Mailer delivers email messages.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// New creates a Mailer from a url. smtp:// and smtps:// urls deliver mail to
+// an SMTP server and file:// urls write messages to a spool directory.
+func New(rawURL string) (Mailer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid mailer url")
+	}
+	switch u.Scheme {
+	case "smtp", "smtps":
+		return NewSMTP(u)
+	case "file":
+		return &Spool{Dir: u.Path}, nil
+	default:
+		return nil, errors.Errorf("unsupported mailer url scheme %q", u.Scheme)
+	}
+}
+
+// SMTP sends mail to an SMTP server.
+type SMTP struct {
+	addr string
+	host string
+	auth smtp.Auth
+	// implicitTLS is set for smtps:// urls. Otherwise STARTTLS is used when
+	// the server supports it.
+	implicitTLS bool
+}
+
+// NewSMTP creates an SMTP mailer from a url of the form
+// smtp[s]://[user:password@]host[:port].
+func NewSMTP(u *url.URL) (*SMTP, error) {
+	host := u.Hostname()
+	if len(host) == 0 {
+		return nil, errors.New("smtp url has no host")
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = "587"
+		if u.Scheme == "smtps" {
+			port = "465"
+		}
+	}
+	s := SMTP{
+		addr:        net.JoinHostPort(host, port),
+		host:        host,
+		implicitTLS: u.Scheme == "smtps",
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		s.auth = smtp.PlainAuth("", u.User.Username(), password, host)
+	}
+	return &s, nil
+}
+
+// Send delivers a message.
+func (s *SMTP) Send(ctx context.Context, msg *Message) error {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return errors.Wrap(err, "invalid from address")
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return errors.Wrap(err, "invalid to address")
+	}
+	var (
+		d    net.Dialer
+		conn net.Conn
+	)
+	if s.implicitTLS {
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: s.host}}
+		conn, err = td.DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to smtp server")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return errors.WithStack(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && !s.implicitTLS {
+		if err = c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if s.auth != nil {
+		if err = c.Auth(s.auth); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err = c.Mail(from.Address); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = c.Rcpt(to.Address); err != nil {
+		return errors.WithStack(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = w.Write(Format(msg)); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = w.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(c.Quit())
+}
+
+// Spool writes each message to a file in a directory instead of sending it.
+// It is meant for development and tests.
+type Spool struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// Send writes a message to the spool directory.
+func (s *Spool) Send(_ context.Context, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	var id [4]byte
+	_, _ = rand.Read(id[:])
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), hex.EncodeToString(id[:]))
+	return errors.WithStack(os.WriteFile(filepath.Join(s.Dir, name), Format(msg), 0o644))
+}
+
+// Messages reads back every message in the spool, oldest first.
+func (s *Spool) Messages() ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.eml"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sort.Strings(files)
+	msgs := make([]*Message, 0, len(files))
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		m, err := mail.ReadMessage(f)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "failed to read %s", file)
+		}
+		var body bytes.Buffer
+		_, err = body.ReadFrom(m.Body)
+		f.Close()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		msgs = append(msgs, &Message{
+			From:    m.Header.Get("From"),
+			To:      m.Header.Get("To"),
+			Subject: subject,
+			HTML:    body.String(),
+		})
+	}
+	return msgs, nil
+}
+
+// Format encodes a message with its headers.
+func Format(msg *Message) []byte {
+	var b bytes.Buffer
+	header := func(k, v string) {
+		b.WriteString(k)
+		b.WriteString(": ")
+		b.WriteString(v)
+		b.WriteString("\r\n")
+	}
+	header("From", msg.From)
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/html; charset="utf-8"`)
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.HTML, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
@@ -0,0 +1,149 @@
+package mailer
+
+import (
+	"context"
+	"embed"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+// Template names. A template defines the message body and a "subject"
+// template for its subject line.
+const (
+	TemplateConfirmEmail  = "confirm_email"
+	TemplateUpdateEmail   = "update_email"
+	TemplateResetPassword = "reset_password"
+	TemplateDeleteAccount = "delete_account"
+	TemplatePlcOperation  = "plc_operation"
+)
+
+// TokenParams are the template parameters for emails that carry a token.
+type TokenParams struct {
+	Handle string
+	Token  string
+}
+
+// ServerMailer renders and sends the emails used by account management.
+type ServerMailer struct {
+	Mailer    Mailer
+	From      string
+	templates map[string]*template.Template
+}
+
+// NewServerMailer creates a ServerMailer with the built in templates. A
+// template is replaced by "<name>.html" in templateDir when that file
+// exists.
+func NewServerMailer(m Mailer, from, templateDir string) (*ServerMailer, error) {
+	entries, err := defaultTemplates.ReadDir("templates")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sm := ServerMailer{
+		Mailer:    m,
+		From:      from,
+		templates: make(map[string]*template.Template, len(entries)),
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".html")
+		var raw []byte
+		if len(templateDir) > 0 {
+			raw, err = os.ReadFile(filepath.Join(templateDir, entry.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, errors.WithStack(err)
+			}
+		}
+		if raw == nil {
+			raw, err = defaultTemplates.ReadFile("templates/" + entry.Name())
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		t, err := template.New(name).Parse(string(raw))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse email template %q", name)
+		}
+		if t.Lookup("subject") == nil {
+			return nil, errors.Errorf("email template %q has no subject", name)
+		}
+		sm.templates[name] = t
+	}
+	return &sm, nil
+}
+
+// SendConfirmEmail sends the token used to confirm an email address.
+func (sm *ServerMailer) SendConfirmEmail(ctx context.Context, to string, params *TokenParams) error {
+	return sm.send(ctx, TemplateConfirmEmail, to, params)
+}
+
+// SendUpdateEmail sends the token used to approve an email address change
+// to the current address.
+func (sm *ServerMailer) SendUpdateEmail(ctx context.Context, to string, params *TokenParams) error {
+	return sm.send(ctx, TemplateUpdateEmail, to, params)
+}
+
+// SendResetPassword sends the token used to reset a password.
+func (sm *ServerMailer) SendResetPassword(ctx context.Context, to string, params *TokenParams) error {
+	return sm.send(ctx, TemplateResetPassword, to, params)
+}
+
+// SendDeleteAccount sends the token used to confirm an account deletion.
+func (sm *ServerMailer) SendDeleteAccount(ctx context.Context, to string, params *TokenParams) error {
+	return sm.send(ctx, TemplateDeleteAccount, to, params)
+}
+
+// SendPlcOperation sends the token used to approve signing an identity
+// operation.
+func (sm *ServerMailer) SendPlcOperation(ctx context.Context, to string, params *TokenParams) error {
+	return sm.send(ctx, TemplatePlcOperation, to, params)
+}
+
+func (sm *ServerMailer) send(ctx context.Context, name, to string, data any) error {
+	t, ok := sm.templates[name]
+	if !ok {
+		return errors.Errorf("no email template %q", name)
+	}
+	var subject, body strings.Builder
+	if err := t.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := t.Execute(&body, data); err != nil {
+		return errors.WithStack(err)
+	}
+	return sm.Mailer.Send(ctx, &Message{
+		From:    sm.From,
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		HTML:    strings.TrimSpace(body.String()),
+	})
+}
+
+// DefaultModerationSubject is the subject of moderation messages that were
+// sent without one.
+const DefaultModerationSubject = "Message via your PDS"
+
+// ModerationMailer sends messages written by moderators. It can use a
+// different mail server and sender than the [ServerMailer].
+type ModerationMailer struct {
+	Mailer Mailer
+	From   string
+}
+
+// Send delivers a moderator's message. The content is html and is sent as is.
+func (mm *ModerationMailer) Send(ctx context.Context, to, subject, content string) error {
+	if len(strings.TrimSpace(subject)) == 0 {
+		subject = DefaultModerationSubject
+	}
+	return mm.Mailer.Send(ctx, &Message{
+		From:    mm.From,
+		To:      to,
+		Subject: subject,
+		HTML:    content,
+	})
+}
@@ -0,0 +1,150 @@
+package pds
+
+import (
+	"context"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	atpapi "github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/account"
+	"github.com/harrybrwn/at/internal/accountstore"
+	"github.com/harrybrwn/at/internal/mailer"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// purgeBatchSize is the most accounts purged in one pass.
+const purgeBatchSize = 50
+
+// RequestAccountDelete emails a token that is needed to delete the
+// requesting account.
+func (pds *PDS) RequestAccountDelete(ctx context.Context) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(acct.Email) == 0 {
+		return nil, xrpc.NewInvalidRequest("account does not have an email address")
+	}
+	token, err := pds.Accounts.CreateEmailToken(ctx, acct.DID, accountstore.PurposeDeleteAccount)
+	if err != nil {
+		return nil, err
+	}
+	err = pds.Mailer.SendDeleteAccount(ctx, acct.Email, &mailer.TokenParams{
+		Handle: acct.Handle.String,
+		Token:  token,
+	})
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to send email").Wrap(err)
+	}
+	return nil, nil
+}
+
+// serverDeleteAccount implements com.atproto.server.deleteAccount, which
+// has the same method name as com.atproto.admin.deleteAccount.
+type serverDeleteAccount struct{ pds *PDS }
+
+var _ atpapi.ServerDeleteAccount = (*serverDeleteAccount)(nil)
+
+// DeleteAccount schedules an account to be purged right away after checking
+// its password and a token from [PDS.RequestAccountDelete].
+func (s *serverDeleteAccount) DeleteAccount(ctx context.Context, req *atpapi.ServerDeleteAccountRequest) (any, error) {
+	pds := s.pds
+	did := req.DID.String()
+	acct, err := pds.Accounts.GetAccount(ctx, did, new(accountstore.GetAccountOpts).WithDeactivated().WithTakenDown())
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("account not found")
+	}
+	if err = pds.Accounts.VerifyAccountPassword(ctx, acct.DID, req.Password); err != nil {
+		return nil, xrpc.NewAuthRequired("Invalid did or password")
+	}
+	if len(req.Token) == 0 {
+		return nil, accountstore.ErrInvalidEmailToken
+	}
+	if err = pds.Accounts.ScheduleAccountDeletion(ctx, acct.DID, req.Token, time.Now()); err != nil {
+		return nil, err
+	}
+	pds.wakePurger()
+	return nil, nil
+}
+
+// RunAccountPurger deletes accounts that are due for deletion every interval
+// until ctx is cancelled. This covers accounts deleted by their owners and
+// deactivated accounts whose "deleteAfter" time has passed.
+func (pds *PDS) RunAccountPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := pds.PurgeDueAccounts(ctx, time.Now())
+			if err != nil {
+				pds.logger.Error("failed to purge accounts", "error", err)
+				break
+			}
+			if n < purgeBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-pds.purge:
+		}
+	}
+}
+
+// PurgeDueAccounts purges a batch of accounts due for deletion at now and
+// returns the number of accounts purged. Accounts that fail are left in place
+// to be retried on the next pass.
+func (pds *PDS) PurgeDueAccounts(ctx context.Context, now time.Time) (int, error) {
+	dids, err := pds.Accounts.AccountsDueForDeletion(ctx, now, purgeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, did := range dids {
+		if err = pds.purgeAccount(ctx, syntax.DID(did)); err != nil {
+			pds.logger.Error("failed to purge account", "did", did, "error", err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeAccount removes all of an account's data. Every step can be repeated
+// and the account rows are removed last, so a purge that is interrupted is
+// picked up again on the next pass.
+func (pds *PDS) purgeAccount(ctx context.Context, did syntax.DID) error {
+	if err := pds.ActorStore.Destroy(did); err != nil {
+		return err
+	}
+	if blobs := pds.newBlobstore(did); blobs != nil {
+		if err := blobs.DeleteAll(ctx); err != nil {
+			return err
+		}
+	}
+	err := pds.sequence(ctx, &Event{SyncSubscribeReposAccount: &atpapi.SyncSubscribeReposAccount{
+		DID:    did,
+		Active: false,
+		Status: account.StatusDeleted.String(),
+	}})
+	if err != nil {
+		return err
+	}
+	if err = pds.Accounts.DeleteAccount(ctx, did.String()); err != nil {
+		return err
+	}
+	pds.logger.Info("purged account", "did", did)
+	return nil
+}
+
+// wakePurger asks the account purger to run without waiting for its next
+// interval.
+func (pds *PDS) wakePurger() {
+	select {
+	case pds.purge <- struct{}{}:
+	default:
+	}
+}
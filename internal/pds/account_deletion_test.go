@@ -0,0 +1,68 @@
+package pds
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/accountstore"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/internal/mailer"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	is := is.New(t)
+	pds := testPDS(t, localhost)
+	ctx := t.Context()
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "deleted-user.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	authed := auth.StashUser(ctx, &xrpc.Auth{DID: acct.DID.String(), Handle: acct.Handle.String()})
+	_, err = pds.RequestAccountDelete(authed)
+	is.NoErr(err)
+	msgs, err := pds.Mailer.Mailer.(*mailer.Spool).Messages()
+	is.NoErr(err)
+	token := regexp.MustCompile(`[A-Z2-7]{5}-[A-Z2-7]{5}`).FindString(msgs[len(msgs)-1].HTML)
+
+	handler := &serverDeleteAccount{pds}
+	_, err = handler.DeleteAccount(ctx, &atproto.ServerDeleteAccountRequest{
+		DID:      acct.DID,
+		Password: "wrong",
+		Token:    token,
+	})
+	is.True(err != nil)
+	_, err = handler.DeleteAccount(ctx, &atproto.ServerDeleteAccountRequest{
+		DID:      acct.DID,
+		Password: "testlab01",
+		Token:    token,
+	})
+	is.NoErr(err)
+	// the token can't be used again
+	_, err = handler.DeleteAccount(ctx, &atproto.ServerDeleteAccountRequest{
+		DID:      acct.DID,
+		Password: "testlab01",
+		Token:    token,
+	})
+	is.True(errors.Is(err, accountstore.ErrInvalidEmailToken))
+
+	n, err := pds.PurgeDueAccounts(ctx, time.Now())
+	is.NoErr(err)
+	is.Equal(n, 1)
+	_, err = pds.Accounts.GetAccount(ctx, acct.DID.String(), new(accountstore.GetAccountOpts).WithDeactivated())
+	is.True(err != nil)
+	_, err = pds.ActorStore.Record(acct.DID)
+	is.True(err != nil)
+	// purging again is a no-op
+	n, err = pds.PurgeDueAccounts(ctx, time.Now())
+	is.NoErr(err)
+	is.Equal(n, 0)
+	is.NoErr(pds.purgeAccount(ctx, acct.DID))
+}
@@ -0,0 +1,281 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harrybrwn/at/internal/accountstore"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// QueryAdminAuditLogNSID lists the entries in the admin audit log.
+const QueryAdminAuditLogNSID = "me.hrry.admin.queryAuditLog"
+
+const (
+	// maxAuditBody is the largest request body whose parameters are
+	// recorded in the audit log.
+	maxAuditBody = 64 * 1024
+	// maxAuditErrorBody is the most of an error response read to find the
+	// error code.
+	maxAuditErrorBody = 4 * 1024
+	redacted          = "[redacted]"
+)
+
+// auditAdminAction records every call it wraps in the admin audit log. It
+// must run after [auth.AdminOnly] so the caller is known. Failing to write
+// the log entry is logged and does not fail the request.
+func (pds *PDS) auditAdminAction(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params map[string]any
+		if r.Method == http.MethodGet {
+			params = queryParams(r.URL.Query())
+		} else if r.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+			if err != nil {
+				xrpc.WriteError(pds.logger, w, xrpc.NewInvalidRequest("Failed to read request body").Wrap(err), xrpc.InvalidRequest)
+				return
+			}
+			if len(body) <= maxAuditBody {
+				// Malformed bodies are reported by the handler.
+				_ = json.Unmarshal(body, &params)
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		aw := auditWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(&aw, r)
+
+		action := accountstore.AdminAction{
+			Method:  strings.TrimPrefix(r.URL.Path, "/xrpc/"),
+			Subject: auditSubject(params),
+			Status:  aw.status,
+		}
+		action.Actor = auditActor(r)
+		if len(params) > 0 {
+			raw, err := json.Marshal(redactParams(params))
+			if err == nil {
+				action.Params = string(raw)
+			}
+		}
+		if aw.status >= 400 {
+			var e xrpc.ErrorResponse
+			_ = json.Unmarshal(aw.errBody.Bytes(), &e)
+			action.Error = string(e.Code)
+			if len(action.Error) == 0 {
+				action.Error = http.StatusText(aw.status)
+			}
+			if len(e.Message) > 0 {
+				action.Error += ": " + e.Message
+			}
+		}
+		ctx := context.WithoutCancel(r.Context())
+		if err := pds.Accounts.RecordAdminAction(ctx, &action); err != nil {
+			pds.logger.Error("failed to record admin action",
+				"method", action.Method,
+				"subject", action.Subject,
+				"error", err)
+		}
+	})
+}
+
+// auditActor names the caller of an admin method. Every admin signs in with
+// the same password so they are told apart by their address. The entryway
+// and other service token callers are named by their did.
+func auditActor(r *http.Request) string {
+	user := auth.UserFromContext(r.Context())
+	switch {
+	case user == nil:
+		return ""
+	case len(user.DID) > 0:
+		return user.DID
+	default:
+		return user.Handle + "@" + remoteIP(r)
+	}
+}
+
+// auditWriter keeps the response status and the start of error responses.
+type auditWriter struct {
+	http.ResponseWriter
+	status  int
+	errBody bytes.Buffer
+}
+
+func (aw *auditWriter) WriteHeader(status int) {
+	aw.status = status
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *auditWriter) Write(b []byte) (int, error) {
+	if aw.status >= 400 && aw.errBody.Len() < maxAuditErrorBody {
+		aw.errBody.Write(b[:min(len(b), maxAuditErrorBody-aw.errBody.Len())])
+	}
+	return aw.ResponseWriter.Write(b)
+}
+
+func (aw *auditWriter) Unwrap() http.ResponseWriter { return aw.ResponseWriter }
+
+func queryParams(q url.Values) map[string]any {
+	params := make(map[string]any, len(q))
+	for k, v := range q {
+		if len(v) == 1 {
+			params[k] = v[0]
+		} else {
+			params[k] = v
+		}
+	}
+	return params
+}
+
+// auditSubject finds the account, record or blob that an admin call acts
+// on. Calls on many accounts, like getAccountInfos, have no single subject.
+func auditSubject(params map[string]any) string {
+	if subject, ok := params["subject"].(map[string]any); ok {
+		// a record's strong ref or a repo or blob ref
+		if uri, ok := subject["uri"].(string); ok {
+			return uri
+		}
+		if did, ok := subject["did"].(string); ok {
+			return did
+		}
+	}
+	for _, key := range []string{"uri", "did", "account", "recipientDid", "forAccount"} {
+		if s, ok := params[key].(string); ok && len(s) > 0 {
+			return s
+		}
+	}
+	return ""
+}
+
+// redactParams replaces the values of anything that looks like a secret.
+func redactParams(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for k, val := range v {
+			if isSecretParam(k) {
+				res[k] = redacted
+			} else {
+				res[k] = redactParams(val)
+			}
+		}
+		return res
+	case []any:
+		res := make([]any, len(v))
+		for i, val := range v {
+			res[i] = redactParams(val)
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+func isSecretParam(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"password", "token", "secret", "jwt"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type adminAuditLog struct {
+	Cursor  string            `json:"cursor,omitempty"`
+	Entries []adminAuditEntry `json:"entries"`
+}
+
+type adminAuditEntry struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor"`
+	Method    string          `json:"method"`
+	Subject   string          `json:"subject,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Status    int             `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	CreatedAt string          `json:"createdAt"`
+}
+
+// QueryAdminAuditLog lists admin audit log entries newest first. Entries can
+// be filtered by actor, method, subject and a "since" datetime.
+func (pds *PDS) QueryAdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := accountstore.AdminActionFilter{
+		Actor:   q.Get("actor"),
+		Method:  q.Get("method"),
+		Subject: q.Get("subject"),
+	}
+	if since := q.Get("since"); len(since) > 0 {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			xrpc.WriteError(pds.logger, w, xrpc.NewInvalidRequest("Invalid since datetime").Wrap(err), xrpc.InvalidRequest)
+			return
+		}
+		filter.Since = t
+	}
+	limit := 50
+	if l := q.Get("limit"); len(l) > 0 {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > 100 {
+			xrpc.WriteError(pds.logger, w, xrpc.NewInvalidRequest("limit must be between 1 and 100"), xrpc.InvalidRequest)
+			return
+		}
+		limit = n
+	}
+	actions, cursor, err := pds.Accounts.ListAdminActions(r.Context(), filter, limit, q.Get("cursor"))
+	if err != nil {
+		xrpc.WriteError(pds.logger, w, err, xrpc.InternalServerError)
+		return
+	}
+	res := adminAuditLog{Cursor: cursor, Entries: make([]adminAuditEntry, len(actions))}
+	for i, a := range actions {
+		res.Entries[i] = adminAuditEntry{
+			ID:        a.ID,
+			Actor:     a.Actor,
+			Method:    a.Method,
+			Subject:   a.Subject,
+			Status:    a.Status,
+			Error:     a.Error,
+			CreatedAt: a.CreatedAt.UTC().Format(time.RFC3339),
+		}
+		if len(a.Params) > 0 {
+			res.Entries[i].Params = json.RawMessage(a.Params)
+		}
+	}
+	writeJSON(w, http.StatusOK, &res)
+}
+
+// RunAdminAuditPurger deletes admin audit log entries older than the
+// configured retention every interval until ctx is cancelled. It returns
+// right away when entries are kept forever.
+func (pds *PDS) RunAdminAuditPurger(ctx context.Context, interval time.Duration) {
+	if pds.cfg.AdminAuditRetentionDays <= 0 {
+		return
+	}
+	retention := time.Duration(pds.cfg.AdminAuditRetentionDays) * 24 * time.Hour
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := pds.Accounts.PurgeAdminActions(ctx, time.Now().Add(-retention))
+		if err != nil {
+			pds.logger.Error("failed to purge admin audit log", "error", err)
+		} else if n > 0 {
+			pds.logger.Info("purged admin audit log", "entries", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package pds
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"github.com/harrybrwn/at/internal/accountstore"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+func TestAuditAdminAction(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	pds := testPDS(t, localhost)
+	opts := auth.Opts{Logger: pds.logger, AdminPassword: "hunter2"}
+	var body string
+	h := auth.AdminOnly(&opts)(pds.auditAdminAction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		is.NoErr(err)
+		body = string(b)
+		if strings.Contains(body, "bad") {
+			xrpc.WriteError(pds.logger, w, xrpc.NewInvalidRequest("bad request"), xrpc.InvalidRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})))
+	do := func(method, target, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if strings.Contains(target, "getAccountInfos") {
+			req.RemoteAddr = "198.51.100.7:4321"
+		}
+		req.SetBasicAuth("admin", "hunter2")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	reqBody := `{"did":"` + did + `","password":"new password"}`
+	is.Equal(do(http.MethodPost, "/xrpc/com.atproto.admin.updateAccountPassword", reqBody), http.StatusOK)
+	is.Equal(body, reqBody) // handler still gets the whole body
+	is.Equal(do(http.MethodPost, "/xrpc/com.atproto.admin.updateSubjectStatus",
+		`{"subject":{"$type":"com.atproto.repo.strongRef","uri":"at://`+did+`/app.bsky.feed.post/1","cid":"x"},"takedown":{"applied":true,"ref":"bad"}}`),
+		http.StatusBadRequest)
+	is.Equal(do(http.MethodGet, "/xrpc/com.atproto.admin.getAccountInfos?dids=a&dids=b", ""), http.StatusOK)
+
+	actions, _, err := pds.Accounts.ListAdminActions(ctx, accountstore.AdminActionFilter{}, 10, "")
+	is.NoErr(err)
+	is.Equal(len(actions), 3)
+
+	is.Equal(actions[2].Actor, "admin@192.0.2.1") // httptest's remote address
+	is.Equal(actions[2].Method, "com.atproto.admin.updateAccountPassword")
+	is.Equal(actions[2].Subject, did)
+	is.Equal(actions[2].Status, http.StatusOK)
+	var params map[string]any
+	is.NoErr(json.Unmarshal([]byte(actions[2].Params), &params))
+	is.Equal(params["password"], redacted)
+	is.Equal(params["did"], did)
+
+	is.Equal(actions[1].Subject, "at://"+did+"/app.bsky.feed.post/1")
+	is.Equal(actions[1].Status, http.StatusBadRequest)
+	is.Equal(actions[1].Error, "InvalidRequest: bad request")
+
+	is.Equal(actions[0].Actor, "admin@198.51.100.7")
+	is.Equal(actions[0].Subject, "")
+	is.Equal(actions[0].Params, `{"dids":["a","b"]}`)
+
+	// unauthorized calls never reach the audit log
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.admin.getAccountInfo?did="+did, nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	actions, _, err = pds.Accounts.ListAdminActions(ctx, accountstore.AdminActionFilter{}, 10, "")
+	is.NoErr(err)
+	is.Equal(len(actions), 3)
+
+	// service token callers are named by their did
+	req = httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.admin.updateAccountHandle", strings.NewReader(`{"did":"`+did+`"}`))
+	req = req.WithContext(auth.StashUser(ctx, &xrpc.Auth{DID: "did:web:entryway.test"}))
+	pds.auditAdminAction(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+	actions, _, err = pds.Accounts.ListAdminActions(ctx, accountstore.AdminActionFilter{Actor: "did:web:entryway.test"}, 10, "")
+	is.NoErr(err)
+	is.Equal(len(actions), 1)
+	is.Equal(actions[0].Subject, did)
+}
+
+func TestQueryAdminAuditLog(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	pds := testPDS(t, localhost)
+	for _, method := range []string{"com.atproto.admin.getAccountInfo", "com.atproto.admin.sendEmail", "com.atproto.admin.getAccountInfo"} {
+		is.NoErr(pds.Accounts.RecordAdminAction(ctx, &accountstore.AdminAction{
+			Actor:  "admin",
+			Method: method,
+			Params: `{"did":"did:plc:ewvi7nxzyoun6zhxrhs64oiz"}`,
+			Status: http.StatusOK,
+		}))
+	}
+	query := func(q string) (int, adminAuditLog) {
+		rec := httptest.NewRecorder()
+		pds.QueryAdminAuditLog(rec, httptest.NewRequest(http.MethodGet, "/xrpc/"+QueryAdminAuditLogNSID+"?"+q, nil))
+		var res adminAuditLog
+		_ = json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+	status, res := query("method=com.atproto.admin.getAccountInfo&limit=1")
+	is.Equal(status, http.StatusOK)
+	is.Equal(len(res.Entries), 1)
+	is.Equal(res.Entries[0].ID, int64(3))
+	is.Equal(string(res.Entries[0].Params), `{"did":"did:plc:ewvi7nxzyoun6zhxrhs64oiz"}`)
+	status, res = query("method=com.atproto.admin.getAccountInfo&limit=1&cursor=" + res.Cursor)
+	is.Equal(status, http.StatusOK)
+	is.Equal(len(res.Entries), 1)
+	is.Equal(res.Entries[0].ID, int64(1))
+
+	status, _ = query("limit=1000")
+	is.Equal(status, http.StatusBadRequest)
+	status, _ = query("since=yesterday")
+	is.Equal(status, http.StatusBadRequest)
+}
@@ -2,8 +2,20 @@ package pds
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
 
 	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/account"
+	"github.com/harrybrwn/at/internal/accountstore"
+	"github.com/harrybrwn/at/internal/actorstore"
+	"github.com/harrybrwn/at/internal/cid"
 	"github.com/harrybrwn/at/xrpc"
 )
 
@@ -14,77 +26,513 @@ type AtprotoAdmin interface {
 	atproto.AdminEnableAccountInvites
 	atproto.AdminGetAccountInfo
 	atproto.AdminGetAccountInfos
+	atproto.AdminGetInviteCodes
 	atproto.AdminGetSubjectStatus
 	atproto.AdminSearchAccounts
+	atproto.AdminSendEmail
 	atproto.AdminUpdateAccountEmail
 	atproto.AdminUpdateAccountHandle
 	atproto.AdminUpdateAccountPassword
-	atproto.AdminUpdateSubjectStatus
 }
 
 var _ AtprotoAdmin = (*PDS)(nil)
 
 func (pds *PDS) DeleteAccount(ctx context.Context, req *atproto.AdminDeleteAccountRequest) (any, error) {
-	err := pds.ActorStore.Destroy(req.DID)
-	if err != nil {
+	if err := pds.purgeAccount(ctx, req.DID); err != nil {
 		return nil, err
 	}
-	err = pds.Accounts.DeleteAccount(ctx, req.DID.String())
-	if err != nil {
-		return nil, err
-	}
-	// TODO sequencers
-	return nil, xrpc.ErrNotImplemented
+	return nil, nil
 }
 
+// DisableAccountInvites stops an account from giving out invites.
 func (pds *PDS) DisableAccountInvites(ctx context.Context, req *atproto.AdminDisableAccountInvitesRequest) (any, error) {
-	return nil, xrpc.ErrNotImplemented
+	if err := pds.Accounts.SetAccountInvitesDisabled(ctx, req.Account.String(), true); err != nil {
+		return nil, err
+	}
+	return nil, nil
 }
 
+// EnableAccountInvites lets an account give out invites again.
 func (pds *PDS) EnableAccountInvites(ctx context.Context, req *atproto.AdminEnableAccountInvitesRequest) (any, error) {
-	return nil, xrpc.ErrNotImplemented
+	if err := pds.Accounts.SetAccountInvitesDisabled(ctx, req.Account.String(), false); err != nil {
+		return nil, err
+	}
+	return nil, nil
 }
 
+// DisableInviteCodes disables invite codes by code or by the account they
+// were made for.
 func (pds *PDS) DisableInviteCodes(ctx context.Context, req *atproto.AdminDisableInviteCodesRequest) (any, error) {
-	return nil, xrpc.ErrNotImplemented
+	if err := pds.Accounts.DisableInviteCodes(ctx, req.Codes, req.Accounts); err != nil {
+		return nil, err
+	}
+	return nil, nil
 }
 
 func (pds *PDS) GetAccountInfo(ctx context.Context, req *atproto.AdminGetAccountInfoParams) (*atproto.AdminGetAccountInfoResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+	views, err := pds.accountViews(ctx, []string{req.DID.String()})
+	if err != nil {
+		return nil, err
+	}
+	if len(views) == 0 {
+		return nil, xrpc.NewInvalidRequest("Account not found")
+	}
+	res := atproto.AdminGetAccountInfoResponse(views[0])
+	return &res, nil
 }
 
 func (pds *PDS) GetAccountInfos(ctx context.Context, req *atproto.AdminGetAccountInfosParams) (*atproto.AdminGetAccountInfosResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+	dids := make([]string, len(req.DIDs))
+	for i, did := range req.DIDs {
+		dids[i] = did.String()
+	}
+	views, err := pds.accountViews(ctx, dids)
+	if err != nil {
+		return nil, err
+	}
+	return &atproto.AdminGetAccountInfosResponse{Infos: views}, nil
 }
 
 func (pds *PDS) GetInviteCodes(ctx context.Context, req *atproto.AdminGetInviteCodesParams) (*atproto.AdminGetInviteCodesResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+	var (
+		sort   = accountstore.InviteSortRecent
+		limit  = 100
+		cursor string
+	)
+	if req != nil {
+		if req.Sort != nil && len(*req.Sort) > 0 {
+			sort = *req.Sort
+		}
+		if req.Limit != nil {
+			limit = int(*req.Limit)
+		}
+		if req.Cursor != nil {
+			cursor = *req.Cursor
+		}
+	}
+	if limit < 1 || limit > 500 {
+		return nil, xrpc.NewInvalidRequest("limit must be between 1 and 500")
+	}
+	codes, next, err := pds.Accounts.ListInviteCodes(ctx, sort, limit, cursor)
+	if err != nil {
+		return nil, err
+	}
+	res := atproto.AdminGetInviteCodesResponse{
+		Cursor: next,
+		Codes:  make([]atproto.ServerInviteCode, len(codes)),
+	}
+	for i := range codes {
+		res.Codes[i] = inviteCodeView(&codes[i])
+	}
+	return &res, nil
 }
 
+// GetSubjectStatus returns the takedown status of a blob, record or repo. A
+// repo's deactivation is returned as well.
 func (pds *PDS) GetSubjectStatus(ctx context.Context, req *atproto.AdminGetSubjectStatusParams) (*atproto.AdminGetSubjectStatusResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+	switch {
+	case req.Blob != nil:
+		if req.DID == nil {
+			return nil, xrpc.NewInvalidRequest("Must provide a did to request blob state")
+		}
+		if err := pds.assertSubjectRepo(ctx, *req.DID); err != nil {
+			return nil, err
+		}
+		blobs, err := pds.ActorStore.Blob(*req.DID, pds.newBlobstore(*req.DID))
+		if err != nil {
+			return nil, err
+		}
+		defer blobs.Close()
+		status, err := blobs.GetBlobTakedownStatus(ctx, gocid.Cid(*req.Blob).String())
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, xrpc.NewInvalidRequest("Subject not found")
+		} else if err != nil {
+			return nil, err
+		}
+		return &atproto.AdminGetSubjectStatusResponse{
+			Subject: &atproto.AdminGetSubjectStatusSubjectUnion{
+				AdminRepoBlobRef: &atproto.AdminRepoBlobRef{DID: *req.DID, CID: *req.Blob},
+			},
+			Takedown: atproto.AdminStatusAttr{Applied: status.Applied, Ref: status.Ref},
+		}, nil
+	case req.URI != nil:
+		did, err := req.URI.Authority().AsDID()
+		if err != nil {
+			return nil, xrpc.NewInvalidRequest("Record uri must contain a did")
+		}
+		if err = pds.assertSubjectRepo(ctx, did); err != nil {
+			return nil, err
+		}
+		rr, err := pds.ActorStore.Record(did)
+		if err != nil {
+			return nil, err
+		}
+		defer rr.Close()
+		status, c, err := rr.GetRecordTakedownStatus(ctx, *req.URI)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, xrpc.NewInvalidRequest("Subject not found")
+		} else if err != nil {
+			return nil, err
+		}
+		return &atproto.AdminGetSubjectStatusResponse{
+			Subject: &atproto.AdminGetSubjectStatusSubjectUnion{
+				RepoStrongRef: &atproto.RepoStrongRef{URI: *req.URI, CID: cid.Cid(c)},
+			},
+			Takedown: atproto.AdminStatusAttr{Applied: status.Applied, Ref: status.Ref},
+		}, nil
+	case req.DID != nil:
+		status, err := pds.Accounts.GetAccountAdminStatus(ctx, req.DID.String())
+		if err != nil {
+			return nil, err
+		}
+		if status == nil {
+			return nil, xrpc.NewInvalidRequest("Subject not found")
+		}
+		return &atproto.AdminGetSubjectStatusResponse{
+			Subject: &atproto.AdminGetSubjectStatusSubjectUnion{
+				AdminRepoRef: &atproto.AdminRepoRef{DID: *req.DID},
+			},
+			Takedown:    accountStatusAttr(status.Takedown),
+			Deactivated: accountStatusAttr(status.Deactivated),
+		}, nil
+	default:
+		return nil, xrpc.NewInvalidRequest("No provided subject")
+	}
 }
 
+// SearchAccounts finds accounts by a part of their email or handle.
 func (pds *PDS) SearchAccounts(ctx context.Context, req *atproto.AdminSearchAccountsParams) (*atproto.AdminSearchAccountsResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+	var (
+		query  string
+		limit  = 50
+		cursor string
+	)
+	if req != nil {
+		if req.Email != nil {
+			query = *req.Email
+		}
+		if req.Limit != nil {
+			limit = int(*req.Limit)
+		}
+		if req.Cursor != nil {
+			cursor = *req.Cursor
+		}
+	}
+	if limit < 1 || limit > 100 {
+		return nil, xrpc.NewInvalidRequest("limit must be between 1 and 100")
+	}
+	accounts, next, err := pds.Accounts.SearchAccounts(ctx, query, limit, cursor)
+	if err != nil {
+		return nil, err
+	}
+	dids := make([]string, len(accounts))
+	for i, a := range accounts {
+		dids[i] = a.DID
+	}
+	views, err := pds.accountViews(ctx, dids)
+	if err != nil {
+		return nil, err
+	}
+	return &atproto.AdminSearchAccountsResponse{Cursor: next, Accounts: views}, nil
 }
 
+// SendEmail sends a message from a moderator to an account's email address.
 func (pds *PDS) SendEmail(ctx context.Context, req *atproto.AdminSendEmailRequest) (*atproto.AdminSendEmailResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+	acct, err := pds.Accounts.GetAccount(ctx, req.RecipientDid.String(), new(accountstore.GetAccountOpts).
+		WithTakenDown().
+		WithDeactivated())
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("Recipient not found").Wrap(err)
+	}
+	if len(acct.Email) == 0 {
+		return nil, xrpc.NewInvalidRequest("Account does not have an email address")
+	}
+	if err = pds.ModMailer.Send(ctx, acct.Email, req.Subject, req.Content); err != nil {
+		return nil, xrpc.NewInternalError("Failed to send email").Wrap(err)
+	}
+	return &atproto.AdminSendEmailResponse{Sent: true}, nil
 }
 
+// UpdateAccountEmail changes an account's email address without a
+// confirmation token. The new address is not confirmed.
 func (pds *PDS) UpdateAccountEmail(ctx context.Context, req *atproto.AdminUpdateAccountEmailRequest) (any, error) {
-	return nil, xrpc.ErrNotImplemented
+	acct, err := pds.Accounts.GetAccount(ctx, req.Account.String(), new(accountstore.GetAccountOpts).
+		WithTakenDown().
+		WithDeactivated())
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("Account not found: %s", req.Account.String()).Wrap(err)
+	}
+	if !isValidEmail(req.Email) {
+		return nil, xrpc.NewInvalidRequest("This email address is not supported, please use a different email.")
+	}
+	other, err := pds.Accounts.GetAccountByEmail(ctx, req.Email, new(accountstore.GetAccountOpts).WithDeactivated().WithTakenDown())
+	if err == nil && other.DID != acct.DID {
+		return nil, xrpc.NewInvalidRequest("This email address is already in use, please use a different email.")
+	}
+	if err = pds.Accounts.UpdateEmail(ctx, acct.DID, req.Email); err != nil {
+		return nil, err
+	}
+	return nil, nil
 }
 
 func (pds *PDS) UpdateAccountHandle(ctx context.Context, req *atproto.AdminUpdateAccountHandleRequest) (any, error) {
-	return nil, xrpc.ErrNotImplemented
+	acct, err := pds.Accounts.GetAccount(ctx, req.DID.String(), &accountstore.GetAccountOpts{
+		IncludeTakenDown:   true,
+		IncludeDeactivated: true,
+	})
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("Account not found: %s", req.DID).Wrap(err)
+	}
+	if err = pds.updateHandle(ctx, acct, req.Handle, true); err != nil {
+		return nil, err
+	}
+	return nil, nil
 }
 
+// UpdateAccountPassword sets an account's password and signs it out
+// everywhere.
 func (pds *PDS) UpdateAccountPassword(ctx context.Context, req *atproto.AdminUpdateAccountPasswordRequest) (any, error) {
-	return nil, xrpc.ErrNotImplemented
+	if len(req.Password) == 0 {
+		return nil, xrpc.NewInvalidRequest("Password is required")
+	}
+	if err := pds.Accounts.UpdateAccountPassword(ctx, req.DID.String(), req.Password); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// UpdateSubjectStatusRequest is the input of
+// com.atproto.admin.updateSubjectStatus. Unlike the generated request, a
+// status that is left out is nil so it can be told apart from one that is
+// not applied.
+type UpdateSubjectStatusRequest struct {
+	Subject     *atproto.AdminUpdateSubjectStatusSubjectUnion `json:"subject"`
+	Takedown    *atproto.AdminStatusAttr                      `json:"takedown,omitempty"`
+	Deactivated *atproto.AdminStatusAttr                      `json:"deactivated,omitempty"`
+}
+
+// maxSubjectStatusBody is far larger than any updateSubjectStatus request.
+const maxSubjectStatusBody = 64 * 1024
+
+// handleUpdateSubjectStatus serves com.atproto.admin.updateSubjectStatus.
+func (pds *PDS) handleUpdateSubjectStatus(w http.ResponseWriter, r *http.Request) {
+	var req UpdateSubjectStatusRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxSubjectStatusBody)).Decode(&req)
+	if err != nil {
+		xrpc.WriteError(pds.logger, w, xrpc.NewInvalidRequest("Invalid request body").Wrap(err), xrpc.InvalidRequest)
+		return
+	}
+	res, err := pds.UpdateSubjectStatus(r.Context(), &req)
+	if err != nil {
+		xrpc.WriteError(pds.logger, w, err, xrpc.InternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// UpdateSubjectStatus applies or reverses the takedown of a repo, record or
+// blob. Repos can also be deactivated and reactivated. Only the statuses set
+// in req are changed.
+func (pds *PDS) UpdateSubjectStatus(ctx context.Context, req *UpdateSubjectStatusRequest) (*atproto.AdminUpdateSubjectStatusResponse, error) {
+	if req.Subject == nil {
+		return nil, xrpc.NewInvalidRequest("No provided subject")
+	}
+	switch {
+	case req.Subject.AdminRepoRef != nil:
+		if err := pds.updateRepoStatus(ctx, req.Subject.AdminRepoRef.DID, req.Takedown, req.Deactivated); err != nil {
+			return nil, err
+		}
+	case req.Subject.RepoStrongRef != nil:
+		if req.Takedown == nil {
+			break
+		}
+		uri := req.Subject.RepoStrongRef.URI
+		did, err := uri.Authority().AsDID()
+		if err != nil {
+			return nil, xrpc.NewInvalidRequest("Record uri must contain a did")
+		}
+		if err = pds.assertSubjectRepo(ctx, did); err != nil {
+			return nil, err
+		}
+		rr, err := pds.ActorStore.Record(did)
+		if err != nil {
+			return nil, err
+		}
+		defer rr.Close()
+		err = rr.Tx(ctx, func(ctx context.Context, tx *actorstore.RecordTransactor) error {
+			return tx.UpdateRecordTakedownStatus(ctx, uri, actorstore.StatusAttr{
+				Applied: req.Takedown.Applied,
+				Ref:     req.Takedown.Ref,
+			})
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, xrpc.NewInvalidRequest("Subject not found")
+		} else if err != nil {
+			return nil, err
+		}
+	case req.Subject.AdminRepoBlobRef != nil:
+		if req.Takedown == nil {
+			break
+		}
+		ref := req.Subject.AdminRepoBlobRef
+		blobstore := pds.newBlobstore(ref.DID)
+		if blobstore == nil {
+			return nil, xrpc.NewInternalError("No blobstore configured")
+		}
+		if err := pds.assertSubjectRepo(ctx, ref.DID); err != nil {
+			return nil, err
+		}
+		blobs, err := pds.ActorStore.Blob(ref.DID, blobstore)
+		if err != nil {
+			return nil, err
+		}
+		defer blobs.Close()
+		err = blobs.UpdateBlobTakedownStatus(ctx, gocid.Cid(ref.CID), actorstore.StatusAttr{
+			Applied: req.Takedown.Applied,
+			Ref:     req.Takedown.Ref,
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, xrpc.NewInvalidRequest("Subject not found")
+		} else if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, xrpc.NewInvalidRequest("Invalid subject")
+	}
+	res := atproto.AdminUpdateSubjectStatusResponse{Subject: req.Subject}
+	if req.Takedown != nil {
+		res.Takedown = *req.Takedown
+	}
+	return &res, nil
+}
+
+// updateRepoStatus updates the takedown and deactivation of an account and
+// tells subscribers about its new status.
+func (pds *PDS) updateRepoStatus(ctx context.Context, did syntax.DID, takedown, deactivated *atproto.AdminStatusAttr) error {
+	status, err := pds.Accounts.GetAccountAdminStatus(ctx, did.String())
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return xrpc.NewInvalidRequest("Subject not found")
+	}
+	if takedown != nil {
+		attr := accountstore.StatusAttr{Applied: takedown.Applied}
+		if len(takedown.Ref) > 0 {
+			attr.Ref = &takedown.Ref
+		}
+		if err = pds.Accounts.TakedownAccount(ctx, did.String(), &attr); err != nil {
+			return err
+		}
+		status.Takedown = attr
+	}
+	if deactivated != nil {
+		if deactivated.Applied {
+			err = pds.Accounts.DeactivateAccount(ctx, did.String(), sql.NullString{})
+		} else {
+			err = pds.Accounts.ActivateAccount(ctx, did.String())
+		}
+		if err != nil {
+			return err
+		}
+		status.Deactivated.Applied = deactivated.Applied
+	}
+	event := atproto.SyncSubscribeReposAccount{DID: did, Active: true}
+	switch {
+	case status.Takedown.Applied:
+		event.Active = false
+		event.Status = account.StatusTakendown.String()
+	case status.Deactivated.Applied:
+		event.Active = false
+		event.Status = account.StatusDeactivated.String()
+	}
+	return pds.sequence(ctx, &Event{SyncSubscribeReposAccount: &event})
 }
 
-func (pds *PDS) UpdateSubjectStatus(ctx context.Context, req *atproto.AdminUpdateSubjectStatusRequest) (*atproto.AdminUpdateSubjectStatusResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+// accountViews builds the admin view of each account in the order of dids.
+// Accounts that do not exist are left out.
+func (pds *PDS) accountViews(ctx context.Context, dids []string) ([]atproto.AdminAccountView, error) {
+	accounts, err := pds.Accounts.GetAccountsByDIDs(ctx, dids)
+	if err != nil {
+		return nil, err
+	}
+	invites, err := pds.Accounts.GetInviteCodesForAccounts(ctx, dids)
+	if err != nil {
+		return nil, err
+	}
+	invitedBy, err := pds.Accounts.GetInvitedBy(ctx, dids)
+	if err != nil {
+		return nil, err
+	}
+	byDID := make(map[string]*account.ActorAccount, len(accounts))
+	for _, a := range accounts {
+		byDID[a.DID] = a
+	}
+	views := make([]atproto.AdminAccountView, 0, len(accounts))
+	for _, did := range dids {
+		acct, ok := byDID[did]
+		if !ok {
+			continue
+		}
+		view := atproto.AdminAccountView{
+			DID:              syntax.DID(acct.DID),
+			Handle:           syntax.Handle(acct.Handle.String),
+			Email:            acct.Email,
+			IndexedAt:        acct.CreatedAt,
+			InvitesDisabled:  acct.InvitesDisabled,
+			EmailConfirmedAt: acct.EmailConfirmedAt.String,
+			DeactivatedAt:    acct.DeactivatedAt.String,
+			Invites:          make([]atproto.ServerInviteCode, len(invites[did])),
+			RelatedRecords:   pds.relatedRecords(ctx, acct.DID),
+		}
+		if !acct.Handle.Valid {
+			view.Handle = syntax.Handle("handle.invalid")
+		}
+		for i := range invites[did] {
+			view.Invites[i] = inviteCodeView(&invites[did][i])
+		}
+		if code, ok := invitedBy[did]; ok {
+			view.InvitedBy = inviteCodeView(code)
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// relatedRecords are the records shown with an account to admins, which is
+// just the profile. Accounts with a repo on another server have none.
+func (pds *PDS) relatedRecords(ctx context.Context, did string) []any {
+	records := make([]any, 0, 1)
+	rr, err := pds.ActorStore.Record(syntax.DID(did))
+	if err != nil {
+		return records
+	}
+	defer rr.Close()
+	uri := syntax.ATURI("at://" + did + "/app.bsky.actor.profile/self")
+	rec, err := rr.GetRecord(ctx, uri, nil, true)
+	if err != nil {
+		return records
+	}
+	return append(records, rec.Value)
+}
+
+// assertSubjectRepo makes sure that a record or blob subject belongs to an
+// account on this server before its actor store is opened.
+func (pds *PDS) assertSubjectRepo(ctx context.Context, did syntax.DID) error {
+	status, err := pds.Accounts.GetAccountAdminStatus(ctx, did.String())
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return xrpc.NewInvalidRequest("Subject not found")
+	}
+	return nil
+}
+
+func accountStatusAttr(attr accountstore.StatusAttr) atproto.AdminStatusAttr {
+	res := atproto.AdminStatusAttr{Applied: attr.Applied}
+	if attr.Ref != nil {
+		res.Ref = *attr.Ref
+	}
+	return res
 }
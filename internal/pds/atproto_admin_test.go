@@ -1 +1,299 @@
 package pds
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/internal/cid"
+	"github.com/harrybrwn/at/internal/mailer"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+func TestAdminAccountInfo(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	pds := testPDS(t, localhost)
+	dids := make([]syntax.DID, 0)
+	for _, handle := range []string{"alice.test", "bob.test", "malice.test"} {
+		acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+			Email:    handle + "@example.com",
+			Handle:   syntax.Handle(handle),
+			Password: "testlab01",
+		})
+		is.NoErr(err)
+		dids = append(dids, acct.DID)
+	}
+	codes, err := pds.CreateInviteCodes(ctx, &atproto.ServerCreateInviteCodesRequest{
+		UseCount:    1,
+		ForAccounts: []syntax.DID{dids[0]},
+	})
+	is.NoErr(err)
+
+	info, err := pds.GetAccountInfo(ctx, &atproto.AdminGetAccountInfoParams{DID: dids[0]})
+	is.NoErr(err)
+	is.Equal(info.Handle, syntax.Handle("alice.test"))
+	is.Equal(info.Email, "alice.test@example.com")
+	is.Equal(len(info.Invites), len(codes.Codes[0].Codes))
+	is.Equal(info.InvitedBy.Code, "")
+	_, err = pds.GetAccountInfo(ctx, &atproto.AdminGetAccountInfoParams{DID: "did:plc:missing"})
+	is.True(err != nil)
+
+	infos, err := pds.GetAccountInfos(ctx, &atproto.AdminGetAccountInfosParams{
+		DIDs: []syntax.DID{dids[2], "did:plc:missing", dids[1]},
+	})
+	is.NoErr(err)
+	is.Equal(len(infos.Infos), 2)
+	is.Equal(infos.Infos[0].DID, dids[2])
+	is.Equal(infos.Infos[1].DID, dids[1])
+
+	email := "alic"
+	limit := int64(1)
+	res, err := pds.SearchAccounts(ctx, &atproto.AdminSearchAccountsParams{Email: &email, Limit: &limit})
+	is.NoErr(err)
+	is.Equal(len(res.Accounts), 1)
+	is.Equal(res.Accounts[0].DID, dids[0])
+	res, err = pds.SearchAccounts(ctx, &atproto.AdminSearchAccountsParams{Email: &email, Cursor: &res.Cursor})
+	is.NoErr(err)
+	is.Equal(len(res.Accounts), 1)
+	is.Equal(res.Accounts[0].DID, dids[2])
+}
+
+func TestAdminSubjectStatus(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	pds := testPDS(t, localhost)
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "alice.test@example.com",
+		Handle:   "alice.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	repo := &atproto.AdminUpdateSubjectStatusSubjectUnion{
+		AdminRepoRef: &atproto.AdminRepoRef{DID: acct.DID},
+	}
+
+	res, err := pds.UpdateSubjectStatus(ctx, &UpdateSubjectStatusRequest{
+		Subject:  repo,
+		Takedown: &atproto.AdminStatusAttr{Applied: true, Ref: "mod-1"},
+	})
+	is.NoErr(err)
+	is.Equal(res.Takedown.Ref, "mod-1")
+	status, err := pds.GetSubjectStatus(ctx, &atproto.AdminGetSubjectStatusParams{DID: &acct.DID})
+	is.NoErr(err)
+	is.True(status.Takedown.Applied)
+	is.Equal(status.Takedown.Ref, "mod-1")
+	is.True(!status.Deactivated.Applied)
+	_, err = pds.GetRepo(ctx, &atproto.SyncGetRepoParams{DID: acct.DID})
+	is.True(err != nil) // taken down repos are not served
+
+	_, err = pds.UpdateSubjectStatus(ctx, &UpdateSubjectStatusRequest{
+		Subject:  repo,
+		Takedown: &atproto.AdminStatusAttr{},
+	})
+	is.NoErr(err)
+	status, err = pds.GetSubjectStatus(ctx, &atproto.AdminGetSubjectStatusParams{DID: &acct.DID})
+	is.NoErr(err)
+	is.True(!status.Takedown.Applied)
+	_, err = pds.GetRepo(ctx, &atproto.SyncGetRepoParams{DID: acct.DID})
+	is.NoErr(err)
+
+	missing := syntax.DID("did:plc:missing")
+	_, err = pds.GetSubjectStatus(ctx, &atproto.AdminGetSubjectStatusParams{DID: &missing})
+	is.True(err != nil)
+	_, err = pds.GetSubjectStatus(ctx, &atproto.AdminGetSubjectStatusParams{})
+	is.True(err != nil)
+}
+
+func TestAdminBlobAndRecordTakedown(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	pds := testPDS(t, localhost)
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "alice.test@example.com",
+		Handle:   "alice.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	did := acct.DID
+	authed := auth.StashUser(ctx, &xrpc.Auth{DID: did.String(), Handle: acct.Handle.String()})
+	blob, err := pds.UploadBlob(authed, strings.NewReader("hello world"))
+	is.NoErr(err)
+	uri := createImagePost(t, pds, did, "3lbtyr7ezgb2a", blob)
+	blobCID := cid.Cid(blob.Blob.Ref)
+	listBlobs := func() []cid.Cid {
+		t.Helper()
+		res, err := pds.ListBlobs(ctx, &atproto.SyncListBlobsParams{DID: did})
+		is.NoErr(err)
+		return res.CIDs
+	}
+	is.Equal(listBlobs(), []cid.Cid{blobCID})
+
+	blobRef := &atproto.AdminUpdateSubjectStatusSubjectUnion{
+		AdminRepoBlobRef: &atproto.AdminRepoBlobRef{DID: did, CID: blobCID},
+	}
+	_, err = pds.UpdateSubjectStatus(ctx, &UpdateSubjectStatusRequest{
+		Subject:  blobRef,
+		Takedown: &atproto.AdminStatusAttr{Applied: true, Ref: "mod-1"},
+	})
+	is.NoErr(err)
+	_, err = pds.GetBlob(ctx, &atproto.SyncGetBlobParams{DID: did, CID: blobCID})
+	is.True(err != nil) // taken down blobs are not served
+	is.Equal(len(listBlobs()), 0)
+	status, err := pds.GetSubjectStatus(ctx, &atproto.AdminGetSubjectStatusParams{DID: &did, Blob: &blobCID})
+	is.NoErr(err)
+	is.True(status.Takedown.Applied)
+	is.Equal(status.Takedown.Ref, "mod-1")
+
+	_, err = pds.UpdateSubjectStatus(ctx, &UpdateSubjectStatusRequest{
+		Subject:  blobRef,
+		Takedown: &atproto.AdminStatusAttr{},
+	})
+	is.NoErr(err)
+	stream, err := pds.GetBlob(ctx, &atproto.SyncGetBlobParams{DID: did, CID: blobCID})
+	is.NoErr(err)
+	is.NoErr(stream.Close())
+	is.Equal(listBlobs(), []cid.Cid{blobCID})
+
+	getRecord := &atproto.RepoGetRecordParams{
+		Repo:       &syntax.AtIdentifier{Inner: did},
+		Collection: "app.bsky.feed.post",
+		RKey:       "3lbtyr7ezgb2a",
+	}
+	record, err := pds.GetRecord(ctx, getRecord)
+	is.NoErr(err)
+	syncParams := &atproto.SyncGetRecordParams{DID: did, Collection: "app.bsky.feed.post", RKey: "3lbtyr7ezgb2a"}
+	car, err := (&syncGetRecord{pds}).GetRecord(ctx, syncParams)
+	is.NoErr(err)
+	is.NoErr(car.Close())
+
+	_, err = pds.UpdateSubjectStatus(ctx, &UpdateSubjectStatusRequest{
+		Subject: &atproto.AdminUpdateSubjectStatusSubjectUnion{
+			RepoStrongRef: &atproto.RepoStrongRef{URI: uri, CID: record.CID},
+		},
+		Takedown: &atproto.AdminStatusAttr{Applied: true, Ref: "mod-2"},
+	})
+	is.NoErr(err)
+	// taken down records look the same as missing ones
+	_, err = pds.GetRecord(ctx, getRecord)
+	var e *xrpc.ErrorResponse
+	is.True(errors.As(err, &e))
+	is.Equal(e.Code, xrpc.RecordNotFound)
+	is.Equal(e.Message, "Could not locate record")
+	_, err = (&syncGetRecord{pds}).GetRecord(ctx, syncParams)
+	is.True(errors.As(err, &e))
+	is.Equal(e.Code, xrpc.RecordNotFound)
+}
+
+func TestHandleUpdateSubjectStatus(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	pds := testPDS(t, localhost)
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "alice.test@example.com",
+		Handle:   "alice.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	update := func(body string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/xrpc/com.atproto.admin.updateSubjectStatus",
+			strings.NewReader(body),
+		)
+		pds.handleUpdateSubjectStatus(rec, req)
+		return rec.Code
+	}
+	subject := `{"$type":"com.atproto.admin.defs#repoRef","did":"` + acct.DID.String() + `"}`
+
+	is.Equal(update(`{"subject":`+subject+`,"takedown":{"applied":true,"ref":"mod-1"}}`), http.StatusOK)
+	// deactivating leaves the takedown alone when it is not sent
+	is.Equal(update(`{"subject":`+subject+`,"deactivated":{"applied":true}}`), http.StatusOK)
+	status, err := pds.GetSubjectStatus(ctx, &atproto.AdminGetSubjectStatusParams{DID: &acct.DID})
+	is.NoErr(err)
+	is.True(status.Takedown.Applied)
+	is.Equal(status.Takedown.Ref, "mod-1")
+	is.True(status.Deactivated.Applied)
+
+	is.Equal(update(`{"subject":`+subject+`,"takedown":{"applied":false}}`), http.StatusOK)
+	status, err = pds.GetSubjectStatus(ctx, &atproto.AdminGetSubjectStatusParams{DID: &acct.DID})
+	is.NoErr(err)
+	is.True(!status.Takedown.Applied)
+	is.True(status.Deactivated.Applied)
+
+	is.Equal(update(`not json`), http.StatusBadRequest)
+	is.Equal(update(`{}`), http.StatusBadRequest)
+}
+
+func TestAdminAccountControls(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	pds := testPDS(t, localhost)
+	var dids []syntax.DID
+	for _, handle := range []string{"alice.test", "bob.test"} {
+		acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+			Email:    handle + "@example.com",
+			Handle:   syntax.Handle(handle),
+			Password: "testlab01",
+		})
+		is.NoErr(err)
+		dids = append(dids, acct.DID)
+	}
+	alice := dids[0]
+
+	_, err := pds.DisableAccountInvites(ctx, &atproto.AdminDisableAccountInvitesRequest{Account: alice})
+	is.NoErr(err)
+	info, err := pds.GetAccountInfo(ctx, &atproto.AdminGetAccountInfoParams{DID: alice})
+	is.NoErr(err)
+	is.True(info.InvitesDisabled)
+	_, err = pds.EnableAccountInvites(ctx, &atproto.AdminEnableAccountInvitesRequest{Account: alice})
+	is.NoErr(err)
+	info, err = pds.GetAccountInfo(ctx, &atproto.AdminGetAccountInfoParams{DID: alice})
+	is.NoErr(err)
+	is.True(!info.InvitesDisabled)
+	_, err = pds.DisableInviteCodes(ctx, &atproto.AdminDisableInviteCodesRequest{Accounts: []string{"admin"}})
+	is.True(err != nil)
+
+	// email changes are taken if the address is free
+	_, err = pds.UpdateAccountEmail(ctx, &atproto.AdminUpdateAccountEmailRequest{
+		Account: syntax.AtIdentifier{Inner: alice},
+		Email:   "bob.test@example.com",
+	})
+	is.True(err != nil)
+	_, err = pds.UpdateAccountEmail(ctx, &atproto.AdminUpdateAccountEmailRequest{
+		Account: syntax.AtIdentifier{Inner: syntax.Handle("alice.test")},
+		Email:   "alice@new.example.com",
+	})
+	is.NoErr(err)
+
+	_, err = pds.UpdateAccountPassword(ctx, &atproto.AdminUpdateAccountPasswordRequest{DID: alice, Password: "testlab02"})
+	is.NoErr(err)
+	_, err = pds.CreateSession(ctx, &atproto.ServerCreateSessionRequest{Identifier: "alice.test", Password: "testlab01"})
+	is.True(err != nil)
+	_, err = pds.CreateSession(ctx, &atproto.ServerCreateSessionRequest{Identifier: "alice.test", Password: "testlab02"})
+	is.NoErr(err)
+
+	res, err := pds.SendEmail(ctx, &atproto.AdminSendEmailRequest{
+		RecipientDid: alice,
+		SenderDid:    "did:plc:moderator",
+		Content:      "<p>Please read the rules</p>",
+	})
+	is.NoErr(err)
+	is.True(res.Sent)
+	msgs, err := pds.ModMailer.Mailer.(*mailer.Spool).Messages()
+	is.NoErr(err)
+	last := msgs[len(msgs)-1]
+	is.Equal(last.To, "alice@new.example.com")
+	is.Equal(last.Subject, mailer.DefaultModerationSubject)
+	_, err = pds.SendEmail(ctx, &atproto.AdminSendEmailRequest{RecipientDid: "did:plc:missing"})
+	is.True(err != nil)
+}
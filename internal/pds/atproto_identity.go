@@ -0,0 +1,334 @@
+package pds
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/pkg/errors"
+
+	atpapi "github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/atp"
+	"github.com/harrybrwn/at/internal/account"
+	"github.com/harrybrwn/at/internal/accountstore"
+	"github.com/harrybrwn/at/internal/mailer"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// GetRecommendedDidCredentials returns the did document fields an account
+// needs for this server to host it.
+func (pds *PDS) GetRecommendedDidCredentials(ctx context.Context) (*atpapi.IdentityGetRecommendedDidCredentialsResponse, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signingKey, err := pds.ActorStore.SigningKey(syntax.DID(acct.DID))
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to get signing key").Wrap(err)
+	}
+	op, err := pds.recommendedPlcOperation(syntax.Handle(acct.Handle.String), signingKey)
+	if err != nil {
+		return nil, err
+	}
+	if !acct.Handle.Valid {
+		op.AlsoKnownAs = []string{}
+	}
+	return &atpapi.IdentityGetRecommendedDidCredentialsResponse{
+		RotationKeys:        op.RotationKeys,
+		AlsoKnownAs:         op.AlsoKnownAs,
+		VerificationMethods: op.VerificationMethods,
+		Services:            op.Services,
+	}, nil
+}
+
+// RequestPlcOperationSignature emails a token that is needed to sign an
+// operation with [PDS.SignPlcOperation].
+func (pds *PDS) RequestPlcOperationSignature(ctx context.Context) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(acct.Email) == 0 {
+		return nil, xrpc.NewInvalidRequest("account does not have an email address")
+	}
+	token, err := pds.Accounts.CreateEmailToken(ctx, acct.DID, accountstore.PurposePlcOperation)
+	if err != nil {
+		return nil, err
+	}
+	err = pds.Mailer.SendPlcOperation(ctx, acct.Email, &mailer.TokenParams{
+		Handle: acct.Handle.String,
+		Token:  token,
+	})
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to send email").Wrap(err)
+	}
+	return nil, nil
+}
+
+// SignPlcOperation signs an update to the account's did:plc with this
+// server's rotation key. Fields missing from the request are copied from
+// the last operation in the did's audit log.
+func (pds *PDS) SignPlcOperation(ctx context.Context, req *atpapi.IdentitySignPlcOperationRequest) (*atpapi.IdentitySignPlcOperationResponse, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Token) == 0 {
+		return nil, xrpc.NewInvalidRequest("email confirmation token required to sign PLC operations")
+	}
+	err = pds.Accounts.AssertValidEmailToken(ctx, acct.DID, accountstore.PurposePlcOperation, req.Token)
+	if err != nil {
+		return nil, err
+	}
+	last, err := pds.PLC.LastOperation(ctx, acct.DID)
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("Could not find last operation for %s", acct.DID).Wrap(err)
+	}
+	prev, err := last.CID()
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to hash last operation").Wrap(err)
+	}
+	op := *last
+	op.Type = atp.PlcOperationType
+	op.Prev = new(string)
+	*op.Prev = prev.String()
+	op.Sig = ""
+	if req.RotationKeys != nil {
+		op.RotationKeys = req.RotationKeys
+	}
+	if req.AlsoKnownAs != nil {
+		op.AlsoKnownAs = req.AlsoKnownAs
+	}
+	if req.VerificationMethods != nil {
+		op.VerificationMethods = nil
+		if err = convertJSON(req.VerificationMethods, &op.VerificationMethods); err != nil {
+			return nil, xrpc.NewInvalidRequest("Invalid verificationMethods").Wrap(err)
+		}
+	}
+	if req.Services != nil {
+		op.Services = nil
+		if err = convertJSON(req.Services, &op.Services); err != nil {
+			return nil, xrpc.NewInvalidRequest("Invalid services").Wrap(err)
+		}
+	}
+	if err = op.Sign(pds.plcRotationKey); err != nil {
+		return nil, xrpc.NewInternalError("Failed to sign plc operation").Wrap(err)
+	}
+	if err = pds.Accounts.DeleteEmailToken(ctx, acct.DID, accountstore.PurposePlcOperation); err != nil {
+		return nil, err
+	}
+	return &atpapi.IdentitySignPlcOperationResponse{Operation: &op}, nil
+}
+
+// SubmitPlcOperation sends a signed operation to the plc directory after
+// checking that it keeps the account hosted on this server.
+func (pds *PDS) SubmitPlcOperation(ctx context.Context, req *atpapi.IdentitySubmitPlcOperationRequest) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var op atp.PlcOperation
+	if err = convertJSON(req.Operation, &op); err != nil {
+		return nil, xrpc.NewInvalidRequest("Invalid operation").Wrap(err)
+	}
+	did := syntax.DID(acct.DID)
+	signingKey, err := pds.ActorStore.SigningKey(did)
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to get signing key").Wrap(err)
+	}
+	handle := syntax.HandleInvalid
+	if acct.Handle.Valid {
+		handle = syntax.Handle(acct.Handle.String)
+	}
+	expected, err := pds.recommendedPlcOperation(handle, signingKey)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(op.RotationKeys, expected.RotationKeys[0]) {
+		return nil, xrpc.NewInvalidRequest("Rotation keys do not include server's rotation key")
+	}
+	if op.Services["atproto_pds"] != expected.Services["atproto_pds"] {
+		return nil, xrpc.NewInvalidRequest("Incorrect endpoint on atproto_pds service")
+	}
+	if op.VerificationMethods["atproto"] != expected.VerificationMethods["atproto"] {
+		return nil, xrpc.NewInvalidRequest("Incorrect signing key")
+	}
+	if acct.Handle.Valid && !slices.Contains(op.AlsoKnownAs, expected.AlsoKnownAs[0]) {
+		return nil, xrpc.NewInvalidRequest("Incorrect handle in alsoKnownAs")
+	}
+	if err = pds.PLC.SubmitOperation(ctx, did.String(), &op); err != nil {
+		return nil, xrpc.NewInvalidRequest("Failed to submit plc operation").Wrap(err)
+	}
+	err = pds.sequence(ctx, &Event{SyncSubscribeReposIdentity: &atpapi.SyncSubscribeReposIdentity{
+		DID:    did,
+		Handle: handle,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ResolveHandle resolves handles of accounts hosted here from the account
+// store and falls back to dns and /.well-known/atproto-did for everything
+// else.
+func (pds *PDS) ResolveHandle(ctx context.Context, params *atpapi.IdentityResolveHandleParams) (*atpapi.IdentityResolveHandleResponse, error) {
+	handle := params.Handle.Normalize()
+	acct, err := pds.Accounts.GetAccount(ctx, handle.String(), nil)
+	if err == nil {
+		return &atpapi.IdentityResolveHandleResponse{DID: syntax.DID(acct.DID)}, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if isServiceDomain(handle.String(), pds.cfg.ServiceHandleDomains) {
+		return nil, xrpc.NewInvalidRequest("Unable to resolve handle")
+	}
+	did, err := pds.Resolver.ResolveHandle(ctx, handle.String())
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("Unable to resolve handle").Wrap(err)
+	}
+	return &atpapi.IdentityResolveHandleResponse{DID: did}, nil
+}
+
+// UpdateHandle changes the requesting account's handle. Handles outside of
+// the service handle domains must already resolve to the account's did.
+func (pds *PDS) UpdateHandle(ctx context.Context, req *atpapi.IdentityUpdateHandleRequest) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = pds.updateHandle(ctx, acct, req.Handle, false); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// updateHandle validates a new handle for an account, updates the account's
+// did:plc and the account store and then tells the network about it. An
+// entryway also passes the handle on to the PDS holding the account's repo.
+func (pds *PDS) updateHandle(ctx context.Context, acct *account.ActorAccount, h syntax.Handle, allowReserved bool) error {
+	did := syntax.DID(acct.DID)
+	handle, err := normalizeAndValidateHandle(ctx, pds, h, did, allowReserved)
+	if err != nil {
+		return err
+	}
+	existing, err := pds.Accounts.GetAccount(ctx, handle.String(), &accountstore.GetAccountOpts{
+		IncludeDeactivated: true,
+		IncludeTakenDown:   true,
+	})
+	if err == nil && existing.DID != acct.DID {
+		return xrpc.NewInvalidRequest("Handle already taken: %s", handle)
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err = ensureDidWebHostFree(ctx, pds, handle, did); err != nil {
+		return err
+	}
+	// Behind an entryway the entryway owns handles and has already updated
+	// the did.
+	if did.Method() == "plc" && !pds.cfg.BehindEntryway() {
+		if err = pds.updatePlcHandle(ctx, did, handle); err != nil {
+			return err
+		}
+	}
+	if existing == nil {
+		if err = pds.Accounts.UpdateHandle(ctx, acct.DID, handle.String()); err != nil {
+			return err
+		}
+	}
+	if pds.cfg.IsEntryway() {
+		if err = pds.pushHandle(ctx, did, handle); err != nil {
+			return err
+		}
+	}
+	if err = pds.didCache.ClearEntry(ctx, acct.DID); err != nil {
+		pds.logger.Warn("failed to clear cached did document", "did", did, "error", err)
+	}
+	if err = pds.didCache.ClearHandle(ctx, handle.String()); err != nil {
+		pds.logger.Warn("failed to clear cached handle", "handle", handle, "error", err)
+	}
+	if acct.Handle.Valid {
+		if err = pds.didCache.ClearHandle(ctx, acct.Handle.String); err != nil {
+			pds.logger.Warn("failed to clear cached handle", "handle", acct.Handle.String, "error", err)
+		}
+	}
+	pds.Resolver.FlushCacheFor(acct.DID)
+	return pds.sequence(ctx, &Event{SyncSubscribeReposIdentity: &atpapi.SyncSubscribeReposIdentity{
+		DID:    did,
+		Handle: handle,
+	}})
+}
+
+// updatePlcHandle submits an operation that replaces the handle in a did's
+// alsoKnownAs.
+func (pds *PDS) updatePlcHandle(ctx context.Context, did syntax.DID, handle syntax.Handle) error {
+	last, err := pds.PLC.LastOperation(ctx, did.String())
+	if err != nil {
+		return xrpc.NewInternalError("Could not find last operation for %s", did).Wrap(err)
+	}
+	prev, err := last.CID()
+	if err != nil {
+		return xrpc.NewInternalError("Failed to hash last operation").Wrap(err)
+	}
+	op := *last
+	op.Type = atp.PlcOperationType
+	op.Prev = new(string)
+	*op.Prev = prev.String()
+	op.Sig = ""
+	op.AlsoKnownAs = []string{"at://" + handle.String()}
+	for _, aka := range last.AlsoKnownAs {
+		if !strings.HasPrefix(aka, "at://") {
+			op.AlsoKnownAs = append(op.AlsoKnownAs, aka)
+		}
+	}
+	if err = op.Sign(pds.plcRotationKey); err != nil {
+		return xrpc.NewInternalError("Failed to sign plc operation").Wrap(err)
+	}
+	if err = pds.PLC.SubmitOperation(ctx, did.String(), &op); err != nil {
+		return xrpc.NewInternalError("Failed to update did document").Wrap(err)
+	}
+	return nil
+}
+
+// recommendedPlcOperation builds an unsigned operation that points a did at
+// this server.
+func (pds *PDS) recommendedPlcOperation(handle syntax.Handle, signingKey crypto.PrivateKey) (*atp.PlcOperation, error) {
+	rotationKey, err := pds.plcRotationKey.PublicKey()
+	if err != nil {
+		return nil, xrpc.NewInternalError("Invalid rotation key").Wrap(err)
+	}
+	signingPub, err := signingKey.PublicKey()
+	if err != nil {
+		return nil, xrpc.NewInternalError("Invalid signing key").Wrap(err)
+	}
+	rotationKeys := []string{rotationKey.DIDKey()}
+	if pds.cfg.BehindEntryway() && len(pds.cfg.Entryway.PlcRotationKey) > 0 {
+		// the entryway owns handles so it needs to be able to update the did
+		rotationKeys = append(rotationKeys, pds.cfg.Entryway.PlcRotationKey)
+	}
+	return &atp.PlcOperation{
+		Type:                atp.PlcOperationType,
+		RotationKeys:        rotationKeys,
+		VerificationMethods: map[string]string{"atproto": signingPub.DIDKey()},
+		AlsoKnownAs:         []string{"at://" + handle.String()},
+		Services: map[string]atp.PlcService{
+			"atproto_pds": {
+				Type:     "AtprotoPersonalDataServer",
+				Endpoint: pds.cfg.PublicURL(),
+			},
+		},
+	}, nil
+}
+
+// convertJSON copies a decoded json value like a map[string]any into dst.
+func convertJSON(src, dst any) error {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(json.Unmarshal(b, dst))
+}
@@ -0,0 +1,174 @@
+package pds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/atp"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+type staticHandles map[string]syntax.DID
+
+func (sh staticHandles) ResolveHandle(_ context.Context, handle string) (syntax.DID, error) {
+	did, ok := sh[handle]
+	if !ok {
+		return "", errors.Errorf("could not resolve %q", handle)
+	}
+	return did, nil
+}
+
+func TestUpdateHandle(t *testing.T) {
+	is := is.New(t)
+	pds := testPDS(t, localhost)
+	ctx := t.Context()
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "old-name.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	other, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "other@test.local",
+		Handle:   "other-name.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	authed := auth.StashUser(ctx, &xrpc.Auth{DID: acct.DID.String(), Handle: acct.Handle.String()})
+	pds.HandleResolver = staticHandles{
+		"alice.example.com": acct.DID,
+		"bob.example.com":   other.DID,
+	}
+	handle := func() string {
+		a, err := pds.Accounts.GetAccount(ctx, acct.DID.String(), nil)
+		is.NoErr(err)
+		return a.Handle.String
+	}
+	alsoKnownAs := func() string {
+		op, err := pds.PLC.LastOperation(ctx, acct.DID.String())
+		is.NoErr(err)
+		return op.AlsoKnownAs[0]
+	}
+
+	_, err = pds.UpdateHandle(authed, &atproto.IdentityUpdateHandleRequest{Handle: "New-Name.test"})
+	is.NoErr(err)
+	is.Equal(handle(), "new-name.test")
+	is.Equal(alsoKnownAs(), "at://new-name.test")
+
+	_, err = pds.UpdateHandle(authed, &atproto.IdentityUpdateHandleRequest{Handle: "other-name.test"})
+	is.True(err != nil) // taken
+	_, err = pds.UpdateHandle(authed, &atproto.IdentityUpdateHandleRequest{Handle: "bob.example.com"})
+	is.True(err != nil) // resolves to another account
+	_, err = pds.UpdateHandle(authed, &atproto.IdentityUpdateHandleRequest{Handle: "carol.example.com"})
+	is.True(err != nil) // does not resolve
+	is.Equal(handle(), "new-name.test")
+
+	_, err = pds.UpdateHandle(authed, &atproto.IdentityUpdateHandleRequest{Handle: "alice.example.com"})
+	is.NoErr(err)
+	is.Equal(handle(), "alice.example.com")
+	is.Equal(alsoKnownAs(), "at://alice.example.com")
+
+	_, err = pds.UpdateAccountHandle(ctx, &atproto.AdminUpdateAccountHandleRequest{
+		DID:    acct.DID,
+		Handle: "admin-set.test",
+	})
+	is.NoErr(err)
+	is.Equal(handle(), "admin-set.test")
+	is.Equal(alsoKnownAs(), "at://admin-set.test")
+}
+
+func TestUpdateHandleDidWeb(t *testing.T) {
+	is := is.New(t)
+	pds := testPDS(t, localhost, func(cfg *EnvConfig) { cfg.DidWebAccounts = true })
+	ctx := t.Context()
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "web-user.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	is.Equal(acct.DID.String(), "did:web:web-user.test")
+	other, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "other@test.local",
+		Handle:   "other-user.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	authed := auth.StashUser(ctx, &xrpc.Auth{DID: acct.DID.String(), Handle: acct.Handle.String()})
+	_, err = pds.UpdateHandle(authed, &atproto.IdentityUpdateHandleRequest{Handle: "renamed.test"})
+	is.NoErr(err)
+
+	// the old handle is still the did:web's hostname
+	_, err = pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "new@test.local",
+		Handle:   "web-user.test",
+		Password: "testlab01",
+	})
+	is.True(err != nil)
+	otherAuthed := auth.StashUser(ctx, &xrpc.Auth{DID: other.DID.String(), Handle: other.Handle.String()})
+	_, err = pds.UpdateHandle(otherAuthed, &atproto.IdentityUpdateHandleRequest{Handle: "web-user.test"})
+	is.True(err != nil)
+	_, err = pds.UpdateAccountHandle(ctx, &atproto.AdminUpdateAccountHandleRequest{
+		DID:    other.DID,
+		Handle: "web-user.test",
+	})
+	is.True(err != nil)
+
+	// the owner can take it back
+	_, err = pds.UpdateHandle(authed, &atproto.IdentityUpdateHandleRequest{Handle: "web-user.test"})
+	is.NoErr(err)
+	a, err := pds.Accounts.GetAccount(ctx, acct.DID.String(), nil)
+	is.NoErr(err)
+	is.Equal(a.Handle.String, "web-user.test")
+}
+
+func TestResolveHandle(t *testing.T) {
+	is := is.New(t)
+	pds := testPDS(t, localhost)
+	ctx := t.Context()
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "hosted.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	pds.Resolver = &atp.Resolver{HandleResolver: staticHandles{"alice.example.com": "did:plc:alice"}}
+
+	res, err := pds.ResolveHandle(ctx, &atproto.IdentityResolveHandleParams{Handle: "Hosted.test"})
+	is.NoErr(err)
+	is.Equal(res.DID, acct.DID)
+	res, err = pds.ResolveHandle(ctx, &atproto.IdentityResolveHandleParams{Handle: "alice.example.com"})
+	is.NoErr(err)
+	is.Equal(res.DID.String(), "did:plc:alice")
+	_, err = pds.ResolveHandle(ctx, &atproto.IdentityResolveHandleParams{Handle: "missing.test"})
+	is.True(err != nil)
+
+	for _, tt := range []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{host: "hosted.test", status: http.StatusOK, body: acct.DID.String()},
+		{host: "hosted.test:3000", status: http.StatusOK, body: acct.DID.String()},
+		{host: "missing.test", status: http.StatusNotFound},
+		{host: "alice.example.com", status: http.StatusNotFound},
+		{host: "localhost", status: http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/.well-known/atproto-did", nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		pds.AtprotoDID(rec, req)
+		is.Equal(rec.Code, tt.status)
+		if tt.status == http.StatusOK {
+			is.Equal(rec.Body.String(), tt.body)
+		}
+	}
+}
@@ -4,15 +4,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"path"
 
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
 	gocid "github.com/ipfs/go-cid"
 	"github.com/pkg/errors"
 
 	atpapi "github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/atp"
+	"github.com/harrybrwn/at/internal/account"
 	"github.com/harrybrwn/at/internal/accountstore"
 	"github.com/harrybrwn/at/internal/actorstore"
 	"github.com/harrybrwn/at/internal/auth"
@@ -44,24 +50,9 @@ func (pds *PDS) DescribeRepo(ctx context.Context, req *atpapi.RepoDescribeRepoPa
 		}
 	}
 
-	account, err := pds.Accounts.GetAccount(ctx, req.Repo.String(), &accountstore.GetAccountOpts{
-		IncludeTakenDown:   true,
-		IncludeDeactivated: true,
-	})
+	account, err := pds.assertRepoAvailable(ctx, did)
 	if err != nil {
-		return nil, xrpc.Wrapf(err, xrpc.RepoNotFound, "Could not find repo for DID: %s", did)
-	}
-	if account.TakedownRef.Valid {
-		return nil, &xrpc.ErrorResponse{
-			Code:    "RepoTakendown",
-			Message: fmt.Sprintf("Repo has been takendown: %s", did),
-		}
-	}
-	if account.DeactivatedAt.Valid {
-		return nil, &xrpc.ErrorResponse{
-			Code:    "RepoDeactivated",
-			Message: fmt.Sprintf("Repo has been deactivated: %s", did),
-		}
+		return nil, err
 	}
 	doc, err := pds.Resolver.GetDocument(ctx, did.String())
 	if err != nil {
@@ -95,6 +86,40 @@ func (pds *PDS) DescribeRepo(ctx context.Context, req *atpapi.RepoDescribeRepoPa
 	}, nil
 }
 
+// assertRepoAvailable looks up the account hosting a repo and fails if the
+// repo has been taken down or deactivated. The account itself can still read
+// its own repo.
+func (pds *PDS) assertRepoAvailable(ctx context.Context, did syntax.DID) (*account.ActorAccount, error) {
+	acct, err := pds.Accounts.GetAccount(ctx, did.String(), new(accountstore.GetAccountOpts).
+		WithTakenDown().
+		WithDeactivated())
+	if err != nil {
+		return nil, xrpc.Wrapf(err, xrpc.RepoNotFound, "Could not find repo for DID: %s", did)
+	}
+	if user := auth.UserFromContext(ctx); user != nil && user.DID == acct.DID {
+		return acct, nil
+	}
+	if acct.TakedownRef.Valid {
+		return nil, &xrpc.ErrorResponse{
+			Code:    "RepoTakendown",
+			Message: fmt.Sprintf("Repo has been takendown: %s", did),
+			Status:  http.StatusBadRequest,
+		}
+	}
+	if acct.DeactivatedAt.Valid {
+		return nil, &xrpc.ErrorResponse{
+			Code:    "RepoDeactivated",
+			Message: fmt.Sprintf("Repo has been deactivated: %s", did),
+			Status:  http.StatusBadRequest,
+		}
+	}
+	return acct, nil
+}
+
+// errRecordTakenDown is the inner error of the RecordNotFound response sent
+// for taken down records. They look the same as missing records to callers.
+var errRecordTakenDown = errors.New("record was taken down")
+
 func (pds *PDS) GetRecord(ctx context.Context, r *atpapi.RepoGetRecordParams) (*atpapi.RepoGetRecordResponse, error) {
 	if !r.Repo.IsDID() {
 		return atpapi.NewRepoClient(pds.Passthrough).GetRecord(ctx, r)
@@ -103,7 +128,9 @@ func (pds *PDS) GetRecord(ctx context.Context, r *atpapi.RepoGetRecordParams) (*
 	if err != nil {
 		return nil, err
 	}
-	// TODO check to see if we have the DID in our database
+	if _, err = pds.assertRepoAvailable(ctx, did); err != nil {
+		return nil, err
+	}
 	rr, err := pds.ActorStore.Record(did)
 	if err != nil {
 		return nil, err
@@ -112,11 +139,11 @@ func (pds *PDS) GetRecord(ctx context.Context, r *atpapi.RepoGetRecordParams) (*
 
 	uri := fmt.Sprintf("at://%s/%s/%s", did, r.Collection, r.RKey)
 	res, err := rr.GetRecord(ctx, syntax.ATURI(uri), (*gocid.Cid)(r.CID), false)
-	if err != nil {
-		return nil, xrpc.Wrap(err, xrpc.RecordNotFound, "couldn't find record")
+	if err == nil && res.TakedownRef.Valid {
+		err = errRecordTakenDown
 	}
-	if res.TakedownRef.Valid {
-		return nil, errors.New("record was taken down")
+	if err != nil {
+		return nil, xrpc.Wrap(err, xrpc.RecordNotFound, "Could not locate record")
 	}
 	return &atpapi.RepoGetRecordResponse{
 		URI:   res.URI,
@@ -236,7 +263,9 @@ func (pds *PDS) ListRecords(ctx context.Context, r *atpapi.RepoListRecordsParams
 	if err != nil {
 		return nil, err
 	}
-	// TODO check to see if we have the DID in our database
+	if _, err = pds.assertRepoAvailable(ctx, did); err != nil {
+		return nil, err
+	}
 	rr, err := pds.ActorStore.Record(did)
 	if err != nil {
 		return nil, xrpc.Wrap(
@@ -273,20 +302,151 @@ func (pds *PDS) DeleteRecord(cxt context.Context, req *atpapi.RepoDeleteRecordRe
 	return nil, xrpc.ErrNotImplemented
 }
 
+// UploadBlob stores a blob for the requesting account. The blob is kept until
+// a record references it or, for accounts that imported a repo, stored
+// permanently if a record already does.
 func (pds *PDS) UploadBlob(ctx context.Context, body io.Reader) (*atpapi.RepoUploadBlobResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	did := syntax.DID(acct.DID)
+	blobs, err := pds.ActorStore.Blob(did, pds.newBlobstore(did))
+	if err != nil {
+		return nil, err
+	}
+	defer blobs.Close()
+	limit := int64(pds.cfg.BlobUploadLimit)
+	ref, err := blobs.UploadBlob(ctx, &limitedReader{r: body, n: limit}, blobContentType(ctx))
+	if errors.Is(err, errBlobTooLarge) {
+		return nil, &xrpc.ErrorResponse{
+			Code:    "BlobTooLarge",
+			Message: fmt.Sprintf("blob is larger than %d bytes", limit),
+			Status:  http.StatusRequestEntityTooLarge,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &atpapi.RepoUploadBlobResponse{Blob: util.LexBlob{
+		Ref:      util.LexLink(ref.CID),
+		MimeType: ref.MimeType,
+		Size:     ref.Size,
+	}}, nil
 }
 
 func (pds *PDS) ApplyWrites(ctx context.Context, req *atpapi.RepoApplyWritesRequest) (*atpapi.RepoApplyWritesResponse, error) {
 	return nil, xrpc.ErrNotImplemented
 }
 
+// ListMissingBlobs lists the blobs referenced by the requesting account's
+// records that have not been uploaded, which is how a migration finds the
+// blobs it still needs to transfer after importing a repo.
 func (pds *PDS) ListMissingBlobs(ctx context.Context, params *atpapi.RepoListMissingBlobsParams) (*atpapi.RepoListMissingBlobsResponse, error) {
-	return nil, xrpc.ErrNotImplemented
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	limit := 500
+	if params.Limit != nil {
+		limit = int(*params.Limit)
+	}
+	if limit < 1 || limit > 1000 {
+		return nil, xrpc.NewInvalidRequest("limit must be between 1 and 1000")
+	}
+	did := syntax.DID(acct.DID)
+	blobs, err := pds.ActorStore.Blob(did, pds.newBlobstore(did))
+	if err != nil {
+		return nil, err
+	}
+	defer blobs.Close()
+	missing, err := blobs.ListMissingBlobs(ctx, params.Cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	res := atpapi.RepoListMissingBlobsResponse{
+		Blobs: make([]atpapi.RepoListMissingBlobsRecordBlob, len(missing)),
+	}
+	for i, m := range missing {
+		c, err := gocid.Decode(m.CID)
+		if err != nil {
+			return nil, xrpc.NewInternalError("invalid stored blob cid").Wrap(errors.WithStack(err))
+		}
+		res.Blobs[i] = atpapi.RepoListMissingBlobsRecordBlob{
+			CID:       cid.Cid(c),
+			RecordUri: syntax.ATURI(m.RecordURI),
+		}
+	}
+	if len(missing) == limit {
+		res.Cursor = missing[len(missing)-1].CID
+	}
+	return &res, nil
 }
 
+// ImportRepo replaces the requesting account's repo with a repo exported as
+// a CAR file by another server. The commit must be signed by the key in the
+// account's did document.
 func (pds *PDS) ImportRepo(ctx context.Context, body io.Reader) (any, error) {
-	return nil, xrpc.ErrNotImplemented
+	if !pds.cfg.AcceptingRepoImports {
+		return nil, xrpc.NewInvalidRequest("Service is not accepting repo imports")
+	}
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = pds.ActorStore.ImportRepo(ctx, syntax.DID(acct.DID), body, pds.repoSigningKey)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// repoSigningKey resolves the key that signs a repo's commits from the
+// repo owner's did document.
+func (pds *PDS) repoSigningKey(ctx context.Context, did string) (crypto.PublicKey, error) {
+	doc, err := pds.Resolver.GetDocument(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	ident := identity.ParseIdentity(atp.ConvertDidDoc(doc))
+	return ident.PublicKey()
+}
+
+type contentTypeKey struct{}
+
+// recordContentType keeps the declared type of an uploaded blob, which the
+// generated handler does not pass on.
+func recordContentType(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err == nil && mediaType != "*/*" {
+			r = r.WithContext(context.WithValue(r.Context(), contentTypeKey{}, mediaType))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// blobContentType returns the declared type of an uploaded blob, or an empty
+// string when the client did not send one.
+func blobContentType(ctx context.Context) string {
+	mediaType, _ := ctx.Value(contentTypeKey{}).(string)
+	return mediaType
+}
+
+var errBlobTooLarge = errors.New("blob too large")
+
+// limitedReader fails once more than n bytes have been read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n, errBlobTooLarge
+	}
+	return n, err
 }
 
 func setCollectionName(record any, collection syntax.NSID) error {
@@ -2,20 +2,27 @@ package pds
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/pkg/errors"
 
 	atpapi "github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/atp"
 	"github.com/harrybrwn/at/internal/account"
 	"github.com/harrybrwn/at/internal/accountstore"
 	"github.com/harrybrwn/at/internal/actorstore"
 	"github.com/harrybrwn/at/internal/auth"
 	"github.com/harrybrwn/at/internal/cid"
+	"github.com/harrybrwn/at/internal/mailer"
 	"github.com/harrybrwn/at/internal/parallel"
 	"github.com/harrybrwn/at/internal/repo"
 	"github.com/harrybrwn/at/internal/sequencer"
@@ -35,6 +42,158 @@ func (pds *PDS) CreateInviteCode(ctx context.Context, req *atpapi.ServerCreateIn
 	return &atpapi.ServerCreateInviteCodeResponse{Code: code}, nil
 }
 
+// CreateInviteCodes creates invite codes for each of the given accounts or
+// for the admin when no accounts are given.
+func (pds *PDS) CreateInviteCodes(ctx context.Context, req *atpapi.ServerCreateInviteCodesRequest) (*atpapi.ServerCreateInviteCodesResponse, error) {
+	if req.UseCount < 1 {
+		return nil, xrpc.NewInvalidRequest("useCount must be at least 1")
+	}
+	codeCount := max(int(req.CodeCount), 1)
+	forAccounts := make([]string, len(req.ForAccounts))
+	for i, did := range req.ForAccounts {
+		forAccounts[i] = did.String()
+	}
+	if len(forAccounts) == 0 {
+		forAccounts = []string{"admin"}
+	}
+	toCreate := make([]accountstore.AccountCodes, len(forAccounts))
+	res := atpapi.ServerCreateInviteCodesResponse{
+		Codes: make([]atpapi.ServerCreateInviteCodesAccountCodes, len(forAccounts)),
+	}
+	for i, account := range forAccounts {
+		codes := make([]string, codeCount)
+		for j := range codes {
+			codes[j] = genInviteCode(pds.cfg)
+		}
+		toCreate[i] = accountstore.AccountCodes{Account: account, Codes: codes}
+		res.Codes[i] = atpapi.ServerCreateInviteCodesAccountCodes{Account: account, Codes: codes}
+	}
+	if err := pds.Accounts.CreateInviteCodes(ctx, toCreate, int(req.UseCount)); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// maxUnusedInviteCodes caps the number of earned invite codes an account can
+// hold without using any of them.
+const maxUnusedInviteCodes = 5
+
+// GetAccountInviteCodes lists the invite codes of the requesting account,
+// creating any codes it has earned since the last request.
+func (pds *PDS) GetAccountInviteCodes(ctx context.Context, params *atpapi.ServerGetAccountInviteCodesParams) (*atpapi.ServerGetAccountInviteCodesResponse, error) {
+	user := auth.UserFromContext(ctx)
+	if user == nil || len(user.DID) == 0 {
+		return nil, xrpc.NewAuthRequired("Malformed token")
+	}
+	includeUsed, createAvailable := true, true
+	if params != nil {
+		if params.IncludeUsed != nil {
+			includeUsed = *params.IncludeUsed
+		}
+		if params.CreateAvailable != nil {
+			createAvailable = *params.CreateAvailable
+		}
+	}
+	acct, err := pds.Accounts.GetAccount(ctx, user.DID, &accountstore.GetAccountOpts{
+		IncludeDeactivated: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	codes, err := pds.Accounts.GetAccountInviteCodes(ctx, user.DID)
+	if err != nil {
+		return nil, err
+	}
+	if createAvailable && pds.cfg.Invite != nil && pds.cfg.Invite.Interval > 0 {
+		createdAt, err := time.Parse(time.RFC3339, acct.CreatedAt)
+		if err != nil {
+			return nil, xrpc.NewInternalError("Invalid account creation time").Wrap(err)
+		}
+		toCreate, total := calculateCodesToCreate(
+			user.DID,
+			createdAt,
+			codes,
+			time.UnixMilli(int64(pds.cfg.Invite.Epoch)),
+			time.Duration(pds.cfg.Invite.Interval)*time.Millisecond,
+			time.Now(),
+		)
+		if toCreate > 0 {
+			newCodes := make([]string, toCreate)
+			for i := range newCodes {
+				newCodes[i] = genInviteCode(pds.cfg)
+			}
+			created, err := pds.Accounts.CreateAccountInviteCodes(ctx, user.DID, newCodes, total, acct.InvitesDisabled)
+			if err != nil {
+				return nil, err
+			}
+			codes = append(codes, created...)
+		}
+	}
+	res := atpapi.ServerGetAccountInviteCodesResponse{
+		Codes: make([]atpapi.ServerInviteCode, 0, len(codes)),
+	}
+	for _, code := range codes {
+		if code.Disabled || (!includeUsed && len(code.Uses) >= code.AvailableUses) {
+			continue
+		}
+		res.Codes = append(res.Codes, inviteCodeView(&code))
+	}
+	return &res, nil
+}
+
+// calculateCodesToCreate returns the number of codes an account has earned
+// but not yet been given and the total number of codes it should have
+// created for itself afterwards. One code is earned every interval starting
+// at either the account's creation or the epoch, whichever is later.
+func calculateCodesToCreate(
+	did string,
+	createdAt time.Time,
+	codes []accountstore.CodeDetail,
+	epoch time.Time,
+	interval time.Duration,
+	now time.Time,
+) (toCreate, total int) {
+	start := createdAt
+	if epoch.After(start) {
+		start = epoch
+	}
+	var created, unused int
+	for _, code := range codes {
+		if code.CreatedBy != did {
+			continue
+		}
+		created++
+		if len(code.Uses) < code.AvailableUses {
+			unused++
+		}
+	}
+	if interval <= 0 || now.Before(start) {
+		return 0, created
+	}
+	earned := int(now.Sub(start) / interval)
+	toCreate = max(min(earned-created, maxUnusedInviteCodes-unused), 0)
+	return toCreate, created + toCreate
+}
+
+func inviteCodeView(code *accountstore.CodeDetail) atpapi.ServerInviteCode {
+	view := atpapi.ServerInviteCode{
+		Code:       code.Code,
+		Available:  int64(code.AvailableUses),
+		Disabled:   code.Disabled,
+		ForAccount: code.ForAccount,
+		CreatedBy:  code.CreatedBy,
+		CreatedAt:  code.CreatedAt,
+		Uses:       make([]atpapi.ServerInviteCodeUse, len(code.Uses)),
+	}
+	for i, use := range code.Uses {
+		view.Uses[i] = atpapi.ServerInviteCodeUse{
+			UsedBy: syntax.DID(use.UsedBy),
+			UsedAt: use.UsedAt,
+		}
+	}
+	return view
+}
+
 func (pds *PDS) DescribeServer(ctx context.Context) (*atpapi.ServerDescribeServerResponse, error) {
 	var err error
 	res := atpapi.ServerDescribeServerResponse{
@@ -57,6 +216,9 @@ func (pds *PDS) CreateAccount(
 	ctx context.Context,
 	req *atpapi.ServerCreateAccountRequest,
 ) (*atpapi.ServerCreateAccountResponse, error) {
+	if pds.cfg.IsEntryway() {
+		return pds.createEntrywayAccount(ctx, req)
+	}
 	inputs, err := validateCreateAccountReqLocalPDS(ctx, pds, req)
 	if err != nil {
 		pds.logger.Warn("request validation failed", "error", err)
@@ -79,17 +241,32 @@ func (pds *PDS) CreateAccount(
 		pds.logger.Warn("repo transactor failed", "error", err)
 		return nil, err
 	}
+	if inputs.plcOp != nil {
+		err = pds.PLC.SubmitOperation(ctx, did.String(), inputs.plcOp)
+		if err != nil {
+			return nil, xrpc.NewInternalError("Failed to create did").Wrap(err)
+		}
+		pds.logger.Debug("created new did", "did", did)
+	}
+	var inviteCode *string
+	if len(req.InviteCode) > 0 {
+		inviteCode = &req.InviteCode
+	}
 	accessJwt, refreshJwt, err := pds.Accounts.CreateAccount(ctx, accountstore.CreateAccountOpts{
 		DID:         did.String(),
 		Handle:      inputs.handle.String(),
 		Email:       &req.Email,
 		Password:    &req.Password,
+		InviteCode:  inviteCode,
 		Deactivated: &inputs.deactivated,
 	})
 	if err != nil {
 		pds.logger.Warn("account managager failed to create account", "error", err)
 		return nil, err
 	}
+	if err = pds.ActorStore.ClearReservedSigningKey(did.String()); err != nil {
+		pds.logger.Warn("failed to clear reserved signing key", "did", did, "error", err)
+	}
 
 	if !inputs.deactivated {
 		now := time.Now().Format(time.RFC3339)
@@ -169,9 +346,9 @@ func (pds *PDS) CreateSession(
 				res.Handle = syntax.HandleInvalid
 				return nil
 			}
-			res.DidDoc, err = pds.Resolver.GetDocument(ctx, login.User.DID)
+			res.DidDoc, err = pds.didDocForSession(ctx, login.User.DID)
 			if err != nil {
-				return errors.Wrap(err, "failed to get did document")
+				return err
 			}
 			res.DID, err = syntax.ParseDID(login.User.DID)
 			if err != nil {
@@ -199,7 +376,8 @@ func (pds *PDS) CreateSession(
 
 func (pds *PDS) RefreshSession(ctx context.Context) (*atpapi.ServerRefreshSessionResponse, error) {
 	user := auth.UserFromContext(ctx)
-	if user == nil {
+	tokenID := auth.TokenID(auth.TokenFromContext(ctx))
+	if user == nil || len(tokenID) == 0 {
 		return nil, xrpc.NewAuthRequired("Malformed token")
 	}
 	acct, err := pds.Accounts.GetAccount(ctx, user.DID, new(accountstore.GetAccountOpts).
@@ -214,38 +392,553 @@ func (pds *PDS) RefreshSession(ctx context.Context) (*atpapi.ServerRefreshSessio
 			Message: "Account has been taken down.",
 		}
 	}
+	var (
+		res  atpapi.ServerRefreshSessionResponse
+		info *sessionInfo
+	)
 	err = parallel.Do(ctx,
-		func(ctx context.Context) error {
-			return nil
+		func(ctx context.Context) (err error) {
+			res.AccessJwt, res.RefreshJwt, err = pds.Accounts.RotateRefreshToken(ctx, tokenID)
+			return err
 		},
-		func(ctx context.Context) error {
-			return nil
+		func(ctx context.Context) (err error) {
+			info, err = pds.sessionInfo(ctx, acct)
+			return err
 		})
 	if err != nil {
 		return nil, err
 	}
-	return nil, xrpc.ErrNotImplemented
+	res.DID = info.did
+	res.Handle = info.handle
+	res.DidDoc = info.didDoc
+	res.Active = info.active
+	res.Status = info.status
+	return &res, nil
+}
+
+func (pds *PDS) GetSession(ctx context.Context) (*atpapi.ServerGetSessionResponse, error) {
+	user := auth.UserFromContext(ctx)
+	if user == nil {
+		return nil, xrpc.NewAuthRequired("Malformed token")
+	}
+	acct, err := pds.Accounts.GetAccount(ctx, user.DID, new(accountstore.GetAccountOpts).
+		WithDeactivated().
+		WithTakenDown())
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("Could not find user info for account: %s", user.DID).Wrap(err)
+	}
+	info, err := pds.sessionInfo(ctx, acct)
+	if err != nil {
+		return nil, err
+	}
+	return &atpapi.ServerGetSessionResponse{
+		DID:            info.did,
+		Handle:         info.handle,
+		DidDoc:         info.didDoc,
+		Email:          acct.Email,
+		EmailConfirmed: acct.EmailConfirmedAt.Valid,
+		Active:         info.active,
+		Status:         info.status,
+	}, nil
+}
+
+// DeleteSession revokes the refresh token used to call it along with every
+// token it was rotated from or into.
+func (pds *PDS) DeleteSession(ctx context.Context) (any, error) {
+	tokenID := auth.TokenID(auth.TokenFromContext(ctx))
+	if len(tokenID) == 0 {
+		return nil, xrpc.NewAuthRequired("Malformed token")
+	}
+	if err := pds.Accounts.RevokeRefreshToken(ctx, tokenID); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (pds *PDS) CreateAppPassword(
+	ctx context.Context,
+	req *atpapi.ServerCreateAppPasswordRequest,
+) (*atpapi.ServerCreateAppPasswordResponse, error) {
+	user := auth.UserFromContext(ctx)
+	if user == nil || len(user.DID) == 0 {
+		return nil, xrpc.NewAuthRequired("Malformed token")
+	}
+	name := strings.TrimSpace(req.Name)
+	if len(name) == 0 {
+		return nil, xrpc.NewInvalidRequest("App password name is required")
+	}
+	ap, err := pds.Accounts.CreateAppPassword(ctx, user.DID, name, req.Privileged)
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("could not create app-specific password").Wrap(err)
+	}
+	return &atpapi.ServerCreateAppPasswordResponse{
+		Name:       ap.Name,
+		Password:   string(ap.Password),
+		CreatedAt:  ap.CreatedAt.Format(time.RFC3339),
+		Privileged: ap.Privileged,
+	}, nil
+}
+
+func (pds *PDS) ListAppPasswords(ctx context.Context) (*atpapi.ServerListAppPasswordsResponse, error) {
+	user := auth.UserFromContext(ctx)
+	if user == nil || len(user.DID) == 0 {
+		return nil, xrpc.NewAuthRequired("Malformed token")
+	}
+	passwords, err := pds.Accounts.ListAppPasswords(ctx, user.DID)
+	if err != nil {
+		return nil, err
+	}
+	res := atpapi.ServerListAppPasswordsResponse{
+		Passwords: make([]atpapi.ServerListAppPasswordsAppPassword, len(passwords)),
+	}
+	for i, ap := range passwords {
+		res.Passwords[i] = atpapi.ServerListAppPasswordsAppPassword{
+			Name:       ap.Name,
+			CreatedAt:  ap.CreatedAt,
+			Privileged: ap.Privileged,
+		}
+	}
+	return &res, nil
+}
+
+// RevokeAppPassword deletes an app password and revokes the sessions that
+// were created with it.
+func (pds *PDS) RevokeAppPassword(ctx context.Context, req *atpapi.ServerRevokeAppPasswordRequest) (any, error) {
+	user := auth.UserFromContext(ctx)
+	if user == nil || len(user.DID) == 0 {
+		return nil, xrpc.NewAuthRequired("Malformed token")
+	}
+	if err := pds.Accounts.DeleteAppPassword(ctx, user.DID, req.Name); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// RequestEmailConfirmation emails a token that confirms the account's email
+// address.
+func (pds *PDS) RequestEmailConfirmation(ctx context.Context) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(acct.Email) == 0 {
+		return nil, xrpc.NewInvalidRequest("account does not have an email address")
+	}
+	token, err := pds.Accounts.CreateEmailToken(ctx, acct.DID, accountstore.PurposeConfirmEmail)
+	if err != nil {
+		return nil, err
+	}
+	err = pds.Mailer.SendConfirmEmail(ctx, acct.Email, &mailer.TokenParams{
+		Handle: acct.Handle.String,
+		Token:  token,
+	})
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to send email").Wrap(err)
+	}
+	return nil, nil
+}
+
+// ConfirmEmail confirms the account's email address with a token from
+// [PDS.RequestEmailConfirmation].
+func (pds *PDS) ConfirmEmail(ctx context.Context, req *atpapi.ServerConfirmEmailRequest) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(acct.Email, req.Email) {
+		return nil, &xrpc.ErrorResponse{
+			Code:    "InvalidEmail",
+			Message: "invalid email",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	if err = pds.Accounts.ConfirmEmail(ctx, acct.DID, req.Token); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// RequestEmailUpdate emails a token to the account's current address that
+// is needed to change it. A token is only required once the current address
+// has been confirmed.
+func (pds *PDS) RequestEmailUpdate(ctx context.Context) (*atpapi.ServerRequestEmailUpdateResponse, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(acct.Email) == 0 {
+		return nil, xrpc.NewInvalidRequest("account does not have an email address")
+	}
+	res := atpapi.ServerRequestEmailUpdateResponse{
+		TokenRequired: acct.EmailConfirmedAt.Valid,
+	}
+	if !res.TokenRequired {
+		return &res, nil
+	}
+	token, err := pds.Accounts.CreateEmailToken(ctx, acct.DID, accountstore.PurposeUpdateEmail)
+	if err != nil {
+		return nil, err
+	}
+	err = pds.Mailer.SendUpdateEmail(ctx, acct.Email, &mailer.TokenParams{
+		Handle: acct.Handle.String,
+		Token:  token,
+	})
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to send email").Wrap(err)
+	}
+	return &res, nil
+}
+
+// UpdateEmail changes the account's email address.
+func (pds *PDS) UpdateEmail(ctx context.Context, req *atpapi.ServerUpdateEmailRequest) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !isValidEmail(req.Email) {
+		return nil, xrpc.NewInvalidRequest("This email address is not supported, please use a different email.")
+	}
+	var token string
+	if acct.EmailConfirmedAt.Valid {
+		if len(req.Token) == 0 {
+			return nil, &xrpc.ErrorResponse{
+				Code:    "TokenRequired",
+				Message: "confirmation token required",
+				Status:  http.StatusBadRequest,
+			}
+		}
+		token = req.Token
+	}
+	other, err := pds.Accounts.GetAccountByEmail(ctx, req.Email, new(accountstore.GetAccountOpts).WithDeactivated().WithTakenDown())
+	if err == nil && other.DID != acct.DID {
+		return nil, xrpc.NewInvalidRequest("This email address is already in use, please use a different email.")
+	}
+	if err = pds.Accounts.UpdateEmailWithToken(ctx, acct.DID, req.Email, token); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// RequestPasswordReset emails a password reset token if an account has the
+// given email address. It succeeds either way so that it cannot be used to
+// find out which addresses have accounts.
+func (pds *PDS) RequestPasswordReset(ctx context.Context, req *atpapi.ServerRequestPasswordResetRequest) (any, error) {
+	acct, err := pds.Accounts.GetAccountByEmail(ctx, req.Email, new(accountstore.GetAccountOpts).WithDeactivated().WithTakenDown())
+	if err != nil || len(acct.Email) == 0 {
+		return nil, nil
+	}
+	token, err := pds.Accounts.CreateEmailToken(ctx, acct.DID, accountstore.PurposeResetPassword)
+	if err != nil {
+		return nil, err
+	}
+	err = pds.Mailer.SendResetPassword(ctx, acct.Email, &mailer.TokenParams{
+		Handle: acct.Handle.String,
+		Token:  token,
+	})
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to send email").Wrap(err)
+	}
+	return nil, nil
+}
+
+// ResetPassword sets a new password with a token from
+// [PDS.RequestPasswordReset] and signs out every session.
+func (pds *PDS) ResetPassword(ctx context.Context, req *atpapi.ServerResetPasswordRequest) (any, error) {
+	if len(req.Password) == 0 {
+		return nil, xrpc.NewInvalidRequest("Password is required")
+	}
+	if _, err := pds.Accounts.ResetPassword(ctx, req.Token, req.Password); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// DeactivateAccount deactivates the requesting account. Its repo is hidden
+// from other users until it is activated again, and it is deleted once
+// "deleteAfter" passes.
+func (pds *PDS) DeactivateAccount(ctx context.Context, req *atpapi.ServerDeactivateAccountRequest) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var deleteAfter sql.NullString
+	if len(req.DeleteAfter) > 0 {
+		t, err := time.Parse(time.RFC3339, req.DeleteAfter)
+		if err != nil {
+			return nil, xrpc.NewInvalidRequest("Invalid deleteAfter: %s", req.DeleteAfter)
+		}
+		deleteAfter = sql.NullString{String: t.UTC().Format(time.RFC3339), Valid: true}
+	}
+	if err = pds.Accounts.DeactivateAccount(ctx, acct.DID, deleteAfter); err != nil {
+		return nil, err
+	}
+	err = pds.sequence(ctx, &Event{SyncSubscribeReposAccount: &atpapi.SyncSubscribeReposAccount{
+		DID:    syntax.DID(acct.DID),
+		Active: false,
+		Status: account.StatusDeactivated.String(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ActivateAccount activates the requesting account after checking that its
+// did document points at this server. The repo head is re-signed with this
+// server's key and the new commit is sequenced ahead of the account event.
+func (pds *PDS) ActivateAccount(ctx context.Context) (any, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	did := syntax.DID(acct.DID)
+	if !pds.validDidDoc(ctx, did) {
+		return nil, xrpc.NewInvalidRequest("DID document does not point to this server")
+	}
+	handle := syntax.HandleInvalid
+	if acct.Handle.Valid {
+		handle = syntax.Handle(acct.Handle.String)
+	}
+	events := []*Event{{SyncSubscribeReposIdentity: &atpapi.SyncSubscribeReposIdentity{
+		DID:    did,
+		Handle: handle,
+	}}}
+	// A migrated repo is still signed by the old server's key.
+	commit, err := pds.ActorStore.ResignRoot(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	if commit != nil {
+		if err = pds.Accounts.UpdateRoot(ctx, acct.DID, commit.CID.String(), commit.Rev); err != nil {
+			return nil, err
+		}
+		blocks, err := repo.BlocksToCarFile(syntax.CID(commit.CID.String()), commit.NewBlocks)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &Event{SyncSubscribeReposCommit: &atpapi.SyncSubscribeReposCommit{
+			Repo:   did,
+			Commit: cid.Cid(commit.CID),
+			Prev:   cid.Cid(commit.Prev),
+			Rev:    commit.Rev,
+			Since:  commit.Since,
+			Blobs:  make([]cid.Cid, 0),
+			Blocks: blocks,
+		}})
+	}
+	if err = pds.Accounts.ActivateAccount(ctx, acct.DID); err != nil {
+		return nil, err
+	}
+	events = append(events, &Event{SyncSubscribeReposAccount: &atpapi.SyncSubscribeReposAccount{
+		DID:    did,
+		Active: true,
+	}})
+	if err = pds.sequence(ctx, events...); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// CheckAccountStatus reports the state of the requesting account's repo so
+// that a migration can be checked before activating the account.
+func (pds *PDS) CheckAccountStatus(ctx context.Context) (*atpapi.ServerCheckAccountStatusResponse, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	did := syntax.DID(acct.DID)
+	stats, err := pds.ActorStore.Stats(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	return &atpapi.ServerCheckAccountStatusResponse{
+		Activated:          !acct.DeactivatedAt.Valid,
+		ValidDid:           pds.validDidDoc(ctx, did),
+		RepoCommit:         cid.Cid(stats.Root.CID),
+		RepoRev:            stats.Root.Rev,
+		RepoBlocks:         stats.RepoBlocks,
+		IndexedRecords:     stats.IndexedRecords,
+		PrivateStateValues: stats.PrivateStateValues,
+		ExpectedBlobs:      stats.ExpectedBlobs,
+		ImportedBlobs:      stats.ImportedBlobs,
+	}, nil
+}
+
+// validDidDoc reports whether the did document of an account names this
+// server as its PDS and, when it declares one, the account's signing key.
+func (pds *PDS) validDidDoc(ctx context.Context, did syntax.DID) bool {
+	doc, err := pds.Resolver.GetDocument(ctx, did.String())
+	if err != nil {
+		pds.logger.Warn("failed to resolve did document", "did", did, "error", err)
+		return false
+	}
+	ident := identity.ParseIdentity(atp.ConvertDidDoc(doc))
+	if ident.PDSEndpoint() != pds.cfg.PublicURL() {
+		return false
+	}
+	pub, err := ident.PublicKey()
+	if errors.Is(err, identity.ErrKeyNotDeclared) {
+		return true
+	} else if err != nil {
+		return false
+	}
+	key, err := pds.ActorStore.SigningKey(did)
+	if err != nil {
+		return false
+	}
+	ours, err := key.PublicKey()
+	if err != nil {
+		return false
+	}
+	return pub.Equal(ours)
+}
+
+// GetServiceAuth signs a service jwt with the account's signing key so that
+// the account can prove its identity to another service, like a server the
+// account is moving to.
+func (pds *PDS) GetServiceAuth(ctx context.Context, params *atpapi.ServerGetServiceAuthParams) (*atpapi.ServerGetServiceAuthResponse, error) {
+	acct, err := pds.requestingAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	exp := now.Add(time.Minute)
+	if params.Exp != nil {
+		exp = time.Unix(*params.Exp, 0)
+		diff := exp.Sub(now)
+		if diff < 0 {
+			return nil, atpapi.ErrServerGetServiceAuthBadExpiration.WithMsg("expiration is in past")
+		} else if diff > time.Hour {
+			return nil, atpapi.ErrServerGetServiceAuthBadExpiration.WithMsg(
+				"cannot request a token with an expiration more than an hour in the future")
+		} else if params.Lxm == nil && diff > time.Minute {
+			return nil, atpapi.ErrServerGetServiceAuthBadExpiration.WithMsg(
+				"cannot request a method-less token with an expiration more than a minute in the future")
+		}
+	}
+	var lxm *string
+	if params.Lxm != nil {
+		method := params.Lxm.String()
+		if tok := auth.TokenFromContext(ctx); tok != nil && !auth.TokenScope(tok).Allows(method) {
+			return nil, xrpc.NewInvalidRequest("Token does not have access to %s", method)
+		}
+		lxm = &method
+	}
+	key, err := pds.ActorStore.SigningKey(syntax.DID(acct.DID))
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to get signing key").Wrap(err)
+	}
+	token, err := auth.CreateServiceJwt(&auth.ServiceJwtOpts{
+		Iss:     acct.DID,
+		Aud:     params.Aud.String(),
+		Iat:     &now,
+		Exp:     &exp,
+		LXM:     lxm,
+		KeyPair: key,
+	})
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to create service token").Wrap(err)
+	}
+	return &atpapi.ServerGetServiceAuthResponse{Token: token}, nil
+}
+
+// ReserveSigningKey creates the signing key for an account that will be
+// moved to this server. The account's did document can then point at the key
+// before the account is created here.
+func (pds *PDS) ReserveSigningKey(ctx context.Context, req *atpapi.ServerReserveSigningKeyRequest) (*atpapi.ServerReserveSigningKeyResponse, error) {
+	key, err := pds.ActorStore.ReserveSigningKey(req.DID.String())
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to reserve signing key").Wrap(err)
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to reserve signing key").Wrap(err)
+	}
+	return &atpapi.ServerReserveSigningKeyResponse{SigningKey: pub.DIDKey()}, nil
+}
+
+// requestingAccount looks up the account of the authenticated user.
+func (pds *PDS) requestingAccount(ctx context.Context) (*account.ActorAccount, error) {
+	user := auth.UserFromContext(ctx)
+	if user == nil || len(user.DID) == 0 {
+		return nil, xrpc.NewAuthRequired("Malformed token")
+	}
+	acct, err := pds.Accounts.GetAccount(ctx, user.DID, new(accountstore.GetAccountOpts).WithDeactivated())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, xrpc.NewInvalidRequest("Account not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return acct, nil
+}
+
+func isValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+type sessionInfo struct {
+	did    syntax.DID
+	handle syntax.Handle
+	didDoc any
+	active bool
+	status string
+}
+
+func (pds *PDS) sessionInfo(ctx context.Context, acct *account.ActorAccount) (*sessionInfo, error) {
+	did, err := syntax.ParseDID(acct.DID)
+	if err != nil {
+		return nil, xrpc.NewInternalError("invalid did syntax").Wrap(errors.WithStack(err))
+	}
+	info := sessionInfo{did: did, handle: syntax.HandleInvalid}
+	if acct.Handle.Valid {
+		info.handle, err = syntax.ParseHandle(acct.Handle.String)
+		if err != nil {
+			return nil, xrpc.NewInternalError("invalid handle syntax").Wrap(errors.WithStack(err))
+		}
+	}
+	status, active := formatAccountStatus(acct)
+	info.active = active
+	info.status = status.String()
+	info.didDoc, err = pds.didDocForSession(ctx, acct.DID)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// didDocForSession resolves the did document returned with sessions when
+// EnableDIDDocWithSession is set.
+func (pds *PDS) didDocForSession(ctx context.Context, did string) (any, error) {
+	if !pds.cfg.EnableDIDDocWithSession {
+		return nil, nil
+	}
+	doc, err := pds.Resolver.GetDocument(ctx, did)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get did document")
+	}
+	return doc, nil
 }
 
 type createAccountValidatedInputs struct {
 	handle      syntax.Handle
 	did         syntax.DID
 	signingKey  *crypto.PrivateKeyK256
-	plcOp       string
+	plcOp       *atp.PlcOperation
 	deactivated bool
 }
 
-func validateCreateAccountReqLocalPDS(
+// validateNewAccount checks the parts of an account creation request that do
+// not depend on where the repo will live and returns the normalized handle.
+func validateNewAccount(
 	ctx context.Context,
 	pds *PDS,
 	req *atpapi.ServerCreateAccountRequest,
-) (res *createAccountValidatedInputs, err error) {
-	requester := auth.UserFromContext(ctx)
-	var inviteRequired bool
-	if pds.cfg.Invite != nil && pds.cfg.Invite.Required {
-		inviteRequired = true
+	checkInvite bool,
+) (syntax.Handle, error) {
+	if checkInvite && pds.cfg.Invite != nil && pds.cfg.Invite.Required {
 		if len(req.InviteCode) == 0 {
-			return nil, &xrpc.ErrorResponse{
+			return "", &xrpc.ErrorResponse{
 				Code:    "InvalidInviteCode",
 				Message: "No invite code provided",
 			}
@@ -253,19 +946,19 @@ func validateCreateAccountReqLocalPDS(
 	}
 	// TODO if email not valid or email is "disposable" throw "This email address is not supported"
 	if len(req.Email) == 0 {
-		return nil, xrpc.NewInvalidRequest("Email is requred")
+		return "", xrpc.NewInvalidRequest("Email is requred")
 	}
 	if len(req.Password) == 0 {
-		return nil, xrpc.NewInvalidRequest("Password is required")
+		return "", xrpc.NewInvalidRequest("Password is required")
 	}
 	handle, err := normalizeAndValidateHandle(ctx, pds, req.Handle, req.DID, false)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	if inviteRequired && len(req.InviteCode) > 0 {
+	if checkInvite && len(req.InviteCode) > 0 {
 		err = pds.Accounts.EnsureInviteAvailable(ctx, req.InviteCode)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 	}
 
@@ -275,7 +968,7 @@ func validateCreateAccountReqLocalPDS(
 			if err == nil {
 				return xrpc.NewInvalidRequest("Handle already taken: %s", handle)
 			}
-			return nil
+			return ensureDidWebHostFree(ctx, pds, handle, "")
 		},
 		func(ctx context.Context) error {
 			_, err = pds.Accounts.GetAccountByEmail(ctx, req.Email, nil)
@@ -285,17 +978,35 @@ func validateCreateAccountReqLocalPDS(
 			return nil
 		})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return handle, nil
+}
 
-	signingKey, err := crypto.GeneratePrivateKeyK256()
+func validateCreateAccountReqLocalPDS(
+	ctx context.Context,
+	pds *PDS,
+	req *atpapi.ServerCreateAccountRequest,
+) (res *createAccountValidatedInputs, err error) {
+	requester := auth.UserFromContext(ctx)
+	// Behind an entryway, accounts are only made by the entryway after it
+	// has checked the invite code.
+	fromEntryway := false
+	if pds.cfg.BehindEntryway() {
+		if requester == nil || requester.DID != pds.cfg.Entryway.DID {
+			return nil, xrpc.NewAuthRequired("Accounts are created through the entryway")
+		}
+		fromEntryway = true
+	}
+	handle, err := validateNewAccount(ctx, pds, req, !fromEntryway)
 	if err != nil {
-		return nil, xrpc.NewInternalError("Account creation failed").Wrap(err)
+		return nil, err
 	}
 
 	var (
-		plcOp       string
 		did         syntax.DID
+		signingKey  *crypto.PrivateKeyK256
+		plcOp       *atp.PlcOperation
 		deactivated = false
 	)
 	if len(req.DID) > 0 {
@@ -303,29 +1014,28 @@ func validateCreateAccountReqLocalPDS(
 			return nil, xrpc.NewAuthRequired("Missing auth to create account with did: %s", req.DID)
 		}
 		did = req.DID
-		plcOp = ""
 		deactivated = true
-	} else {
-		// did, plcOp, err = formatDidAndPlcOp(ctx, pds, handle, req, signingKey)
-		// if err != nil {
-		// 	return nil, err
-		// }
-		newDID, err := pds.PLC.CreateDID(
-			ctx,
-			nil,
-			req.RecoveryKey,
-			handle.String(),
-			pds.cfg.PublicURL(),
-		)
+		// An account moving to this server may have already pointed its did
+		// document at a reserved key.
+		signingKey, err = pds.ActorStore.ReservedSigningKey(did.String())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, xrpc.NewInternalError("Account creation failed").Wrap(err)
+		}
+	}
+	if signingKey == nil {
+		signingKey, err = crypto.GeneratePrivateKeyK256()
 		if err != nil {
-			return nil, xrpc.NewInternalError("Failed to create did").Wrap(err)
+			return nil, xrpc.NewInternalError("Account creation failed").Wrap(err)
 		}
-		did, err = syntax.ParseDID(newDID)
+	}
+	if len(did) == 0 && pds.cfg.DidWebAccounts && isServiceDomain(handle.String(), pds.cfg.ServiceHandleDomains) {
+		did = syntax.DID("did:web:" + handle.String())
+	} else if len(did) == 0 {
+		did, plcOp, err = formatDidAndPlcOp(pds, handle, req, signingKey)
 		if err != nil {
-			return nil, xrpc.NewInternalError("plc returned invalid did").Wrap(err)
+			return nil, err
 		}
 	}
-	pds.logger.Debug("created new did", "did", did)
 	return &createAccountValidatedInputs{
 		handle:      handle,
 		did:         did,
@@ -370,7 +1080,7 @@ func normalizeAndValidateHandle(ctx context.Context, pds *PDS, h syntax.Handle,
 		if len(did) == 0 {
 			return h, atpapi.ErrServerCreateAccountUnsupportedDomain.WithMsg("Not a supported handle domain")
 		}
-		resolved, err := pds.Resolver.ResolveHandle(ctx, h.String())
+		resolved, err := pds.HandleResolver.ResolveHandle(ctx, h.String())
 		if err != nil {
 			return h, xrpc.NewInvalidRequest("Failed to resolved handle %q", h).Wrap(err)
 		}
@@ -381,6 +1091,26 @@ func normalizeAndValidateHandle(ctx context.Context, pds *PDS, h syntax.Handle,
 	return h, nil
 }
 
+// ensureDidWebHostFree returns an error when a handle is the hostname of
+// another account's did:web. Those hostnames stay reserved after the account
+// changes its handle because the did document is still served from them.
+func ensureDidWebHostFree(ctx context.Context, pds *PDS, handle syntax.Handle, did syntax.DID) error {
+	webDID := "did:web:" + handle.String()
+	if webDID == did.String() {
+		return nil
+	}
+	_, err := pds.Accounts.GetAccount(ctx, webDID, &accountstore.GetAccountOpts{
+		IncludeDeactivated: true,
+		IncludeTakenDown:   true,
+	})
+	if err == nil {
+		return xrpc.NewInvalidRequest("Handle already taken: %s", handle)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return nil
+}
+
 func hasExplicitSlur(string) bool {
 	return false
 }
@@ -423,21 +1153,32 @@ func ensureHandleServiceConstraints(h syntax.Handle, availableUserDomains []stri
 	return nil
 }
 
+// formatDidAndPlcOp creates the genesis operation of a new did:plc that
+// points at this server.
 func formatDidAndPlcOp(
-	ctx context.Context,
 	pds *PDS,
 	handle syntax.Handle,
 	req *atpapi.ServerCreateAccountRequest,
 	signingKey *crypto.PrivateKeyK256,
-) (syntax.DID, string, error) {
-	// pds.plcRotationKey.PublicKey()
-	pubPlcRotKey, err := pds.plcRotationKey.PublicKey()
+) (syntax.DID, *atp.PlcOperation, error) {
+	var rotationKeys []string
+	if len(req.RecoveryKey) > 0 {
+		if _, err := crypto.ParsePublicDIDKey(req.RecoveryKey); err != nil {
+			return "", nil, xrpc.NewInvalidRequest("Invalid recovery key").Wrap(err)
+		}
+		rotationKeys = append(rotationKeys, req.RecoveryKey)
+	}
+	op, err := pds.recommendedPlcOperation(handle, signingKey)
+	if err != nil {
+		return "", nil, err
+	}
+	op.RotationKeys = append(rotationKeys, op.RotationKeys...)
+	if err = op.Sign(pds.plcRotationKey); err != nil {
+		return "", nil, xrpc.NewInternalError("Failed to sign plc operation").Wrap(err)
+	}
+	did, err := op.DID()
 	if err != nil {
-		return "", "", err
+		return "", nil, xrpc.NewInternalError("Failed to create did").Wrap(err)
 	}
-	rotationDids := []string{pubPlcRotKey.DIDKey()}
-	_ = rotationDids
-	// did.PubKeyFromCrypto()
-	// pds.PLC.CreateDID(ctx, signingKey, req.RecoveryKey, handle.String(), pds.cfg.PublicURL())
-	return "", "", nil
+	return syntax.DID(did), op, nil
 }
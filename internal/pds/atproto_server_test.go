@@ -1,14 +1,20 @@
 package pds
 
 import (
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/matryer/is"
+	"github.com/pkg/errors"
 
 	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/accountstore"
 	"github.com/harrybrwn/at/internal/auth"
 	"github.com/harrybrwn/at/internal/cbor/dagcbor"
+	"github.com/harrybrwn/at/internal/mailer"
 	"github.com/harrybrwn/at/xrpc"
 )
 
@@ -110,3 +116,126 @@ func TestCreateSession(t *testing.T) {
 	is.Equal(acct.DID, session.DID)
 	is.Equal(session.Email, "me@test.local")
 }
+
+func TestCalculateCodesToCreate(t *testing.T) {
+	is := is.New(t)
+	const did = "did:plc:abc"
+	day := 24 * time.Hour
+	now := time.Now()
+	created := now.Add(-10 * day)
+	epoch := now.Add(-3*day - time.Hour)
+
+	// codes are earned from the later of the epoch and account creation
+	n, total := calculateCodesToCreate(did, created, nil, epoch, day, now)
+	is.Equal(n, 3)
+	is.Equal(total, 3)
+	codes := []accountstore.CodeDetail{
+		{InviteCode: accountstore.InviteCode{Code: "a", AvailableUses: 1, CreatedBy: did}},
+		{InviteCode: accountstore.InviteCode{Code: "b", AvailableUses: 5, CreatedBy: "admin"}},
+	}
+	n, total = calculateCodesToCreate(did, created, codes, epoch, day, now)
+	is.Equal(n, 2)
+	is.Equal(total, 3)
+
+	// unused codes are capped
+	n, _ = calculateCodesToCreate(did, created, nil, time.Time{}, day, now)
+	is.Equal(n, maxUnusedInviteCodes)
+	n, total = calculateCodesToCreate(did, created, codes, epoch, 0, now)
+	is.Equal(n, 0)
+	is.Equal(total, 1)
+}
+
+func TestEmailFlows(t *testing.T) {
+	is := is.New(t)
+	pds := testPDS(t, localhost)
+	ctx := t.Context()
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "email-user.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	ctx = auth.StashUser(ctx, &xrpc.Auth{DID: acct.DID.String(), Handle: acct.Handle.String()})
+	spool := pds.Mailer.Mailer.(*mailer.Spool)
+	tokenPattern := regexp.MustCompile(`[A-Z2-7]{5}-[A-Z2-7]{5}`)
+	lastToken := func(to string) string {
+		msgs, err := spool.Messages()
+		is.NoErr(err)
+		is.True(len(msgs) > 0)
+		last := msgs[len(msgs)-1]
+		is.Equal(last.To, to)
+		return tokenPattern.FindString(last.HTML)
+	}
+
+	_, err = pds.RequestEmailConfirmation(ctx)
+	is.NoErr(err)
+	_, err = pds.ConfirmEmail(ctx, &atproto.ServerConfirmEmailRequest{Email: "other@test.local", Token: lastToken("me@test.local")})
+	is.True(err != nil)
+	_, err = pds.ConfirmEmail(ctx, &atproto.ServerConfirmEmailRequest{Email: "me@test.local", Token: lastToken("me@test.local")})
+	is.NoErr(err)
+
+	// a confirmed email needs a token to change
+	_, err = pds.UpdateEmail(ctx, &atproto.ServerUpdateEmailRequest{Email: "new@test.local"})
+	is.True(err != nil)
+	update, err := pds.RequestEmailUpdate(ctx)
+	is.NoErr(err)
+	is.True(update.TokenRequired)
+	_, err = pds.UpdateEmail(ctx, &atproto.ServerUpdateEmailRequest{Email: "new@test.local", Token: lastToken("me@test.local")})
+	is.NoErr(err)
+
+	_, err = pds.RequestPasswordReset(ctx, &atproto.ServerRequestPasswordResetRequest{Email: "nobody@test.local"})
+	is.NoErr(err)
+	_, err = pds.RequestPasswordReset(ctx, &atproto.ServerRequestPasswordResetRequest{Email: "new@test.local"})
+	is.NoErr(err)
+	_, err = pds.ResetPassword(ctx, &atproto.ServerResetPasswordRequest{Token: lastToken("new@test.local"), Password: "testlab02"})
+	is.NoErr(err)
+	_, err = pds.CreateSession(ctx, &atproto.ServerCreateSessionRequest{Identifier: "email-user.test", Password: "testlab02"})
+	is.NoErr(err)
+}
+
+func TestDeactivateAccount(t *testing.T) {
+	is := is.New(t)
+	pds := testPDS(t, localhost)
+	ctx := t.Context()
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "deactivated-user.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	authed := auth.StashUser(ctx, &xrpc.Auth{DID: acct.DID.String(), Handle: acct.Handle.String()})
+	list := &atproto.RepoListRecordsParams{
+		Repo:       syntax.AtIdentifier{Inner: acct.DID},
+		Collection: "app.bsky.feed.post",
+	}
+
+	_, err = pds.DeactivateAccount(authed, &atproto.ServerDeactivateAccountRequest{DeleteAfter: "yesterday"})
+	is.True(err != nil)
+	deleteAfter := time.Now().Add(time.Hour).Format(time.RFC3339)
+	_, err = pds.DeactivateAccount(authed, &atproto.ServerDeactivateAccountRequest{DeleteAfter: deleteAfter})
+	is.NoErr(err)
+	_, err = pds.ListRecords(ctx, list)
+	var e *xrpc.ErrorResponse
+	is.True(errors.As(err, &e))
+	is.Equal(e.Code, xrpc.Code("RepoDeactivated"))
+	_, err = pds.ListRecords(authed, list)
+	is.NoErr(err)
+
+	status, err := pds.CheckAccountStatus(authed)
+	is.NoErr(err)
+	is.True(!status.Activated)
+	is.True(status.ValidDid)
+	is.True(status.RepoBlocks > 0)
+	is.True(len(status.RepoRev) > 0)
+	is.Equal(status.IndexedRecords, int64(0))
+
+	_, err = pds.ActivateAccount(authed)
+	is.NoErr(err)
+	_, err = pds.ListRecords(ctx, list)
+	is.NoErr(err)
+	rev := status.RepoRev
+	status, err = pds.CheckAccountStatus(authed)
+	is.NoErr(err)
+	is.True(status.Activated)
+	is.Equal(status.RepoRev, rev) // repos signed by this server are not re-signed
+}
@@ -1,10 +1,20 @@
 package pds
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"iter"
 
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	gocid "github.com/ipfs/go-cid"
+
 	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/actorstore"
+	"github.com/harrybrwn/at/internal/cid"
+	"github.com/harrybrwn/at/internal/repo"
+	"github.com/harrybrwn/at/xrpc"
 )
 
 func (pds *PDS) SubscribeRepos(ctx context.Context, params *atproto.SyncSubscribeReposParams) (iter.Seq[*atproto.SyncSubscribeReposUnion], error) {
@@ -30,6 +40,151 @@ func (pds *PDS) SubscribeRepos(ctx context.Context, params *atproto.SyncSubscrib
 	}, nil
 }
 
+// GetRepo exports a repo as a CAR file. The "since" parameter is not
+// supported yet so the whole repo is always returned.
+func (pds *PDS) GetRepo(ctx context.Context, params *atproto.SyncGetRepoParams) (io.ReadCloser, error) {
+	if _, err := pds.assertRepoAvailable(ctx, params.DID); err != nil {
+		return nil, err
+	}
+	key, err := pds.ActorStore.SigningKey(params.DID)
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to open repo").Wrap(err)
+	}
+	rr, err := pds.ActorStore.Repo(params.DID, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rr.Close()
+	root, err := rr.GetRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := rr.ListAllBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Taken down records are left out unless a live record shares their
+	// block. The tree still references them so the rest of the repo can be
+	// verified.
+	takendown, err := rr.ListTakendownRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range takendown {
+		blocks.Delete(c)
+	}
+	var buf bytes.Buffer
+	if err = repo.WriteCar(&buf, root, blocks); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// GetBlob returns the contents of a blob stored for a repo.
+func (pds *PDS) GetBlob(ctx context.Context, params *atproto.SyncGetBlobParams) (io.ReadCloser, error) {
+	if _, err := pds.assertRepoAvailable(ctx, params.DID); err != nil {
+		return nil, err
+	}
+	blobs, err := pds.ActorStore.Blob(params.DID, pds.newBlobstore(params.DID))
+	if err != nil {
+		return nil, err
+	}
+	defer blobs.Close()
+	_, _, stream, err := blobs.GetBlob(ctx, gocid.Cid(params.CID))
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// ListBlobs lists the blobs referenced by a repo's records. Taken down blobs
+// are left out.
+func (pds *PDS) ListBlobs(ctx context.Context, params *atproto.SyncListBlobsParams) (*atproto.SyncListBlobsResponse, error) {
+	if _, err := pds.assertRepoAvailable(ctx, params.DID); err != nil {
+		return nil, err
+	}
+	limit := 500
+	if params.Limit != nil {
+		limit = int(*params.Limit)
+	}
+	if limit < 1 || limit > 1000 {
+		return nil, xrpc.NewInvalidRequest("limit must be between 1 and 1000")
+	}
+	blobs, err := pds.ActorStore.Blob(params.DID, pds.newBlobstore(params.DID))
+	if err != nil {
+		return nil, err
+	}
+	defer blobs.Close()
+	list, err := blobs.ListBlobs(ctx, limit, &actorstore.ListBlobsOpts{
+		Since:  params.Since,
+		Cursor: params.Cursor,
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := atproto.SyncListBlobsResponse{CIDs: make([]cid.Cid, 0, len(list))}
+	for _, b := range list {
+		c, err := cid.Decode(b)
+		if err != nil {
+			return nil, xrpc.NewInternalError("Invalid blob cid").Wrap(err)
+		}
+		res.CIDs = append(res.CIDs, c)
+	}
+	if len(list) == limit {
+		res.Cursor = &list[len(list)-1]
+	}
+	return &res, nil
+}
+
+// syncGetRecord implements com.atproto.sync.getRecord, which has the same
+// method name as com.atproto.repo.getRecord.
+type syncGetRecord struct{ pds *PDS }
+
+// GetRecord returns a CAR file with the repo's current commit and the blocks
+// proving that a record is in it. Taken down records are not found.
+func (s *syncGetRecord) GetRecord(ctx context.Context, params *atproto.SyncGetRecordParams) (io.ReadCloser, error) {
+	pds := s.pds
+	if _, err := pds.assertRepoAvailable(ctx, params.DID); err != nil {
+		return nil, err
+	}
+	collection, rkey := string(params.Collection), string(params.RKey)
+	rr, err := pds.ActorStore.Record(params.DID)
+	if err != nil {
+		return nil, err
+	}
+	defer rr.Close()
+	uri := syntax.ATURI(fmt.Sprintf("at://%s/%s/%s", params.DID, collection, rkey))
+	rec, err := rr.GetRecord(ctx, uri, nil, false)
+	if err == nil && rec.TakedownRef.Valid {
+		err = errRecordTakenDown
+	}
+	if err != nil {
+		return nil, xrpc.Wrap(err, xrpc.RecordNotFound, "Could not locate record")
+	}
+	key, err := pds.ActorStore.SigningKey(params.DID)
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to open repo").Wrap(err)
+	}
+	repoReader, err := pds.ActorStore.Repo(params.DID, key)
+	if err != nil {
+		return nil, err
+	}
+	defer repoReader.Close()
+	root, blocks, err := repoReader.GetRecordProof(ctx, collection, rkey)
+	if err != nil {
+		return nil, xrpc.Wrap(err, xrpc.RecordNotFound, "Could not locate record")
+	}
+	var buf bytes.Buffer
+	if err = repo.WriteCar(&buf, root, blocks); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
 var (
 	_ atproto.SyncSubscribeRepos = (*PDS)(nil)
+	_ atproto.SyncGetRepo        = (*PDS)(nil)
+	_ atproto.SyncGetBlob        = (*PDS)(nil)
+	_ atproto.SyncListBlobs      = (*PDS)(nil)
+	_ atproto.SyncGetRecord      = (*syncGetRecord)(nil)
 )
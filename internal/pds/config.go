@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/url"
 	"path/filepath"
+	"time"
 )
 
 type EnvConfig struct {
@@ -22,6 +23,7 @@ type EnvConfig struct {
 	TermsOfServiceURL              string
 	ContactEmailAddress            string
 	AcceptingRepoImports           bool
+	DidWebAccounts                 bool
 	BlobUploadLimit                int
 	DevMode                        bool
 	LogEnabled                     bool   `env:"LOG_ENABLED,noprefix"`
@@ -49,11 +51,20 @@ type EnvConfig struct {
 	HandleBackupNameservers []string
 	EnableDIDDocWithSession bool
 	Entryway                *EnvEntrywayConfig
+	EntrywayHost            *EnvEntrywayHostConfig
 	Invite                  *EnvInviteConfig
 	Email                   struct {
+		// SmtpURL is where emails are sent. It may also be a file:// url
+		// for a directory to write emails to. Defaults to the "mail"
+		// directory in the data directory.
 		SmtpURL     string
 		FromAddress string
+		// TemplateDirectory holds email templates that replace the
+		// built in ones.
+		TemplateDirectory string
 	}
+	// ModerationEmail is used to send messages from moderators. Both
+	// fields default to the matching Email settings.
 	ModerationEmail struct {
 		SmtpURL string
 		Address string
@@ -81,9 +92,16 @@ type EnvConfig struct {
 		KmsKeyID          string
 		K256PrivateKeyHex string
 	}
-	FetchMaxResponseSize  int
+	// FetchMaxResponseSize is the largest response in bytes read when
+	// fetching did documents, handles and oauth client metadata.
+	FetchMaxResponseSize int
+	// DisableSSRFProtection allows requests to loopback and private
+	// addresses. It is only allowed in dev mode.
 	DisableSSRFProtection bool
 	Proxy                 EnvProxyConfig
+	// AdminAuditRetentionDays is how many days admin audit log entries are
+	// kept. Zero keeps them forever.
+	AdminAuditRetentionDays int
 }
 
 type ConfigService struct {
@@ -124,6 +142,24 @@ func (c *EnvConfig) InitDefaults() {
 	if c.BlobstoreS3 != nil && c.BlobstoreS3.UploadTimeoutMS == 0 {
 		c.BlobstoreS3.UploadTimeoutMS = 20000
 	}
+	if c.DIDCache.StaleTTL == 0 {
+		c.DIDCache.StaleTTL = int(time.Hour / time.Millisecond)
+	}
+	if c.DIDCache.MaxTTL == 0 {
+		c.DIDCache.MaxTTL = int(24 * time.Hour / time.Millisecond)
+	}
+	if c.FetchMaxResponseSize == 0 {
+		c.FetchMaxResponseSize = 512 * 1024 // 512kb
+	}
+	if c.Proxy.HeadersTimeout == 0 {
+		c.Proxy.HeadersTimeout = 10_000
+	}
+	if c.Proxy.BodyTimeout == 0 {
+		c.Proxy.BodyTimeout = 30_000
+	}
+	if c.Proxy.MaxResponseSize == 0 {
+		c.Proxy.MaxResponseSize = 10 * 1024 * 1024 // 10mb
+	}
 	if c.ActorStore.CacheSize == 0 {
 		c.ActorStore.CacheSize = 100
 	}
@@ -138,6 +174,11 @@ func (c *EnvConfig) InitDefaults() {
 	d(&c.AccountDBLocation, filepath.Join(c.DataDirectory, "account.sqlite"))
 	d(&c.SequencerDBLocation, filepath.Join(c.DataDirectory, "sequencer.sqlite"))
 	d(&c.DIDCacheDBLocation, filepath.Join(c.DataDirectory, "did_cache.sqlite"))
+	d(&c.Email.SmtpURL, "file://"+filepath.Join(c.DataDirectory, "mail"))
+	d(&c.Email.TemplateDirectory, filepath.Join(c.DataDirectory, "email_templates"))
+	d(&c.Email.FromAddress, "noreply@"+c.Hostname)
+	d(&c.ModerationEmail.SmtpURL, c.Email.SmtpURL)
+	d(&c.ModerationEmail.Address, c.Email.FromAddress)
 	d(&c.LogLevel, "info")
 }
 
@@ -156,6 +197,20 @@ func (c *EnvConfig) Validate() error {
 	if len(c.DataDirectory) == 0 {
 		return errors.New("PDS_DATA_DIRECTORY is required")
 	}
+	if c.DisableSSRFProtection && !c.DevMode {
+		return errors.New("PDS_DISABLE_SSRF_PROTECTION is only allowed with PDS_DEV_MODE")
+	}
+	if c.BehindEntryway() && len(c.Entryway.JWTVerifyKeyK256PublicKeyHex) == 0 {
+		return errors.New("PDS_ENTRYWAY_JWT_VERIFY_KEY_K256_PUBLIC_KEY_HEX is required behind an entryway")
+	}
+	if c.IsEntryway() {
+		if c.BehindEntryway() {
+			return errors.New("an entryway cannot also be behind an entryway")
+		}
+		if len(c.EntrywayHost.JWTSigningKeyK256PrivateKeyHex) == 0 {
+			return errors.New("PDS_ENTRYWAY_HOST_JWT_SIGNING_KEY_K256_PRIVATE_KEY_HEX is required for an entryway")
+		}
+	}
 	return nil
 }
 
@@ -166,19 +221,69 @@ func (c *EnvConfig) PublicURL() string {
 	return fmt.Sprintf("https://%s", c.Hostname)
 }
 
+// BehindEntryway returns true when this server is a PDS behind an entryway.
+func (c *EnvConfig) BehindEntryway() bool {
+	return c.Entryway != nil && c.Entryway.ConfigService != nil && len(c.Entryway.DID) > 0
+}
+
+// IsEntryway returns true when this server is an entryway for other PDSes.
+func (c *EnvConfig) IsEntryway() bool {
+	return c.EntrywayHost != nil && len(c.EntrywayHost.PDSHosts) > 0
+}
+
+// ServiceDID is the did of this server, falling back to a did:web of the
+// hostname.
+func (c *EnvConfig) ServiceDID() string {
+	if len(c.Service.DID) > 0 {
+		return c.Service.DID
+	}
+	return "did:web:" + c.Hostname
+}
+
+// EnvProxyConfig controls how requests are proxied to other services.
 type EnvProxyConfig struct {
-	AllowHTTP2       bool
-	HeadersTimeout   int
-	BodyTimeout      int
-	MaxResponseSize  int
-	MaxRetries       int
+	// AllowHTTP2 lets upstream connections use http/2.
+	AllowHTTP2 bool
+	// HeadersTimeout is how long to wait for upstream response headers in
+	// milliseconds.
+	HeadersTimeout int
+	// BodyTimeout is how long an upstream response body can take in
+	// milliseconds.
+	BodyTimeout int
+	// MaxResponseSize is the largest upstream response in bytes.
+	MaxResponseSize int
+	// MaxRetries is how many times a failed GET request is retried.
+	MaxRetries int
+	// PreferCompressed asks upstream services for compressed responses.
 	PreferCompressed bool
+	// AllowedMethods are nsid prefixes that may be proxied. Every method is
+	// allowed when it is empty.
+	AllowedMethods []string
+	// DeniedMethods are nsid prefixes that are never proxied.
+	DeniedMethods []string
 }
 
+// EnvEntrywayConfig is set when this server is a PDS behind an entryway. The
+// entryway's access tokens are trusted and account level calls are sent to
+// it.
 type EnvEntrywayConfig struct {
 	*ConfigService
-	JWTVerifyKeyK256PublicKeyHex string
-	PlcRotationKey               string
+	// JWTVerifyKeyK256PublicKeyHex is the hex encoded public key that the
+	// entryway signs access tokens with.
+	JWTVerifyKeyK256PublicKeyHex string `env:"JWT_VERIFY_KEY_K256_PUBLIC_KEY_HEX"`
+	// PlcRotationKey is the did:key of the entryway's plc rotation key. It is
+	// added to new dids so that the entryway can update handles.
+	PlcRotationKey string
+}
+
+// EnvEntrywayHostConfig is set when this server is an entryway. It owns
+// accounts, sessions and handles and puts the repos of new accounts on the
+// PDS in PDSHosts with the fewest accounts.
+type EnvEntrywayHostConfig struct {
+	PDSHosts []string
+	// JWTSigningKeyK256PrivateKeyHex signs access tokens and the service
+	// jwts sent to PDSHosts.
+	JWTSigningKeyK256PrivateKeyHex string `env:"JWT_SIGNING_KEY_K256_PRIVATE_KEY_HEX"`
 }
 
 type EnvInviteConfig struct {
@@ -0,0 +1,17 @@
+package pds
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestConfigValidate(t *testing.T) {
+	is := is.New(t)
+	conf := EnvConfig{DataDirectory: t.TempDir()}
+	is.NoErr(conf.Validate())
+	conf.DisableSSRFProtection = true
+	is.True(conf.Validate() != nil) // only in dev mode
+	conf.DevMode = true
+	is.NoErr(conf.Validate())
+}
@@ -0,0 +1,283 @@
+package pds
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/pkg/errors"
+
+	atpapi "github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/accountstore"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// entrywayMethods are the account level methods that a PDS behind an
+// entryway sends to the entryway.
+var entrywayMethods = []xrpc.Method{
+	xrpc.NewMethod("com.atproto.identity.updateHandle", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.confirmEmail", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.createAppPassword", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.createSession", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.deleteSession", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.getAccountInviteCodes", xrpc.Query),
+	xrpc.NewMethod("com.atproto.server.getSession", xrpc.Query),
+	xrpc.NewMethod("com.atproto.server.listAppPasswords", xrpc.Query),
+	xrpc.NewMethod("com.atproto.server.refreshSession", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.requestEmailConfirmation", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.requestEmailUpdate", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.requestPasswordReset", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.resetPassword", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.revokeAppPassword", xrpc.Procedure),
+	xrpc.NewMethod("com.atproto.server.updateEmail", xrpc.Procedure),
+}
+
+// forwardToEntryway sends the account level methods to the entryway. The
+// caller's access token is forwarded untouched since the entryway issued it.
+func (pds *PDS) forwardToEntryway(srv *xrpc.Server) {
+	scheme := "https"
+	if u, err := url.Parse(pds.cfg.Entryway.URL); err == nil && len(u.Scheme) > 0 {
+		scheme = u.Scheme
+	}
+	p := pds.entrywayPipethrough()
+	p.Host = pds.cfg.Entryway.URLHost()
+	p.Scheme = scheme
+	for _, m := range entrywayMethods {
+		srv.AddHandler(m, p)
+	}
+}
+
+// entrywayPipethrough creates the proxy used between an entryway and its
+// PDSes. Repo exports and blobs go through it, so unlike the proxy to other
+// services there is no limit on the size of a response or how long its body
+// takes.
+func (pds *PDS) entrywayPipethrough() *xrpc.Pipethrough {
+	return &xrpc.Pipethrough{
+		Client:           newPipethroughClient(&pds.cfg.Proxy, false),
+		Logger:           pds.logger,
+		HeadersTimeout:   time.Duration(pds.cfg.Proxy.HeadersTimeout) * time.Millisecond,
+		MaxRetries:       pds.cfg.Proxy.MaxRetries,
+		PreferCompressed: pds.cfg.Proxy.PreferCompressed,
+	}
+}
+
+// routeToAccountPDS returns middleware that sends requests for accounts
+// whose repo lives on another PDS to that PDS. Requests are routed by their
+// "repo" or "did" parameter, falling back to the authenticated account. The
+// caller's credentials are replaced with a service jwt for the account. It
+// does nothing unless this server is an entryway.
+func (pds *PDS) routeToAccountPDS() func(http.Handler) http.Handler {
+	if !pds.cfg.IsEntryway() {
+		return func(h http.Handler) http.Handler { return h }
+	}
+	p := pds.entrywayPipethrough()
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			user := auth.UserFromContext(ctx)
+			did := r.URL.Query().Get("repo")
+			if len(did) == 0 {
+				did = r.URL.Query().Get("did")
+			}
+			if len(did) == 0 && user != nil {
+				did = user.DID
+			}
+			if len(did) == 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if !strings.HasPrefix(did, "did:") {
+				acct, err := pds.Accounts.GetAccount(ctx, did, nil)
+				if err != nil {
+					h.ServeHTTP(w, r)
+					return
+				}
+				did = acct.DID
+			}
+			host, err := pds.Accounts.GetAccountPDS(ctx, did)
+			if errors.Is(err, accountstore.ErrNoPDS) {
+				h.ServeHTTP(w, r)
+				return
+			} else if err != nil {
+				xrpc.WriteError(pds.logger, w, err, xrpc.InternalServerError)
+				return
+			}
+			base, err := url.Parse(host)
+			if err != nil {
+				xrpc.WriteError(pds.logger, w, xrpc.NewInternalError("Invalid pds url for %s", did).Wrap(err), "")
+				return
+			}
+			req := r.Clone(ctx)
+			req.Header.Del("Authorization")
+			req.Header.Del("DPoP")
+			if user != nil && len(user.DID) > 0 {
+				token, err := pds.accountServiceJwt(ctx, user.DID, host, path.Base(r.URL.Path))
+				if err != nil {
+					xrpc.WriteError(pds.logger, w, err, "")
+					return
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			p.Forward(w, req, base)
+		})
+	}
+}
+
+// accountServiceJwt creates a short lived token that lets the entryway call
+// a method on a PDS for one of its accounts. App password scopes are kept so
+// that the PDS applies the same restrictions.
+func (pds *PDS) accountServiceJwt(ctx context.Context, did, host, lxm string) (string, error) {
+	scope := auth.ScopeAccess
+	switch s := auth.TokenScope(auth.TokenFromContext(ctx)); s {
+	case auth.ScopeAppPass, auth.ScopeAppPassPrivileged:
+		scope = s
+	}
+	token, err := auth.CreateServiceJwt(&auth.ServiceJwtOpts{
+		Iss:     pds.cfg.ServiceDID(),
+		Aud:     pdsServiceDID(host),
+		LXM:     &lxm,
+		KeyPair: pds.entrywayKey,
+		Sub:     did,
+		Scope:   scope,
+	})
+	if err != nil {
+		return "", xrpc.NewInternalError("Failed to create service token").Wrap(err)
+	}
+	return token, nil
+}
+
+// pushHandle tells the PDS holding an account's repo about a new handle. The
+// entryway has already updated the did so the PDS only updates its own
+// records and the firehose.
+func (pds *PDS) pushHandle(ctx context.Context, did syntax.DID, handle syntax.Handle) error {
+	host, err := pds.Accounts.GetAccountPDS(ctx, did.String())
+	if errors.Is(err, accountstore.ErrNoPDS) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lxm := "com.atproto.admin.updateAccountHandle"
+	token, err := auth.CreateServiceJwt(&auth.ServiceJwtOpts{
+		Iss:     pds.cfg.ServiceDID(),
+		Aud:     pdsServiceDID(host),
+		LXM:     &lxm,
+		KeyPair: pds.entrywayKey,
+	})
+	if err != nil {
+		return xrpc.NewInternalError("Failed to create service token").Wrap(err)
+	}
+	client := xrpc.NewClient(xrpc.WithURL(host), xrpc.WithClient(pds.serviceClient), xrpc.WithJwt(token))
+	_, err = atpapi.NewAdminClient(client).UpdateAccountHandle(ctx, &atpapi.AdminUpdateAccountHandleRequest{
+		DID:    did,
+		Handle: handle,
+	})
+	if err != nil {
+		return xrpc.Wrap(err, xrpc.UpstreamFailure, "Failed to update handle on pds")
+	}
+	return nil
+}
+
+// entrywayOrAdmin lets the entryway call an admin method with a service jwt.
+// Everyone else needs the admin password.
+func (pds *PDS) entrywayOrAdmin(serviceJwt, adminOnly func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fromEntryway := serviceJwt(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := auth.UserFromContext(r.Context())
+			if user == nil || user.DID != pds.cfg.Entryway.DID {
+				xrpc.WriteError(pds.logger, w, xrpc.NewAuthRequired("Only the entryway can use a service token here"), "")
+				return
+			}
+			h.ServeHTTP(w, r)
+		}))
+		admin := adminOnly(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				fromEntryway.ServeHTTP(w, r)
+				return
+			}
+			admin.ServeHTTP(w, r)
+		})
+	}
+}
+
+// createEntrywayAccount creates the repo of a new account on the entryway's
+// least used PDS and keeps the account's password, email and handle here.
+func (pds *PDS) createEntrywayAccount(
+	ctx context.Context,
+	req *atpapi.ServerCreateAccountRequest,
+) (*atpapi.ServerCreateAccountResponse, error) {
+	if len(req.DID) > 0 {
+		return nil, xrpc.NewInvalidRequest("Existing accounts cannot be moved to an entryway")
+	}
+	handle, err := validateNewAccount(ctx, pds, req, true)
+	if err != nil {
+		return nil, err
+	}
+	host, err := pds.Accounts.LeastUsedPDS(ctx, pds.cfg.EntrywayHost.PDSHosts)
+	if err != nil {
+		return nil, xrpc.NewInternalError("Account creation failed").Wrap(err)
+	}
+	lxm := "com.atproto.server.createAccount"
+	token, err := auth.CreateServiceJwt(&auth.ServiceJwtOpts{
+		Iss:     pds.cfg.ServiceDID(),
+		Aud:     pdsServiceDID(host),
+		LXM:     &lxm,
+		KeyPair: pds.entrywayKey,
+	})
+	if err != nil {
+		return nil, xrpc.NewInternalError("Failed to create service token").Wrap(err)
+	}
+	// The PDS never checks this password since sessions are created here.
+	password, err := auth.GenerateJTI()
+	if err != nil {
+		return nil, xrpc.NewInternalError("Account creation failed").Wrap(err)
+	}
+	client := xrpc.NewClient(xrpc.WithURL(host), xrpc.WithClient(pds.serviceClient), xrpc.WithJwt(token))
+	created, err := atpapi.NewServerClient(client).CreateAccount(ctx, &atpapi.ServerCreateAccountRequest{
+		Email:       req.Email,
+		Handle:      handle,
+		Password:    password,
+		RecoveryKey: req.RecoveryKey,
+	})
+	if err != nil {
+		return nil, xrpc.Wrap(err, xrpc.UpstreamFailure, "Failed to create account on pds")
+	}
+
+	var inviteCode *string
+	if len(req.InviteCode) > 0 {
+		inviteCode = &req.InviteCode
+	}
+	accessJwt, refreshJwt, err := pds.Accounts.CreateAccount(ctx, accountstore.CreateAccountOpts{
+		DID:        created.DID.String(),
+		Handle:     handle.String(),
+		Email:      &req.Email,
+		Password:   &req.Password,
+		InviteCode: inviteCode,
+		PDS:        host,
+	})
+	if err != nil {
+		pds.logger.Error("repo was created without an account",
+			"did", created.DID, "pds", host, "error", err)
+		return nil, err
+	}
+	return &atpapi.ServerCreateAccountResponse{
+		AccessJwt:  accessJwt,
+		RefreshJwt: refreshJwt,
+		DID:        created.DID,
+		Handle:     handle,
+	}, nil
+}
+
+// pdsServiceDID is the did:web of the PDS at a url.
+func pdsServiceDID(pdsURL string) string {
+	u, err := url.Parse(pdsURL)
+	if err != nil {
+		return ""
+	}
+	return "did:web:" + strings.ReplaceAll(u.Host, ":", "%3A")
+}
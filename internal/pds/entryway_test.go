@@ -0,0 +1,172 @@
+package pds
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/matryer/is"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+func TestEntryway(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	pub, err := key.PublicKey()
+	is.NoErr(err)
+
+	pdsSrv, entrywaySrv := xrpc.NewServer(), xrpc.NewServer()
+	pdsTS, entrywayTS := httptest.NewServer(pdsSrv), httptest.NewServer(entrywaySrv)
+	t.Cleanup(pdsTS.Close)
+	t.Cleanup(entrywayTS.Close)
+	backend := testPDS(t, localhost, func(c *EnvConfig) {
+		c.Service.DID = pdsServiceDID(pdsTS.URL)
+		c.Entryway = &EnvEntrywayConfig{
+			ConfigService:                &ConfigService{URL: entrywayTS.URL, DID: "did:web:entryway.test"},
+			JWTVerifyKeyK256PublicKeyHex: hex.EncodeToString(pub.Bytes()),
+		}
+	})
+	backend.Apply(pdsSrv)
+	entryway := testPDS(t, localhost, func(c *EnvConfig) {
+		c.Service.DID = "did:web:entryway.test"
+		c.EntrywayHost = &EnvEntrywayHostConfig{
+			PDSHosts:                       []string{pdsTS.URL},
+			JWTSigningKeyK256PrivateKeyHex: hex.EncodeToString(key.Bytes()),
+		}
+	})
+	entryway.Apply(entrywaySrv)
+
+	acct, err := entryway.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "alice@test.local",
+		Handle:   "alice.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	host, err := entryway.Accounts.GetAccountPDS(ctx, acct.DID.String())
+	is.NoErr(err)
+	is.Equal(host, pdsTS.URL)
+	// the repo lives on the pds
+	_, err = backend.ActorStore.SigningKey(acct.DID)
+	is.NoErr(err)
+	_, err = entryway.ActorStore.SigningKey(acct.DID)
+	is.True(err != nil)
+
+	// only the entryway can create accounts on the pds
+	_, err = backend.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "bob@test.local",
+		Handle:   "bob.test",
+		Password: "testlab01",
+	})
+	is.True(err != nil)
+
+	// the pds trusts the entryway's access tokens
+	cli := xrpc.NewClient(xrpc.WithURL(pdsTS.URL), xrpc.WithClient(pdsTS.Client()), xrpc.WithJwt(acct.AccessJwt))
+	status, err := atproto.NewServerClient(cli).CheckAccountStatus(ctx)
+	is.NoErr(err)
+	is.True(status.Activated)
+
+	// logins through the pds are sent to the entryway
+	cli = xrpc.NewClient(xrpc.WithURL(pdsTS.URL), xrpc.WithClient(pdsTS.Client()))
+	session, err := atproto.NewServerClient(cli).CreateSession(ctx, &atproto.ServerCreateSessionRequest{
+		Identifier: "alice.test",
+		Password:   "testlab01",
+	})
+	is.NoErr(err)
+	is.Equal(session.DID, acct.DID)
+	_, err = atproto.NewServerClient(cli).CreateSession(ctx, &atproto.ServerCreateSessionRequest{
+		Identifier: "alice.test",
+		Password:   "wrong",
+	})
+	is.True(err != nil)
+
+	// repo calls made to the entryway end up on the pds
+	entryway.PLC = backend.PLC
+	cli = xrpc.NewClient(xrpc.WithURL(entrywayTS.URL), xrpc.WithClient(entrywayTS.Client()), xrpc.WithJwt(acct.AccessJwt))
+	body, err := cli.Procedure(ctx, &xrpc.Request{
+		NSID:        "com.atproto.repo.createRecord",
+		ContentType: "application/json",
+		Body: strings.NewReader(fmt.Sprintf(`{
+			"repo": %q,
+			"collection": "app.bsky.feed.post",
+			"record": {"$type": "app.bsky.feed.post", "text": "hello", "createdAt": "2025-01-01T00:00:00Z"}
+		}`, acct.DID)),
+	})
+	is.NoErr(err)
+	var created struct {
+		URI string `json:"uri"`
+	}
+	is.NoErr(json.NewDecoder(body).Decode(&created))
+	is.NoErr(body.Close())
+	for _, ts := range []*httptest.Server{pdsTS, entrywayTS} {
+		c := xrpc.NewClient(xrpc.WithURL(ts.URL), xrpc.WithClient(ts.Client()))
+		body, err = c.Query(ctx, &xrpc.Request{
+			NSID: "com.atproto.repo.getRecord",
+			Params: url.Values{
+				"repo":       {acct.DID.String()},
+				"collection": {"app.bsky.feed.post"},
+				"rkey":       {path.Base(created.URI)},
+			},
+		})
+		is.NoErr(err)
+		is.NoErr(body.Close())
+	}
+	_, err = entryway.ActorStore.SigningKey(acct.DID)
+	is.True(err != nil)
+
+	// handle changes are pushed to the pds
+	_, err = atproto.NewIdentityClient(cli).UpdateHandle(ctx, &atproto.IdentityUpdateHandleRequest{Handle: "alice2.test"})
+	is.NoErr(err)
+	for _, p := range []*PDS{entryway, backend} {
+		a, err := p.Accounts.GetAccount(ctx, acct.DID.String(), nil)
+		is.NoErr(err)
+		is.Equal(a.Handle.String, "alice2.test")
+	}
+}
+
+func TestRouteToAccountPDSLargeResponse(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	car := bytes.Repeat([]byte("repo"), 64*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+		for chunk := range slices.Chunk(car, 4096) {
+			_, _ = w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	entryway := testPDS(t, localhost, func(c *EnvConfig) {
+		c.Service.DID = "did:web:entryway.test"
+		c.EntrywayHost = &EnvEntrywayHostConfig{
+			PDSHosts:                       []string{upstream.URL},
+			JWTSigningKeyK256PrivateKeyHex: hex.EncodeToString(key.Bytes()),
+		}
+		c.Proxy.MaxResponseSize = 1024
+		c.Proxy.BodyTimeout = 1
+	})
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	is.NoErr(entryway.Accounts.SetAccountPDS(ctx, did, upstream.URL))
+
+	h := entryway.routeToAccountPDS()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request was not sent to the account's pds")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.sync.getRepo?did="+did, nil))
+	is.Equal(rec.Code, http.StatusOK)
+	is.Equal(rec.Body.Len(), len(car)) // the proxy limits don't apply
+}
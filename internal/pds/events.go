@@ -1,9 +1,11 @@
 package pds
 
 import (
+	"context"
 	"time"
 
 	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/sequencer"
 )
 
 // type Event repo.Event[atproto.SyncSubscribeReposUnion]
@@ -46,3 +48,18 @@ func (e *Event) SetTime(tm time.Time) {
 	case e.SyncSubscribeReposInfo != nil:
 	}
 }
+
+// sequence publishes events to the firehose in order.
+func (pds *PDS) sequence(ctx context.Context, events ...*Event) error {
+	pub, err := pds.Bus.Publisher(ctx)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	for _, e := range events {
+		if err = pub.Pub(ctx, sequencer.NewEvent(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
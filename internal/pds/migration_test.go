@@ -0,0 +1,236 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/atp"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/internal/cid"
+	"github.com/harrybrwn/at/internal/mailer"
+	"github.com/harrybrwn/at/internal/repo"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+func TestMigrateAccount(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	directory := newPlcDirectory(t)
+	oldPDS := directory.attach(testPDS(t, withHost("old.test")))
+	newPDS := directory.attach(testPDS(t, withHost("new.test")))
+
+	acct, err := oldPDS.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "alice.old.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	did := acct.DID
+	oldAuth := auth.StashUser(ctx, &xrpc.Auth{DID: did.String(), Handle: acct.Handle.String()})
+	blob, err := oldPDS.UploadBlob(context.WithValue(oldAuth, contentTypeKey{}, "text/markdown"), strings.NewReader("hello world"))
+	is.NoErr(err)
+	is.Equal(blob.Blob.MimeType, "text/markdown") // declared types are kept
+	postURI := createImagePost(t, oldPDS, did, "3lbtyr7ezgb2a", blob)
+
+	// create the account on the new server
+	lxm := syntax.NSID("com.atproto.server.createAccount")
+	serviceAuth, err := oldPDS.GetServiceAuth(oldAuth, &atproto.ServerGetServiceAuthParams{
+		Aud: syntax.DID(newPDS.cfg.ServiceDID()),
+		Lxm: &lxm,
+	})
+	is.NoErr(err)
+	iss, err := auth.VerifyServiceJwt(ctx, newPDS.Resolver, serviceAuth.Token, newPDS.cfg.ServiceDID(), lxm.String())
+	is.NoErr(err)
+	is.Equal(iss, did.String())
+	_, err = auth.VerifyServiceJwt(ctx, newPDS.Resolver, serviceAuth.Token, oldPDS.cfg.ServiceDID(), lxm.String())
+	is.True(err != nil) // wrong audience
+	reserved, err := newPDS.ReserveSigningKey(ctx, &atproto.ServerReserveSigningKeyRequest{DID: did})
+	is.NoErr(err)
+	newAuth := auth.StashUser(ctx, &xrpc.Auth{DID: iss})
+	_, err = newPDS.CreateAccount(newAuth, &atproto.ServerCreateAccountRequest{
+		DID:      did,
+		Email:    "me@test.local",
+		Handle:   "alice.new.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	newAuth = auth.StashUser(ctx, &xrpc.Auth{DID: did.String(), Handle: "alice.new.test"})
+	status, err := newPDS.CheckAccountStatus(newAuth)
+	is.NoErr(err)
+	is.True(!status.Activated)
+	is.True(!status.ValidDid)
+
+	// move the repo and blobs
+	car, err := oldPDS.GetRepo(ctx, &atproto.SyncGetRepoParams{DID: did})
+	is.NoErr(err)
+	_, err = newPDS.ImportRepo(newAuth, car)
+	is.NoErr(err)
+	missing, err := newPDS.ListMissingBlobs(newAuth, &atproto.RepoListMissingBlobsParams{})
+	is.NoErr(err)
+	is.Equal(len(missing.Blobs), 1)
+	is.Equal(missing.Blobs[0].CID.String(), blob.Blob.Ref.String())
+	is.Equal(missing.Blobs[0].RecordUri, postURI)
+	stream, err := oldPDS.GetBlob(ctx, &atproto.SyncGetBlobParams{DID: did, CID: cid.Cid(blob.Blob.Ref)})
+	is.NoErr(err)
+	uploaded, err := newPDS.UploadBlob(newAuth, stream)
+	is.NoErr(err)
+	is.NoErr(stream.Close())
+	is.Equal(uploaded.Blob.Ref.String(), blob.Blob.Ref.String())
+	is.Equal(uploaded.Blob.MimeType, "text/plain; charset=utf-8") // sniffed without a declared type
+	missing, err = newPDS.ListMissingBlobs(newAuth, &atproto.RepoListMissingBlobsParams{})
+	is.NoErr(err)
+	is.Equal(len(missing.Blobs), 0)
+
+	// point the did at the new server
+	creds, err := newPDS.GetRecommendedDidCredentials(newAuth)
+	is.NoErr(err)
+	is.Equal(creds.VerificationMethods.(map[string]string)["atproto"], reserved.SigningKey)
+	_, err = oldPDS.RequestPlcOperationSignature(oldAuth)
+	is.NoErr(err)
+	_, err = oldPDS.SignPlcOperation(oldAuth, &atproto.IdentitySignPlcOperationRequest{Token: "AAAAA-AAAAA"})
+	is.True(err != nil)
+	signed, err := oldPDS.SignPlcOperation(oldAuth, &atproto.IdentitySignPlcOperationRequest{
+		Token:               lastMailToken(t, oldPDS),
+		RotationKeys:        creds.RotationKeys,
+		AlsoKnownAs:         creds.AlsoKnownAs,
+		VerificationMethods: creds.VerificationMethods,
+		Services:            creds.Services,
+	})
+	is.NoErr(err)
+	_, err = newPDS.SubmitPlcOperation(newAuth, &atproto.IdentitySubmitPlcOperationRequest{Operation: signed.Operation})
+	is.NoErr(err)
+	doc, err := newPDS.Resolver.GetDocument(ctx, did.String())
+	is.NoErr(err)
+	ident := identity.ParseIdentity(atp.ConvertDidDoc(doc))
+	is.Equal(ident.PDSEndpoint(), newPDS.cfg.PublicURL())
+
+	_, err = newPDS.ActivateAccount(newAuth)
+	is.NoErr(err)
+	// the head is re-signed with the new server's key
+	car, err = newPDS.GetRepo(ctx, &atproto.SyncGetRepoParams{DID: did})
+	is.NoErr(err)
+	root, blocks, err := repo.ReadCar(car)
+	is.NoErr(err)
+	is.NoErr(car.Close())
+	report := repo.Verify(ctx, root, blocks, newPDS.repoSigningKey)
+	is.True(report.OK()) // report.Problems
+	is.Equal(report.Records, 1)
+	_, err = oldPDS.DeactivateAccount(oldAuth, &atproto.ServerDeactivateAccountRequest{})
+	is.NoErr(err)
+	status, err = newPDS.CheckAccountStatus(newAuth)
+	is.NoErr(err)
+	is.True(status.Activated)
+	is.True(status.ValidDid)
+	is.Equal(status.ImportedBlobs, int64(1))
+	status, err = oldPDS.CheckAccountStatus(oldAuth)
+	is.NoErr(err)
+	is.True(!status.Activated)
+	is.True(!status.ValidDid)
+}
+
+func lastMailToken(t *testing.T, pds *PDS) string {
+	t.Helper()
+	msgs, err := pds.Mailer.Mailer.(*mailer.Spool).Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) == 0 {
+		t.Fatal("no mail was sent")
+	}
+	return regexp.MustCompile(`[A-Z2-7]{5}-[A-Z2-7]{5}`).FindString(msgs[len(msgs)-1].HTML)
+}
+
+// plcDirectory is an in-memory stand-in for plc.directory.
+type plcDirectory struct {
+	mu  sync.Mutex
+	ops map[string][]*atp.PlcOperation
+	url *url.URL
+}
+
+func newPlcDirectory(t *testing.T) *plcDirectory {
+	d := plcDirectory{ops: make(map[string][]*atp.PlcOperation)}
+	srv := httptest.NewServer(&d)
+	t.Cleanup(srv.Close)
+	d.url, _ = url.Parse(srv.URL)
+	return &d
+}
+
+// attach points a test server's plc client and did resolver at the
+// directory.
+func (d *plcDirectory) attach(pds *PDS) *PDS {
+	resolver := atp.Resolver{PlcURL: d.url, HttpClient: http.DefaultClient}
+	pds.PLC = &atp.PLC{Resolver: &resolver}
+	pds.Resolver = &resolver
+	return pds
+}
+
+func (d *plcDirectory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	did, last := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/log/last")
+	ops := d.ops[did]
+	switch r.Method {
+	case http.MethodGet:
+		if len(ops) == 0 {
+			http.Error(w, "DID not registered", http.StatusNotFound)
+			return
+		}
+		var res any = ops[len(ops)-1]
+		if !last {
+			doc, err := ops[len(ops)-1].Document(did)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res = doc
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	case http.MethodPost:
+		var op atp.PlcOperation
+		if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := d.validate(did, &op, ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.ops[did] = append(ops, &op)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *plcDirectory) validate(did string, op *atp.PlcOperation, ops []*atp.PlcOperation) error {
+	if len(ops) == 0 {
+		genesis, err := op.DID()
+		if err != nil {
+			return err
+		}
+		if genesis != did {
+			return errors.Errorf("genesis operation is for %s", genesis)
+		}
+		return op.Verify(op.RotationKeys)
+	}
+	prev, err := ops[len(ops)-1].CID()
+	if err != nil {
+		return err
+	}
+	if op.Prev == nil || *op.Prev != prev.String() {
+		return errors.New("prev does not reference the last operation")
+	}
+	return op.Verify(ops[len(ops)-1].RotationKeys)
+}
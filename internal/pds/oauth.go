@@ -0,0 +1,572 @@
+package pds
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/accountstore"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/oauth"
+)
+
+const (
+	oauthRequestLifetime = 5 * time.Minute
+	oauthCodeLifetime    = time.Minute
+	oauthAccessLifetime  = time.Hour
+	oauthRefreshLifetime = 14 * 24 * time.Hour
+
+	deviceIDCookie   = "device-id"
+	sessionIDCookie  = "session-id"
+	requestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+)
+
+//go:embed templates/authorize.html
+var authorizePage string
+
+var authorizeTemplate = template.Must(template.New("authorize").Parse(authorizePage))
+
+// oauthParams are the parameters of a pushed authorization request. DPoPJKT
+// is the thumbprint of the key the client used for the request, tokens are
+// only issued to the same key.
+type oauthParams struct {
+	ClientID            string `json:"client_id"`
+	ResponseType        string `json:"response_type"`
+	ResponseMode        string `json:"response_mode,omitempty"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state,omitempty"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	LoginHint           string `json:"login_hint,omitempty"`
+	DPoPJKT             string `json:"dpop_jkt"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	Sub          string `json:"sub"`
+}
+
+// OAuthProtectedResource serves /.well-known/oauth-protected-resource. The
+// PDS is its own authorization server.
+func (pds *PDS) OAuthProtectedResource(w http.ResponseWriter, r *http.Request) {
+	u := pds.cfg.PublicURL()
+	writeJSON(w, http.StatusOK, &oauth.ProtectedResourceMetadata{
+		Resource:               u,
+		AuthorizationServers:   []string{u},
+		ScopesSupported:        auth.OAuthScopes,
+		BearerMethodsSupported: []string{"header"},
+	})
+}
+
+// OAuthAuthorizationServer serves /.well-known/oauth-authorization-server.
+func (pds *PDS) OAuthAuthorizationServer(w http.ResponseWriter, r *http.Request) {
+	u := pds.cfg.PublicURL()
+	writeJSON(w, http.StatusOK, &oauth.AuthorizationServerMetadata{
+		Issuer:                                     u,
+		AuthorizationEndpoint:                      u + "/oauth/authorize",
+		TokenEndpoint:                              u + "/oauth/token",
+		PushedAuthorizationRequestEndpoint:         u + "/oauth/par",
+		RevocationEndpoint:                         u + "/oauth/revoke",
+		RequirePushedAuthorizationRequests:         true,
+		ScopesSupported:                            auth.OAuthScopes,
+		ResponseTypesSupported:                     []string{"code"},
+		ResponseModesSupported:                     []string{"query", "fragment"},
+		GrantTypesSupported:                        []string{"authorization_code", "refresh_token"},
+		CodeChallengeMethodsSupported:              []string{"S256"},
+		TokenEndpointAuthMethodsSupported:          []string{"none"},
+		DPoPSigningAlgValuesSupported:              []string{"ES256"},
+		AuthorizationResponseIssParameterSupported: true,
+		ClientIDMetadataDocumentSupported:          true,
+	})
+}
+
+// OAuthPAR handles pushed authorization requests. Clients must push their
+// request before sending the user to the authorization page.
+func (pds *PDS) OAuthPAR(w http.ResponseWriter, r *http.Request) {
+	jkt, ok := pds.verifyOAuthDPoP(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "invalid form body")
+		return
+	}
+	params := oauthParams{
+		ClientID:            r.PostForm.Get("client_id"),
+		ResponseType:        r.PostForm.Get("response_type"),
+		ResponseMode:        r.PostForm.Get("response_mode"),
+		RedirectURI:         r.PostForm.Get("redirect_uri"),
+		Scope:               r.PostForm.Get("scope"),
+		State:               r.PostForm.Get("state"),
+		CodeChallenge:       r.PostForm.Get("code_challenge"),
+		CodeChallengeMethod: r.PostForm.Get("code_challenge_method"),
+		LoginHint:           r.PostForm.Get("login_hint"),
+		DPoPJKT:             r.PostForm.Get("dpop_jkt"),
+	}
+	client, err := oauth.FetchClientMetadata(r.Context(), pds.httpClient, params.ClientID)
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_client", err.Error())
+		return
+	}
+	if len(params.RedirectURI) == 0 && len(client.RedirectURIs) == 1 {
+		params.RedirectURI = client.RedirectURIs[0]
+	}
+	switch {
+	case params.ResponseType != "code":
+		oauthError(w, http.StatusBadRequest, "unsupported_response_type", "response_type must be code")
+	case !client.AllowsRedirect(params.RedirectURI):
+		oauthError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered by the client")
+	case params.ResponseMode != "" && params.ResponseMode != "query" && params.ResponseMode != "fragment":
+		oauthError(w, http.StatusBadRequest, "invalid_request", "unsupported response_mode")
+	case !slices.Contains(strings.Fields(params.Scope), auth.OAuthScopeAtproto):
+		oauthError(w, http.StatusBadRequest, "invalid_scope", `scope must include "atproto"`)
+	case !client.AllowsScope(params.Scope) || !supportedScopes(params.Scope):
+		oauthError(w, http.StatusBadRequest, "invalid_scope", "scope is not allowed for this client")
+	case params.CodeChallengeMethod != "S256" || len(params.CodeChallenge) == 0:
+		oauthError(w, http.StatusBadRequest, "invalid_request", "an S256 code_challenge is required")
+	case len(params.DPoPJKT) > 0 && params.DPoPJKT != jkt:
+		oauthError(w, http.StatusBadRequest, "invalid_dpop_proof", "dpop_jkt does not match the DPoP proof")
+	default:
+		params.DPoPJKT = jkt
+		raw, err := json.Marshal(&params)
+		if err != nil {
+			oauthServerError(w, pds, err)
+			return
+		}
+		id := requestURIPrefix + randomID("req-")
+		err = pds.Accounts.CreateAuthorizationRequest(r.Context(), &accountstore.AuthorizationRequest{
+			ID:         id,
+			ClientID:   params.ClientID,
+			ClientAuth: `{"method":"none"}`,
+			Parameters: string(raw),
+			ExpiresAt:  time.Now().Add(oauthRequestLifetime).UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			oauthServerError(w, pds, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{
+			"request_uri": id,
+			"expires_in":  int64(oauthRequestLifetime / time.Second),
+		})
+	}
+}
+
+type authorizePageData struct {
+	Client     string
+	Host       string
+	Scope      string
+	RequestURI string
+	LoginHint  string
+	Error      string
+	Accounts   []*accountstore.RememberedAccount
+}
+
+// OAuthAuthorize shows the sign in and consent page for a pushed
+// authorization request and handles its form submissions.
+func (pds *PDS) OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if origin := r.Header.Get("Origin"); len(origin) > 0 && origin != pds.cfg.PublicURL() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	requestURI := r.FormValue("request_uri")
+	req, err := pds.Accounts.GetAuthorizationRequest(ctx, requestURI)
+	if err != nil || req.Code.Valid {
+		http.Error(w, "Authorization request not found or expired", http.StatusBadRequest)
+		return
+	}
+	if clientID := r.FormValue("client_id"); r.Method == http.MethodGet && clientID != req.ClientID {
+		http.Error(w, "client_id does not match the authorization request", http.StatusBadRequest)
+		return
+	}
+	var params oauthParams
+	if err = json.Unmarshal([]byte(req.Parameters), &params); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	device, err := pds.oauthDevice(w, r)
+	if err != nil {
+		pds.logger.Error("failed to load oauth device", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := authorizePageData{
+		Client:     params.ClientID,
+		Host:       pds.cfg.Hostname,
+		Scope:      params.Scope,
+		RequestURI: requestURI,
+		LoginHint:  params.LoginHint,
+	}
+
+	var did string
+	switch r.PostForm.Get("action") {
+	case "":
+	case "deny":
+		_ = pds.Accounts.DeleteAuthorizationRequest(ctx, req.ID)
+		pds.oauthRedirect(w, r, &params, url.Values{
+			"error":             {"access_denied"},
+			"error_description": {"Access denied"},
+		})
+		return
+	case "login":
+		login, err := pds.Accounts.Login(ctx, r.PostForm.Get("identifier"), r.PostForm.Get("password"))
+		switch {
+		case err != nil:
+			data.Error = "Invalid identifier or password"
+		case login.AppPassword != nil:
+			data.Error = "App passwords can't be used to sign in here"
+		default:
+			did = login.User.DID
+			remember := r.PostForm.Get("remember") == "true"
+			if err = pds.Accounts.UpsertDeviceAccount(ctx, device.ID, did, remember, params.ClientID); err != nil {
+				oauthServerError(w, pds, err)
+				return
+			}
+		}
+	case "accept":
+		accounts, err := pds.Accounts.ListDeviceAccounts(ctx, device.ID)
+		if err != nil {
+			oauthServerError(w, pds, err)
+			return
+		}
+		for _, a := range accounts {
+			if a.DID == r.PostForm.Get("did") {
+				did = a.DID
+			}
+		}
+		if len(did) == 0 {
+			data.Error = "Please sign in again"
+		} else if err = pds.Accounts.UpsertDeviceAccount(ctx, device.ID, did, true, params.ClientID); err != nil {
+			oauthServerError(w, pds, err)
+			return
+		}
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if len(did) > 0 {
+		code := randomID("cod-")
+		err = pds.Accounts.AuthorizeRequest(ctx, req.ID, did, device.ID, code, time.Now().Add(oauthCodeLifetime))
+		if err != nil {
+			oauthServerError(w, pds, err)
+			return
+		}
+		pds.oauthRedirect(w, r, &params, url.Values{"code": {code}})
+		return
+	}
+	data.Accounts, err = pds.Accounts.ListDeviceAccounts(ctx, device.ID)
+	if err != nil {
+		oauthServerError(w, pds, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	if len(data.Error) > 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	if err = authorizeTemplate.Execute(w, &data); err != nil {
+		pds.logger.Error("failed to render authorize page", "error", err)
+	}
+}
+
+// OAuthToken exchanges authorization codes and refresh tokens for access
+// tokens.
+func (pds *PDS) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	jkt, ok := pds.verifyOAuthDPoP(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "invalid form body")
+		return
+	}
+	var (
+		params oauthParams
+		tok    *accountstore.Token
+		err    error
+	)
+	tokenID := randomID("tok-")
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		req, err := pds.Accounts.ConsumeAuthorizationCode(ctx, r.PostForm.Get("code"))
+		if err != nil || !req.DID.Valid {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+			return
+		}
+		if err = json.Unmarshal([]byte(req.Parameters), &params); err != nil {
+			oauthServerError(w, pds, err)
+			return
+		}
+		switch {
+		case r.PostForm.Get("client_id") != req.ClientID:
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "client_id does not match the code")
+			return
+		case r.PostForm.Get("redirect_uri") != params.RedirectURI:
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the code")
+			return
+		case params.DPoPJKT != jkt:
+			oauthError(w, http.StatusBadRequest, "invalid_dpop_proof", "DPoP key does not match the authorization request")
+			return
+		}
+		if err = oauth.VerifyPKCE(r.PostForm.Get("code_verifier"), params.CodeChallenge, params.CodeChallengeMethod); err != nil {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+		tok = &accountstore.Token{
+			DID:        req.DID.String,
+			TokenID:    tokenID,
+			ExpiresAt:  time.Now().Add(oauthRefreshLifetime).UTC().Format(time.RFC3339),
+			ClientID:   req.ClientID,
+			ClientAuth: req.ClientAuth,
+			DeviceID:   req.DeviceID,
+			Parameters: req.Parameters,
+			Code:       req.Code,
+		}
+		if err = pds.Accounts.CreateOAuthToken(ctx, tok); err != nil {
+			oauthServerError(w, pds, err)
+			return
+		}
+	case "refresh_token":
+		tok, err = pds.Accounts.RotateOAuthRefreshToken(
+			ctx,
+			r.PostForm.Get("refresh_token"),
+			tokenID,
+			time.Now().Add(oauthRefreshLifetime),
+		)
+		if err != nil {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "invalid refresh token")
+			return
+		}
+		if err = json.Unmarshal([]byte(tok.Parameters), &params); err != nil {
+			oauthServerError(w, pds, err)
+			return
+		}
+		if tok.ClientID != r.PostForm.Get("client_id") || params.DPoPJKT != jkt {
+			// The refresh token was used by someone else, end the session.
+			_ = pds.Accounts.RevokeOAuthToken(ctx, tokenID)
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "refresh token was issued to another client")
+			return
+		}
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "unsupported grant_type")
+		return
+	}
+
+	access, err := auth.CreateOAuthAccessToken(&auth.OAuthTokenOpts{
+		DID:        tok.DID,
+		ClientID:   tok.ClientID,
+		ServiceDID: pds.cfg.ServiceDID(),
+		Scope:      params.Scope,
+		JKT:        jkt,
+		TokenID:    tokenID,
+		JWTKey:     []byte(pds.cfg.JwtSecret),
+		ExpiresIn:  oauthAccessLifetime,
+	})
+	if err != nil {
+		oauthServerError(w, pds, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, &oauthTokenResponse{
+		AccessToken:  access,
+		TokenType:    "DPoP",
+		RefreshToken: tok.CurrentRefreshToken.String,
+		ExpiresIn:    int64(oauthAccessLifetime / time.Second),
+		Scope:        params.Scope,
+		Sub:          tok.DID,
+	})
+}
+
+// OAuthRevoke revokes an access or refresh token (RFC 7009).
+func (pds *PDS) OAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "invalid form body")
+		return
+	}
+	token := r.PostForm.Get("token")
+	if id, err := auth.ParseOAuthTokenID(token, []byte(pds.cfg.JwtSecret)); err == nil {
+		token = id
+	}
+	if err := pds.Accounts.RevokeOAuthToken(r.Context(), token); err != nil {
+		oauthServerError(w, pds, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// oauthTokenActive reports whether an oauth access token is still the
+// current one of its session. Revoking or refreshing a session invalidates
+// its older access tokens.
+func (pds *PDS) oauthTokenActive(ctx context.Context, tokenID string) (bool, error) {
+	_, err := pds.Accounts.GetOAuthToken(ctx, tokenID)
+	if errors.Is(err, accountstore.ErrOAuthTokenNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RunOAuthPurger deletes expired authorization requests every interval until
+// ctx is cancelled.
+func (pds *PDS) RunOAuthPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := pds.Accounts.DeleteExpiredAuthorizationRequests(ctx); err != nil {
+			pds.logger.Error("failed to purge expired authorization requests", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// verifyOAuthDPoP checks the DPoP proof sent to an oauth endpoint and returns
+// the thumbprint of its key.
+func (pds *PDS) verifyOAuthDPoP(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Set("DPoP-Nonce", pds.dpop.Nonce())
+	w.Header().Add("Access-Control-Expose-Headers", "DPoP-Nonce")
+	jkt, err := pds.dpop.Verify(r.Header.Get("DPoP"), r.Method, pds.cfg.PublicURL()+r.URL.Path, "")
+	if err != nil {
+		var dpopErr *auth.DPoPError
+		if !errors.As(err, &dpopErr) {
+			oauthServerError(w, pds, err)
+			return "", false
+		}
+		oauthError(w, http.StatusBadRequest, dpopErr.Code, dpopErr.Description)
+		return "", false
+	}
+	return jkt, true
+}
+
+// oauthDevice returns the device of the browser making the request, creating
+// a new one when the cookies are missing or stale.
+func (pds *PDS) oauthDevice(w http.ResponseWriter, r *http.Request) (*accountstore.Device, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	deviceID, _ := r.Cookie(deviceIDCookie)
+	sessionID, _ := r.Cookie(sessionIDCookie)
+	if deviceID != nil && sessionID != nil {
+		device, err := pds.Accounts.GetDevice(r.Context(), deviceID.Value, sessionID.Value)
+		if err == nil {
+			device.LastSeenAt = now
+			return device, pds.Accounts.UpsertDevice(r.Context(), device)
+		}
+	}
+	device := accountstore.Device{
+		ID:         randomID("dev-"),
+		SessionID:  randomID("ses-"),
+		IPAddress:  remoteIP(r),
+		LastSeenAt: now,
+	}
+	device.UserAgent.String = r.UserAgent()
+	device.UserAgent.Valid = len(device.UserAgent.String) > 0
+	if err := pds.Accounts.UpsertDevice(r.Context(), &device); err != nil {
+		return nil, err
+	}
+	secure := strings.HasPrefix(pds.cfg.PublicURL(), "https://")
+	for name, value := range map[string]string{deviceIDCookie: device.ID, sessionIDCookie: device.SessionID} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/oauth",
+			MaxAge:   int((365 * 24 * time.Hour) / time.Second),
+			HttpOnly: true,
+			Secure:   secure,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return &device, nil
+}
+
+// oauthRedirect sends the user back to the client.
+func (pds *PDS) oauthRedirect(w http.ResponseWriter, r *http.Request, params *oauthParams, values url.Values) {
+	u, err := url.Parse(params.RedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	values.Set("iss", pds.cfg.PublicURL())
+	if len(params.State) > 0 {
+		values.Set("state", params.State)
+	}
+	if params.ResponseMode == "fragment" {
+		u.Fragment = values.Encode()
+	} else {
+		q := u.Query()
+		for k, v := range values {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+func supportedScopes(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(auth.OAuthScopes, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func oauthServerError(w http.ResponseWriter, pds *PDS, err error) {
+	pds.logger.Error("oauth request failed", "error", err)
+	oauthError(w, http.StatusInternalServerError, "server_error", "Internal server error")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomID(prefix string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
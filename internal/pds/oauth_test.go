@@ -0,0 +1,189 @@
+package pds
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/oauth"
+)
+
+func TestOAuthFlow(t *testing.T) {
+	is := is.New(t)
+	pds := testPDS(t, localhost)
+	ctx := t.Context()
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "oauth-user.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	redirect := "http://127.0.0.1:8123/callback"
+	clientID := "http://localhost?" + url.Values{
+		"redirect_uri": {redirect},
+		"scope":        {"atproto transition:generic"},
+	}.Encode()
+	pkce, err := oauth.NewPKCE()
+	is.NoErr(err)
+
+	var nonce string
+	post := func(h http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+		proof, err := auth.CreateDPoPProof(key, http.MethodPost, pds.cfg.PublicURL()+path, nonce, "")
+		is.NoErr(err)
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("DPoP", proof)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		nonce = rec.Header().Get("DPoP-Nonce")
+		return rec
+	}
+	parForm := url.Values{
+		"client_id":             {clientID},
+		"response_type":         {"code"},
+		"redirect_uri":          {redirect},
+		"scope":                 {"atproto transition:generic"},
+		"state":                 {"xyz"},
+		"code_challenge":        {pkce.Challenge},
+		"code_challenge_method": {"S256"},
+	}
+	rec := post(pds.OAuthPAR, "/oauth/par", parForm)
+	is.Equal(rec.Code, http.StatusBadRequest)
+	is.True(strings.Contains(rec.Body.String(), "use_dpop_nonce"))
+	rec = post(pds.OAuthPAR, "/oauth/par", parForm)
+	is.Equal(rec.Code, http.StatusCreated)
+	var par struct {
+		RequestURI string `json:"request_uri"`
+	}
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&par))
+
+	page := httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+url.Values{
+		"client_id":   {clientID},
+		"request_uri": {par.RequestURI},
+	}.Encode(), nil)
+	rec = httptest.NewRecorder()
+	pds.OAuthAuthorize(rec, page)
+	is.Equal(rec.Code, http.StatusOK)
+	cookies := rec.Result().Cookies()
+	is.Equal(len(cookies), 2)
+
+	authorize := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		pds.OAuthAuthorize(rec, req)
+		return rec
+	}
+	rec = authorize(url.Values{
+		"request_uri": {par.RequestURI},
+		"action":      {"login"},
+		"identifier":  {"oauth-user.test"},
+		"password":    {"wrong"},
+	})
+	is.Equal(rec.Code, http.StatusUnauthorized)
+	rec = authorize(url.Values{
+		"request_uri": {par.RequestURI},
+		"action":      {"login"},
+		"identifier":  {"oauth-user.test"},
+		"password":    {"testlab01"},
+		"remember":    {"true"},
+	})
+	is.Equal(rec.Code, http.StatusSeeOther)
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	is.NoErr(err)
+	is.Equal(loc.Query().Get("state"), "xyz")
+	is.Equal(loc.Query().Get("iss"), pds.cfg.PublicURL())
+	code := loc.Query().Get("code")
+	is.True(len(code) > 0)
+
+	tokenForm := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirect},
+		"code":          {code},
+		"code_verifier": {"wrong-verifier-wrong-verifier-wrong-verifier"},
+	}
+	rec = post(pds.OAuthToken, "/oauth/token", tokenForm)
+	is.Equal(rec.Code, http.StatusBadRequest) // bad pkce uses up the code
+	rec = post(pds.OAuthToken, "/oauth/token", tokenForm)
+	is.Equal(rec.Code, http.StatusBadRequest)
+
+	// the remembered account can authorize a second request without a password
+	rec = post(pds.OAuthPAR, "/oauth/par", parForm)
+	is.Equal(rec.Code, http.StatusCreated)
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&par))
+	rec = authorize(url.Values{
+		"request_uri": {par.RequestURI},
+		"action":      {"accept"},
+		"did":         {acct.DID.String()},
+	})
+	is.Equal(rec.Code, http.StatusSeeOther)
+	loc, err = url.Parse(rec.Header().Get("Location"))
+	is.NoErr(err)
+	tokenForm.Set("code", loc.Query().Get("code"))
+	tokenForm.Set("code_verifier", pkce.Verifier)
+	rec = post(pds.OAuthToken, "/oauth/token", tokenForm)
+	is.Equal(rec.Code, http.StatusOK)
+	var tok oauthTokenResponse
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&tok))
+	is.Equal(tok.TokenType, "DPoP")
+	is.Equal(tok.Sub, acct.DID.String())
+
+	// access tokens work with the auth middleware
+	var user string
+	h := auth.Required(&auth.Opts{
+		Logger:           pds.logger,
+		JWTSecret:        []byte(pds.cfg.JwtSecret),
+		DPoP:             pds.dpop,
+		PublicURL:        pds.cfg.PublicURL(),
+		OAuthTokenActive: pds.oauthTokenActive,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = auth.UserFromContext(r.Context()).DID
+	}))
+	access := func(token string) int {
+		proof, err := auth.CreateDPoPProof(key, http.MethodGet, pds.cfg.PublicURL()+"/xrpc/com.atproto.repo.createRecord", nonce, token)
+		is.NoErr(err)
+		req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.repo.createRecord", nil)
+		req.Header.Set("Authorization", "DPoP "+token)
+		req.Header.Set("DPoP", proof)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	is.Equal(access(tok.AccessToken), http.StatusOK)
+	is.Equal(user, acct.DID.String())
+
+	refreshForm := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"refresh_token": {tok.RefreshToken},
+	}
+	rec = post(pds.OAuthToken, "/oauth/token", refreshForm)
+	is.Equal(rec.Code, http.StatusOK)
+	var refreshed oauthTokenResponse
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&refreshed))
+	is.True(refreshed.RefreshToken != tok.RefreshToken)
+	is.Equal(access(tok.AccessToken), http.StatusUnauthorized) // replaced by the refresh
+	is.Equal(access(refreshed.AccessToken), http.StatusOK)
+	rec = post(pds.OAuthToken, "/oauth/token", refreshForm)
+	is.Equal(rec.Code, http.StatusBadRequest) // replayed
+	refreshForm.Set("refresh_token", refreshed.RefreshToken)
+	rec = post(pds.OAuthToken, "/oauth/token", refreshForm)
+	is.Equal(rec.Code, http.StatusBadRequest) // session was revoked by the replay
+	is.Equal(access(refreshed.AccessToken), http.StatusUnauthorized)
+}
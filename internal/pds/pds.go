@@ -5,11 +5,11 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/events"
-	"github.com/bluesky-social/indigo/plc"
 
 	appbsky "github.com/harrybrwn/at/api/app/bsky"
 	atpapi "github.com/harrybrwn/at/api/com/atproto"
@@ -17,8 +17,11 @@ import (
 	"github.com/harrybrwn/at/internal/accountstore"
 	"github.com/harrybrwn/at/internal/actorstore"
 	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/internal/didcache"
+	"github.com/harrybrwn/at/internal/mailer"
 	"github.com/harrybrwn/at/internal/repo"
 	"github.com/harrybrwn/at/internal/sequencer"
+	"github.com/harrybrwn/at/internal/ssrf"
 	"github.com/harrybrwn/at/xrpc"
 )
 
@@ -29,11 +32,29 @@ type PDS struct {
 	Accounts       *accountstore.AccountStore
 	Passthrough    *xrpc.Client
 	Resolver       atp.DidResolver
-	PLC            plc.PLCClient
+	HandleResolver atp.HandleResolver
+	PLC            atp.PLCClient
 	Events         *events.EventManager
+	Mailer         *mailer.ServerMailer
+	// ModMailer sends messages from moderators.
+	ModMailer      *mailer.ModerationMailer
 	Bus            sequencer.Bus[*Event]
 	plcRotationKey *crypto.PrivateKeyK256
+	didCache       *didcache.DIDCache
 	pipethrough    *xrpc.Pipethrough
+	dpop           *auth.DPoPVerifier
+	// httpClient fetches user supplied urls.
+	httpClient *http.Client
+	// serviceClient talks to services from the config, which may be on a
+	// private network.
+	serviceClient *http.Client
+	// entrywayKey signs access tokens and service jwts when this server is
+	// an entryway.
+	entrywayKey *crypto.PrivateKeyK256
+	// entrywayPub checks tokens signed by the entryway.
+	entrywayPub *crypto.PublicKeyK256
+	// purge wakes up the account purger.
+	purge chan struct{}
 }
 
 func New(
@@ -43,20 +64,36 @@ func New(
 	accounts *accountstore.AccountStore,
 	bus sequencer.Bus[*Event],
 ) (*PDS, error) {
-	plcRotKeyRaw, err := hex.DecodeString(config.PlcRotationKey.K256PrivateKeyHex)
+	plcRotationKey, err := parseK256PrivateHex(config.PlcRotationKey.K256PrivateKeyHex)
 	if err != nil {
 		return nil, err
 	}
-	plcRotationKey, err := crypto.ParsePrivateBytesK256(plcRotKeyRaw)
+	plcURL, err := url.Parse(config.DidPlcURL)
 	if err != nil {
 		return nil, err
 	}
-	resolver := atp.Resolver{HttpClient: http.DefaultClient}
-	resolver.HandleResolver, err = atp.NewDefaultHandleResolver()
+	clientOpts := ssrf.ClientOpts{
+		MaxResponseSize: int64(config.FetchMaxResponseSize),
+		Unprotected:     config.DisableSSRFProtection,
+	}
+	if len(plcURL.Host) > 0 {
+		// The plc directory is configured by the operator and may be an
+		// internal mirror.
+		clientOpts.AllowedHosts = []string{plcURL.Host}
+	}
+	httpClient := ssrf.NewClient(&clientOpts)
+	resolver := atp.Resolver{HttpClient: httpClient, PlcURL: plcURL}
+	handles, err := atp.NewDefaultHandleResolver()
 	if err != nil {
 		return nil, err
 	}
-	resolver.PlcURL, err = url.Parse(config.DidPlcURL)
+	handles.SetHTTPClient(httpClient)
+	resolver.HandleResolver = handles
+	didCache, err := didcache.NewDIDCache(
+		config.DIDCacheDBLocation,
+		time.Duration(config.DIDCache.StaleTTL)*time.Millisecond,
+		time.Duration(config.DIDCache.MaxTTL)*time.Millisecond,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +101,25 @@ func New(
 	if err != nil {
 		return nil, err
 	}
+	transport, err := mailer.New(config.Email.SmtpURL)
+	if err != nil {
+		return nil, err
+	}
+	if spool, ok := transport.(*mailer.Spool); ok && !config.DevMode {
+		logger.Warn("email is written to a directory and never sent, set PDS_EMAIL_SMTP_URL to send it",
+			"directory", spool.Dir)
+	}
+	serverMailer, err := mailer.NewServerMailer(transport, config.Email.FromAddress, config.Email.TemplateDirectory)
+	if err != nil {
+		return nil, err
+	}
+	modTransport := transport
+	if config.ModerationEmail.SmtpURL != config.Email.SmtpURL {
+		modTransport, err = mailer.New(config.ModerationEmail.SmtpURL)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	pds := PDS{
 		logger:         logger,
@@ -71,70 +127,232 @@ func New(
 		ActorStore:     actorstore,
 		Accounts:       accounts,
 		Resolver:       &resolver,
+		HandleResolver: resolver.HandleResolver,
 		Bus:            seq,
+		Mailer:         serverMailer,
+		ModMailer: &mailer.ModerationMailer{
+			Mailer: modTransport,
+			From:   config.ModerationEmail.Address,
+		},
+		purge:          make(chan struct{}, 1),
 		plcRotationKey: plcRotationKey,
+		didCache:       didCache,
+		dpop:           auth.NewDPoPVerifier([]byte(config.JwtSecret)),
+		httpClient:     httpClient,
+		serviceClient:  ssrf.NewClient(&ssrf.ClientOpts{Unprotected: true}),
 		pipethrough: &xrpc.Pipethrough{
-			Host:   config.BskyAppView.URLHost(),
-			Client: resolver.HttpClient,
-			Logger: logger,
+			Host:             config.BskyAppView.URLHost(),
+			Client:           newPipethroughClient(&config.Proxy, !config.DisableSSRFProtection),
+			Logger:           logger,
+			HeadersTimeout:   time.Duration(config.Proxy.HeadersTimeout) * time.Millisecond,
+			BodyTimeout:      time.Duration(config.Proxy.BodyTimeout) * time.Millisecond,
+			MaxResponseSize:  int64(config.Proxy.MaxResponseSize),
+			MaxRetries:       config.Proxy.MaxRetries,
+			PreferCompressed: config.Proxy.PreferCompressed,
 		},
 	}
+	switch {
+	case config.IsEntryway():
+		pds.entrywayKey, err = parseK256PrivateHex(config.EntrywayHost.JWTSigningKeyK256PrivateKeyHex)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := pds.entrywayKey.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		pds.entrywayPub = pub.(*crypto.PublicKeyK256)
+		accounts.SetAccessTokenKey(pds.entrywayKey)
+	case config.BehindEntryway():
+		raw, err := hex.DecodeString(config.Entryway.JWTVerifyKeyK256PublicKeyHex)
+		if err != nil {
+			return nil, err
+		}
+		pds.entrywayPub, err = crypto.ParsePublicBytesK256(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if config.DevMode {
 		pds.PLC = &atp.FakePLC{Resolver: &resolver}
 		pds.Resolver = accountstore.NewResolver(pds.Accounts, config.Hostname)
 	} else {
 		pds.PLC = &atp.PLC{Resolver: &resolver}
+		pds.Resolver = &cachedResolver{
+			Resolver:       didcache.NewDIDResolver(&resolver, didCache),
+			HandleResolver: didcache.NewHandleResolver(&resolver, didCache),
+		}
 	}
 	return &pds, nil
 }
 
+func newPipethroughClient(cfg *EnvProxyConfig, protect bool) *http.Client {
+	transport := xrpc.NewPipethroughTransport(cfg.AllowHTTP2)
+	if protect {
+		ssrf.Protect(transport)
+	}
+	return &http.Client{
+		Transport: transport,
+		// Redirects are passed back to the client.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
 func (pds *PDS) Apply(srv *xrpc.Server, middleware ...func(http.Handler) http.Handler) {
 	opts := auth.Opts{
-		Logger:        pds.logger,
-		JWTSecret:     []byte(pds.cfg.JwtSecret),
-		AdminPassword: pds.cfg.AdminPassword,
-		Resolver:      pds.Resolver,
+		Logger:           pds.logger,
+		JWTSecret:        []byte(pds.cfg.JwtSecret),
+		AdminPassword:    pds.cfg.AdminPassword,
+		Resolver:         pds.Resolver,
+		ServiceDID:       pds.cfg.ServiceDID(),
+		DPoP:             pds.dpop,
+		PublicURL:        pds.cfg.PublicURL(),
+		EntrywayKey:      pds.entrywayPub,
+		OAuthTokenActive: pds.oauthTokenActive,
+	}
+	switch {
+	case pds.cfg.IsEntryway():
+		opts.EntrywayDID = pds.cfg.ServiceDID()
+	case pds.cfg.BehindEntryway():
+		opts.EntrywayDID = pds.cfg.Entryway.DID
 	}
 	adminOnly := auth.AdminOnly(&opts)
 	authRequired := auth.Required(&opts)
 	refreshTokenRequired := auth.RefreshTokenOnly(&opts)
-	srv.With(adminOnly).AddRPCs(
+	srv.With(adminOnly, pds.auditAdminAction).AddRPCs(
+		atpapi.NewAdminDisableAccountInvitesHandler(pds),
+		atpapi.NewAdminDisableInviteCodesHandler(pds),
+		atpapi.NewAdminEnableAccountInvitesHandler(pds),
+		atpapi.NewAdminGetAccountInfoHandler(pds),
+		atpapi.NewAdminGetAccountInfosHandler(pds),
+		atpapi.NewAdminGetInviteCodesHandler(pds),
+		atpapi.NewAdminGetSubjectStatusHandler(pds),
+		atpapi.NewAdminSearchAccountsHandler(pds),
+		atpapi.NewAdminSendEmailHandler(pds),
+		atpapi.NewAdminUpdateAccountEmailHandler(pds),
+		atpapi.NewAdminUpdateAccountHandleHandler(pds),
+		atpapi.NewAdminUpdateAccountPasswordHandler(pds),
 		atpapi.NewServerCreateInviteCodeHandler(pds),
+		atpapi.NewServerCreateInviteCodesHandler(pds),
+	)
+	srv.AddHandler(
+		xrpc.NewMethod("com.atproto.admin.updateSubjectStatus", xrpc.Procedure),
+		http.HandlerFunc(pds.handleUpdateSubjectStatus),
+		adminOnly,
+		pds.auditAdminAction,
+	)
+	srv.AddHandler(
+		xrpc.NewMethod(QueryAdminAuditLogNSID, xrpc.Query),
+		http.HandlerFunc(pds.QueryAdminAuditLog),
+		adminOnly,
+		pds.auditAdminAction,
 	)
 	serviceJwt := auth.ServiceJwt(&opts)
+	// An entryway keeps accounts, sessions and handles itself and sends
+	// everything that needs the account's repo to the PDS holding it.
+	toAccountPDS := pds.routeToAccountPDS()
 	srv.With(authRequired).AddRPCs(
+		atpapi.NewServerConfirmEmailHandler(pds),
+		atpapi.NewServerCreateAppPasswordHandler(pds),
+		atpapi.NewServerGetAccountInviteCodesHandler(pds),
+		atpapi.NewServerGetSessionHandler(pds),
+		atpapi.NewServerListAppPasswordsHandler(pds),
+		atpapi.NewServerRequestAccountDeleteHandler(pds),
+		atpapi.NewServerRequestEmailConfirmationHandler(pds),
+		atpapi.NewServerRequestEmailUpdateHandler(pds),
+		atpapi.NewServerRevokeAppPasswordHandler(pds),
+		atpapi.NewServerUpdateEmailHandler(pds),
+		atpapi.NewIdentityUpdateHandleHandler(pds),
+	)
+	srv.With(authRequired, toAccountPDS).AddRPCs(
 		appbsky.NewActorGetProfileHandler(pds),
 		appbsky.NewNotificationListNotificationsHandler(pds),
+		atpapi.NewServerActivateAccountHandler(pds),
+		atpapi.NewServerCheckAccountStatusHandler(pds),
+		atpapi.NewServerDeactivateAccountHandler(pds),
+		atpapi.NewServerGetServiceAuthHandler(pds),
+		atpapi.NewIdentityGetRecommendedDidCredentialsHandler(pds),
+		atpapi.NewIdentityRequestPlcOperationSignatureHandler(pds),
+		atpapi.NewIdentitySignPlcOperationHandler(pds),
+		atpapi.NewIdentitySubmitPlcOperationHandler(pds),
 		atpapi.NewRepoApplyWritesHandler(pds),
 		atpapi.NewRepoCreateRecordHandler(pds),
 		atpapi.NewRepoDeleteRecordHandler(pds),
+		atpapi.NewRepoImportRepoHandler(pds),
 		atpapi.NewRepoListMissingBlobsHandler(pds),
 		atpapi.NewRepoPutRecordHandler(pds),
+	)
+	srv.With(authRequired, toAccountPDS, recordContentType).AddRPCs(
 		atpapi.NewRepoUploadBlobHandler(pds),
 	)
 	srv.With(serviceJwt).AddRPCs(
 		atpapi.NewServerCreateAccountHandler(pds),
 	)
+	proxy := auth.Optional(&opts)(toAccountPDS(http.HandlerFunc(pds.ProxyRequest)))
 	srv.AddHandler(
 		xrpc.NewMethod("app.bsky.actor.getProfile", xrpc.Query),
-		pds.pipethrough,
+		proxy,
 	)
+	// everything this server does not implement goes to another service
+	srv.Router().Handle("/xrpc/*", proxy)
+	srv.Router().Get("/.well-known/atproto-did", pds.AtprotoDID)
+	srv.Router().Get("/.well-known/did.json", pds.DidJSON)
+	srv.Router().Get("/.well-known/oauth-protected-resource", pds.OAuthProtectedResource)
+	srv.Router().Get("/.well-known/oauth-authorization-server", pds.OAuthAuthorizationServer)
+	srv.Router().Post("/oauth/par", pds.OAuthPAR)
+	srv.Router().Get("/oauth/authorize", pds.OAuthAuthorize)
+	srv.Router().Post("/oauth/authorize", pds.OAuthAuthorize)
+	srv.Router().Post("/oauth/token", pds.OAuthToken)
+	srv.Router().Post("/oauth/revoke", pds.OAuthRevoke)
 	srv.AddHandlers(
+		atpapi.NewIdentityResolveHandleHandler(pds),
+		atpapi.NewServerCreateSessionHandler(pds),
+		atpapi.NewServerDeleteAccountHandler(&serverDeleteAccount{pds}),
+		atpapi.NewServerDescribeServerHandler(pds),
+		atpapi.NewServerRequestPasswordResetHandler(pds),
+		atpapi.NewServerReserveSigningKeyHandler(pds),
+		atpapi.NewServerResetPasswordHandler(pds),
+	)
+	srv.With(toAccountPDS).AddHandlers(
 		atpapi.NewRepoDescribeRepoHandler(pds),
 		atpapi.NewRepoGetRecordHandler(pds),
-		atpapi.NewRepoImportRepoHandler(pds),
 		atpapi.NewRepoListRecordsHandler(pds),
-		// atpapi.NewServerConfirmEmailHandler(pds),
-		atpapi.NewServerCreateSessionHandler(pds),
-		// atpapi.NewServerDeleteAccountHandler(pds),
-		// atpapi.NewServerDeleteSessionHandler(pds),
-		atpapi.NewServerDescribeServerHandler(pds),
-		// atpapi.NewServerGetSessionHandler(pds),
-		// atpapi.NewServerUpdateEmailHandler(pds),
+		atpapi.NewSyncGetBlobHandler(pds),
+		atpapi.NewSyncGetRecordHandler(&syncGetRecord{pds}),
+		atpapi.NewSyncGetRepoHandler(pds),
+		atpapi.NewSyncListBlobsHandler(pds),
 	)
 	srv.With(refreshTokenRequired).AddHandlers(
+		atpapi.NewServerDeleteSessionHandler(pds),
 		atpapi.NewServerRefreshSessionHandler(pds),
 	)
+	if pds.cfg.BehindEntryway() {
+		// Registered last so that they replace the local handlers.
+		pds.forwardToEntryway(srv)
+		// The entryway pushes handle changes here.
+		srv.AddHandler(
+			xrpc.NewMethod("com.atproto.admin.updateAccountHandle", xrpc.Procedure),
+			atpapi.NewAdminUpdateAccountHandleHandler(pds),
+			pds.entrywayOrAdmin(serviceJwt, adminOnly),
+			pds.auditAdminAction,
+		)
+	}
+}
+
+func parseK256PrivateHex(s string) (*crypto.PrivateKeyK256, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.ParsePrivateBytesK256(raw)
+}
+
+// cachedResolver resolves dids and handles through the did cache.
+type cachedResolver struct {
+	*didcache.Resolver
+	*didcache.HandleResolver
 }
 
 func (pds *PDS) newBlobstore(did syntax.DID) *repo.DiskBlobStore {
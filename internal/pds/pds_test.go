@@ -1,13 +1,18 @@
 package pds
 
 import (
+	"context"
 	"log/slog"
 	"path/filepath"
 	"testing"
 
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	gocid "github.com/ipfs/go-cid"
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/harrybrwn/at/api/com/atproto"
 	"github.com/harrybrwn/at/internal/actorstore"
+	"github.com/harrybrwn/at/internal/repo"
 	"github.com/harrybrwn/at/internal/sequencer"
 	"github.com/harrybrwn/at/pubsub"
 )
@@ -23,11 +28,14 @@ func withHost(h string) testConfOption {
 func testPDS(t *testing.T, opts ...testConfOption) *PDS {
 	t.Helper()
 	conf := EnvConfig{
-		DevMode:       true,
-		LogEnabled:    true,
-		LogLevel:      "debug",
-		DataDirectory: t.TempDir(),
-		JwtSecret:     "fe62fcf606785c916f265548c39a3628",
+		DevMode:              true,
+		LogEnabled:           true,
+		LogLevel:             "debug",
+		DataDirectory:        t.TempDir(),
+		JwtSecret:            "fe62fcf606785c916f265548c39a3628",
+		AcceptingRepoImports: true,
+		// test upstreams listen on localhost
+		DisableSSRFProtection: true,
 		BlobstoreDisk: &EnvBlobstoreDisk{
 			Location:    filepath.Join(t.TempDir(), "blobs"),
 			TmpLocation: filepath.Join(t.TempDir(), "tmp-blobs"),
@@ -64,3 +72,40 @@ func must[T any](v T, e error) T {
 	}
 	return v
 }
+
+// createImagePost writes a post that embeds an uploaded blob directly to a
+// repo, which makes the blob permanent.
+func createImagePost(t *testing.T, pds *PDS, did syntax.DID, rkey string, blob *atproto.RepoUploadBlobResponse) syntax.ATURI {
+	t.Helper()
+	uri := syntax.ATURI("at://" + did.String() + "/app.bsky.feed.post/" + rkey)
+	err := pds.ActorStore.Transact(t.Context(), did, pds.newBlobstore(did), func(ctx context.Context, tx *actorstore.ActorStoreTransactor) error {
+		_, err := tx.Repo.ProcessWrites(ctx, []repo.PreparedWrite{
+			repo.PrepWrite(&repo.PreparedCreate{
+				URI:   uri,
+				Blobs: []repo.PreparedBlobRef{{CID: gocid.Cid(blob.Blob.Ref), MimeType: blob.Blob.MimeType}},
+				Record: map[string]any{
+					"$type":     "app.bsky.feed.post",
+					"text":      "hello",
+					"createdAt": "2024-11-28T00:00:00Z",
+					"embed": map[string]any{
+						"$type": "app.bsky.embed.images",
+						"images": []any{map[string]any{
+							"alt": "",
+							"image": map[string]any{
+								"$type":    "blob",
+								"ref":      gocid.Cid(blob.Blob.Ref),
+								"mimeType": blob.Blob.MimeType,
+								"size":     blob.Blob.Size,
+							},
+						}},
+					},
+				},
+			}),
+		}, gocid.Undef)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uri
+}
@@ -0,0 +1,192 @@
+package pds
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// proxyHeader picks the service a request is sent to. It is formatted as
+// "did#service_id".
+const proxyHeader = "atproto-proxy"
+
+// proxyTarget is a service that requests are proxied to.
+type proxyTarget struct {
+	did string
+	url *url.URL
+}
+
+// ProxyRequest sends an xrpc call to the service in the atproto-proxy header,
+// or to the default service for the method's namespace when there is no
+// header. Calls from a signed in user carry a service jwt signed with the
+// user's repo key in place of their access token.
+func (pds *PDS) ProxyRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	nsid, err := syntax.ParseNSID(path.Base(r.URL.Path))
+	if err != nil {
+		xrpc.WriteError(pds.logger, w, &xrpc.ErrorResponse{
+			Code:    xrpc.MethodNotImplemented,
+			Message: "Method not implemented",
+			Status:  http.StatusNotImplemented,
+		}, "")
+		return
+	}
+	if err = pds.checkProxyMethod(nsid.String()); err != nil {
+		xrpc.WriteError(pds.logger, w, err, "")
+		return
+	}
+	target, err := pds.proxyTarget(ctx, r.Header.Get(proxyHeader), nsid.String())
+	if err != nil {
+		xrpc.WriteError(pds.logger, w, err, "")
+		return
+	}
+
+	req := r.Clone(ctx)
+	req.Header.Del(proxyHeader)
+	req.Header.Del("Authorization")
+	req.Header.Del("DPoP")
+	if user := auth.UserFromContext(ctx); user != nil && len(user.DID) > 0 {
+		if tok := auth.TokenFromContext(ctx); tok != nil && !auth.TokenScope(tok).Allows(nsid.String()) {
+			xrpc.WriteError(pds.logger, w, &xrpc.ErrorResponse{
+				Code:    "InvalidToken",
+				Message: "Bad token scope",
+				Status:  http.StatusForbidden,
+			}, "")
+			return
+		}
+		token, err := pds.proxyServiceJwt(user.DID, target.did, nsid.String())
+		if err != nil {
+			xrpc.WriteError(pds.logger, w, err, "")
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	pds.pipethrough.Forward(w, req, target.url)
+}
+
+// checkProxyMethod returns an error for methods that must not be proxied.
+// Protected methods are never sent to another service so that an app
+// password cannot be used to reach them.
+func (pds *PDS) checkProxyMethod(nsid string) error {
+	denied := auth.Protected(nsid) || hasAnyPrefix(nsid, pds.cfg.Proxy.DeniedMethods)
+	allowed := len(pds.cfg.Proxy.AllowedMethods) == 0 || hasAnyPrefix(nsid, pds.cfg.Proxy.AllowedMethods)
+	if denied || !allowed {
+		return &xrpc.ErrorResponse{
+			Code:    xrpc.InvalidRequest,
+			Message: "Method cannot be proxied: " + nsid,
+			Status:  http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+// proxyTarget finds the service for an atproto-proxy header. Configured
+// services are used without resolving their did.
+func (pds *PDS) proxyTarget(ctx context.Context, header, nsid string) (*proxyTarget, error) {
+	if len(header) == 0 {
+		svc := pds.defaultProxyService(nsid)
+		if svc == nil || len(svc.URL) == 0 {
+			return nil, &xrpc.ErrorResponse{
+				Code:    xrpc.MethodNotImplemented,
+				Message: "Method not implemented",
+				Status:  http.StatusNotImplemented,
+			}
+		}
+		return newProxyTarget(svc.DID, svc.URL)
+	}
+	did, serviceID, ok := strings.Cut(header, "#")
+	if !ok || len(serviceID) == 0 {
+		return nil, xrpc.NewInvalidRequest("Invalid %s header", proxyHeader)
+	}
+	if _, err := syntax.ParseDID(did); err != nil {
+		return nil, xrpc.NewInvalidRequest("Invalid %s header", proxyHeader).Wrap(err)
+	}
+	if did == pds.cfg.ServiceDID() {
+		return nil, xrpc.NewInvalidRequest("Cannot proxy requests to this server")
+	}
+	for _, svc := range []struct {
+		id string
+		*ConfigService
+	}{
+		{"bsky_appview", &pds.cfg.BskyAppView.ConfigService},
+		{"atproto_labeler", &pds.cfg.ModService},
+		{"atproto_labeler", &pds.cfg.ReportService},
+	} {
+		if svc.DID == did && svc.id == serviceID && len(svc.URL) > 0 {
+			return newProxyTarget(svc.DID, svc.URL)
+		}
+	}
+
+	doc, err := pds.Resolver.GetDocument(ctx, did)
+	if err != nil {
+		return nil, xrpc.NewInvalidRequest("Could not resolve proxy did").Wrap(err)
+	}
+	for _, svc := range doc.Service {
+		_, id, _ := strings.Cut(svc.ID.String(), "#")
+		if id == serviceID {
+			return newProxyTarget(did, svc.ServiceEndpoint)
+		}
+	}
+	return nil, xrpc.NewInvalidRequest("Could not find %s service in did document of %s", serviceID, did)
+}
+
+// defaultProxyService is where calls without an atproto-proxy header are
+// sent.
+func (pds *PDS) defaultProxyService(nsid string) *ConfigService {
+	switch {
+	case strings.HasPrefix(nsid, "app.bsky."), strings.HasPrefix(nsid, "chat.bsky."):
+		return &pds.cfg.BskyAppView.ConfigService
+	case strings.HasPrefix(nsid, "tools.ozone."):
+		return &pds.cfg.ModService
+	case strings.HasPrefix(nsid, "com.atproto.moderation."):
+		return &pds.cfg.ReportService
+	}
+	return nil
+}
+
+// proxyServiceJwt creates a short lived service jwt for one method call.
+func (pds *PDS) proxyServiceJwt(iss, aud, lxm string) (string, error) {
+	key, err := pds.ActorStore.SigningKey(syntax.DID(iss))
+	if err != nil {
+		return "", xrpc.NewInternalError("Failed to get signing key").Wrap(err)
+	}
+	now := time.Now()
+	exp := now.Add(time.Minute)
+	token, err := auth.CreateServiceJwt(&auth.ServiceJwtOpts{
+		Iss:     iss,
+		Aud:     aud,
+		Iat:     &now,
+		Exp:     &exp,
+		LXM:     &lxm,
+		KeyPair: key,
+	})
+	if err != nil {
+		return "", xrpc.NewInternalError("Failed to create service token").Wrap(err)
+	}
+	return token, nil
+}
+
+func newProxyTarget(did, endpoint string) (*proxyTarget, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || len(u.Host) == 0 {
+		return nil, xrpc.NewInvalidRequest("Invalid service endpoint for %s", did)
+	}
+	return &proxyTarget{did: did, url: u}, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/did"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/matryer/is"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/atp"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// docResolver serves fixed did documents and falls back to another resolver.
+type docResolver struct {
+	atp.DidResolver
+	docs map[string]*did.Document
+}
+
+func (r *docResolver) GetDocument(ctx context.Context, d string) (*did.Document, error) {
+	if doc, ok := r.docs[d]; ok {
+		return doc, nil
+	}
+	return r.DidResolver.GetDocument(ctx, d)
+}
+
+func TestProxyRequest(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	type call struct {
+		service, path, auth string
+	}
+	calls := make(chan call, 1)
+	upstream := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls <- call{name, r.URL.Path, r.Header.Get("Authorization")}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	appview, labeler, chat := upstream("appview"), upstream("labeler"), upstream("chat")
+	pds := testPDS(t, localhost, func(c *EnvConfig) {
+		c.BskyAppView.URL = appview.URL
+		c.BskyAppView.DID = "did:web:appview.test"
+		c.ReportService = ConfigService{URL: labeler.URL, DID: "did:web:labeler.test"}
+		c.Proxy.DeniedMethods = []string{"app.bsky.unspecced."}
+	})
+	var chatDoc did.Document
+	is.NoErr(json.Unmarshal([]byte(`{
+		"id": "did:web:chat.test",
+		"service": [{"id": "#bsky_chat", "type": "BskyChatService", "serviceEndpoint": "`+chat.URL+`"}]
+	}`), &chatDoc))
+	pds.Resolver = &docResolver{DidResolver: pds.Resolver, docs: map[string]*did.Document{"did:web:chat.test": &chatDoc}}
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "proxy@test.local",
+		Handle:   "proxy.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	userCtx := auth.StashUser(ctx, &xrpc.Auth{DID: acct.DID.String()})
+
+	do := func(ctx context.Context, nsid, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(ctx, "GET", "/xrpc/"+nsid, nil)
+		if len(header) > 0 {
+			req.Header.Set(proxyHeader, header)
+		}
+		rec := httptest.NewRecorder()
+		pds.ProxyRequest(rec, req)
+		return rec
+	}
+
+	// signed in calls get a service jwt for the method
+	rec := do(userCtx, "app.bsky.feed.getTimeline", "")
+	is.Equal(rec.Code, http.StatusOK)
+	c := <-calls
+	is.Equal(c.service, "appview")
+	is.Equal(c.path, "/xrpc/app.bsky.feed.getTimeline")
+	is.True(strings.HasPrefix(c.auth, "Bearer "))
+	key, err := pds.ActorStore.SigningKey(acct.DID)
+	is.NoErr(err)
+	claims := make(jwt.MapClaims)
+	_, err = jwt.ParseWithClaims(strings.TrimPrefix(c.auth, "Bearer "), &claims, func(*jwt.Token) (any, error) { return key, nil })
+	is.NoErr(err)
+	is.Equal(claims["iss"], acct.DID.String())
+	is.Equal(claims["aud"], "did:web:appview.test")
+	is.Equal(claims["lxm"], "app.bsky.feed.getTimeline")
+
+	// anonymous calls are sent without auth
+	rec = do(ctx, "app.bsky.feed.getPosts", "")
+	is.Equal(rec.Code, http.StatusOK)
+	c = <-calls
+	is.Equal(c.auth, "")
+
+	rec = do(userCtx, "com.atproto.moderation.createReport", "")
+	is.Equal(rec.Code, http.StatusOK)
+	is.Equal((<-calls).service, "labeler")
+
+	// the header picks a service from the did document
+	rec = do(userCtx, "chat.bsky.convo.listConvos", "did:web:chat.test#bsky_chat")
+	is.Equal(rec.Code, http.StatusOK)
+	c = <-calls
+	is.Equal(c.service, "chat")
+	claims = make(jwt.MapClaims)
+	_, err = jwt.ParseWithClaims(strings.TrimPrefix(c.auth, "Bearer "), &claims, func(*jwt.Token) (any, error) { return key, nil })
+	is.NoErr(err)
+	is.Equal(claims["aud"], "did:web:chat.test")
+
+	for _, tt := range []struct {
+		nsid, header string
+		code         int
+	}{
+		{"chat.bsky.convo.listConvos", "did:web:chat.test#unknown", http.StatusBadRequest},
+		{"chat.bsky.convo.listConvos", "did:web:chat.test", http.StatusBadRequest},
+		{"app.bsky.feed.getTimeline", pds.cfg.ServiceDID() + "#bsky_appview", http.StatusBadRequest},
+		{"com.example.unknown", "", http.StatusNotImplemented},
+		{"app.bsky.unspecced.getConfig", "", http.StatusBadRequest},
+		{"com.atproto.server.createAppPassword", "did:web:chat.test#bsky_chat", http.StatusBadRequest},
+	} {
+		rec = do(userCtx, tt.nsid, tt.header)
+		is.Equal(rec.Code, tt.code)
+	}
+	is.Equal(len(calls), 0)
+}
@@ -0,0 +1,108 @@
+package pds
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/did"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/account"
+)
+
+// AtprotoDID serves /.well-known/atproto-did for handles under the service
+// handle domains. The handle is taken from the Host header so that a single
+// wildcard dns record can point every hosted handle at this server.
+func (pds *PDS) AtprotoDID(w http.ResponseWriter, r *http.Request) {
+	handle, err := syntax.ParseHandle(requestHost(r))
+	if err != nil || !isServiceDomain(handle.Normalize().String(), pds.cfg.ServiceHandleDomains) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	acct, err := pds.Accounts.GetAccount(r.Context(), handle.Normalize().String(), nil)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		pds.logger.Error("failed to look up handle", "handle", handle, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(acct.DID))
+}
+
+// DidJSON serves /.well-known/did.json for the service's did:web and for
+// accounts with a did:web under the service handle domains. Documents are
+// generated from the current account state so they always have the latest
+// handle and signing key.
+func (pds *PDS) DidJSON(w http.ResponseWriter, r *http.Request) {
+	host := requestHost(r)
+	id := "did:web:" + host
+	var (
+		doc *did.Document
+		err error
+	)
+	switch {
+	case id == pds.cfg.ServiceDID():
+		doc, err = pds.serviceDidDocument()
+	case isServiceDomain(host, pds.cfg.ServiceHandleDomains):
+		var acct *account.ActorAccount
+		acct, err = pds.Accounts.GetAccount(r.Context(), id, nil)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "DID not found", http.StatusNotFound)
+			return
+		} else if err == nil {
+			doc, err = pds.accountDidDocument(acct)
+		}
+	default:
+		http.Error(w, "DID not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pds.logger.Error("failed to build did document", "did", id, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(doc)
+}
+
+// serviceDidDocument builds the did document of this server. The plc rotation
+// key doubles as the service's signing key.
+func (pds *PDS) serviceDidDocument() (*did.Document, error) {
+	op, err := pds.recommendedPlcOperation(syntax.HandleInvalid, pds.plcRotationKey)
+	if err != nil {
+		return nil, err
+	}
+	op.AlsoKnownAs = nil
+	return op.Document(pds.cfg.ServiceDID())
+}
+
+// accountDidDocument builds the did document of an account with a did:web.
+func (pds *PDS) accountDidDocument(acct *account.ActorAccount) (*did.Document, error) {
+	key, err := pds.ActorStore.SigningKey(syntax.DID(acct.DID))
+	if err != nil {
+		return nil, err
+	}
+	op, err := pds.recommendedPlcOperation(syntax.Handle(acct.Handle.String), key)
+	if err != nil {
+		return nil, err
+	}
+	if !acct.Handle.Valid {
+		op.AlsoKnownAs = nil
+	}
+	return op.Document(acct.DID)
+}
+
+// requestHost is the host of a request without the port.
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return r.Host
+	}
+	return host
+}
@@ -0,0 +1,71 @@
+package pds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/did"
+	"github.com/matryer/is"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/atp"
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+func TestDidJSON(t *testing.T) {
+	is := is.New(t)
+	pds := testPDS(t, localhost, func(cfg *EnvConfig) { cfg.DidWebAccounts = true })
+	ctx := t.Context()
+	acct, err := pds.CreateAccount(ctx, &atproto.ServerCreateAccountRequest{
+		Email:    "me@test.local",
+		Handle:   "web-user.test",
+		Password: "testlab01",
+	})
+	is.NoErr(err)
+	is.Equal(acct.DID.String(), "did:web:web-user.test")
+	get := func(host string) (int, *identity.Identity) {
+		req := httptest.NewRequest(http.MethodGet, "/.well-known/did.json", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		pds.DidJSON(rec, req)
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+		var doc did.Document
+		is.NoErr(json.NewDecoder(rec.Body).Decode(&doc))
+		ident := identity.ParseIdentity(atp.ConvertDidDoc(&doc))
+		return rec.Code, &ident
+	}
+
+	status, ident := get("web-user.test")
+	is.Equal(status, http.StatusOK)
+	is.Equal(ident.DID.String(), "did:web:web-user.test")
+	is.Equal(ident.Handle.String(), "web-user.test")
+	is.Equal(ident.PDSEndpoint(), pds.cfg.PublicURL())
+	key, err := pds.ActorStore.SigningKey(acct.DID)
+	is.NoErr(err)
+	pub, err := ident.PublicKey()
+	is.NoErr(err)
+	is.Equal(pub.DIDKey(), must(key.PublicKey()).DIDKey())
+
+	// handle changes show up without touching the did
+	authed := auth.StashUser(ctx, &xrpc.Auth{DID: acct.DID.String(), Handle: acct.Handle.String()})
+	_, err = pds.UpdateHandle(authed, &atproto.IdentityUpdateHandleRequest{Handle: "renamed.test"})
+	is.NoErr(err)
+	status, ident = get("web-user.test:3000")
+	is.Equal(status, http.StatusOK)
+	is.Equal(ident.Handle.String(), "renamed.test")
+
+	status, ident = get("localhost")
+	is.Equal(status, http.StatusOK)
+	is.Equal(ident.DID.String(), pds.cfg.ServiceDID())
+	is.Equal(ident.PDSEndpoint(), pds.cfg.PublicURL())
+	status, _ = get("missing.test")
+	is.Equal(status, http.StatusNotFound)
+	status, _ = get("example.com")
+	is.Equal(status, http.StatusNotFound)
+}
@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"github.com/ipfs/go-cid"
+)
+
+// BlobRef is a reference to a blob found inside of a record.
+type BlobRef struct {
+	CID      cid.Cid
+	MimeType string
+	Size     int64
+}
+
+// BlobRefs finds every blob referenced by a record that has been decoded into
+// maps and slices.
+func BlobRefs(record any) []BlobRef {
+	var refs []BlobRef
+	findBlobRefs(record, &refs)
+	return refs
+}
+
+func findBlobRefs(v any, refs *[]BlobRef) {
+	switch v := v.(type) {
+	case map[string]any:
+		if ref, ok := asBlobRef(v); ok {
+			*refs = append(*refs, ref)
+			return
+		}
+		for _, val := range v {
+			findBlobRefs(val, refs)
+		}
+	case []any:
+		for _, val := range v {
+			findBlobRefs(val, refs)
+		}
+	}
+}
+
+func asBlobRef(m map[string]any) (BlobRef, bool) {
+	if typ, _ := m["$type"].(string); typ != "blob" {
+		return BlobRef{}, false
+	}
+	link, ok := m["ref"].(map[string]any)
+	if !ok {
+		return BlobRef{}, false
+	}
+	var ref BlobRef
+	switch c := link["$link"].(type) {
+	case cid.Cid:
+		ref.CID = c
+	case string:
+		parsed, err := cid.Decode(c)
+		if err != nil {
+			return BlobRef{}, false
+		}
+		ref.CID = parsed
+	default:
+		return BlobRef{}, false
+	}
+	ref.MimeType, _ = m["mimeType"].(string)
+	switch size := m["size"].(type) {
+	case int64:
+		ref.Size = size
+	case int:
+		ref.Size = int64(size)
+	case float64:
+		ref.Size = int64(size)
+	}
+	return ref, true
+}
@@ -0,0 +1,43 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/matryer/is"
+)
+
+func TestBlobRefs(t *testing.T) {
+	is := is.New(t)
+	avatar, err := cid.Decode("bafkreidpjxht62vut32z45pyonzch3cwqzws4lw6qklgbid5nyh4j3qtbi")
+	is.NoErr(err)
+	image, err := cid.Decode("bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku")
+	is.NoErr(err)
+	refs := BlobRefs(map[string]any{
+		"$type": "app.bsky.feed.post",
+		"text":  "hello",
+		"avatar": map[string]any{
+			"$type":    "blob",
+			"ref":      map[string]any{"$link": avatar},
+			"mimeType": "image/jpeg",
+			"size":     int64(57366),
+		},
+		"embed": map[string]any{
+			"images": []any{
+				map[string]any{
+					"image": map[string]any{
+						"$type":    "blob",
+						"ref":      map[string]any{"$link": image.String()},
+						"mimeType": "image/png",
+						"size":     int64(12),
+					},
+				},
+			},
+		},
+	})
+	is.Equal(len(refs), 2)
+	byCID := map[cid.Cid]BlobRef{refs[0].CID: refs[0], refs[1].CID: refs[1]}
+	is.Equal(byCID[avatar], BlobRef{CID: avatar, MimeType: "image/jpeg", Size: 57366})
+	is.Equal(byCID[image], BlobRef{CID: image, MimeType: "image/png", Size: 12})
+	is.Equal(len(BlobRefs(map[string]any{"text": "no blobs"})), 0)
+}
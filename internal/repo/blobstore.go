@@ -2,6 +2,7 @@ package repo
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"os"
@@ -59,13 +60,12 @@ func (d *DiskBlobStore) ensureQuarantine() error {
 }
 
 func (d *DiskBlobStore) genKey() string {
-	// Note: Implementation would need crypto/rand for proper random string generation
-	// This is a simplified version
 	const charset = "abcdefghijklmnopqrstuvwxyz234567"
 	const length = 32
 	result := make([]byte, length)
+	_, _ = rand.Read(result)
 	for i := range result {
-		result[i] = charset[i%len(charset)]
+		result[i] = charset[int(result[i])%len(charset)]
 	}
 	return string(result)
 }
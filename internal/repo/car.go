@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/pkg/errors"
+)
+
+// ReadCar reads every block in a CAR file into memory and returns the root
+// commit CID along with the blocks.
+func ReadCar(r io.Reader) (cid.Cid, *BlockMap, error) {
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return cid.Undef, nil, errors.Wrap(err, "failed to read car header")
+	}
+	if len(cr.Header.Roots) == 0 {
+		return cid.Undef, nil, errors.New("car file has no roots")
+	}
+	bm := NewBlockMap()
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return cid.Undef, nil, errors.Wrap(err, "failed to read car block")
+		}
+		bm.Set(blk.Cid(), blk.RawData())
+	}
+	return cr.Header.Roots[0], bm, nil
+}
+
+// LoadCar reads a CAR file into memory and loads the repository at the
+// CAR's root. The returned repo is read-only.
+func LoadCar(ctx context.Context, r io.Reader) (*Repo, error) {
+	root, bm, err := ReadCar(r)
+	if err != nil {
+		return nil, err
+	}
+	return Load(ctx, NewMemoryBlockstore(bm), root, readOnlySigner)
+}
+
+// WriteCar writes blocks to w as a CAR file with root as its only root.
+func WriteCar(w io.Writer, root cid.Cid, bm *BlockMap) error {
+	err := car.WriteHeader(&car.CarHeader{
+		Roots:   []cid.Cid{root},
+		Version: 1,
+	}, w)
+	if err != nil {
+		return errors.Wrap(err, "failed to write car header")
+	}
+	for c, b := range bm.Iter() {
+		if err = carutil.LdWrite(w, c.Bytes(), b); err != nil {
+			return errors.Wrap(err, "failed to write car block")
+		}
+	}
+	return nil
+}
+
+// NewMemoryBlockstore creates a [Blockstore] backed by a [BlockMap].
+func NewMemoryBlockstore(bm *BlockMap) Blockstore {
+	return &memoryBlockstore{bm: bm}
+}
+
+type memoryBlockstore struct{ bm *BlockMap }
+
+func (m *memoryBlockstore) Get(_ context.Context, c cid.Cid) (blocks.Block, error) {
+	b, ok := m.bm.Get(c)
+	if !ok {
+		return nil, errors.Errorf("block %q not found", c)
+	}
+	return blocks.NewBlockWithCid(b, c)
+}
+
+func (m *memoryBlockstore) Put(_ context.Context, blk blocks.Block) error {
+	m.bm.Set(blk.Cid(), blk.RawData())
+	return nil
+}
+
+// RecordProof returns the blocks that prove a record is in the repo at root.
+// These are the commit, the tree nodes on the path to the record and the
+// record itself.
+func RecordProof(ctx context.Context, storage Blockstore, root cid.Cid, collection, rkey string) (*BlockMap, error) {
+	rec := recordingBlockstore{Blockstore: storage, seen: NewBlockMap()}
+	r, err := Load(ctx, &rec, root, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err = r.GetRecordBytes(ctx, collection, rkey); err != nil {
+		return nil, err
+	}
+	return rec.seen, nil
+}
+
+// recordingBlockstore keeps every block read from a Blockstore.
+type recordingBlockstore struct {
+	Blockstore
+	seen *BlockMap
+}
+
+func (r *recordingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := r.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	r.seen.Set(c, blk.RawData())
+	return blk, nil
+}
+
+func readOnlySigner(context.Context, string, []byte) ([]byte, error) {
+	return nil, errors.New("cannot sign commits for a read-only repo")
+}
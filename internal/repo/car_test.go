@@ -0,0 +1,90 @@
+package repo
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/ipfs/go-cid"
+	"github.com/matryer/is"
+)
+
+func TestLoadCar(t *testing.T) {
+	ctx := t.Context()
+	is := is.New(t)
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	bm := NewBlockMap()
+	r := New("did:plc:nsu4iq7726acidyqpha2zuk3", NewMemoryBlockstore(bm), signer(key))
+	posts := []string{"3lhmfbobbfk2k", "3lhmfbobbfk2l", "3lhmfbobbfk2m"}
+	for _, rkey := range posts {
+		_, err = r.PutRecord(ctx, "app.bsky.feed.post", rkey, map[string]any{
+			"$type": "app.bsky.feed.post",
+			"text":  "hello " + rkey,
+		})
+		is.NoErr(err)
+	}
+	_, err = r.PutRecord(ctx, "app.bsky.actor.profile", "self", map[string]any{
+		"$type":       "app.bsky.actor.profile",
+		"displayName": "test",
+	})
+	is.NoErr(err)
+	root, rev, err := r.Commit(ctx)
+	is.NoErr(err)
+
+	var buf bytes.Buffer
+	is.NoErr(WriteCar(&buf, root, bm))
+	loaded, err := LoadCar(ctx, &buf)
+	is.NoErr(err)
+	is.Equal(loaded.DID(), "did:plc:nsu4iq7726acidyqpha2zuk3")
+	is.Equal(loaded.Rev(), rev)
+	is.True(loaded.Root().Equals(root))
+
+	keys := make([]string, 0)
+	err = loaded.Walk(ctx, func(collection, rkey string, c cid.Cid) error {
+		keys = append(keys, collection+"/"+rkey)
+		_, err := loaded.GetBlock(ctx, c)
+		return err
+	})
+	is.NoErr(err)
+	is.Equal(keys, []string{
+		"app.bsky.actor.profile/self",
+		"app.bsky.feed.post/3lhmfbobbfk2k",
+		"app.bsky.feed.post/3lhmfbobbfk2l",
+		"app.bsky.feed.post/3lhmfbobbfk2m",
+	})
+	_, _, err = loaded.Commit(ctx)
+	is.True(err != nil) // loaded car repos are read-only
+}
+
+func TestRecordProof(t *testing.T) {
+	ctx := t.Context()
+	is := is.New(t)
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	bm := NewBlockMap()
+	r := New("did:plc:nsu4iq7726acidyqpha2zuk3", NewMemoryBlockstore(bm), signer(key))
+	for _, rkey := range []string{"3lhmfbobbfk2k", "3lhmfbobbfk2l", "3lhmfbobbfk2m"} {
+		_, err = r.PutRecord(ctx, "app.bsky.feed.post", rkey, map[string]any{
+			"$type": "app.bsky.feed.post",
+			"text":  "hello " + rkey,
+		})
+		is.NoErr(err)
+	}
+	root, _, err := r.Commit(ctx)
+	is.NoErr(err)
+
+	proof, err := RecordProof(ctx, NewMemoryBlockstore(bm), root, "app.bsky.feed.post", "3lhmfbobbfk2l")
+	is.NoErr(err)
+	is.True(proof.Size() < bm.Size())
+	loaded, err := Load(ctx, NewMemoryBlockstore(proof), root, nil)
+	is.NoErr(err)
+	c, raw, err := loaded.GetRecordBytes(ctx, "app.bsky.feed.post", "3lhmfbobbfk2l")
+	is.NoErr(err)
+	want, ok := bm.Get(c)
+	is.True(ok)
+	is.Equal(raw, want)
+
+	_, err = RecordProof(ctx, NewMemoryBlockstore(bm), root, "app.bsky.feed.post", "missing")
+	is.True(err != nil)
+}
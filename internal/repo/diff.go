@@ -0,0 +1,146 @@
+package repo
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/cbor/dagcbor"
+)
+
+// RecordDiff is a change made to a single record between two commits.
+type RecordDiff struct {
+	Action     WriteOpAction
+	Collection string
+	RecordKey  string
+	// Old is undefined for created records.
+	Old cid.Cid
+	// New is undefined for deleted records.
+	New cid.Cid
+}
+
+func (rd *RecordDiff) Path() string { return path.Join(rd.Collection, rd.RecordKey) }
+
+// Diff returns the records that were created, updated or deleted between two
+// commits in the same blockstore, sorted by record path. If from is undefined
+// then every record in the newer commit is reported as created.
+func Diff(ctx context.Context, bs Blockstore, from, to cid.Cid) ([]RecordDiff, error) {
+	var fromData cid.Cid
+	if from.Defined() {
+		commit, err := loadCommit(ctx, bs, from)
+		if err != nil {
+			return nil, err
+		}
+		fromData = commit.Data
+	}
+	commit, err := loadCommit(ctx, bs, to)
+	if err != nil {
+		return nil, err
+	}
+	return diffData(ctx, bs, fromData, commit.Data)
+}
+
+func loadCommit(ctx context.Context, bs Blockstore, c cid.Cid) (*SignedCommit, error) {
+	blk, err := bs.Get(ctx, c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get commit %s", c)
+	}
+	var commit SignedCommit
+	if err = dagcbor.Unmarshal(blk.RawData(), &commit); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode commit %s", c)
+	}
+	return &commit, nil
+}
+
+type leaf struct {
+	key string
+	cid cid.Cid
+}
+
+// diffData compares the leaves of two MSTs given their root nodes.
+func diffData(ctx context.Context, bs Blockstore, from, to cid.Cid) ([]RecordDiff, error) {
+	var (
+		err       error
+		old, next []leaf
+	)
+	if from.Defined() {
+		old, err = leaves(ctx, bs, from)
+		if err != nil {
+			return nil, err
+		}
+	}
+	next, err = leaves(ctx, bs, to)
+	if err != nil {
+		return nil, err
+	}
+	diffs := make([]RecordDiff, 0)
+	add := func(action WriteOpAction, key string, o, n cid.Cid) {
+		collection, rkey, _ := strings.Cut(key, "/")
+		diffs = append(diffs, RecordDiff{
+			Action:     action,
+			Collection: collection,
+			RecordKey:  rkey,
+			Old:        o,
+			New:        n,
+		})
+	}
+	i, j := 0, 0
+	for i < len(old) && j < len(next) {
+		o, n := old[i], next[j]
+		switch {
+		case o.key == n.key:
+			if !o.cid.Equals(n.cid) {
+				add(WriteOpActionUpdate, o.key, o.cid, n.cid)
+			}
+			i++
+			j++
+		case o.key < n.key:
+			add(WriteOpActionDelete, o.key, o.cid, cid.Undef)
+			i++
+		default:
+			add(WriteOpActionCreate, n.key, cid.Undef, n.cid)
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		add(WriteOpActionDelete, old[i].key, old[i].cid, cid.Undef)
+	}
+	for ; j < len(next); j++ {
+		add(WriteOpActionCreate, next[j].key, cid.Undef, next[j].cid)
+	}
+	return diffs, nil
+}
+
+func leaves(ctx context.Context, bs Blockstore, root cid.Cid) ([]leaf, error) {
+	res := make([]leaf, 0)
+	tree := mst.LoadMST(&ipldStore{bs: bs}, root)
+	err := tree.WalkLeavesFrom(ctx, "", func(key string, c cid.Cid) error {
+		res = append(res, leaf{key: key, cid: c})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to walk mst %s", root)
+	}
+	return res, nil
+}
+
+// FindCommit searches a set of blocks for a commit with the given rev.
+func FindCommit(blocks *BlockMap, rev string) (cid.Cid, bool) {
+	for c, b := range blocks.Iter() {
+		if c.Prefix().Codec != DefaultPrefix.Codec {
+			continue
+		}
+		var commit SignedCommit
+		if err := dagcbor.Unmarshal(b, &commit); err != nil {
+			continue
+		}
+		if len(commit.DID) > 0 && commit.Data.Defined() && commit.Rev == rev {
+			return c, true
+		}
+	}
+	return cid.Undef, false
+}
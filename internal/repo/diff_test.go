@@ -0,0 +1,65 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/ipfs/go-cid"
+	"github.com/matryer/is"
+)
+
+func TestDiff(t *testing.T) {
+	ctx := t.Context()
+	is := is.New(t)
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	bs := NewMemoryBlockstore(NewBlockMap())
+	r := New("did:plc:nsu4iq7726acidyqpha2zuk3", bs, signer(key))
+	post := func(text string) map[string]any {
+		return map[string]any{"$type": "app.bsky.feed.post", "text": text}
+	}
+	for _, rkey := range []string{"a", "b", "c"} {
+		_, err = r.PutRecord(ctx, "app.bsky.feed.post", rkey, post(rkey))
+		is.NoErr(err)
+	}
+	first, _, err := r.Commit(ctx)
+	is.NoErr(err)
+
+	oldB, _, err := r.GetRecordBytes(ctx, "app.bsky.feed.post", "b")
+	is.NoErr(err)
+	oldC, _, err := r.GetRecordBytes(ctx, "app.bsky.feed.post", "c")
+	is.NoErr(err)
+	newB, err := r.UpdateRecord(ctx, "app.bsky.feed.post", "b", post("updated"))
+	is.NoErr(err)
+	is.NoErr(r.DeleteRecord(ctx, "app.bsky.feed.post", "c"))
+	newD, err := r.PutRecord(ctx, "app.bsky.feed.post", "d", post("d"))
+	is.NoErr(err)
+	second, _, err := r.Commit(ctx)
+	is.NoErr(err)
+
+	expected := []RecordDiff{
+		{Action: WriteOpActionUpdate, Collection: "app.bsky.feed.post", RecordKey: "b", Old: oldB, New: newB},
+		{Action: WriteOpActionDelete, Collection: "app.bsky.feed.post", RecordKey: "c", Old: oldC, New: cid.Undef},
+		{Action: WriteOpActionCreate, Collection: "app.bsky.feed.post", RecordKey: "d", Old: cid.Undef, New: newD},
+	}
+	diffs, err := Diff(ctx, bs, first, second)
+	is.NoErr(err)
+	is.Equal(diffs, expected)
+	diffs, err = r.DiffSince(ctx, first)
+	is.NoErr(err)
+	is.Equal(diffs, expected)
+
+	diffs, err = Diff(ctx, bs, cid.Undef, first)
+	is.NoErr(err)
+	is.Equal(len(diffs), 3)
+	for _, d := range diffs {
+		is.Equal(d.Action, WriteOpActionCreate)
+	}
+	bm := bs.(*memoryBlockstore).bm
+	found, ok := FindCommit(bm, r.Rev())
+	is.True(ok)
+	is.True(found.Equals(second))
+	diffs, err = Diff(ctx, bs, second, second)
+	is.NoErr(err)
+	is.Equal(len(diffs), 0)
+}
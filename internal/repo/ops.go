@@ -27,7 +27,15 @@ type CommitData struct {
 }
 
 func BlocksToCarFile(root syntax.CID, blocks *BlockMap) ([]byte, error) {
-	return nil, nil
+	c, err := cid.Parse(root.String())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var buf bytes.Buffer
+	if err = WriteCar(&buf, c, blocks); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 type WriteOpAction string
@@ -2,9 +2,9 @@ package repo
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
 	"path"
+	"strings"
 
 	"github.com/bluesky-social/indigo/mst"
 	blocks "github.com/ipfs/go-block-format"
@@ -58,7 +58,8 @@ func New(did string, storage Blockstore, signer Signer) *Repo {
 }
 
 func Load(ctx context.Context, storage Blockstore, root cid.Cid, signer Signer) (*Repo, error) {
-	repo := newRepo(storage, signer, mst.LoadMST(&ipldStore{bs: storage}, root))
+	// The tree is loaded lazily from the commit's data pointer.
+	repo := newRepo(storage, signer, nil)
 	repo.root = root
 	blk, err := storage.Get(ctx, root)
 	if err != nil {
@@ -87,6 +88,33 @@ func (r *Repo) SignedCommit() *SignedCommit {
 	return &r.commit
 }
 
+// DID returns the DID of the repository owner.
+func (r *Repo) DID() string { return r.commit.DID }
+
+// Rev returns the revision of the current commit.
+func (r *Repo) Rev() string { return r.commit.Rev }
+
+// Root returns the CID of the commit the repo was loaded from.
+func (r *Repo) Root() cid.Cid { return r.root }
+
+// Walk calls fn for every record in the repo in key order. Returning an error
+// from fn stops the walk.
+func (r *Repo) Walk(ctx context.Context, fn func(collection, rkey string, c cid.Cid) error) error {
+	return r.getTree().WalkLeavesFrom(ctx, "", func(key string, c cid.Cid) error {
+		collection, rkey := path.Split(key)
+		return fn(strings.TrimSuffix(collection, "/"), rkey, c)
+	})
+}
+
+// GetBlock returns the raw bytes for a block in the repo's storage.
+func (r *Repo) GetBlock(ctx context.Context, c cid.Cid) ([]byte, error) {
+	blk, err := r.storage.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return blk.RawData(), nil
+}
+
 func (r *Repo) getTree() *mst.MerkleSearchTree {
 	if r.mst == nil {
 		r.mst = mst.LoadMST(&ipldStore{bs: r.storage}, r.commit.Data)
@@ -97,7 +125,6 @@ func (r *Repo) getTree() *mst.MerkleSearchTree {
 func (r *Repo) GetRecordBytes(ctx context.Context, collection, rkey string) (cid.Cid, []byte, error) {
 	t := r.getTree()
 	key := path.Join(collection, rkey)
-	fmt.Printf("mst.Get(%q)\n", key)
 	c, err := t.Get(ctx, key)
 	if err != nil {
 		return cid.Undef, nil, errors.WithStack(err)
@@ -250,31 +277,23 @@ func (r *Repo) Commit(ctx context.Context) (cid.Cid, string, error) {
 	return c, commit.Rev, nil
 }
 
-func (r *Repo) DiffSince(ctx context.Context, oldrepo cid.Cid) ([]*mst.DiffOp, error) {
+// DiffSince returns the records that changed between an older commit and the
+// repo's current tree. Every record is reported as created if oldrepo is
+// undefined.
+func (r *Repo) DiffSince(ctx context.Context, oldrepo cid.Cid) ([]RecordDiff, error) {
 	var oldTree cid.Cid
 	if oldrepo.Defined() {
-		otherRepo, err := Load(ctx, r.storage, oldrepo, r.signer)
+		commit, err := loadCommit(ctx, r.storage, oldrepo)
 		if err != nil {
 			return nil, err
 		}
-		oldmst := otherRepo.getTree()
-		oldptr, err := oldmst.GetPointer(ctx)
-		if err != nil {
-			return nil, err
-		}
-		oldTree = oldptr
+		oldTree = commit.Data
 	}
-	curmst := r.getTree()
-	curptr, err := curmst.GetPointer(ctx)
+	curptr, err := r.getTree().GetPointer(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return mst.DiffTrees(
-		ctx,
-		&ipldBlockstore{r.storage},
-		oldTree,
-		curptr,
-	)
+	return diffData(ctx, r.storage, oldTree, curptr)
 }
 
 func (r *Repo) FormatCommit(
@@ -418,12 +437,19 @@ func diffOf(ctx context.Context, bs Blockstore, from, to cid.Cid) (*dataDiff, er
 		newleafCids: cid.NewSet(),
 		removedCids: cid.NewSet(),
 	}
-	ops, err := mst.DiffTrees(ctx, &ipldBlockstore{bs}, from, to)
+	records, err := diffData(ctx, bs, from, to)
 	if err != nil {
 		return nil, err
 	}
-	for _, op := range ops {
-		fmt.Println(op)
+	for _, rec := range records {
+		switch rec.Action {
+		case WriteOpActionCreate:
+			diff.leafAdd(rec.Path(), rec.New)
+		case WriteOpActionUpdate:
+			diff.leafUpdate(rec.Path(), rec.Old, rec.New)
+		case WriteOpActionDelete:
+			diff.leafDelete(rec.Path(), rec.Old)
+		}
 	}
 	return &diff, nil
 }
@@ -0,0 +1,321 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/cbor/dagcbor"
+)
+
+// Names of the checks run by [Verify].
+const (
+	CheckBlockHash = "block-hash"
+	CheckCommit    = "commit"
+	CheckSignature = "signature"
+	CheckMST       = "mst"
+	CheckMissing   = "missing-block"
+)
+
+// Signature verification results.
+const (
+	SignatureValid   = "valid"
+	SignatureInvalid = "invalid"
+	SignatureSkipped = "skipped"
+)
+
+// VerifyReport is the result of verifying a repo that has been loaded into
+// memory.
+type VerifyReport struct {
+	Root      string          `json:"root"`
+	DID       string          `json:"did"`
+	Rev       string          `json:"rev"`
+	Version   int64           `json:"version"`
+	Blocks    int             `json:"blocks"`
+	Nodes     int             `json:"mstNodes"`
+	Records   int             `json:"records"`
+	Signature string          `json:"signature"`
+	Problems  []VerifyProblem `json:"problems"`
+}
+
+// VerifyProblem describes a single failed check.
+type VerifyProblem struct {
+	Check   string `json:"check"`
+	CID     string `json:"cid,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+// OK returns true if no problems were found.
+func (vr *VerifyReport) OK() bool { return len(vr.Problems) == 0 }
+
+func (vr *VerifyReport) problem(check string, c cid.Cid, key, format string, v ...any) {
+	p := VerifyProblem{Check: check, Key: key, Message: fmt.Sprintf(format, v...)}
+	if c.Defined() {
+		p.CID = c.String()
+	}
+	vr.Problems = append(vr.Problems, p)
+}
+
+// KeyFunc looks up the public signing key of a repo's owner.
+type KeyFunc func(ctx context.Context, did string) (crypto.PublicKey, error)
+
+// Verify checks that every block hashes to its CID, that the commit at root
+// is signed by the key returned from keyfn and that the MST is well formed.
+// Signature verification is skipped when keyfn is nil.
+func Verify(ctx context.Context, root cid.Cid, blocks *BlockMap, keyfn KeyFunc) *VerifyReport {
+	report := VerifyReport{
+		Root:      root.String(),
+		Blocks:    blocks.Size(),
+		Signature: SignatureSkipped,
+		Problems:  make([]VerifyProblem, 0),
+	}
+	for c, b := range blocks.Iter() {
+		sum, err := c.Prefix().Sum(b)
+		if err != nil {
+			report.problem(CheckBlockHash, c, "", "failed to hash block: %v", err)
+		} else if !sum.Equals(c) {
+			report.problem(CheckBlockHash, c, "", "block hashes to %s", sum)
+		}
+	}
+
+	raw, ok := blocks.Get(root)
+	if !ok {
+		report.problem(CheckMissing, root, "", "commit block not found")
+		return &report
+	}
+	var commit SignedCommit
+	if err := dagcbor.Unmarshal(raw, &commit); err != nil {
+		report.problem(CheckCommit, root, "", "failed to decode commit: %v", err)
+		return &report
+	}
+	report.DID = commit.DID
+	report.Rev = commit.Rev
+	report.Version = commit.Version
+	if commit.Version != repoVersion {
+		report.problem(CheckCommit, root, "", "unsupported repo version %d", commit.Version)
+	}
+	if _, err := syntax.ParseDID(commit.DID); err != nil {
+		report.problem(CheckCommit, root, "", "invalid did: %v", err)
+	}
+	if _, err := syntax.ParseTID(commit.Rev); err != nil {
+		report.problem(CheckCommit, root, "", "invalid rev: %v", err)
+	}
+
+	if keyfn != nil {
+		key, err := keyfn(ctx, commit.DID)
+		if err != nil {
+			report.Signature = SignatureInvalid
+			report.problem(CheckSignature, root, "", "failed to get signing key: %v", err)
+		} else if err = VerifyCommitSignature(&commit, key); err != nil {
+			report.Signature = SignatureInvalid
+			report.problem(CheckSignature, root, "", "%v", err)
+		} else {
+			report.Signature = SignatureValid
+		}
+	}
+
+	v := mstVerifier{blocks: blocks, report: &report}
+	v.verify(commit.Data)
+	return &report
+}
+
+// VerifyCommitSignature checks a commit's signature against a public key.
+func VerifyCommitSignature(commit *SignedCommit, key crypto.PublicKey) error {
+	unsigned := UnsignedCommit{
+		DID:     commit.DID,
+		Version: commit.Version,
+		Prev:    commit.Prev,
+		Data:    commit.Data,
+		Rev:     commit.Rev,
+	}
+	b, err := dagcbor.Marshal(&unsigned)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(key.HashAndVerify(b, commit.Sig), "commit signature does not verify")
+}
+
+type mstVerifier struct {
+	blocks  *BlockMap
+	report  *VerifyReport
+	lastKey string
+}
+
+type mstEntry struct {
+	key   string
+	value cid.Cid
+	tree  cid.Cid
+}
+
+type mstNode struct {
+	left    cid.Cid
+	entries []mstEntry
+}
+
+func (v *mstVerifier) verify(root cid.Cid) {
+	node, ok := v.node(root)
+	if !ok {
+		return
+	}
+	if len(node.entries) == 0 {
+		// an empty repo has an empty root node
+		if node.left.Defined() {
+			v.report.problem(CheckMST, root, "", "root node has no entries")
+			v.walk(node.left, -1)
+		}
+		return
+	}
+	v.walkNode(root, node, keyLayer(node.entries[0].key))
+}
+
+// walk visits the node at c, which should be at layer. A layer of -1 means
+// the layer is not known ahead of time.
+func (v *mstVerifier) walk(c cid.Cid, layer int) {
+	node, ok := v.node(c)
+	if !ok {
+		return
+	}
+	if len(node.entries) == 0 && !node.left.Defined() {
+		v.report.problem(CheckMST, c, "", "empty non-root node")
+		return
+	}
+	if layer < 0 && len(node.entries) > 0 {
+		layer = keyLayer(node.entries[0].key)
+	}
+	v.walkNode(c, node, layer)
+}
+
+func (v *mstVerifier) walkNode(c cid.Cid, node *mstNode, layer int) {
+	v.report.Nodes++
+	if node.left.Defined() {
+		v.subtree(c, node.left, layer)
+	}
+	for _, e := range node.entries {
+		if l := keyLayer(e.key); l != layer {
+			v.report.problem(CheckMST, c, e.key, "key belongs on layer %d, found on layer %d", l, layer)
+		}
+		if !validMSTKey(e.key) {
+			v.report.problem(CheckMST, c, e.key, "invalid key")
+		}
+		if len(v.lastKey) > 0 && e.key <= v.lastKey {
+			v.report.problem(CheckMST, c, e.key, "key is not sorted after %q", v.lastKey)
+		}
+		v.lastKey = e.key
+		v.report.Records++
+		if !v.blocks.Has(e.value) {
+			v.report.problem(CheckMissing, e.value, e.key, "record block not found")
+		}
+		if e.tree.Defined() {
+			v.subtree(c, e.tree, layer)
+		}
+	}
+}
+
+func (v *mstVerifier) subtree(parent, c cid.Cid, layer int) {
+	if layer == 0 {
+		v.report.problem(CheckMST, parent, "", "node on layer 0 has a subtree")
+		v.walk(c, -1)
+		return
+	}
+	v.walk(c, layer-1)
+}
+
+func (v *mstVerifier) node(c cid.Cid) (*mstNode, bool) {
+	raw, ok := v.blocks.Get(c)
+	if !ok {
+		v.report.problem(CheckMissing, c, "", "mst node not found")
+		return nil, false
+	}
+	node, err := decodeMSTNode(raw)
+	if err != nil {
+		v.report.problem(CheckMST, c, "", "failed to decode node: %v", err)
+		return nil, false
+	}
+	return node, true
+}
+
+func decodeMSTNode(raw []byte) (*mstNode, error) {
+	obj, err := data.UnmarshalCBOR(raw)
+	if err != nil {
+		return nil, err
+	}
+	var node mstNode
+	switch l := obj["l"].(type) {
+	case nil:
+	case data.CIDLink:
+		node.left = l.CID()
+	default:
+		return nil, errors.Errorf("invalid left link type %T", l)
+	}
+	rawEntries, ok := obj["e"].([]any)
+	if !ok {
+		return nil, errors.New("node has no entries list")
+	}
+	var prev string
+	for i, re := range rawEntries {
+		m, ok := re.(map[string]any)
+		if !ok {
+			return nil, errors.Errorf("entry %d is not an object", i)
+		}
+		p, ok := m["p"].(int64)
+		if !ok || p < 0 || int(p) > len(prev) {
+			return nil, errors.Errorf("entry %d has an invalid prefix length", i)
+		}
+		k, ok := m["k"].(data.Bytes)
+		if !ok {
+			return nil, errors.Errorf("entry %d has an invalid key suffix", i)
+		}
+		val, ok := m["v"].(data.CIDLink)
+		if !ok {
+			return nil, errors.Errorf("entry %d has an invalid value", i)
+		}
+		e := mstEntry{key: prev[:p] + string(k), value: val.CID()}
+		switch t := m["t"].(type) {
+		case nil:
+		case data.CIDLink:
+			e.tree = t.CID()
+		default:
+			return nil, errors.Errorf("entry %d has an invalid tree link type %T", i, t)
+		}
+		node.entries = append(node.entries, e)
+		prev = e.key
+	}
+	return &node, nil
+}
+
+// keyLayer counts the leading pairs of zero bits in the sha256 hash of an MST
+// key.
+func keyLayer(key string) (zeros int) {
+	sum := sha256.Sum256([]byte(key))
+	for _, b := range sum {
+		if b == 0 {
+			zeros += 4
+			continue
+		}
+		for mask := byte(0xC0); mask != 0 && b&mask == 0; mask >>= 2 {
+			zeros++
+		}
+		break
+	}
+	return zeros
+}
+
+func validMSTKey(key string) bool {
+	collection, rkey, ok := strings.Cut(key, "/")
+	if !ok || len(key) > 256 {
+		return false
+	}
+	if _, err := syntax.ParseNSID(collection); err != nil {
+		return false
+	}
+	_, err := syntax.ParseRecordKey(rkey)
+	return err == nil
+}
@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/ipfs/go-cid"
+	"github.com/matryer/is"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := t.Context()
+	is := is.New(t)
+	key, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	pub, err := key.PublicKey()
+	is.NoErr(err)
+	keyfn := func(context.Context, string) (crypto.PublicKey, error) { return pub, nil }
+
+	bm := NewBlockMap()
+	r := New("did:plc:nsu4iq7726acidyqpha2zuk3", NewMemoryBlockstore(bm), signer(key))
+	// enough records to span multiple mst layers
+	for range 100 {
+		rkey := NextTID().String()
+		_, err = r.PutRecord(ctx, "app.bsky.feed.post", rkey, map[string]any{
+			"$type": "app.bsky.feed.post",
+			"text":  "hello " + rkey,
+		})
+		is.NoErr(err)
+	}
+	root, _, err := r.Commit(ctx)
+	is.NoErr(err)
+
+	report := Verify(ctx, root, bm, keyfn)
+	is.True(report.OK())
+	is.Equal(report.Signature, SignatureValid)
+	is.Equal(report.Records, 100)
+	is.True(report.Nodes > 1)
+	is.Equal(report.DID, "did:plc:nsu4iq7726acidyqpha2zuk3")
+
+	report = Verify(ctx, root, bm, nil)
+	is.True(report.OK())
+	is.Equal(report.Signature, SignatureSkipped)
+
+	other, err := crypto.GeneratePrivateKeyK256()
+	is.NoErr(err)
+	otherPub, err := other.PublicKey()
+	is.NoErr(err)
+	report = Verify(ctx, root, bm, func(context.Context, string) (crypto.PublicKey, error) { return otherPub, nil })
+	is.True(!report.OK())
+	is.Equal(report.Signature, SignatureInvalid)
+	is.Equal(report.Problems[0].Check, CheckSignature)
+
+	// corrupt one record and remove another
+	var recordCids []cid.Cid
+	err = r.Walk(ctx, func(_, _ string, c cid.Cid) error {
+		recordCids = append(recordCids, c)
+		return nil
+	})
+	is.NoErr(err)
+	bm.Set(recordCids[0], []byte("not the original bytes"))
+	bm.Delete(recordCids[1])
+	report = Verify(ctx, root, bm, keyfn)
+	is.Equal(len(report.Problems), 2)
+	checks := map[string]bool{}
+	for _, p := range report.Problems {
+		checks[p.Check] = true
+	}
+	is.True(checks[CheckBlockHash])
+	is.True(checks[CheckMissing])
+}
+
+func TestKeyLayer(t *testing.T) {
+	is := is.New(t)
+	// test vectors from the atproto repository spec
+	for key, layer := range map[string]int{
+		"2653ae71":                        0,
+		"blue":                            1,
+		"app.bsky.feed.post/454397e440ec": 4,
+		"app.bsky.feed.post/9adeb165882c": 8,
+	} {
+		is.Equal(keyLayer(key), layer)
+	}
+}
@@ -0,0 +1,204 @@
+// Package ssrf protects outbound requests to user supplied urls from reaching
+// internal services.
+package ssrf
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrForbiddenAddress = errors.New("ssrf: address is not allowed")
+	ErrTooManyRedirects = errors.New("ssrf: too many redirects")
+	ErrResponseTooLarge = errors.New("ssrf: response too large")
+)
+
+// blocked are the address ranges that are never dialed: loopback, private,
+// link-local (which has cloud metadata services), shared, multicast and
+// reserved networks. The 6to4 and Teredo tunnels are blocked as well since
+// they can carry any ipv4 address.
+var blocked = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// nat64 embeds an ipv4 address in the last 32 bits.
+var nat64 = netip.MustParsePrefix("64:ff9b::/96")
+
+// Allowed returns true if ip is a public address.
+func Allowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if nat64.Contains(ip) {
+		b := ip.As16()
+		ip = netip.AddrFrom4([4]byte(b[12:]))
+	}
+	for _, p := range blocked {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return ip.IsValid()
+}
+
+// Control checks the address of a connection right before it is made, after
+// any dns lookups. It is meant to be used as a [net.Dialer] Control function.
+func Control(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return errors.Wrap(ErrForbiddenAddress, err.Error())
+	}
+	if !Allowed(addr.Addr()) {
+		return errors.Wrapf(ErrForbiddenAddress, "%s", addr.Addr())
+	}
+	return nil
+}
+
+// Protect makes t refuse to connect to addresses that are not public. Proxies
+// from the environment are turned off since they would be dialed instead of
+// the real destination.
+func Protect(t *http.Transport) *http.Transport {
+	t.Proxy = nil
+	t.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   Control,
+	}).DialContext
+	return t
+}
+
+// ClientOpts configures a client from [NewClient].
+type ClientOpts struct {
+	// MaxRedirects is how many redirects are followed. Defaults to 5.
+	MaxRedirects int
+	// MaxResponseSize is the largest response body in bytes. There is no
+	// limit when it is zero.
+	MaxResponseSize int64
+	// Timeout limits the whole request. Defaults to 30 seconds.
+	Timeout time.Duration
+	// Unprotected turns off the address checks but keeps the other limits.
+	Unprotected bool
+	// AllowedHosts are trusted hosts, like a configured plc directory, that
+	// may be at private addresses. They are compared to the host and port of
+	// each request url, so redirects elsewhere are still checked.
+	AllowedHosts []string
+}
+
+// NewClient creates an http client for fetching user supplied urls.
+func NewClient(opts *ClientOpts) *http.Client {
+	maxRedirects := opts.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = 5
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	var rt http.RoundTripper = t
+	if !opts.Unprotected {
+		Protect(t)
+		if len(opts.AllowedHosts) > 0 {
+			rt = &allowTransport{
+				protected: t,
+				trusted:   http.DefaultTransport.(*http.Transport).Clone(),
+				hosts:     opts.AllowedHosts,
+			}
+		}
+	}
+	if opts.MaxResponseSize > 0 {
+		rt = &limitTransport{rt: rt, max: opts.MaxResponseSize}
+	}
+	return &http.Client{
+		Transport: rt,
+		Timeout:   timeout,
+		// Each redirect is dialed with the same checks.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return ErrTooManyRedirects
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.Errorf("ssrf: cannot redirect to %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// allowTransport sends requests for trusted hosts without the address checks.
+type allowTransport struct {
+	protected, trusted http.RoundTripper
+	hosts              []string
+}
+
+func (t *allowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if slices.Contains(t.hosts, req.URL.Host) {
+		return t.trusted.RoundTrip(req)
+	}
+	return t.protected.RoundTrip(req)
+}
+
+type limitTransport struct {
+	rt  http.RoundTripper
+	max int64
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.ContentLength > t.max {
+		res.Body.Close()
+		return nil, ErrResponseTooLarge
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, n: t.max}
+	return res, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return n + int(b.n), ErrResponseTooLarge
+	}
+	return n, err
+}
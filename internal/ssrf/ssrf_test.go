@@ -0,0 +1,90 @@
+package ssrf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+)
+
+func TestAllowed(t *testing.T) {
+	is := is.New(t)
+	for _, tt := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.20.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00:ec2::254", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::101:101", true},
+		{"2002:a00:1::1", false},               // 6to4 of 10.0.0.1
+		{"2001:0:4136:e378::f5ff:fffe", false}, // teredo
+		{"2001:4860:4860::8888", true},
+	} {
+		is.Equal(Allowed(netip.MustParseAddr(tt.ip)), tt.allowed) // tt.ip
+	}
+}
+
+func TestClient(t *testing.T) {
+	is := is.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/redirect", http.StatusFound)
+		case "/large":
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write([]byte(strings.Repeat("a", 100)))
+		case "/stream":
+			for range 10 {
+				_, _ = w.Write([]byte(strings.Repeat("a", 10)))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	_, err := NewClient(&ClientOpts{}).Get(srv.URL)
+	is.True(errors.Is(err, ErrForbiddenAddress))
+	host := strings.TrimPrefix(srv.URL, "http://")
+	res, err := NewClient(&ClientOpts{AllowedHosts: []string{host}}).Get(srv.URL)
+	is.NoErr(err) // trusted hosts can be private
+	res.Body.Close()
+	_, err = NewClient(&ClientOpts{AllowedHosts: []string{"plc.test"}}).Get(srv.URL)
+	is.True(errors.Is(err, ErrForbiddenAddress))
+
+	c := NewClient(&ClientOpts{MaxRedirects: 2, MaxResponseSize: 50, Unprotected: true})
+	res, err = c.Get(srv.URL)
+	is.NoErr(err)
+	b, err := io.ReadAll(res.Body)
+	is.NoErr(err)
+	is.Equal(string(b), "ok")
+	res.Body.Close()
+	_, err = c.Get(srv.URL + "/redirect")
+	is.True(errors.Is(err, ErrTooManyRedirects))
+	_, err = c.Get(srv.URL + "/large")
+	is.True(errors.Is(err, ErrResponseTooLarge))
+	res, err = c.Get(srv.URL + "/stream")
+	is.NoErr(err)
+	_, err = io.ReadAll(res.Body)
+	is.True(errors.Is(err, ErrResponseTooLarge))
+	res.Body.Close()
+}
@@ -385,6 +385,7 @@ func (g *Generator) GenClients(outDir string) error {
 		imports := make(map[string]*Import)
 		for _, pair := range group.Pairs {
 			addClientImports(imports, pair.K.GetDef())
+			g.addPaginatorImports(imports, pair.K.GetDef())
 		}
 
 		p := printer(f)
@@ -458,6 +459,9 @@ type %[2]sClient struct {
 	}
 	return &response, nil
 }` + "\n\n")
+					if err = g.genPaginator(f, pair.K, typ); err != nil {
+						return err
+					}
 				case lex.EncodingANY, lex.EncodingCAR, lex.EncodingMP4:
 					p("\treturn resbody, nil\n}\n\n")
 				default:
@@ -1,6 +1,7 @@
 package lexgen
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/matryer/is"
@@ -278,3 +279,75 @@ func TestDuplicateInnerUnion(t *testing.T) {
 	is.Equal("FeedReplyRefRootUnion", g.typeName(replyRef.Properties["root"], replyRef.DefName))
 	is.Equal("FeedReplyRefParentUnion", g.typeName(replyRef.Properties["parent"], replyRef.DefName))
 }
+
+func TestPaginator(t *testing.T) {
+	is := is.New(t)
+	schema := &lex.Schema{
+		Lexicon: 1,
+		ID:      "com.atproto.repo.listRecords",
+		Defs: map[string]*lex.TypeSchema{
+			"main": {
+				Type: lex.TypeQuery,
+				Parameters: &lex.TypeSchema{
+					Type:     lex.TypeParams,
+					Required: []string{"repo", "collection"},
+					Properties: map[string]*lex.TypeSchema{
+						"repo":       {Type: lex.TypeString, Format: lex.FmtAtIdentifier},
+						"collection": {Type: lex.TypeString, Format: lex.FmtNSID},
+						"limit":      {Type: lex.TypeInt},
+						"cursor":     {Type: lex.TypeString},
+					},
+				},
+				Output: &lex.OutputType{
+					Encoding: lex.EncodingJSON,
+					Schema: &lex.TypeSchema{
+						Type:     lex.TypeObject,
+						Required: []string{"records"},
+						Properties: map[string]*lex.TypeSchema{
+							"cursor": {Type: lex.TypeString},
+							"records": {
+								Type:  lex.TypeArray,
+								Items: &lex.TypeSchema{Type: lex.TypeRef, Ref: "#record"},
+							},
+						},
+					},
+				},
+			},
+			"record": {
+				Type:     lex.TypeObject,
+				Required: []string{"uri", "cid", "value"},
+				Properties: map[string]*lex.TypeSchema{
+					"uri":   {Type: lex.TypeString, Format: lex.FmtATURI},
+					"cid":   {Type: lex.TypeString, Format: lex.FmtCID},
+					"value": {Type: lex.TypeUnknown},
+				},
+			},
+		},
+	}
+	g := NewGenerator("github.com/harrybrwn/at/api")
+	g.AddSchema(schema)
+	fg, err := g.NewGenerator(schema)
+	is.NoErr(err)
+	key, items := paginatedItems(schema.Defs["main"])
+	is.Equal(key, "records")
+	is.True(items != nil)
+
+	var st *StructType
+	for _, typ := range fg.Types {
+		if typ.Def == schema.Defs["main"] {
+			st = typ
+		}
+	}
+	is.True(st != nil)
+	var buf strings.Builder
+	is.NoErr(g.genPaginator(&buf, st, "Repo"))
+	out := buf.String()
+	is.True(strings.Contains(out, "func (c *RepoClient) ListRecordsIter(ctx context.Context, params *RepoListRecordsParams, limit int) iter.Seq2[RepoListRecordsRecord, error]"))
+	is.True(strings.Contains(out, "range res.Records"))
+	is.True(strings.Contains(out, "p.Cursor = &cursor"))
+
+	// queries without an output cursor are not paginated
+	delete(schema.Defs["main"].Output.Schema.Properties, "cursor")
+	_, items = paginatedItems(schema.Defs["main"])
+	is.True(items == nil)
+}
@@ -0,0 +1,131 @@
+package lexgen
+
+import (
+	"io"
+	"strings"
+
+	"github.com/harrybrwn/at/internal/str"
+	"github.com/harrybrwn/at/lex"
+)
+
+// paginatedItems returns the name and schema of the array property that
+// holds the results of a query which pages through them with a "cursor"
+// parameter and a "cursor" output field. The returned schema is nil if the
+// query cannot be paginated.
+func paginatedItems(def *lex.TypeSchema) (string, *lex.TypeSchema) {
+	if def == nil || def.Type != lex.TypeQuery ||
+		def.Parameters == nil || def.Output == nil ||
+		def.Output.Encoding != lex.EncodingJSON ||
+		def.Output.Schema == nil ||
+		def.Output.Schema.Type != lex.TypeObject {
+		return "", nil
+	}
+	if cursor, ok := def.Parameters.Properties["cursor"]; !ok || cursor.Type != lex.TypeString {
+		return "", nil
+	}
+	if cursor, ok := def.Output.Schema.Properties["cursor"]; !ok || cursor.Type != lex.TypeString {
+		return "", nil
+	}
+	var (
+		name  string
+		items *lex.TypeSchema
+	)
+	for key, prop := range IterMap(def.Output.Schema.Properties) {
+		if prop.Type != lex.TypeArray || prop.Items == nil {
+			continue
+		}
+		if items != nil {
+			// more than one list of results is ambiguous
+			return "", nil
+		}
+		name, items = key, prop
+	}
+	return name, items
+}
+
+// addPaginatorImports adds the imports needed by the paginator generated for
+// a query.
+func (g *Generator) addPaginatorImports(imports map[string]*Import, def *lex.TypeSchema) {
+	key, items := paginatedItems(def)
+	if items == nil {
+		return
+	}
+	addImport(imports, "iter")
+	if items.Items.Type == lex.TypeRef {
+		ref := newRef(g.BasePackage, items.Items.SchemaID, items.Items.Ref)
+		if ref.HasImport() {
+			imports[ref.Import.Path] = &Import{Name: ref.Import.Name, Path: ref.Import.Path}
+		}
+		return
+	}
+	itemType := strings.TrimLeft(g.typeName(items, key), "[]*")
+	switch {
+	case strings.HasPrefix(itemType, "syntax."):
+		addImport(imports, "github.com/bluesky-social/indigo/atproto/syntax")
+	case strings.HasPrefix(itemType, "cid."):
+		addImport(imports, "github.com/ipfs/go-cid")
+	case strings.HasPrefix(itemType, "util."):
+		addImport(imports, "github.com/bluesky-social/indigo/lex/util")
+	}
+}
+
+// genPaginator writes an iterator method to a client that calls a query
+// until the server stops returning a cursor.
+func (g *Generator) genPaginator(w io.Writer, st *StructType, clientType string) error {
+	def := st.GetDef()
+	key, items := paginatedItems(def)
+	if items == nil {
+		return nil
+	}
+	var (
+		p        = printer(w)
+		name     = st.StructName()
+		method   = str.Title(lastDot(def.SchemaID))
+		itemType = strings.TrimPrefix(g.typeName(items, key), "[]")
+		setter   = "p.Cursor = &cursor"
+	)
+	if def.Parameters.IsRequired("cursor") {
+		setter = "p.Cursor = cursor"
+	}
+	p(`// %[2]sIter pages through the results of %[2]s. The iterator stops when
+// there are no more results, after limit items when limit is greater than
+// zero or when the context is cancelled.
+func (c *%[1]sClient) %[2]sIter(ctx context.Context, params *%[3]sParams, limit int) iter.Seq2[%[4]s, error] {
+	return func(yield func(%[4]s, error) bool) {
+		var (
+			n    int
+			p    %[3]sParams
+			zero %[4]s
+		)
+		if params != nil {
+			p = *params
+		}
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(zero, errors.WithStack(err))
+				return
+			}
+			res, err := c.%[2]s(ctx, &p)
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			for _, item := range res.%[5]s {
+				if !yield(item, nil) {
+					return
+				}
+				n++
+				if limit > 0 && n >= limit {
+					return
+				}
+			}
+			if len(res.Cursor) == 0 || len(res.%[5]s) == 0 {
+				return
+			}
+			cursor := res.Cursor
+			%[6]s
+		}
+	}
+}`+"\n\n", clientType, method, name, itemType, str.Title(key), setter)
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/harrybrwn/xdg"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/harrybrwn/at/api/com/atproto"
+	"github.com/harrybrwn/at/oauth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+// savedSession is the session stored by "at login". Only one of Password and
+// OAuth is set.
+type savedSession struct {
+	PDS      string         `json:"pds"`
+	Password *xrpc.Auth     `json:"password,omitempty"`
+	OAuth    *oauth.Session `json:"oauth,omitempty"`
+}
+
+func sessionFile() string {
+	return filepath.Join(xdg.Config("at"), "session.json")
+}
+
+func newLoginCmd(cx *Context) *cobra.Command {
+	var (
+		useOAuth bool
+		password string
+		timeout  = 5 * time.Minute
+	)
+	c := cobra.Command{
+		Use:   "login <handle|did|pds-url>",
+		Short: "Sign in to a PDS and save the session",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			var (
+				session *savedSession
+				err     error
+			)
+			if useOAuth {
+				ctx, cancel := context.WithTimeout(ctx, timeout)
+				defer cancel()
+				session, err = oauthLogin(ctx, cx, cmd, args[0])
+			} else {
+				if len(password) == 0 {
+					password = os.Getenv("AT_PASSWORD")
+				}
+				if len(password) == 0 {
+					return errors.New("a password is required, use --password or $AT_PASSWORD")
+				}
+				if strings.HasPrefix(args[0], "https://") || strings.HasPrefix(args[0], "http://") {
+					return errors.New("signing in with a PDS url needs --oauth")
+				}
+				session, err = passwordLogin(ctx, cx, args[0], password)
+			}
+			if err != nil {
+				return err
+			}
+			if err = saveSession(session); err != nil {
+				return err
+			}
+			did := session.PDS
+			if session.OAuth != nil {
+				did = session.OAuth.DID
+			} else if session.Password != nil {
+				did = session.Password.DID
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "signed in as %s\n", did)
+			return nil
+		},
+	}
+	c.Flags().BoolVar(&useOAuth, "oauth", useOAuth, "sign in with oauth in the browser")
+	c.Flags().StringVarP(&password, "password", "p", password, "account or app password")
+	c.Flags().DurationVar(&timeout, "timeout", timeout, "how long to wait for the browser sign in")
+	return &c
+}
+
+// oauthLogin runs the oauth flow as a loopback client. The user is sent to
+// their authorization server and redirected back to a local http server.
+func oauthLogin(ctx context.Context, cx *Context, cmd *cobra.Command, identifier string) (*savedSession, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer l.Close()
+	const scope = "atproto transition:generic"
+	redirect := fmt.Sprintf("http://%s/callback", l.Addr().String())
+	client := oauth.Client{
+		HTTP:        cx.client,
+		Directory:   cx.dir,
+		ClientID:    oauth.LoopbackClientID(redirect, scope),
+		RedirectURI: redirect,
+		Scope:       scope,
+	}
+	req, err := client.Authorize(ctx, identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	callback := make(chan url.Values, 1)
+	srv := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/callback" {
+				http.NotFound(w, r)
+				return
+			}
+			select {
+			case callback <- r.URL.Query():
+				fmt.Fprintln(w, "Signed in, you can close this window.")
+			default:
+				http.Error(w, "Already signed in", http.StatusConflict)
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	fmt.Fprintf(cmd.ErrOrStderr(), "Opening %s\n", req.URL)
+	if err = urlOpen(req.URL); err != nil {
+		fmt.Fprintln(cmd.ErrOrStderr(), "Could not open a browser, open the link above to continue.")
+	}
+	var query url.Values
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "timed out waiting for the browser sign in")
+	case query = <-callback:
+	}
+	session, err := client.Callback(ctx, req, query)
+	if err != nil {
+		return nil, err
+	}
+	return &savedSession{PDS: session.PDS, OAuth: session}, nil
+}
+
+func passwordLogin(ctx context.Context, cx *Context, identifier, password string) (*savedSession, error) {
+	id, err := syntax.ParseAtIdentifier(identifier)
+	if err != nil {
+		return nil, err
+	}
+	ident, err := cx.dir.Lookup(ctx, *id)
+	if err != nil {
+		return nil, err
+	}
+	cli := xrpc.NewClient(xrpc.WithURL(ident.PDSEndpoint()), xrpc.WithClient(HttpClient))
+	res, err := atproto.NewServerClient(cli).CreateSession(ctx, &atproto.ServerCreateSessionRequest{
+		Identifier: identifier,
+		Password:   password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &savedSession{
+		PDS: ident.PDSEndpoint(),
+		Password: &xrpc.Auth{
+			AccessJwt:  res.AccessJwt,
+			RefreshJwt: res.RefreshJwt,
+			Handle:     res.Handle.String(),
+			DID:        res.DID.String(),
+		},
+	}, nil
+}
+
+func saveSession(s *savedSession) error {
+	file := sessionFile()
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(file, b, 0o600))
+}
+
+func loadSession() (*savedSession, error) {
+	b, err := os.ReadFile(sessionFile())
+	if err != nil {
+		return nil, err
+	}
+	var s savedSession
+	if err = json.Unmarshal(b, &s); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if s.OAuth != nil {
+		s.OAuth.HTTP = HttpClient
+		s.OAuth.OnRefresh = func(*oauth.Session) {
+			if err := saveSession(&s); err != nil {
+				slog.Warn("failed to save refreshed session", "error", err)
+			}
+		}
+	}
+	return &s, nil
+}
+
+// pdsClient creates a client for a PDS. The saved session is used when it
+// belongs to that PDS.
+func pdsClient(pds string) *xrpc.Client {
+	opts := []xrpc.ClientOption{xrpc.WithEnv(), xrpc.WithURL(pds), xrpc.WithClient(HttpClient)}
+	if s, err := loadSession(); err == nil && s.PDS == pds {
+		switch {
+		case s.OAuth != nil:
+			opts = append(opts, xrpc.WithAuthorizer(s.OAuth))
+		case s.Password != nil:
+			auth := *s.Password
+			opts = append(opts, func(c *xrpc.Client) {
+				if c.Auth == nil {
+					c.Auth = &auth
+				}
+			})
+		}
+	}
+	return xrpc.NewClient(opts...)
+}
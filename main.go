@@ -90,6 +90,9 @@ func NewRootCmd() *cobra.Command {
 		newServerCmd(),
 		newResolveCmd(ctx),
 		newServiceJwtCmd(),
+		newRepoCmd(ctx),
+		newLoginCmd(ctx),
+		newAdminCmd(ctx),
 	)
 	c.Flags().BoolVarP(&ctx.verbose, "verbose", "v", ctx.verbose, "verbose output")
 	c.Flags().BoolVarP(&ctx.history, "history", "H", ctx.history, "show did:plc history")
@@ -97,6 +100,7 @@ func NewRootCmd() *cobra.Command {
 	c.PersistentFlags().BoolVar(&ctx.purge, "purge", ctx.purge, "purge cache when before doing a resource lookup")
 	c.PersistentFlags().StringVar(&ctx.cursor, "cursor", "", "cursor for fetching lists")
 	c.PersistentFlags().IntVar(&ctx.limit, "limit", ctx.limit, "limit when fetching lists")
+	c.PersistentFlags().BoolVarP(&ctx.all, "all", "a", ctx.all, "fetch every page when fetching lists, ignoring --limit")
 	c.PersistentFlags().BoolVar(&ctx.noCache, "no-cache", ctx.noCache, "disable caching")
 	c.PersistentFlags().StringVarP(&logLevelStr, "log-level", "l", logLevelStr, "set the log level (debug|info|warn|error)")
 	c.PersistentFlags().BoolVarP(&debug, "debug", "d", debug, "turn on debug mode")
@@ -177,7 +181,7 @@ func view(c *Context, arg string) error {
 			fmt.Println()
 			fmt.Println("avatar:", blobURL(client.pds, did, cid))
 		default:
-			cli := xrpc.NewClient(xrpc.WithEnv(), xrpc.WithURL(ident.PDSEndpoint()), xrpc.WithClient(HttpClient))
+			cli := pdsClient(ident.PDSEndpoint())
 			record, err := atproto.NewRepoClient(cli).GetRecord(c.ctx, &atproto.RepoGetRecordParams{
 				Repo:       &syntax.AtIdentifier{Inner: did},
 				Collection: collection,
@@ -203,21 +207,26 @@ func view(c *Context, arg string) error {
 			fmt.Println(res)
 
 		default:
-			records, err := client.ListRecords(c.ctx, did, collection, c.limit, c.cursor)
-			if err != nil {
-				return err
+			cli := pdsClient(ident.PDSEndpoint())
+			params := atproto.RepoListRecordsParams{
+				Repo:       &syntax.AtIdentifier{Inner: did},
+				Collection: collection,
+				Limit:      c.pageSize(),
+				Cursor:     c.startCursor(),
 			}
-			if c.verbose {
-				for _, record := range records.Records {
+			records := atproto.NewRepoClient(cli).ListRecordsIter(c.ctx, &params, c.listLimit())
+			for record, err := range records {
+				if err != nil {
+					return err
+				}
+				if c.verbose {
 					err = jsonIndent(os.Stdout, record)
 					if err != nil {
 						return err
 					}
 					fmt.Println()
-				}
-			} else {
-				for _, record := range records.Records {
-					fmt.Println(record.Cid, record.URI)
+				} else {
+					fmt.Println(record.CID, record.URI)
 				}
 			}
 		}
@@ -225,7 +234,7 @@ func view(c *Context, arg string) error {
 		fmt.Printf("did:      %s\n", did)
 		fmt.Printf("alias:    %s\n", ident.Handle)
 		fmt.Printf("endpoint: %s\n", ident.PDSEndpoint())
-		cli := xrpc.NewClient(xrpc.WithEnv(), xrpc.WithURL(ident.PDSEndpoint()), xrpc.WithClient(HttpClient))
+		cli := pdsClient(ident.PDSEndpoint())
 		repo, err := atproto.NewRepoClient(cli).DescribeRepo(c.ctx, &atproto.RepoDescribeRepoParams{
 			Repo: &syntax.AtIdentifier{Inner: did},
 		})
@@ -360,13 +369,18 @@ func newBlobCmd(ctx *Context) *cobra.Command {
 					fmt.Println(u)
 				}
 			} else {
-				client := XRPCClient{pds: ident.PDSEndpoint()}
-				blobs, err := client.ListBlobs(ctx.ctx, ident.DID, ctx.limit, ctx.cursor)
-				if err != nil {
-					return err
+				cli := pdsClient(ident.PDSEndpoint())
+				params := atproto.SyncListBlobsParams{
+					DID:    ident.DID,
+					Limit:  ctx.pageSize(),
+					Cursor: ctx.startCursor(),
 				}
-				for _, cid := range blobs.CIDs {
-					fmt.Printf("\"%[3]s/xrpc/com.atproto.sync.getBlob?did=%[1]s&cid=%[2]s\"\n", ident.DID, cid, client.pds)
+				blobs := atproto.NewSyncClient(cli).ListBlobsIter(ctx.ctx, &params, ctx.listLimit())
+				for cid, err := range blobs {
+					if err != nil {
+						return err
+					}
+					fmt.Printf("\"%[3]s/xrpc/com.atproto.sync.getBlob?did=%[1]s&cid=%[2]s\"\n", ident.DID, cid, ident.PDSEndpoint())
 				}
 			}
 			return nil
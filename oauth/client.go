@@ -0,0 +1,493 @@
+package oauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/pkg/errors"
+
+	"github.com/harrybrwn/at/internal/auth"
+)
+
+// Error is an error response from an authorization server.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	Status      int    `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Description) == 0 {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// Client is an atproto oauth client. It finds the authorization server of an
+// account, pushes an authorization request and exchanges the code it gets
+// back for a DPoP bound [Session].
+type Client struct {
+	HTTP        *http.Client
+	Directory   identity.Directory
+	ClientID    string
+	RedirectURI string
+	Scope       string
+}
+
+// AuthRequest is an authorization that is waiting on the user. Send the user
+// to URL and pass the query of the redirect back to [Client.Callback].
+type AuthRequest struct {
+	URL      string
+	State    string
+	Verifier string
+	// DID is the account that the user is expected to sign in with. It is
+	// empty when the flow was started with a server url.
+	DID    string
+	PDS    string
+	Server *AuthorizationServerMetadata
+	key    *ecdsa.PrivateKey
+	nonces *nonces
+}
+
+// LoopbackClientID is the client id of a loopback client that redirects to
+// redirectURI.
+func LoopbackClientID(redirectURI, scope string) string {
+	return "http://localhost?" + url.Values{
+		"redirect_uri": {redirectURI},
+		"scope":        {scope},
+	}.Encode()
+}
+
+// Authorize starts an authorization. The identifier is a handle or did, or
+// the url of a PDS or authorization server when the account isn't known yet.
+func (c *Client) Authorize(ctx context.Context, identifier string) (*AuthRequest, error) {
+	var (
+		req = AuthRequest{nonces: newNonces()}
+		err error
+	)
+	if strings.HasPrefix(identifier, "https://") || strings.HasPrefix(identifier, "http://") {
+		req.PDS = strings.TrimSuffix(identifier, "/")
+	} else {
+		id, err := syntax.ParseAtIdentifier(strings.TrimPrefix(identifier, "@"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid handle or did")
+		}
+		ident, err := c.Directory.Lookup(ctx, *id)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to resolve account")
+		}
+		req.DID = ident.DID.String()
+		req.PDS = ident.PDSEndpoint()
+		if len(req.PDS) == 0 {
+			return nil, errors.Errorf("%s has no PDS", identifier)
+		}
+	}
+	req.Server, err = c.ResolveAuthServer(ctx, req.PDS)
+	if err != nil {
+		return nil, err
+	}
+	req.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pkce, err := NewPKCE()
+	if err != nil {
+		return nil, err
+	}
+	req.Verifier = pkce.Verifier
+	req.State, err = randomString()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"client_id":             {c.ClientID},
+		"response_type":         {"code"},
+		"redirect_uri":          {c.RedirectURI},
+		"scope":                 {c.Scope},
+		"state":                 {req.State},
+		"code_challenge":        {pkce.Challenge},
+		"code_challenge_method": {pkce.Method},
+	}
+	if len(req.DID) > 0 && !strings.HasPrefix(identifier, "did:") {
+		form.Set("login_hint", strings.TrimPrefix(identifier, "@"))
+	}
+	var par struct {
+		RequestURI string `json:"request_uri"`
+	}
+	err = postDPoP(ctx, c.httpClient(), req.key, req.nonces, req.Server.PushedAuthorizationRequestEndpoint, form, &par)
+	if err != nil {
+		return nil, errors.Wrap(err, "pushed authorization request failed")
+	}
+	u, err := url.Parse(req.Server.AuthorizationEndpoint)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	u.RawQuery = url.Values{
+		"client_id":   {c.ClientID},
+		"request_uri": {par.RequestURI},
+	}.Encode()
+	req.URL = u.String()
+	return &req, nil
+}
+
+// Callback finishes an authorization with the query parameters of the
+// redirect.
+func (c *Client) Callback(ctx context.Context, req *AuthRequest, query url.Values) (*Session, error) {
+	if query.Get("state") != req.State {
+		return nil, errors.New("oauth state mismatch")
+	}
+	if query.Has("error") {
+		return nil, &Error{Code: query.Get("error"), Description: query.Get("error_description")}
+	}
+	if iss := query.Get("iss"); iss != req.Server.Issuer {
+		return nil, errors.Errorf("unexpected issuer %q", iss)
+	}
+	var tok tokenResponse
+	err := postDPoP(ctx, c.httpClient(), req.key, req.nonces, req.Server.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {c.ClientID},
+		"redirect_uri":  {c.RedirectURI},
+		"code":          {query.Get("code")},
+		"code_verifier": {req.Verifier},
+	}, &tok)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to exchange authorization code")
+	}
+	if tok.TokenType != "DPoP" {
+		return nil, errors.Errorf("unexpected token type %q", tok.TokenType)
+	}
+	pds := req.PDS
+	switch {
+	case len(req.DID) > 0 && tok.Sub != req.DID:
+		return nil, errors.Errorf("signed in as %s instead of %s", tok.Sub, req.DID)
+	case len(req.DID) == 0:
+		// Make sure the account really uses this authorization server.
+		did, err := syntax.ParseDID(tok.Sub)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid token subject")
+		}
+		ident, err := c.Directory.LookupDID(ctx, did)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to resolve account")
+		}
+		pds = ident.PDSEndpoint()
+		server, err := c.ResolveAuthServer(ctx, pds)
+		if err != nil {
+			return nil, err
+		}
+		if server.Issuer != req.Server.Issuer {
+			return nil, errors.Errorf("%s does not use %s for authorization", tok.Sub, req.Server.Issuer)
+		}
+	}
+	s := Session{
+		DID:                tok.Sub,
+		PDS:                pds,
+		Issuer:             req.Server.Issuer,
+		TokenEndpoint:      req.Server.TokenEndpoint,
+		RevocationEndpoint: req.Server.RevocationEndpoint,
+		ClientID:           c.ClientID,
+		DPoPKey:            auth.NewPrivateJWK(req.key),
+		HTTP:               c.HTTP,
+		key:                req.key,
+		nonces:             req.nonces,
+	}
+	s.setTokens(&tok)
+	return &s, nil
+}
+
+// ResolveAuthServer finds the authorization server of a PDS. Servers that
+// are their own authorization server are supported as well.
+func (c *Client) ResolveAuthServer(ctx context.Context, pds string) (*AuthorizationServerMetadata, error) {
+	var (
+		resource ProtectedResourceMetadata
+		issuer   = pds
+	)
+	err := getJSON(ctx, c.httpClient(), pds+"/.well-known/oauth-protected-resource", &resource)
+	if err == nil {
+		if len(resource.AuthorizationServers) == 0 {
+			return nil, errors.Errorf("%s has no authorization servers", pds)
+		}
+		issuer = resource.AuthorizationServers[0]
+	}
+	var md AuthorizationServerMetadata
+	err = getJSON(ctx, c.httpClient(), strings.TrimSuffix(issuer, "/")+"/.well-known/oauth-authorization-server", &md)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get authorization server metadata")
+	}
+	if md.Issuer != issuer {
+		return nil, errors.Errorf("authorization server issuer %q does not match %q", md.Issuer, issuer)
+	}
+	if len(md.PushedAuthorizationRequestEndpoint) == 0 {
+		return nil, errors.New("authorization server does not support pushed authorization requests")
+	}
+	return &md, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return c.HTTP
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	Sub          string `json:"sub"`
+}
+
+// Session is a DPoP bound oauth session. It implements xrpc.Authorizer and
+// refreshes its access token when it expires. Sessions can be stored as
+// json.
+type Session struct {
+	DID                string    `json:"did"`
+	PDS                string    `json:"pds"`
+	Issuer             string    `json:"issuer"`
+	TokenEndpoint      string    `json:"token_endpoint"`
+	RevocationEndpoint string    `json:"revocation_endpoint,omitempty"`
+	ClientID           string    `json:"client_id"`
+	AccessToken        string    `json:"access_token"`
+	RefreshToken       string    `json:"refresh_token"`
+	Scope              string    `json:"scope"`
+	ExpiresAt          time.Time `json:"expires_at"`
+	DPoPKey            *auth.JWK `json:"dpop_key"`
+	// HTTP is used to refresh the session.
+	HTTP *http.Client `json:"-"`
+	// OnRefresh is called after the tokens are refreshed so that they can be
+	// stored. Refresh tokens can only be used once.
+	OnRefresh func(*Session) `json:"-"`
+
+	mu     sync.Mutex
+	key    *ecdsa.PrivateKey
+	nonces *nonces
+}
+
+// Authorize adds the access token and a DPoP proof to a request, refreshing
+// the session first if it has expired.
+func (s *Session) Authorize(req *http.Request) error {
+	key, err := s.dpopKey()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	expired := len(s.RefreshToken) > 0 && time.Now().Add(30*time.Second).After(s.ExpiresAt)
+	s.mu.Unlock()
+	if expired {
+		if err = s.Refresh(req.Context()); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	token := s.AccessToken
+	s.mu.Unlock()
+	htu := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: req.URL.Path}
+	proof, err := auth.CreateDPoPProof(key, req.Method, htu.String(), s.nonces.get(req.URL.Host), token)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "DPoP "+token)
+	req.Header.Set("DPoP", proof)
+	return nil
+}
+
+// Observe remembers the DPoP nonce sent by the server and reports whether the
+// request failed because it used an old nonce.
+func (s *Session) Observe(res *http.Response) bool {
+	changed := s.nonces.observe(res)
+	return changed && res.StatusCode == http.StatusUnauthorized &&
+		strings.Contains(res.Header.Get("WWW-Authenticate"), "use_dpop_nonce")
+}
+
+// Refresh gets a new access token.
+func (s *Session) Refresh(ctx context.Context) error {
+	key, err := s.dpopKey()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	var tok tokenResponse
+	err = postDPoP(ctx, s.httpClient(), key, s.nonces, s.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {s.ClientID},
+		"refresh_token": {s.RefreshToken},
+	}, &tok)
+	if err == nil && tok.Sub != s.DID {
+		err = errors.Errorf("refreshed session is for %s instead of %s", tok.Sub, s.DID)
+	} else if err == nil {
+		s.setTokens(&tok)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to refresh oauth session")
+	}
+	if s.OnRefresh != nil {
+		s.OnRefresh(s)
+	}
+	return nil
+}
+
+// Revoke ends the session.
+func (s *Session) Revoke(ctx context.Context) error {
+	if len(s.RevocationEndpoint) == 0 {
+		return nil
+	}
+	key, err := s.dpopKey()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return postDPoP(ctx, s.httpClient(), key, s.nonces, s.RevocationEndpoint, url.Values{
+		"client_id": {s.ClientID},
+		"token":     {s.RefreshToken},
+	}, nil)
+}
+
+func (s *Session) setTokens(tok *tokenResponse) {
+	s.AccessToken = tok.AccessToken
+	s.RefreshToken = tok.RefreshToken
+	s.Scope = tok.Scope
+	s.ExpiresAt = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+}
+
+// dpopKey parses the session's key after it was loaded from json.
+func (s *Session) dpopKey() (*ecdsa.PrivateKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nonces == nil {
+		s.nonces = newNonces()
+	}
+	if s.key != nil {
+		return s.key, nil
+	}
+	if s.DPoPKey == nil {
+		return nil, errors.New("oauth session has no DPoP key")
+	}
+	key, err := s.DPoPKey.PrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	s.key = key
+	return key, nil
+}
+
+func (s *Session) httpClient() *http.Client {
+	if s.HTTP == nil {
+		return http.DefaultClient
+	}
+	return s.HTTP
+}
+
+// nonces are the last DPoP nonce seen from each host.
+type nonces struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func newNonces() *nonces { return &nonces{m: make(map[string]string)} }
+
+func (n *nonces) get(host string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.m[host]
+}
+
+// observe stores the nonce of a response and reports whether it changed.
+func (n *nonces) observe(res *http.Response) bool {
+	nonce := res.Header.Get("DPoP-Nonce")
+	if len(nonce) == 0 || res.Request == nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	host := res.Request.URL.Host
+	changed := n.m[host] != nonce
+	n.m[host] = nonce
+	return changed
+}
+
+// postDPoP sends a form to an authorization server endpoint with a DPoP
+// proof, retrying once if the server wants a new nonce.
+func postDPoP(ctx context.Context, client *http.Client, key *ecdsa.PrivateKey, n *nonces, endpoint string, form url.Values, dst any) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for attempt := 0; ; attempt++ {
+		proof, err := auth.CreateDPoPProof(key, http.MethodPost, endpoint, n.get(u.Host), "")
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("DPoP", proof)
+		res, err := client.Do(req)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		changed := n.observe(res)
+		body, err := io.ReadAll(io.LimitReader(res.Body, maxMetadataSize))
+		res.Body.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if res.StatusCode >= 400 {
+			e := Error{Status: res.StatusCode}
+			if err = json.Unmarshal(body, &e); err != nil || len(e.Code) == 0 {
+				return errors.Errorf("%s: status %d", endpoint, res.StatusCode)
+			}
+			if e.Code == "use_dpop_nonce" && changed && attempt == 0 {
+				continue
+			}
+			return &e
+		}
+		if dst == nil {
+			return nil
+		}
+		return errors.WithStack(json.Unmarshal(body, dst))
+	}
+}
+
+func getJSON(ctx context.Context, client *http.Client, u string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s: status %d", u, res.StatusCode)
+	}
+	return errors.WithStack(json.NewDecoder(io.LimitReader(res.Body, maxMetadataSize)).Decode(dst))
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,212 @@
+package oauth
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/matryer/is"
+
+	"github.com/harrybrwn/at/internal/auth"
+	"github.com/harrybrwn/at/xrpc"
+)
+
+var testJWTKey = []byte("fe62fcf606785c916f265548c39a3628")
+
+// testServer is a minimal authorization server that approves every request
+// for did:plc:alice.
+type testServer struct {
+	*httptest.Server
+	dpop     *auth.DPoPVerifier
+	mu       sync.Mutex
+	requests map[string]url.Values
+	codes    map[string]url.Values
+	issued   int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ts := testServer{
+		dpop:     auth.NewDPoPVerifier(testJWTKey),
+		requests: make(map[string]url.Values),
+		codes:    make(map[string]url.Values),
+	}
+	mux := http.NewServeMux()
+	ts.Server = httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	mux.HandleFunc("GET /.well-known/oauth-protected-resource", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&ProtectedResourceMetadata{Resource: ts.URL, AuthorizationServers: []string{ts.URL}})
+	})
+	mux.HandleFunc("GET /.well-known/oauth-authorization-server", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&AuthorizationServerMetadata{
+			Issuer:                             ts.URL,
+			AuthorizationEndpoint:              ts.URL + "/oauth/authorize",
+			TokenEndpoint:                      ts.URL + "/oauth/token",
+			PushedAuthorizationRequestEndpoint: ts.URL + "/oauth/par",
+		})
+	})
+	mux.HandleFunc("POST /oauth/par", func(w http.ResponseWriter, r *http.Request) {
+		if !ts.verify(w, r) {
+			return
+		}
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		id := "urn:ietf:params:oauth:request_uri:" + r.PostFormValue("state")
+		ts.requests[id] = r.PostForm
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"request_uri": id})
+	})
+	mux.HandleFunc("GET /oauth/authorize", func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		req, ok := ts.requests[r.URL.Query().Get("request_uri")]
+		if !ok {
+			http.Error(w, "not found", http.StatusBadRequest)
+			return
+		}
+		ts.codes["code-1"] = req
+		u, _ := url.Parse(req.Get("redirect_uri"))
+		u.RawQuery = url.Values{"code": {"code-1"}, "state": {req.Get("state")}, "iss": {ts.URL}}.Encode()
+		http.Redirect(w, r, u.String(), http.StatusSeeOther)
+	})
+	mux.HandleFunc("POST /oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		jkt, ok := ts.verifyJKT(w, r)
+		if !ok {
+			return
+		}
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		switch r.PostFormValue("grant_type") {
+		case "authorization_code":
+			req, ok := ts.codes[r.PostFormValue("code")]
+			delete(ts.codes, r.PostFormValue("code"))
+			if !ok || VerifyPKCE(r.PostFormValue("code_verifier"), req.Get("code_challenge"), "S256") != nil {
+				writeError(w, "invalid_grant")
+				return
+			}
+		case "refresh_token":
+			if r.PostFormValue("refresh_token") != "refresh-1" {
+				writeError(w, "invalid_grant")
+				return
+			}
+		}
+		ts.issued++
+		token, err := auth.CreateOAuthAccessToken(&auth.OAuthTokenOpts{
+			DID:    "did:plc:alice",
+			Scope:  "atproto transition:generic",
+			JKT:    jkt,
+			JWTKey: testJWTKey,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  token,
+			"token_type":    "DPoP",
+			"refresh_token": "refresh-1",
+			"expires_in":    3600,
+			"scope":         "atproto transition:generic",
+			"sub":           "did:plc:alice",
+		})
+	})
+	mux.Handle("GET /xrpc/com.atproto.server.getSession", auth.Required(&auth.Opts{
+		Logger:    slog.Default(),
+		JWTSecret: testJWTKey,
+		DPoP:      ts.dpop,
+		PublicURL: ts.URL,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"did": auth.UserFromContext(r.Context()).DID})
+	})))
+	return &ts
+}
+
+func (ts *testServer) verify(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := ts.verifyJKT(w, r)
+	return ok
+}
+
+func (ts *testServer) verifyJKT(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Set("DPoP-Nonce", ts.dpop.Nonce())
+	jkt, err := ts.dpop.Verify(r.Header.Get("DPoP"), r.Method, ts.URL+r.URL.Path, "")
+	if err != nil {
+		writeError(w, err.(*auth.DPoPError).Code)
+		return "", false
+	}
+	return jkt, true
+}
+
+func writeError(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func TestClient(t *testing.T) {
+	is := is.New(t)
+	ctx := t.Context()
+	ts := newTestServer(t)
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    "did:plc:alice",
+		Handle: "alice.test",
+		Services: map[string]identity.Service{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: ts.URL},
+		},
+	})
+	redirect := "http://127.0.0.1:9999/callback"
+	client := Client{
+		HTTP:        ts.Client(),
+		Directory:   &dir,
+		ClientID:    LoopbackClientID(redirect, "atproto transition:generic"),
+		RedirectURI: redirect,
+		Scope:       "atproto transition:generic",
+	}
+
+	req, err := client.Authorize(ctx, "@alice.test")
+	is.NoErr(err)
+	is.Equal(req.DID, "did:plc:alice")
+	noRedirect := *ts.Client()
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	res, err := noRedirect.Get(req.URL)
+	is.NoErr(err)
+	res.Body.Close()
+	loc, err := url.Parse(res.Header.Get("Location"))
+	is.NoErr(err)
+
+	bad := url.Values{"state": {"other"}, "code": {loc.Query().Get("code")}, "iss": {ts.URL}}
+	_, err = client.Callback(ctx, req, bad)
+	is.True(err != nil)
+	session, err := client.Callback(ctx, req, loc.Query())
+	is.NoErr(err)
+	is.Equal(session.DID, "did:plc:alice")
+	is.Equal(session.PDS, ts.URL)
+
+	// sessions survive being stored
+	raw, err := json.Marshal(session)
+	is.NoErr(err)
+	var loaded Session
+	is.NoErr(json.Unmarshal(raw, &loaded))
+	loaded.HTTP = ts.Client()
+
+	xc := xrpc.NewClient(xrpc.WithURL(ts.URL), xrpc.WithClient(ts.Client()), xrpc.WithAuthorizer(&loaded))
+	body, err := xc.Query(ctx, &xrpc.Request{NSID: "com.atproto.server.getSession"})
+	is.NoErr(err)
+	b, err := io.ReadAll(body)
+	is.NoErr(err)
+	is.NoErr(body.Close())
+	is.Equal(string(b), "{\"did\":\"did:plc:alice\"}\n")
+
+	// expired sessions are refreshed before a request
+	loaded.ExpiresAt = time.Now().Add(-time.Minute)
+	body, err = xc.Query(ctx, &xrpc.Request{NSID: "com.atproto.server.getSession"})
+	is.NoErr(err)
+	is.NoErr(body.Close())
+	is.Equal(ts.issued, 2)
+	is.True(loaded.ExpiresAt.After(time.Now()))
+}
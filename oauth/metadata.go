@@ -0,0 +1,209 @@
+// Package oauth has the pieces of atproto oauth that are shared between the
+// authorization server and clients.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AuthorizationServerMetadata is served at
+// /.well-known/oauth-authorization-server (RFC 8414).
+type AuthorizationServerMetadata struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	PushedAuthorizationRequestEndpoint         string   `json:"pushed_authorization_request_endpoint"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint,omitempty"`
+	RequirePushedAuthorizationRequests         bool     `json:"require_pushed_authorization_requests"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	ResponseModesSupported                     []string `json:"response_modes_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	DPoPSigningAlgValuesSupported              []string `json:"dpop_signing_alg_values_supported"`
+	AuthorizationResponseIssParameterSupported bool     `json:"authorization_response_iss_parameter_supported"`
+	ClientIDMetadataDocumentSupported          bool     `json:"client_id_metadata_document_supported"`
+}
+
+// ProtectedResourceMetadata is served by a PDS at
+// /.well-known/oauth-protected-resource so clients can find its
+// authorization server.
+type ProtectedResourceMetadata struct {
+	Resource               string   `json:"resource"`
+	AuthorizationServers   []string `json:"authorization_servers"`
+	ScopesSupported        []string `json:"scopes_supported"`
+	BearerMethodsSupported []string `json:"bearer_methods_supported"`
+}
+
+// ClientMetadata is the document a client publishes at its client_id url.
+type ClientMetadata struct {
+	ClientID                    string   `json:"client_id"`
+	ClientName                  string   `json:"client_name,omitempty"`
+	ClientURI                   string   `json:"client_uri,omitempty"`
+	LogoURI                     string   `json:"logo_uri,omitempty"`
+	ApplicationType             string   `json:"application_type,omitempty"`
+	RedirectURIs                []string `json:"redirect_uris"`
+	GrantTypes                  []string `json:"grant_types"`
+	ResponseTypes               []string `json:"response_types"`
+	Scope                       string   `json:"scope"`
+	TokenEndpointAuthMethod     string   `json:"token_endpoint_auth_method"`
+	DPoPBoundAccessTokens       bool     `json:"dpop_bound_access_tokens"`
+	JwksURI                     string   `json:"jwks_uri,omitempty"`
+	TokenEndpointAuthSigningAlg string   `json:"token_endpoint_auth_signing_alg,omitempty"`
+}
+
+// maxMetadataSize limits the size of fetched client metadata documents.
+const maxMetadataSize = 64 * 1024
+
+// IsLoopbackClientID reports whether the client id is a development client
+// that has no metadata document.
+func IsLoopbackClientID(clientID string) bool {
+	return clientID == "http://localhost" || strings.HasPrefix(clientID, "http://localhost?")
+}
+
+// LoopbackClientMetadata is the metadata of a loopback client. The redirect
+// uris and scope may be set with query parameters on the client id.
+func LoopbackClientMetadata(clientID string) (*ClientMetadata, error) {
+	u, err := url.Parse(clientID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !IsLoopbackClientID(clientID) || len(u.Path) > 0 {
+		return nil, errors.Errorf("invalid loopback client id %q", clientID)
+	}
+	md := ClientMetadata{
+		ClientID:                clientID,
+		ClientName:              "Loopback client",
+		ApplicationType:         "native",
+		RedirectURIs:            u.Query()["redirect_uri"],
+		GrantTypes:              []string{"authorization_code", "refresh_token"},
+		ResponseTypes:           []string{"code"},
+		Scope:                   u.Query().Get("scope"),
+		TokenEndpointAuthMethod: "none",
+		DPoPBoundAccessTokens:   true,
+	}
+	if len(md.RedirectURIs) == 0 {
+		md.RedirectURIs = []string{"http://127.0.0.1/", "http://[::1]/"}
+	}
+	if len(md.Scope) == 0 {
+		md.Scope = "atproto"
+	}
+	for _, uri := range md.RedirectURIs {
+		r, err := url.Parse(uri)
+		if err != nil || r.Scheme != "http" || (r.Hostname() != "127.0.0.1" && r.Hostname() != "::1") {
+			return nil, errors.Errorf("loopback clients must redirect to 127.0.0.1 or [::1]: %q", uri)
+		}
+	}
+	return &md, nil
+}
+
+// FetchClientMetadata gets the metadata document of a client and checks that
+// it describes that client.
+func FetchClientMetadata(ctx context.Context, client *http.Client, clientID string) (*ClientMetadata, error) {
+	if IsLoopbackClientID(clientID) {
+		return LoopbackClientMetadata(clientID)
+	}
+	u, err := url.Parse(clientID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if u.Scheme != "https" || len(u.Fragment) > 0 || len(u.Path) == 0 {
+		return nil, errors.Errorf("client id %q must be an https url with a path", clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, clientID, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch client metadata")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch client metadata: status %d", res.StatusCode)
+	}
+	var md ClientMetadata
+	err = json.NewDecoder(io.LimitReader(res.Body, maxMetadataSize)).Decode(&md)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid client metadata")
+	}
+	if md.ClientID != clientID {
+		return nil, errors.Errorf("client metadata has client_id %q, expected %q", md.ClientID, clientID)
+	}
+	if err = md.Validate(); err != nil {
+		return nil, err
+	}
+	return &md, nil
+}
+
+// Validate checks the parts of the metadata that atproto requires.
+func (md *ClientMetadata) Validate() error {
+	if len(md.RedirectURIs) == 0 {
+		return errors.New("client metadata must have redirect_uris")
+	}
+	if !md.DPoPBoundAccessTokens {
+		return errors.New("client metadata must set dpop_bound_access_tokens")
+	}
+	if !slices.Contains(md.GrantTypes, "authorization_code") {
+		return errors.New("client metadata must allow the authorization_code grant")
+	}
+	if !slices.Contains(md.ResponseTypes, "code") {
+		return errors.New("client metadata must allow the code response type")
+	}
+	if !slices.Contains(strings.Fields(md.Scope), "atproto") {
+		return errors.New(`client metadata scope must include "atproto"`)
+	}
+	switch md.TokenEndpointAuthMethod {
+	case "none":
+	default:
+		return errors.Errorf("unsupported token_endpoint_auth_method %q", md.TokenEndpointAuthMethod)
+	}
+	return nil
+}
+
+// AllowsScope reports whether every scope in a request was declared by the
+// client.
+func (md *ClientMetadata) AllowsScope(scope string) bool {
+	declared := strings.Fields(md.Scope)
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(declared, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsRedirect reports whether uri is one of the client's redirect uris.
+// Loopback redirects may use any port.
+func (md *ClientMetadata) AllowsRedirect(uri string) bool {
+	if slices.Contains(md.RedirectURIs, uri) {
+		return true
+	}
+	if !IsLoopbackClientID(md.ClientID) {
+		return false
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range md.RedirectURIs {
+		a, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+		if a.Scheme == u.Scheme && a.Hostname() == u.Hostname() && strings.TrimSuffix(a.Path, "/") == strings.TrimSuffix(u.Path, "/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+)
+
+// PKCE is a proof key for code exchange (RFC 7636). Only the S256 method is
+// supported.
+type PKCE struct {
+	Verifier  string
+	Challenge string
+	Method    string
+}
+
+// NewPKCE generates a random code verifier and its challenge.
+func NewPKCE() (*PKCE, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(b)
+	return &PKCE{
+		Verifier:  verifier,
+		Challenge: S256Challenge(verifier),
+		Method:    "S256",
+	}, nil
+}
+
+// S256Challenge is the S256 code challenge of a verifier.
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyPKCE checks a code verifier against the challenge from the
+// authorization request.
+func VerifyPKCE(verifier, challenge, method string) error {
+	if method != "S256" {
+		return errors.Errorf("unsupported code_challenge_method %q", method)
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return errors.New("invalid code_verifier length")
+	}
+	if subtle.ConstantTimeCompare([]byte(S256Challenge(verifier)), []byte(challenge)) != 1 {
+		return errors.New("invalid code_verifier")
+	}
+	return nil
+}
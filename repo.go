@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/harrybrwn/at/internal/repo"
+)
+
+func newRepoCmd(cx *Context) *cobra.Command {
+	c := cobra.Command{
+		Use:   "repo",
+		Short: "Export and inspect repositories",
+	}
+	c.AddCommand(
+		newRepoExportCmd(cx),
+		newRepoLsCmd(cx),
+		newRepoDumpCmd(cx),
+		newRepoVerifyCmd(cx),
+		newRepoDiffCmd(cx),
+	)
+	return &c
+}
+
+func newRepoExportCmd(cx *Context) *cobra.Command {
+	var output string
+	c := cobra.Command{
+		Use:   "export <at-identifier>",
+		Short: "Download a repo as a CAR file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = cx.init(cmd.Context()); err != nil {
+				return err
+			}
+			ident, err := lookupIdentity(cx, args[0])
+			if err != nil {
+				return err
+			}
+			w := cmd.OutOrStdout()
+			if len(output) > 0 && output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				defer f.Close()
+				w = f
+			}
+			client := XRPCClient{pds: ident.PDSEndpoint()}
+			return client.GetRepo(cx.ctx, ident.DID, w)
+		},
+	}
+	c.Flags().StringVarP(&output, "output", "o", output, "write the CAR file to a path instead of stdout")
+	return &c
+}
+
+func newRepoLsCmd(cx *Context) *cobra.Command {
+	var (
+		collection  string
+		collections bool
+	)
+	c := cobra.Command{
+		Use:   "ls <car|at-identifier>",
+		Short: "List the records in a repo",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = cx.init(cmd.Context()); err != nil {
+				return err
+			}
+			r, err := openRepo(cx, args[0])
+			if err != nil {
+				return err
+			}
+			var (
+				out    = cmd.OutOrStdout()
+				counts = make(map[string]int)
+				names  = make([]string, 0)
+			)
+			err = r.Walk(cx.ctx, func(col, rkey string, c cid.Cid) error {
+				if len(collection) > 0 && col != collection {
+					return nil
+				}
+				if collections {
+					if _, ok := counts[col]; !ok {
+						names = append(names, col)
+					}
+					counts[col]++
+					return nil
+				}
+				_, err := fmt.Fprintf(out, "%s %s/%s\n", c, col, rkey)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				fmt.Fprintf(out, "%s %d\n", name, counts[name])
+			}
+			return nil
+		},
+	}
+	c.Flags().StringVarP(&collection, "collection", "c", collection, "only list records in a collection")
+	c.Flags().BoolVar(&collections, "collections", collections, "list collections and their record counts")
+	return &c
+}
+
+func newRepoDumpCmd(cx *Context) *cobra.Command {
+	var collection string
+	c := cobra.Command{
+		Use:   "dump <car|at-identifier>",
+		Short: "Print every record in a repo as JSON Lines",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = cx.init(cmd.Context()); err != nil {
+				return err
+			}
+			r, err := openRepo(cx, args[0])
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			return r.Walk(cx.ctx, func(col, rkey string, c cid.Cid) error {
+				if len(collection) > 0 && col != collection {
+					return nil
+				}
+				raw, err := r.GetBlock(cx.ctx, c)
+				if err != nil {
+					return err
+				}
+				value, err := data.UnmarshalCBOR(raw)
+				if err != nil {
+					return errors.Wrapf(err, "failed to decode record %s/%s", col, rkey)
+				}
+				return enc.Encode(&dumpedRecord{
+					URI:   fmt.Sprintf("at://%s/%s/%s", r.DID(), col, rkey),
+					CID:   c.String(),
+					Value: value,
+				})
+			})
+		},
+	}
+	c.Flags().StringVarP(&collection, "collection", "c", collection, "only dump records in a collection")
+	return &c
+}
+
+func newRepoVerifyCmd(cx *Context) *cobra.Command {
+	var (
+		publicKey     string
+		skipSignature bool
+	)
+	c := cobra.Command{
+		Use:   "verify <car>",
+		Short: "Verify the blocks, signature and MST of a CAR file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = cx.init(cmd.Context()); err != nil {
+				return err
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			root, blocks, err := repo.ReadCar(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			var keyfn repo.KeyFunc
+			switch {
+			case skipSignature:
+			case len(publicKey) > 0:
+				key, err := parsePublicKey(publicKey)
+				if err != nil {
+					return err
+				}
+				keyfn = func(context.Context, string) (crypto.PublicKey, error) { return key, nil }
+			default:
+				keyfn = func(_ context.Context, did string) (crypto.PublicKey, error) {
+					ident, err := lookupIdentity(cx, did)
+					if err != nil {
+						return nil, err
+					}
+					return ident.PublicKey()
+				}
+			}
+			report := repo.Verify(cx.ctx, root, blocks, keyfn)
+			if err = jsonIndent(cmd.OutOrStdout(), report); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout())
+			if !report.OK() {
+				return errors.Errorf("repo verification failed with %d problem(s)", len(report.Problems))
+			}
+			return nil
+		},
+	}
+	c.Flags().StringVarP(&publicKey, "key", "k", publicKey, "verify the commit with a did:key or multibase public key instead of resolving the did")
+	c.Flags().BoolVar(&skipSignature, "skip-signature", skipSignature, "do not verify the commit signature")
+	return &c
+}
+
+func parsePublicKey(s string) (crypto.PublicKey, error) {
+	if strings.HasPrefix(s, "did:key:") {
+		return crypto.ParsePublicDIDKey(s)
+	}
+	return crypto.ParsePublicMultibase(s)
+}
+
+func newRepoDiffCmd(cx *Context) *cobra.Command {
+	var (
+		records bool
+		asJSON  bool
+	)
+	c := cobra.Command{
+		Use:   "diff <old> <new>",
+		Short: "Show the records that changed between two commits",
+		Long: `Show the records that changed between two commits.
+
+Each side can be a CAR file, an at-identifier for a repo on a live PDS, a
+commit CID or a rev. Commit CIDs and revs are looked up in the blocks loaded
+for the other side, so at least one side must be a CAR file or a repo. A live
+PDS only serves its latest commit, so older revs have to come from a CAR file
+that holds them.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = cx.init(cmd.Context()); err != nil {
+				return err
+			}
+			var (
+				blocks = repo.NewBlockMap()
+				roots  [2]cid.Cid
+			)
+			for i, arg := range args {
+				roots[i], err = loadDiffBlocks(cx, arg, blocks)
+				if err != nil {
+					return err
+				}
+			}
+			if blocks.Size() == 0 {
+				return errors.New("at least one side of the diff must be a CAR file or a repo")
+			}
+			for i, arg := range args {
+				if roots[i].Defined() {
+					continue
+				}
+				roots[i], err = findDiffCommit(arg, blocks)
+				if err != nil {
+					return err
+				}
+			}
+			bs := repo.NewMemoryBlockstore(blocks)
+			diffs, err := repo.Diff(cx.ctx, bs, roots[0], roots[1])
+			if err != nil {
+				return err
+			}
+			var (
+				out = cmd.OutOrStdout()
+				enc = json.NewEncoder(out)
+			)
+			for _, d := range diffs {
+				var changes []fieldChange
+				if records {
+					changes, err = diffRecords(cx, bs, d.Old, d.New)
+					if err != nil {
+						return errors.Wrapf(err, "failed to diff %s", d.Path())
+					}
+				}
+				if asJSON {
+					err = enc.Encode(&diffedRecord{
+						Action:  string(d.Action),
+						Path:    d.Path(),
+						Old:     cidString(d.Old),
+						New:     cidString(d.New),
+						Changes: changes,
+					})
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				switch d.Action {
+				case repo.WriteOpActionCreate:
+					fmt.Fprintf(out, "+ %s %s\n", d.Path(), d.New)
+				case repo.WriteOpActionUpdate:
+					fmt.Fprintf(out, "~ %s %s -> %s\n", d.Path(), d.Old, d.New)
+				case repo.WriteOpActionDelete:
+					fmt.Fprintf(out, "- %s %s\n", d.Path(), d.Old)
+				}
+				for _, ch := range changes {
+					fmt.Fprintf(out, "    %s: %s -> %s\n", ch.Path, jsonString(ch.Old), jsonString(ch.New))
+				}
+			}
+			return nil
+		},
+	}
+	c.Flags().BoolVarP(&records, "records", "r", records, "show changes to the contents of each record")
+	c.Flags().BoolVar(&asJSON, "json", asJSON, "print the diff as JSON Lines")
+	return &c
+}
+
+// loadDiffBlocks adds the blocks from a CAR file or a live repo to blocks
+// and returns the root commit. An undefined CID is returned if arg is a commit
+// CID or rev that should be found in the blocks of the other side.
+func loadDiffBlocks(cx *Context, arg string, blocks *repo.BlockMap) (cid.Cid, error) {
+	if _, err := cid.Parse(arg); err == nil {
+		return cid.Undef, nil
+	}
+	if _, err := syntax.ParseTID(arg); err == nil {
+		return cid.Undef, nil
+	}
+	var buf bytes.Buffer
+	if exists(arg) {
+		f, err := os.Open(arg)
+		if err != nil {
+			return cid.Undef, errors.WithStack(err)
+		}
+		defer f.Close()
+		if _, err = buf.ReadFrom(f); err != nil {
+			return cid.Undef, errors.WithStack(err)
+		}
+	} else {
+		ident, err := lookupIdentity(cx, arg)
+		if err != nil {
+			return cid.Undef, err
+		}
+		client := XRPCClient{pds: ident.PDSEndpoint()}
+		if err = client.GetRepo(cx.ctx, ident.DID, &buf); err != nil {
+			return cid.Undef, err
+		}
+	}
+	root, bm, err := repo.ReadCar(&buf)
+	if err != nil {
+		return cid.Undef, err
+	}
+	blocks.AddMap(bm)
+	return root, nil
+}
+
+func findDiffCommit(arg string, blocks *repo.BlockMap) (cid.Cid, error) {
+	if c, err := cid.Parse(arg); err == nil {
+		if !blocks.Has(c) {
+			return cid.Undef, errors.Errorf("commit %s is not in the CAR file or repo on the other side", c)
+		}
+		return c, nil
+	}
+	c, ok := repo.FindCommit(blocks, arg)
+	if !ok {
+		return cid.Undef, errors.Errorf("no commit with rev %q in the CAR file or repo on the other side, older revs are not served by a PDS", arg)
+	}
+	return c, nil
+}
+
+type diffedRecord struct {
+	Action  string        `json:"action"`
+	Path    string        `json:"path"`
+	Old     string        `json:"old,omitempty"`
+	New     string        `json:"new,omitempty"`
+	Changes []fieldChange `json:"changes,omitempty"`
+}
+
+type fieldChange struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+func diffRecords(cx *Context, bs repo.Blockstore, oldCid, newCid cid.Cid) ([]fieldChange, error) {
+	var (
+		values  [2]any
+		changes = make([]fieldChange, 0)
+	)
+	for i, c := range []cid.Cid{oldCid, newCid} {
+		if !c.Defined() {
+			continue
+		}
+		blk, err := bs.Get(cx.ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		record, err := data.UnmarshalCBOR(blk.RawData())
+		if err != nil {
+			return nil, err
+		}
+		// Round trip through json so that links and bytes are compared using
+		// their json encoding.
+		b, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(b, &values[i]); err != nil {
+			return nil, err
+		}
+	}
+	diffValues(".", values[0], values[1], &changes)
+	return changes, nil
+}
+
+func diffValues(path string, prev, next any, changes *[]fieldChange) {
+	child := func(key string) string {
+		if path == "." {
+			return key
+		}
+		return path + "." + key
+	}
+	switch o := prev.(type) {
+	case map[string]any:
+		n, ok := next.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(o)+len(n))
+		for k := range o {
+			keys = append(keys, k)
+		}
+		for k := range n {
+			if _, ok := o[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			diffValues(child(k), o[k], n[k], changes)
+		}
+		return
+	case []any:
+		n, ok := next.([]any)
+		if !ok {
+			break
+		}
+		for i := range max(len(o), len(n)) {
+			var ov, nv any
+			if i < len(o) {
+				ov = o[i]
+			}
+			if i < len(n) {
+				nv = n[i]
+			}
+			diffValues(child(strconv.Itoa(i)), ov, nv, changes)
+		}
+		return
+	}
+	if !reflect.DeepEqual(prev, next) {
+		*changes = append(*changes, fieldChange{Path: path, Old: prev, New: next})
+	}
+}
+
+func cidString(c cid.Cid) string {
+	if !c.Defined() {
+		return ""
+	}
+	return c.String()
+}
+
+func jsonString(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+type dumpedRecord struct {
+	URI   string         `json:"uri"`
+	CID   string         `json:"cid"`
+	Value map[string]any `json:"value"`
+}
+
+// openRepo loads a repo from a local CAR file or, if arg is not a file,
+// downloads it from the PDS of the account it identifies.
+func openRepo(cx *Context, arg string) (*repo.Repo, error) {
+	if exists(arg) {
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer f.Close()
+		return repo.LoadCar(cx.ctx, f)
+	}
+	ident, err := lookupIdentity(cx, arg)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	client := XRPCClient{pds: ident.PDSEndpoint()}
+	if err = client.GetRepo(cx.ctx, ident.DID, &buf); err != nil {
+		return nil, err
+	}
+	return repo.LoadCar(cx.ctx, &buf)
+}
+
+func lookupIdentity(cx *Context, arg string) (*identity.Identity, error) {
+	id, err := syntax.ParseAtIdentifier(strings.TrimPrefix(arg, "at://"))
+	if err != nil {
+		return nil, err
+	}
+	if cx.purge {
+		if err = cx.dir.Purge(cx.ctx, *id); err != nil {
+			slog.Error("failed to purge cache",
+				slog.String("identifier", id.String()),
+				slog.Any("error", err))
+		}
+	}
+	ident, err := cx.dir.Lookup(cx.ctx, *id)
+	switch {
+	case errors.Is(err, identity.ErrHandleMismatch):
+		if ident == nil {
+			return nil, err
+		}
+		slog.Warn("handle mismatch", slog.Any("error", err))
+	case err != nil:
+		return nil, err
+	}
+	return ident, nil
+}
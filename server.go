@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/harrybrwn/env"
@@ -22,8 +23,9 @@ import (
 func newServerCmd() *cobra.Command {
 	var (
 		conf = pds.EnvConfig{
-			Port:    3000,
-			DevMode: true, // TODO Change this later
+			Port:                 3000,
+			DevMode:              true, // TODO Change this later
+			AcceptingRepoImports: true,
 		}
 		asBluesky = true
 	)
@@ -86,6 +88,9 @@ Most API routes are under /xrpc/`)
 			}
 			pds.Passthrough = xrpc.NewClient(xrpc.WithEnv(), xrpc.WithURL(conf.BskyAppView.URL))
 			routes(s, pds)
+			go pds.RunAccountPurger(ctx, time.Minute)
+			go pds.RunAdminAuditPurger(ctx, time.Hour)
+			go pds.RunOAuthPurger(ctx, 10*time.Minute)
 			logger.Info("starting server", "port", conf.Port)
 			if conf.DevMode {
 				logger.Warn("running pds server in dev mode")
@@ -274,6 +274,24 @@ func (c *XRPCClient) GetBlob(ctx context.Context, did syntax.DID, cid syntax.CID
 	return errors.WithStack(err)
 }
 
+// GetRepo downloads a full repo export as a CAR file.
+func (c *XRPCClient) GetRepo(ctx context.Context, did syntax.DID, w io.Writer) error {
+	res, err := c.do(ctx, xrpc.Query, "com.atproto.sync.getRepo", url.Values{
+		"did": []string{did.String()},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		e := Error{Status: res.StatusCode}
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return &e
+	}
+	_, err = io.Copy(w, res.Body)
+	return errors.WithStack(err)
+}
+
 func blobURL(pds string, did syntax.DID, cid syntax.CID) string {
 	u, err := url.Parse(pds)
 	if err != nil {
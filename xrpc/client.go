@@ -24,6 +24,24 @@ type Client struct {
 	Host       string
 	AdminToken *string
 	Auth       *Auth
+	// Retry is the policy used to retry failed requests. Requests are only
+	// attempted once when nil.
+	Retry *RetryPolicy
+	// Limiter throttles requests made to each host.
+	Limiter *RateLimiter
+	// Authorizer adds credentials to requests in place of Auth, for example
+	// an oauth session that signs each request with a DPoP proof.
+	Authorizer Authorizer
+}
+
+// Authorizer adds credentials to requests.
+type Authorizer interface {
+	// Authorize is called before each attempt of a request.
+	Authorize(*http.Request) error
+	// Observe is called with every response and reports whether the request
+	// should be authorized and sent again, for example when the server asks
+	// for a new DPoP nonce.
+	Observe(*http.Response) bool
 }
 
 type ClientOption func(*Client)
@@ -44,6 +62,9 @@ func WithInsecure() ClientOption                  { return func(c *Client) { c.I
 func WithJwt(token string) ClientOption           { return func(c *Client) { c.Auth = &Auth{AccessJwt: token} } }
 func WithHost(host string) ClientOption           { return func(c *Client) { c.Host = host } }
 func WithClient(client *http.Client) ClientOption { return func(c *Client) { c.Client = client } }
+func WithRetry(p RetryPolicy) ClientOption        { return func(c *Client) { c.Retry = &p } }
+func WithRateLimiter(l *RateLimiter) ClientOption { return func(c *Client) { c.Limiter = l } }
+func WithAuthorizer(a Authorizer) ClientOption    { return func(c *Client) { c.Authorizer = a } }
 
 func WithEnv() ClientOption {
 	return func(c *Client) {
@@ -151,6 +172,18 @@ func (c *Client) url(path string, q url.Values) *url.URL {
 }
 
 func (c *Client) do(ctx context.Context, t RequestType, contentType, ns string, q url.Values, body io.Reader) (*http.Response, error) {
+	if c.Retry == nil {
+		res, _, err := c.send(ctx, t, contentType, ns, q, body)
+		return res, err
+	}
+	return c.Retry.do(ctx, t, body, func() (*http.Response, *RateLimit, error) {
+		return c.send(ctx, t, contentType, ns, q, body)
+	})
+}
+
+// send makes a single request, returning the rate limit reported by the
+// server alongside any error.
+func (c *Client) send(ctx context.Context, t RequestType, contentType, ns string, q url.Values, body io.Reader) (*http.Response, *RateLimit, error) {
 	u := c.url(ns, q)
 	req := http.Request{
 		Host:   u.Host,
@@ -172,6 +205,7 @@ func (c *Client) do(ctx context.Context, t RequestType, contentType, ns string,
 	if c.AdminToken != nil &&
 		(strings.HasPrefix(ns, "com.atproto.admin.") ||
 			strings.HasPrefix(ns, "tools.ozone.") ||
+			strings.HasPrefix(ns, "me.hrry.admin.") ||
 			ns == "com.atproto.server.createInviteCode" ||
 			ns == "com.atproto.server.createInviteCodes") {
 		auth := base64.StdEncoding.EncodeToString([]byte("admin:" + *c.AdminToken))
@@ -179,7 +213,7 @@ func (c *Client) do(ctx context.Context, t RequestType, contentType, ns string,
 			"Authorization",
 			"Basic "+auth,
 		)
-	} else if c.Auth != nil {
+	} else if c.Auth != nil && c.Authorizer == nil {
 		// TODO add jwt token
 		req.Header.Set(
 			"Authorization",
@@ -187,23 +221,65 @@ func (c *Client) do(ctx context.Context, t RequestType, contentType, ns string,
 		)
 	}
 
-	res, err := c.Client.Do(req.WithContext(ctx))
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx, c.Host); err != nil {
+			return nil, nil, err
+		}
+	}
+	res, err := c.authorizeAndDo(ctx, &req, body)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, err
+	}
+	rl := ParseRateLimit(res.Header)
+	if c.Limiter != nil {
+		c.Limiter.Observe(c.Host, rl)
 	}
 	if res.StatusCode >= 400 {
 		e := ErrorResponse{Status: res.StatusCode}
 		err = json.NewDecoder(res.Body).Decode(&e)
 		if err != nil {
 			res.Body.Close()
-			return nil, e.Wrap(err)
+			return nil, rl, e.Wrap(err)
 		}
 		if err = res.Body.Close(); err != nil {
-			return nil, e.Wrap(err)
+			return nil, rl, e.Wrap(err)
+		}
+		return nil, rl, errors.WithStack(&e)
+	}
+	return res, rl, nil
+}
+
+// authorizeAndDo sends a request, letting the Authorizer retry it once when
+// the body can be rewound.
+func (c *Client) authorizeAndDo(ctx context.Context, req *http.Request, body io.Reader) (*http.Response, error) {
+	if c.Authorizer == nil || req.Header.Get("Authorization") != "" {
+		res, err := c.Client.Do(req.WithContext(ctx))
+		return res, errors.WithStack(err)
+	}
+	for attempt := 0; ; attempt++ {
+		if err := c.Authorizer.Authorize(req); err != nil {
+			return nil, err
+		}
+		res, err := c.Client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !c.Authorizer.Observe(res) || attempt > 0 {
+			return res, nil
+		}
+		if body != nil {
+			s, ok := body.(io.Seeker)
+			if !ok {
+				return res, nil
+			}
+			if _, err = s.Seek(0, io.SeekStart); err != nil {
+				return res, nil
+			}
+			req.Body = io.NopCloser(body)
 		}
-		return nil, errors.WithStack(&e)
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
 	}
-	return res, nil
 }
 
 type RequestBuilder interface {
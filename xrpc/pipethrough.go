@@ -1,15 +1,43 @@
 package xrpc
 
 import (
+	"context"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 type Pipethrough struct {
-	Host   string
+	Host string
+	// Scheme is used for the upstream request when the incoming request does
+	// not have one, which is the case for requests received by a server.
+	// Defaults to https.
+	Scheme string
 	Client *http.Client
 	Logger *slog.Logger
+
+	// HeadersTimeout is how long to wait for the upstream response headers.
+	// There is no limit when it is zero.
+	HeadersTimeout time.Duration
+	// BodyTimeout is how long the upstream response body can take once the
+	// headers have arrived. There is no limit when it is zero.
+	BodyTimeout time.Duration
+	// MaxResponseSize is the largest upstream response body in bytes that
+	// will be passed on. There is no limit when it is zero.
+	MaxResponseSize int64
+	// MaxRetries is how many times a GET or HEAD request is retried after a
+	// network error or a 502, 503 or 504 response.
+	MaxRetries int
+	// PreferCompressed asks the upstream for a gzip or brotli response when
+	// the client accepts one. Otherwise responses are requested without
+	// compression. Either way bodies are passed through without decoding.
+	PreferCompressed bool
 }
 
 func NewPipethrough(host string) *Pipethrough {
@@ -20,6 +48,17 @@ func NewPipethrough(host string) *Pipethrough {
 	}
 }
 
+// NewPipethroughTransport creates a transport for a [Pipethrough]. It never
+// decompresses responses so that they can be passed through as they are.
+func NewPipethroughTransport(allowHTTP2 bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableCompression = true
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP1(true)
+	t.Protocols.SetHTTP2(allowHTTP2)
+	return t
+}
+
 // Hop-by-hop headers. These are removed when sent to the backend.
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
 var hopHeaders = []string{
@@ -39,27 +78,195 @@ func cleanHeaders(header http.Header) {
 	}
 }
 
+var (
+	errHeadersTimeout   = errors.New("upstream headers timeout")
+	errBodyTimeout      = errors.New("upstream body timeout")
+	errResponseTooLarge = errors.New("upstream response too large")
+)
+
+// ServeHTTP sends the request to p.Host.
 func (p *Pipethrough) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r := *req
+	scheme := req.URL.Scheme
+	if len(scheme) == 0 {
+		scheme = p.Scheme
+	}
+	p.Forward(w, req, &url.URL{Scheme: scheme, Host: p.Host})
+}
+
+// Forward sends the request to the server at base, keeping the request's path
+// and query, and streams the response to w. The request path is added to the
+// path of base.
+func (p *Pipethrough) Forward(w http.ResponseWriter, req *http.Request, base *url.URL) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	defer cancel(nil)
+	r := req.Clone(ctx)
+	r.URL.Scheme = base.Scheme
+	if len(r.URL.Scheme) == 0 {
+		r.URL.Scheme = "https"
+	}
+	r.URL.Host = base.Host
+	if prefix := strings.TrimSuffix(base.Path, "/"); len(prefix) > 0 {
+		r.URL.Path = prefix + "/" + strings.TrimPrefix(r.URL.Path, "/")
+		r.URL.RawPath = ""
+	}
 	r.RequestURI = ""
-	r.Host = p.Host
-	r.URL.Host = p.Host
+	r.Host = base.Host
 	cleanHeaders(r.Header)
-	response, err := p.Client.Do(&r)
+	r.Header.Set("Accept-Encoding", p.acceptEncoding(req.Header.Get("Accept-Encoding")))
+
+	response, err := p.send(ctx, cancel, r)
 	if err != nil {
-		p.Logger.Error("failed to pipe request", "error", err)
-		w.WriteHeader(500)
+		if req.Context().Err() != nil {
+			return // the client went away
+		}
+		if errors.Is(context.Cause(ctx), errHeadersTimeout) {
+			WriteError(p.Logger, w, &ErrorResponse{
+				Code:    UpstreamTimeout,
+				Message: "Upstream server timed out",
+				Status:  http.StatusGatewayTimeout,
+				Inner:   err,
+			}, UpstreamTimeout)
+			return
+		}
+		WriteError(p.Logger, w, &ErrorResponse{
+			Code:    UpstreamFailure,
+			Message: "Upstream server request failed",
+			Status:  http.StatusBadGateway,
+			Inner:   err,
+		}, UpstreamFailure)
 		return
 	}
 	defer response.Body.Close()
+	if p.MaxResponseSize > 0 && response.ContentLength > p.MaxResponseSize {
+		WriteError(p.Logger, w, &ErrorResponse{
+			Code:    UpstreamFailure,
+			Message: "Upstream response too large",
+			Status:  http.StatusBadGateway,
+			Inner:   errResponseTooLarge,
+		}, UpstreamFailure)
+		return
+	}
+	if p.BodyTimeout > 0 {
+		timer := time.AfterFunc(p.BodyTimeout, func() { cancel(errBodyTimeout) })
+		defer timer.Stop()
+	}
+
 	cleanHeaders(response.Header)
 	for k, v := range response.Header {
 		w.Header()[k] = v
 	}
 	w.WriteHeader(response.StatusCode)
-	_, err = io.Copy(w, response.Body)
+	var body io.Reader = response.Body
+	if p.MaxResponseSize > 0 {
+		body = &limitedReader{r: response.Body, n: p.MaxResponseSize}
+	}
+	if _, err = io.Copy(&flushWriter{w: w, rc: http.NewResponseController(w)}, body); err != nil {
+		if req.Context().Err() == nil {
+			if cause := context.Cause(ctx); cause != nil {
+				err = cause
+			}
+			p.Logger.Error("failed to copy proxied body to response body", "error", err)
+		}
+		// The status has already been sent so the only way to tell the
+		// client that the body is incomplete is to abort the response.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// send makes the upstream request, retrying queries that fail before a
+// response is received or with a gateway error. The headers timeout cancels
+// ctx so timed out requests are never retried.
+func (p *Pipethrough) send(ctx context.Context, cancel context.CancelCauseFunc, r *http.Request) (*http.Response, error) {
+	retry := RetryPolicy{Attempts: p.MaxRetries + 1}
+	retryable := (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		(r.Body == nil || r.Body == http.NoBody)
+	for attempt := 1; ; attempt++ {
+		var timer *time.Timer
+		if p.HeadersTimeout > 0 {
+			timer = time.AfterFunc(p.HeadersTimeout, func() { cancel(errHeadersTimeout) })
+		}
+		res, err := p.Client.Do(r)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !retryable || attempt >= retry.attempts() || ctx.Err() != nil {
+			return res, errors.WithStack(err)
+		}
+		if err == nil {
+			switch res.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+				res.Body.Close()
+			default:
+				return res, nil
+			}
+		}
+		if err = sleep(ctx, retry.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// acceptEncoding picks the Accept-Encoding header sent upstream. Only
+// encodings that the client accepts are asked for since the body is not
+// decoded.
+func (p *Pipethrough) acceptEncoding(client string) string {
+	if !p.PreferCompressed {
+		return "identity"
+	}
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(client, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = true
+	}
+	var codings []string
+	for _, c := range []string{"br", "gzip"} {
+		if accepted[c] || accepted["*"] {
+			codings = append(codings, c)
+		}
+	}
+	return strings.Join(append(codings, "identity"), ", ")
+}
+
+// flushWriter sends each write to the client right away so that responses
+// are streamed instead of buffered.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
 	if err != nil {
-		p.Logger.Error("failed to copy proxied body to response body", "error", err)
-		return
+		return n, err
+	}
+	if err = f.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
+
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), errResponseTooLarge
 	}
+	return n, err
 }
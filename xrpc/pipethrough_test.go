@@ -2,8 +2,14 @@ package xrpc
 
 import (
 	"encoding/json"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 )
@@ -29,3 +35,123 @@ func TestPipethrough(t *testing.T) {
 	is.Equal(body["handle"], "hrry.me")
 	is.Equal(body["displayName"], "Harry Brown")
 }
+
+func TestPipethroughForward(t *testing.T) {
+	is := is.New(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("X-Path", r.URL.Path+"?"+r.URL.RawQuery)
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+	base, err := url.Parse(upstream.URL)
+	is.NoErr(err)
+
+	p := NewPipethrough("unused.test")
+	req := httptest.NewRequest("GET", "/xrpc/app.bsky.feed.getTimeline?limit=1", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	rec := httptest.NewRecorder()
+	p.Forward(rec, req, base)
+	is.Equal(rec.Code, http.StatusTeapot)
+	is.Equal(rec.Header().Get("X-Path"), "/xrpc/app.bsky.feed.getTimeline?limit=1")
+	is.Equal(rec.Header().Get("Connection"), "") // hop-by-hop headers are dropped
+	is.Equal(rec.Body.String(), "Bearer abc")
+	is.Equal(req.Header.Get("Keep-Alive"), "timeout=5") // the original request is not changed
+
+	// the path of the service endpoint is kept
+	base.Path = "/prefix/"
+	rec = httptest.NewRecorder()
+	p.Forward(rec, req, base)
+	is.Equal(rec.Header().Get("X-Path"), "/prefix/xrpc/app.bsky.feed.getTimeline?limit=1")
+	is.Equal(req.URL.Path, "/xrpc/app.bsky.feed.getTimeline")
+}
+
+func TestPipethroughLimits(t *testing.T) {
+	is := is.New(t)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/large":
+			_, _ = w.Write([]byte(strings.Repeat("a", 100)))
+		case "/stream":
+			for range 10 {
+				_, _ = w.Write([]byte(strings.Repeat("a", 10)))
+				w.(http.Flusher).Flush()
+			}
+		case "/flaky":
+			if n < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		case "/encoding":
+			_, _ = w.Write([]byte(r.Header.Get("Accept-Encoding")))
+		}
+	}))
+	defer upstream.Close()
+	base, err := url.Parse(upstream.URL)
+	is.NoErr(err)
+	p := NewPipethrough("unused.test")
+	p.Client = &http.Client{Transport: NewPipethroughTransport(false)}
+	p.HeadersTimeout = 50 * time.Millisecond
+	p.MaxResponseSize = 50
+	p.MaxRetries = 2
+	do := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		p.Forward(rec, req, base)
+		return rec
+	}
+
+	rec := do("/slow", nil)
+	is.Equal(rec.Code, http.StatusGatewayTimeout)
+	var e ErrorResponse
+	is.NoErr(json.Unmarshal(rec.Body.Bytes(), &e))
+	is.Equal(e.Code, UpstreamTimeout)
+
+	rec = do("/large", nil)
+	is.Equal(rec.Code, http.StatusBadGateway)
+	is.NoErr(json.Unmarshal(rec.Body.Bytes(), &e))
+	is.Equal(e.Code, UpstreamFailure)
+
+	calls.Store(0)
+	rec = do("/flaky", nil)
+	is.Equal(rec.Code, http.StatusOK)
+	is.Equal(rec.Body.String(), "ok")
+	is.Equal(calls.Load(), int32(3))
+
+	rec = do("/encoding", http.Header{"Accept-Encoding": {"gzip, br"}})
+	is.Equal(rec.Body.String(), "identity")
+	p.PreferCompressed = true
+	rec = do("/encoding", http.Header{"Accept-Encoding": {"gzip, br;q=0, deflate"}})
+	is.Equal(rec.Body.String(), "gzip, identity")
+	rec = do("/encoding", nil)
+	is.Equal(rec.Body.String(), "identity")
+
+	// responses without a length are cut off once they pass the limit
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.Forward(w, r, base)
+	}))
+	defer proxy.Close()
+	proxy.Config.ErrorLog = nil
+	res, err := proxy.Client().Get(proxy.URL + "/stream")
+	is.NoErr(err)
+	defer res.Body.Close()
+	is.Equal(res.StatusCode, http.StatusOK)
+	_, err = io.ReadAll(res.Body)
+	is.True(err != nil)
+
+	// nothing is listening
+	upstream.Close()
+	p.MaxRetries = 0
+	rec = do("/", nil)
+	is.Equal(rec.Code, http.StatusBadGateway)
+}
@@ -0,0 +1,280 @@
+package xrpc
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is the rate limit state reported by a server in response headers.
+type RateLimit struct {
+	// Limit and Remaining are -1 when the server did not send them.
+	Limit     int
+	Remaining int
+	// Reset is when the current window ends. It is the zero time when unknown.
+	Reset time.Time
+	// RetryAfter is the delay requested with a Retry-After header.
+	RetryAfter time.Duration
+}
+
+// ParseRateLimit reads the ratelimit-* and Retry-After headers of a response.
+// It returns nil if none of them are present.
+func ParseRateLimit(h http.Header) *RateLimit {
+	rl := RateLimit{Limit: -1, Remaining: -1}
+	found := false
+	if n, err := strconv.Atoi(h.Get("ratelimit-limit")); err == nil {
+		rl.Limit = n
+		found = true
+	}
+	if n, err := strconv.Atoi(h.Get("ratelimit-remaining")); err == nil {
+		rl.Remaining = n
+		found = true
+	}
+	if n, err := strconv.ParseInt(h.Get("ratelimit-reset"), 10, 64); err == nil {
+		rl.Reset = time.Unix(n, 0)
+		found = true
+	}
+	if v := h.Get("Retry-After"); len(v) > 0 {
+		if secs, err := strconv.Atoi(v); err == nil {
+			rl.RetryAfter = time.Duration(secs) * time.Second
+			found = true
+		} else if t, err := http.ParseTime(v); err == nil {
+			rl.RetryAfter = max(time.Until(t), 0)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &rl
+}
+
+// Delay is how long to wait before the server will accept another request.
+func (rl *RateLimit) Delay(now time.Time) time.Duration {
+	if rl == nil {
+		return 0
+	}
+	if rl.RetryAfter > 0 {
+		return rl.RetryAfter
+	}
+	if !rl.Reset.IsZero() {
+		return max(rl.Reset.Sub(now), 0)
+	}
+	return 0
+}
+
+// RetryPolicy controls how failed requests are retried. Queries are retried
+// after network errors and 5xx responses. Any request that is rejected with
+// RateLimitExceeded is retried once the rate limit resets as long as its body
+// can be rewound, which means the body is nil or implements [io.Seeker].
+//
+// Zero values are replaced with defaults.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts including the first.
+	// Defaults to 4.
+	Attempts int
+	// MinBackoff is the delay before the first retry, doubling for each
+	// attempt after that. Defaults to 250ms.
+	MinBackoff time.Duration
+	// MaxBackoff caps the backoff between attempts. Defaults to 10s.
+	MaxBackoff time.Duration
+	// MaxWait is the longest the client will sleep waiting for a rate limit
+	// to reset before giving up. Defaults to 1m.
+	MaxWait time.Duration
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.Attempts <= 0 {
+		return 4
+	}
+	return p.Attempts
+}
+
+func (p *RetryPolicy) maxWait() time.Duration {
+	if p.MaxWait <= 0 {
+		return time.Minute
+	}
+	return p.MaxWait
+}
+
+// backoff returns a jittered exponential delay for the given attempt,
+// starting at one.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	lo, hi := p.MinBackoff, p.MaxBackoff
+	if lo <= 0 {
+		lo = 250 * time.Millisecond
+	}
+	if hi <= 0 {
+		hi = 10 * time.Second
+	}
+	d := lo
+	for i := 1; i < attempt && d < hi; i++ {
+		d *= 2
+	}
+	d = min(d, hi)
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// delay decides whether a failed request should be retried and how long to
+// wait before doing so.
+func (p *RetryPolicy) delay(t RequestType, attempt int, rl *RateLimit, err error) (time.Duration, bool) {
+	var e *ErrorResponse
+	if !errors.As(err, &e) {
+		if t != Query || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return 0, false
+		}
+		// network error
+		return p.backoff(attempt), true
+	}
+	switch {
+	case e.Status == http.StatusTooManyRequests || e.Code == RateLimitExceeded:
+		d := rl.Delay(time.Now())
+		if d == 0 {
+			d = p.backoff(attempt)
+		}
+		return d, d <= p.maxWait()
+	case t != Query:
+		return 0, false
+	}
+	switch e.Status {
+	case http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		d := max(p.backoff(attempt), rl.Delay(time.Now()))
+		return d, d <= p.maxWait()
+	}
+	return 0, false
+}
+
+func (p *RetryPolicy) do(
+	ctx context.Context,
+	t RequestType,
+	body io.Reader,
+	send func() (*http.Response, *RateLimit, error),
+) (*http.Response, error) {
+	var (
+		seeker io.Seeker
+		start  int64
+		rewind = body == nil
+	)
+	if s, ok := body.(io.Seeker); ok {
+		offset, err := s.Seek(0, io.SeekCurrent)
+		if err == nil {
+			seeker, start, rewind = s, offset, true
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		res, rl, err := send()
+		if err == nil {
+			return res, nil
+		}
+		if !rewind || attempt >= p.attempts() {
+			return nil, err
+		}
+		d, ok := p.delay(t, attempt, rl, err)
+		if !ok {
+			return nil, err
+		}
+		if seeker != nil {
+			if _, serr := seeker.Seek(start, io.SeekStart); serr != nil {
+				return nil, err
+			}
+		}
+		if serr := sleep(ctx, d); serr != nil {
+			return nil, err
+		}
+	}
+}
+
+// RateLimiter is a client side token bucket for each host. It also blocks
+// requests to a host that has reported its rate limit is used up until the
+// limit resets. A RateLimiter can be shared between clients.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+type hostLimit struct {
+	bucket *rate.Limiter
+	until  time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing r requests per second to
+// each host with bursts of up to burst requests. When r is zero, only the
+// limits reported by servers are enforced.
+func NewRateLimiter(r rate.Limit, burst int) *RateLimiter {
+	if r <= 0 {
+		r = rate.Inf
+	}
+	return &RateLimiter{
+		limit: r,
+		burst: max(burst, 1),
+		hosts: make(map[string]*hostLimit),
+	}
+}
+
+func (l *RateLimiter) host(host string) *hostLimit {
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{bucket: rate.NewLimiter(l.limit, l.burst)}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// Wait blocks until a request can be made to host.
+func (l *RateLimiter) Wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	h := l.host(host)
+	until := h.until
+	l.mu.Unlock()
+	if wait := time.Until(until); wait > 0 {
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(until) {
+			return errors.WithStack(&ErrorResponse{
+				Code:    RateLimitExceeded,
+				Message: "rate limit resets after context deadline",
+				Status:  http.StatusTooManyRequests,
+			})
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(h.bucket.Wait(ctx))
+}
+
+// Observe records the rate limit reported by host.
+func (l *RateLimiter) Observe(host string, rl *RateLimit) {
+	if rl == nil || (rl.Remaining != 0 && rl.RetryAfter == 0) {
+		return
+	}
+	until := time.Now().Add(rl.Delay(time.Now()))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.host(host)
+	if until.After(h.until) {
+		h.until = until
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-t.C:
+		return nil
+	}
+}
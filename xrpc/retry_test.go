@@ -0,0 +1,115 @@
+package xrpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := t.Context()
+	is := is.New(t)
+	var (
+		calls  atomic.Int32
+		status atomic.Int32
+	)
+	status.Store(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if r.Method == "POST" {
+			b, _ := io.ReadAll(r.Body)
+			if string(b) != "body" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if n < 3 {
+			code := int(status.Load())
+			if code == http.StatusTooManyRequests {
+				w.Header().Set("ratelimit-remaining", "0")
+				w.Header().Set("Retry-After", "0")
+			}
+			w.WriteHeader(code)
+			w.Write([]byte(`{"error":"Oops","message":"try again"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	policy := RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+	c := NewClient(WithURL(srv.URL), WithRetry(policy))
+
+	body, err := c.Query(ctx, &Request{NSID: "com.example.test"})
+	is.NoErr(err)
+	body.Close()
+	is.Equal(calls.Load(), int32(3))
+
+	// procedures are not retried after server errors
+	calls.Store(0)
+	_, err = c.Procedure(ctx, &Request{NSID: "com.example.test", Body: bytes.NewReader([]byte("body"))})
+	var e *ErrorResponse
+	is.True(errors.As(err, &e))
+	is.Equal(e.Status, http.StatusServiceUnavailable)
+	is.Equal(calls.Load(), int32(1))
+
+	// but are retried when rate limited
+	calls.Store(0)
+	status.Store(http.StatusTooManyRequests)
+	body, err = c.Procedure(ctx, &Request{NSID: "com.example.test", Body: bytes.NewReader([]byte("body"))})
+	is.NoErr(err)
+	body.Close()
+	is.Equal(calls.Load(), int32(3))
+
+	// a single attempt
+	calls.Store(0)
+	status.Store(http.StatusBadGateway)
+	c = NewClient(WithURL(srv.URL), WithRetry(RetryPolicy{Attempts: 1}))
+	_, err = c.Query(ctx, &Request{NSID: "com.example.test"})
+	is.True(err != nil)
+	is.Equal(calls.Load(), int32(1))
+}
+
+func TestParseRateLimit(t *testing.T) {
+	is := is.New(t)
+	is.Equal(ParseRateLimit(http.Header{}), nil)
+	now := time.Now()
+	reset := now.Add(time.Minute).Unix()
+	h := http.Header{}
+	h.Set("ratelimit-limit", "3000")
+	h.Set("ratelimit-remaining", "0")
+	h.Set("ratelimit-reset", strconv.FormatInt(reset, 10))
+	rl := ParseRateLimit(h)
+	is.True(rl != nil)
+	is.Equal(rl.Limit, 3000)
+	is.Equal(rl.Remaining, 0)
+	is.Equal(rl.Reset.Unix(), reset)
+	d := rl.Delay(now)
+	is.True(d > 58*time.Second && d <= time.Minute)
+	h.Set("Retry-After", "5")
+	is.Equal(ParseRateLimit(h).Delay(now), 5*time.Second)
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := t.Context()
+	is := is.New(t)
+	l := NewRateLimiter(0, 1)
+	is.NoErr(l.Wait(ctx, "example.com"))
+	l.Observe("example.com", &RateLimit{Limit: 10, Remaining: 0, Reset: time.Now().Add(time.Hour)})
+	// other hosts are not affected
+	is.NoErr(l.Wait(ctx, "bsky.social"))
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := l.Wait(short, "example.com")
+	var e *ErrorResponse
+	is.True(errors.As(err, &e))
+	is.Equal(e.Code, RateLimitExceeded)
+}